@@ -0,0 +1,64 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/ironwood/network"
+)
+
+// newNode returns a node with the given options, which is closed when the test ends.
+func newNode(tb testing.TB, options ...network.Option) *PacketConn {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	conn, err := NewPacketConn(priv, options...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// nodeKey returns a node's public key.
+func nodeKey(conn *PacketConn) ed25519.PublicKey {
+	return conn.PrivateKey().Public().(ed25519.PublicKey)
+}
+
+// linkNodes has two nodes handle the ends of a connection between them, which are closed when the test ends.
+func linkNodes(tb testing.TB, a, b *PacketConn, cA, cB net.Conn) {
+	tb.Cleanup(func() {
+		cA.Close()
+		cB.Close()
+	})
+	go a.HandleConn(nodeKey(b), cA, 0)
+	go b.HandleConn(nodeKey(a), cB, 0)
+}
+
+// newPair returns two nodes with the given options, linked over a net.Pipe.
+func newPair(tb testing.TB, options ...network.Option) (a, b *PacketConn) {
+	a, b = newNode(tb, options...), newNode(tb, options...)
+	cA, cB := net.Pipe()
+	linkNodes(tb, a, b, cA, cB)
+	return
+}
+
+// sendUntilReceived writes the message to a node until it arrives, retrying while paths and sessions are set up, and returns false if it doesn't within 30 seconds.
+// write is the sender's WriteTo, or anything like it, and the sender needs to be reading to finish session setup.
+func sendUntilReceived(tb testing.TB, write func([]byte, net.Addr) (int, error), to *PacketConn, msg []byte) bool {
+	buf := make([]byte, to.MTU())
+	for start := time.Now(); time.Since(start) < 30*time.Second; {
+		if _, err := write(msg, to.LocalAddr()); err != nil {
+			tb.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		n, _, err := to.ReadFromCtx(ctx, buf)
+		cancel()
+		if err == nil && bytes.Equal(buf[:n], msg) {
+			return true
+		}
+	}
+	return false
+}
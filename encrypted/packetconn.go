@@ -1,6 +1,7 @@
 package encrypted
 
 import (
+	"context"
 	"crypto/ed25519"
 	"net"
 
@@ -17,6 +18,7 @@ type PacketConn struct {
 	secretBox boxPriv
 	sessions  sessionManager
 	network   netManager
+	codec     types.AddrCodecValue
 	Debug     Debug
 }
 
@@ -36,13 +38,23 @@ func NewPacketConn(secret ed25519.PrivateKey, options ...network.Option) (*Packe
 }
 
 func (pc *PacketConn) ReadFrom(p []byte) (n int, from net.Addr, err error) {
+	return pc.ReadFromCtx(context.Background(), p)
+}
+
+func (pc *PacketConn) ReadFromCtx(ctx context.Context, p []byte) (n int, from net.Addr, err error) {
 	pc.network.read()
-	info := <-pc.network.readCh
+	var info netReadInfo
+	select {
+	case info = <-pc.network.readCh:
+	case <-ctx.Done():
+		// Anything sent to readCh stays there for the next read
+		return 0, nil, ctx.Err()
+	}
 	if info.err != nil {
 		err = info.err
 		return
 	}
-	n, from = len(info.data), types.Addr(info.from.asKey())
+	n, from = len(info.data), pc.codec.Encode(info.from.asKey())
 	if n > len(p) {
 		n = len(p)
 	}
@@ -52,25 +64,59 @@ func (pc *PacketConn) ReadFrom(p []byte) (n int, from net.Addr, err error) {
 }
 
 func (pc *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return pc.WriteToOptions(p, addr, network.PacketOptions{})
+}
+
+// WriteToClass is like WriteTo, but sends the packet with the given class, see network.PacketConn.WriteToClass.
+func (pc *PacketConn) WriteToClass(p []byte, addr net.Addr, class network.TrafficClass) (n int, err error) {
+	return pc.WriteToOptions(p, addr, network.PacketOptions{Class: class})
+}
+
+// WriteToTraced is like WriteTo, but every node that handles the encrypted packet reports what it did with it, see network.PacketConn.WriteToTraced.
+func (pc *PacketConn) WriteToTraced(p []byte, addr net.Addr) (n int, err error) {
+	return pc.WriteToOptions(p, addr, network.PacketOptions{Traced: true})
+}
+
+// WriteToOptions is like WriteTo, but sends the packet with the given options, see network.PacketConn.WriteToOptions.
+func (pc *PacketConn) WriteToOptions(p []byte, addr net.Addr, opts network.PacketOptions) (n int, err error) {
 	select {
 	case <-pc.network.closed:
 		return 0, types.ErrClosed
 	default:
 	}
-	destKey, ok := addr.(types.Addr)
-	if !ok || len(destKey) != edPubSize {
-		return 0, types.ErrBadAddress
+	destKey, err := pc.codec.Decode(addr)
+	if err != nil {
+		return 0, err
+	}
+	if uint64(len(p)) > pc.MTU() || (opts.Traced && uint64(len(p)) == pc.MTU()) {
+		return 0, types.ErrOversizedMessage // A traced packet is 1 byte longer, see network.PacketConn.WriteToTraced
 	}
-	if uint64(len(p)) > pc.MTU() {
-		return 0, types.ErrOversizedMessage
+	if opts.Class > network.TrafficClassBulk {
+		return 0, types.ErrBadClass
 	}
 	n = len(p)
 	var dest edPub
 	copy(dest[:], destKey)
-	pc.sessions.writeTo(dest, append(allocBytes(0), p...))
+	pc.sessions.writeTo(dest, append(allocBytes(0), p...), opts)
 	return
 }
 
+func (pc *PacketConn) WriteToCtx(ctx context.Context, p []byte, addr net.Addr) (n int, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	return pc.WriteTo(p, addr)
+}
+
+func (pc *PacketConn) LocalAddr() net.Addr {
+	return pc.codec.Encode(pc.secretEd.pub().asKey())
+}
+
+// SetAddrCodec sets a codec for the application's own address type, see network.PacketConn.SetAddrCodec.
+func (pc *PacketConn) SetAddrCodec(codec types.AddrCodec) {
+	pc.codec.Store(codec)
+}
+
 // MTU returns the maximum transmission unit of the PacketConn, i.e. maximum safe message size to send over the network.
 func (pc *PacketConn) MTU() uint64 {
 	return pc.PacketConn.MTU() - sessionTrafficOverhead
@@ -0,0 +1,142 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/network"
+	"github.com/Arceliar/ironwood/types"
+)
+
+// leakConn notes if anything written to it contains the message.
+type leakConn struct {
+	net.Conn
+	msg    []byte
+	leaked *int32
+}
+
+func (c leakConn) Write(b []byte) (int, error) {
+	if bytes.Contains(b, c.msg) {
+		atomic.StoreInt32(c.leaked, 1)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestWriteToTraced(t *testing.T) {
+	msg := []byte("this should only be seen by b")
+	delivered := make(chan struct{}, 1)
+	a := newNode(t)
+	b := newNode(t, network.WithTraceHandler(func(e network.TraceEvent) {
+		if e.Decision == network.TraceDelivered {
+			select {
+			case delivered <- struct{}{}:
+			default:
+			}
+		}
+	}))
+	var leaked int32
+	cA, cB := net.Pipe()
+	linkNodes(t, a, b, leakConn{cA, msg, &leaked}, cB)
+	go func() {
+		// Session setup is handled by reads, so a needs to read too
+		buf := make([]byte, a.MTU())
+		for {
+			if _, _, err := a.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	// The first packets wait for a path and a session
+	if !sendUntilReceived(t, a.WriteToTraced, b, msg) {
+		t.Fatal("timeout")
+	}
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("b didn't trace the packet")
+	}
+	if atomic.LoadInt32(&leaked) != 0 {
+		t.Fatal("the traced packet was sent in plaintext")
+	}
+}
+
+func TestSendRotation(t *testing.T) {
+	a, b := newPair(t)
+	pubA, pubB := nodeKey(a), nodeKey(b)
+	fromB := make(chan []byte, 8)
+	go func() {
+		// Session setup is handled by reads, so a needs to read too
+		buf := make([]byte, a.MTU())
+		for {
+			n, _, err := a.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case fromB <- append([]byte(nil), buf[:n]...):
+			default:
+			}
+		}
+	}()
+	buf := make([]byte, b.MTU())
+	read := func(msg []byte) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		n, _, err := b.ReadFromCtx(ctx, buf)
+		return err == nil && bytes.Equal(buf[:n], msg)
+	}
+	// The first packets wait for a path and a session
+	if !sendUntilReceived(t, a.WriteTo, b, []byte("before")) {
+		t.Fatal("timeout")
+	}
+	// Push a's send nonce to the edge, so the next send rotates a's keys without hearing from b
+	var edB edPub
+	copy(edB[:], pubB)
+	var info *sessionInfo
+	phony.Block(&a.sessions, func() {
+		info = a.sessions.sessions[edB]
+	})
+	if info == nil {
+		t.Fatal("a has no session")
+	}
+	phony.Block(info, func() {
+		info.sendNonce = ^uint64(0)
+	})
+	for idx := 0; idx < 4; idx++ {
+		// Every packet across the rotation should arrive without a new init
+		msg := []byte{byte(idx)}
+		if _, err := a.WriteTo(msg, types.Addr(pubB)); err != nil {
+			t.Fatal(err)
+		}
+		if !read(msg) {
+			t.Fatalf("packet %d was lost after the rotation", idx)
+		}
+	}
+	// And the session should keep working in both directions
+	for idx := 0; idx < 4; idx++ {
+		msg := []byte{byte(idx)}
+		if _, err := b.WriteTo(msg, types.Addr(pubA)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case bs := <-fromB:
+			if !bytes.Equal(bs, msg) {
+				t.Fatalf("a got %v, expected %v", bs, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("reply %d was lost after the rotation", idx)
+		}
+		if _, err := a.WriteTo(msg, types.Addr(pubB)); err != nil {
+			t.Fatal(err)
+		}
+		if !read(msg) {
+			t.Fatalf("packet %d was lost after the reply", idx)
+		}
+	}
+}
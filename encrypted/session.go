@@ -6,6 +6,7 @@ import (
 
 	"github.com/Arceliar/phony"
 
+	"github.com/Arceliar/ironwood/network"
 	"github.com/Arceliar/ironwood/types"
 )
 
@@ -105,7 +106,7 @@ func (mgr *sessionManager) _handleInit(pub *edPub, init *sessionInit) {
 	if info, buf := mgr._sessionForInit(pub, init); info != nil {
 		info.handleInit(mgr, init)
 		if buf != nil && buf.data != nil {
-			info.doSend(mgr, buf.data)
+			info.doSend(mgr, buf.data, buf.opts)
 		}
 	}
 }
@@ -119,7 +120,7 @@ func (mgr *sessionManager) _handleAck(pub *edPub, ack *sessionAck) {
 			info.handleInit(mgr, &ack.sessionInit)
 		}
 		if buf != nil && buf.data != nil {
-			info.doSend(mgr, buf.data)
+			info.doSend(mgr, buf.data, buf.opts)
 		}
 	}
 }
@@ -139,19 +140,19 @@ func (mgr *sessionManager) _handleTraffic(pub *edPub, msg []byte) {
 	}
 }
 
-func (mgr *sessionManager) writeTo(toKey edPub, msg []byte) {
+func (mgr *sessionManager) writeTo(toKey edPub, msg []byte, opts network.PacketOptions) {
 	// WARNING: unsafe to call from within an actor, must only be exposed over the PacketConn functions (which are, themselves, unsafe for actors to call in most cases, since they may block)
 	phony.Block(mgr, func() {
 		if info := mgr.sessions[toKey]; info != nil {
-			info.doSend(mgr, msg)
+			info.doSend(mgr, msg, opts)
 		} else {
 			// Need to buffer the traffic
-			mgr._bufferAndInit(toKey, msg)
+			mgr._bufferAndInit(toKey, msg, opts)
 		}
 	})
 }
 
-func (mgr *sessionManager) _bufferAndInit(toKey edPub, msg []byte) {
+func (mgr *sessionManager) _bufferAndInit(toKey edPub, msg []byte, opts network.PacketOptions) {
 	var buf *sessionBuffer
 	if buf = mgr.buffers[toKey]; buf == nil {
 		// Create a new buffer (including timer)
@@ -165,6 +166,7 @@ func (mgr *sessionManager) _bufferAndInit(toKey edPub, msg []byte) {
 		mgr.buffers[toKey] = buf
 	}
 	buf.data = msg
+	buf.opts = opts
 	buf.timer.Stop()
 	mgr.sendInit(&toKey, &buf.init)
 	buf.timer = time.AfterFunc(sessionTimeout, func() {
@@ -296,7 +298,7 @@ func (info *sessionInfo) _handleUpdate(init *sessionInit) {
 	info._resetTimer()
 }
 
-func (info *sessionInfo) doSend(from phony.Actor, msg []byte) {
+func (info *sessionInfo) doSend(from phony.Actor, msg []byte, opts network.PacketOptions) {
 	// TODO? some worker pool to multi-thread this
 	info.Act(from, func() {
 		defer freeBytes(msg)
@@ -307,7 +309,8 @@ func (info *sessionInfo) doSend(from phony.Actor, msg []byte) {
 			info.sendPub, info.sendPriv = info.nextPub, info.nextPriv
 			info.nextPub, info.nextPriv = newBoxKeys()
 			info.localKeySeq++
-			info._fixShared(0, 0)
+			// Start from 1, the receiver only accepts nonces above the last one
+			info._fixShared(0, 1)
 		}
 		bs := allocBytes(sessionTrafficOverhead + len(msg))
 		defer freeBytes(bs)
@@ -325,7 +328,7 @@ func (info *sessionInfo) doSend(from phony.Actor, msg []byte) {
 		bs = boxSeal(bs, tmp, info.sendNonce, &info.sendShared)
 		freeBytes(tmp)
 		// send
-		info.mgr.pc.PacketConn.WriteTo(bs, types.Addr(info.ed[:]))
+		info.mgr.pc.PacketConn.WriteToOptions(bs, types.Addr(info.ed[:]), opts)
 		info.tx += uint64(len(msg))
 		info._resetTimer()
 	})
@@ -398,29 +401,20 @@ func (info *sessionInfo) doRecv(from phony.Actor, msg []byte) {
 			}
 		case fromNext && toRecv:
 			// The remote side appears to have ratcheted forward early
-			// Technically there's no reason we can't handle this
-			//panic("DEBUG") // TODO test this
+			// They rotated on their own (e.g. nonce overflow) without hearing from our send key
 			if !(info.nextRecvNonce < nonce) {
 				return
 			}
 			sharedKey = &info.nextRecvShared
 			onSuccess = func(innerKey boxPub) {
 				info.nextRecvNonce = nonce
-				if info.rotated.IsZero() || time.Since(info.rotated) > time.Minute {
-					// Rotate their keys
-					info.current = info.next
-					info.next = innerKey
-					info.remoteKeySeq++ // = remoteKeySeq
-					// Rotate our own keys
-					info.recvPub, info.recvPriv = info.sendPub, info.sendPriv
-					info.sendPub, info.sendPriv = info.nextPub, info.nextPriv
-					info.localKeySeq++
-					// Generate new next keys
-					info.nextPub, info.nextPriv = newBoxKeys()
-					// Update nonces
-					info._fixShared(nonce, 0)
-					info.rotated = time.Now()
-				}
+				// Rotate their keys
+				info.current = info.next
+				info.next = innerKey
+				info.remoteKeySeq++ // = remoteKeySeq
+				// They still send to our recv key, so ours stay where they are
+				// Don't roll back sendNonce, our send key didn't change
+				info._fixShared(nonce, info.sendNonce)
 			}
 		default:
 			// We can't make sense of their message
@@ -572,6 +566,7 @@ func (ack *sessionAck) encrypt(from *edPriv, to *edPub) ([]byte, error) {
 
 type sessionBuffer struct {
 	data        []byte
+	opts        network.PacketOptions
 	init        sessionInit
 	currentPriv boxPriv     // pairs with init.recv
 	nextPriv    boxPriv     // pairs with init.send
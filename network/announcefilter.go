@@ -0,0 +1,42 @@
+package network
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AnnounceVerdict is what the announce filter decides to do with an info, see WithAnnounceFilter.
+type AnnounceVerdict uint8
+
+const (
+	AnnounceEvictable AnnounceVerdict = iota // Store it, and drop it if a new info needs the room, see WithRouterMaxInfos
+	AnnounceKeep                             // Store it, and never drop it to make room
+	AnnounceReject                           // Don't store it or pass it on
+)
+
+// announceSlow is how long the announce filter can take before the call is counted as slow, see WithAnnounceFilter.
+const announceSlow = time.Millisecond
+
+// _filterAnnounce returns what the announce filter decides to do with the info, see WithAnnounceFilter.
+func (r *router) _filterAnnounce(ann *routerAnnounce) AnnounceVerdict {
+	filter := r.core.config.announceFilter
+	if filter == nil || ann.key == r.core.crypto.publicKey {
+		return AnnounceEvictable
+	}
+	start := time.Now()
+	verdict := filter(ann.key.toEd(), ann.parent.toEd(), ann.seq)
+	if took := time.Since(start); took > announceSlow {
+		atomic.AddInt64(&r.core.metrics.annFilterSlow, 1)
+		r.core.config.announceFilterSlow(ann.key.toEd(), took)
+	}
+	return verdict
+}
+
+// _pin records whether the info we just stored for the key can be evicted, see WithRouterMaxInfos.
+func (r *router) _pin(key publicKey, verdict AnnounceVerdict) {
+	if verdict == AnnounceKeep {
+		r.pinned[key] = struct{}{}
+	} else {
+		delete(r.pinned, key)
+	}
+}
@@ -86,9 +86,9 @@ func (b *bloom) decode(data []byte) error {
 	us := usArray[:0]
 	var flags0, flags1 [bloomFilterF]byte
 	if !wireChopSlice(flags0[:], &data) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if !wireChopSlice(flags1[:], &data) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	}
 	for idx := 0; idx < bloomFilterU; idx++ {
 		flag0 := flags0[idx/8] & (0x80 >> (uint64(idx) % 8))
@@ -104,11 +104,11 @@ func (b *bloom) decode(data []byte) error {
 			us = append(us, u)
 			data = data[8:]
 		} else {
-			return types.ErrDecode
+			return types.ErrDecodeTruncated
 		}
 	}
 	if len(data) != 0 {
-		return types.ErrDecode
+		return types.ErrDecodeTrailingBytes
 	}
 	tmp.filter = bfilter.From(us, bloomFilterK)
 	*b = tmp
@@ -143,32 +143,35 @@ func (bs *blooms) _isOnTree(key publicKey) bool {
 
 func (bs *blooms) _fixOnTree() {
 	selfKey := bs.router.core.crypto.publicKey
-	if selfInfo, isIn := bs.router.infos[selfKey]; isIn {
-		for pk, pbi := range bs.blooms {
-			wasOn := pbi.onTree
-			pbi.onTree = false
-			if selfInfo.parent == pk {
+	selfInfo, isIn := bs.router.infos[selfKey]
+	if !isIn {
+		// We haven't picked a parent yet (see WithStartupListen), so only peers that use us as their parent can be on the tree
+		selfInfo.parent = selfKey
+	}
+	for pk, pbi := range bs.blooms {
+		wasOn := pbi.onTree
+		pbi.onTree = false
+		if selfInfo.parent == pk {
+			pbi.onTree = true
+		} else if info, isIn := bs.router.infos[pk]; isIn {
+			if info.parent == selfKey {
 				pbi.onTree = true
-			} else if info, isIn := bs.router.infos[pk]; isIn {
-				if info.parent == selfKey {
-					pbi.onTree = true
-				}
-			} else {
-				// They must not have sent us their info yet
 			}
-			if wasOn && !pbi.onTree {
-				// We dropped them from the tree, so we need to send a blank update
-				// That way, if the link returns to the tree, we don't start with false positives
-				b := newBloom()
-				pbi.send = *b
-				for p := range bs.router.peers[pk] {
+		} else {
+			// They must not have sent us their info yet
+		}
+		if wasOn && !pbi.onTree {
+			// We dropped them from the tree, so we need to send a blank update
+			// That way, if the link returns to the tree, we don't start with false positives
+			b := newBloom()
+			pbi.send = *b
+			for p := range bs.router.peers[pk] {
+				if p.proven {
 					p.sendBloom(bs.router, b)
 				}
 			}
-			bs.blooms[pk] = pbi
 		}
-	} else {
-		panic("this should never happen")
+		bs.blooms[pk] = pbi
 	}
 }
 
@@ -193,12 +196,17 @@ func (bs *blooms) _removeInfo(key publicKey) {
 }
 
 func (bs *blooms) handleBloom(fromPeer *peer, b *bloom) {
-	bs.router.Act(fromPeer, func() {
+	bs.router.act(fromPeer, func() {
 		bs._handleBloom(fromPeer, b)
 	})
 }
 
 func (bs blooms) _handleBloom(fromPeer *peer, b *bloom) {
+	if !fromPeer.proven {
+		// It could be from anyone, so keep it until the link proves its key, see router._handleResponse
+		fromPeer.unprovenBloom = b
+		return
+	}
 	pbi, isIn := bs.blooms[fromPeer.key]
 	if !isIn {
 		return
@@ -272,7 +280,9 @@ func (bs *blooms) _sendAllBlooms() {
 		if b, isNew := bs._getBloomFor(k, keepOnes); isNew {
 			if ps, isIn := bs.router.peers[k]; isIn {
 				for p := range ps {
-					p.sendBloom(bs.router, b)
+					if p.proven {
+						p.sendBloom(bs.router, b)
+					}
 				}
 			} else {
 				panic("this should never happen")
@@ -285,7 +295,7 @@ func (bs *blooms) sendMulticast(from phony.Actor, packet pqPacket, fromKey publi
 	// Ideally we need a way to detect duplicate packets from multiple links to the same peer, so we can drop them
 	// I.e. we need to sequence number all multicast packets... This can maybe be part of the framing, along side the packet length, or something
 	// For now, we just send to 1 peer (possibly at random)
-	bs.router.Act(from, func() {
+	bs.router.act(from, func() {
 		bs._sendMulticast(packet, fromKey, toKey)
 	})
 }
@@ -308,14 +318,9 @@ func (bs *blooms) _sendMulticast(packet pqPacket, fromKey publicKey, toKey publi
 			continue
 		}
 		// Send this broadcast packet to the peer
-		var bestPeer *peer
-		for p := range bs.router.peers[k] {
-			if bestPeer == nil || p.prio < bestPeer.prio {
-				bestPeer = p
-			}
-		}
+		bestPeer := bs.router._bestLink(k, false)
 		if bestPeer == nil {
-			panic("this should never happen")
+			continue // None of the links to this key have proven it yet
 		}
 		bestPeer.sendQueued(bs.router, packet)
 	}
@@ -0,0 +1,204 @@
+package network
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// BroadcastMaxSize is the largest payload that can be sent with PacketConn.Broadcast.
+const BroadcastMaxSize = 1024
+
+const (
+	broadcastRate  = 1.0 // Broadcasts per second that we forward from each origin, on average
+	broadcastBurst = 8.0 // Broadcasts that we forward from each origin in a burst, before rate limiting kicks in
+)
+
+/**************
+ * broadcasts *
+ **************/
+
+// broadcasts floods packets along the spanning tree (to our parent and children), so every reachable node gets 1 copy.
+// WARNING This should only be used from within the router's actor, it's not threadsafe
+type broadcasts struct {
+	router  *router
+	seq     uint64
+	origins map[publicKey]broadcastOrigin
+}
+
+type broadcastOrigin struct {
+	seq     uint64    // Highest seq seen from this origin, anything lower or equal is a duplicate
+	tokens  float64   // Rate limiting, see broadcastRate and broadcastBurst
+	updated time.Time // Time tokens was last updated
+}
+
+func (bs *broadcasts) init(r *router) {
+	bs.router = r
+	bs.seq = uint64(time.Now().UnixNano()) // So seqs keep increasing if we restart
+	bs.origins = make(map[publicKey]broadcastOrigin)
+}
+
+func (bs *broadcasts) _doMaintenance() {
+	// Forget origins we haven't heard from in a while
+	// A replay of an old broadcast could get through after this, but only at the rate limit for that origin
+	for key, origin := range bs.origins {
+		if time.Since(origin.updated) > bs.router.core.config.routerTimeout {
+			delete(bs.origins, key)
+		}
+	}
+}
+
+func (bs *broadcasts) _sendBroadcast(payload []byte, ttl uint8) {
+	if ttl == 0 {
+		return
+	}
+	bs.seq++
+	b := &broadcast{
+		source:  bs.router.core.crypto.publicKey,
+		seq:     bs.seq,
+		ttl:     ttl,
+		payload: payload,
+	}
+	var err error
+	if b.sig, err = bs.router.core.crypto.sign(b.bytesForSig()); err != nil {
+		return
+	}
+	bs._flood(b, b.source)
+}
+
+func (bs *broadcasts) handleBroadcast(p *peer, b *broadcast) {
+	bs.router.act(p, func() {
+		bs._handleBroadcast(p.key, b)
+	})
+}
+
+func (bs *broadcasts) _handleBroadcast(fromKey publicKey, b *broadcast) {
+	if !bs.router.blooms._isOnTree(fromKey) {
+		// Only accept broadcasts along the tree, anything else is a duplicate
+		return
+	}
+	if b.source == bs.router.core.crypto.publicKey {
+		return
+	}
+	now := time.Now()
+	origin, isIn := bs.origins[b.source]
+	if !isIn {
+		origin = broadcastOrigin{tokens: broadcastBurst, updated: now}
+	} else if b.seq <= origin.seq {
+		// Duplicate or replay
+		return
+	}
+	origin.seq = b.seq
+	origin.tokens += broadcastRate * now.Sub(origin.updated).Seconds()
+	if origin.tokens > broadcastBurst {
+		origin.tokens = broadcastBurst
+	}
+	origin.updated = now
+	if origin.tokens < 1 {
+		atomic.AddInt64(&bs.router.core.metrics.dropBroadcast, 1)
+		bs.origins[b.source] = origin
+		return
+	}
+	origin.tokens--
+	bs.origins[b.source] = origin
+	bs.router.core.pconn.handleBroadcast(bs.router, b.source, b.payload)
+	if b.ttl > 1 {
+		b.ttl--
+		bs._flood(b, fromKey)
+	}
+}
+
+// _flood sends the broadcast to every peer on the tree, except the one we got it from.
+// Peers without featureBroadcast would close the link if we sent them one, so they (and anything behind them) don't get it.
+func (bs *broadcasts) _flood(b *broadcast, fromKey publicKey) {
+	for k, pbi := range bs.router.blooms.blooms {
+		if !pbi.onTree || k == fromKey {
+			continue
+		}
+		if p := bs.router._bestLink(k, false); p != nil && p.features&featureBroadcast != 0 {
+			p.sendQueued(bs.router, b)
+		}
+	}
+}
+
+/*************
+ * broadcast *
+ *************/
+
+type broadcast struct {
+	source  publicKey
+	seq     uint64
+	ttl     uint8 // Not signed, decremented at each hop
+	sig     signature
+	payload []byte
+}
+
+func (b *broadcast) bytesForSig() []byte {
+	bs := append([]byte(nil), b.source[:]...)
+	bs = wireAppendUint(bs, b.seq)
+	bs = append(bs, b.payload...)
+	return bs
+}
+
+func (b *broadcast) check() bool {
+	if len(b.payload) > BroadcastMaxSize {
+		return false
+	}
+	return b.source.verify(b.bytesForSig(), &b.sig)
+}
+
+func (b *broadcast) size() int {
+	size := len(b.source)
+	size += wireSizeUint(b.seq)
+	size += 1 // ttl
+	size += len(b.sig)
+	size += len(b.payload)
+	return size
+}
+
+func (b *broadcast) encode(out []byte) ([]byte, error) {
+	start := len(out)
+	out = append(out, b.source[:]...)
+	out = wireAppendUint(out, b.seq)
+	out = append(out, b.ttl)
+	out = append(out, b.sig[:]...)
+	out = append(out, b.payload...)
+	end := len(out)
+	if end-start != b.size() {
+		panic("this should never happen")
+	}
+	return out, nil
+}
+
+func (b *broadcast) decode(data []byte) error {
+	var tmp broadcast
+	if !wireChopSlice(tmp.source[:], &data) {
+		return types.ErrDecodeTruncated
+	} else if !wireChopUint(&tmp.seq, &data) {
+		return types.ErrDecodeTruncated
+	} else if len(data) < 1 {
+		return types.ErrDecodeTruncated
+	}
+	tmp.ttl, data = data[0], data[1:]
+	if !wireChopSlice(tmp.sig[:], &data) {
+		return types.ErrDecodeTruncated
+	}
+	tmp.payload = append(b.payload[:0], data...)
+	*b = tmp
+	return nil
+}
+
+// Functions needed for pqPacket
+
+func (b *broadcast) wireType() wirePacketType {
+	return wireProtoBroadcast
+}
+
+func (b *broadcast) sourceKey() publicKey {
+	return b.source
+}
+
+func (b *broadcast) destKey() publicKey {
+	return publicKey{} // Not sent to anyone in particular
+}
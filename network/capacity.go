@@ -0,0 +1,94 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"sync/atomic"
+
+	"github.com/Arceliar/phony"
+)
+
+// SetCapacityHandler sets a function to call when a new info arrives while the router is full, see WithRouterMaxInfos, or unsets it if the handler is nil.
+// current is how many infos the router had stored when the new one arrived, and evicted is the info that was dropped, which may be the new one.
+// evicted is nil if nothing could be dropped and the announce filter said to keep the new info anyway.
+// If this fires, the node can't track the whole network, so routing to some nodes may take longer or fail.
+func (pc *PacketConn) SetCapacityHandler(handler func(current, max int, evicted ed25519.PublicKey)) {
+	phony.Block(&pc.core.router, func() {
+		pc.core.router.capacityHandler = handler
+	})
+}
+
+// _makeRoom returns false if a new info for the announcement's key doesn't fit, see WithRouterMaxInfos.
+// If the router is full, an info from a leaving announcement is dropped first, since it's treated as missing anyway.
+// Otherwise the evictable info with the highest key is dropped, unless that's the new one.
+// Our own ancestry and our peers' ancestries are never dropped, since we need them to pick a parent and route.
+// It's only called for keys we have no info for, which _update always accepts, so nothing is dropped for an announcement that's then rejected.
+func (r *router) _makeRoom(ann *routerAnnounce, verdict AnnounceVerdict) bool {
+	key := ann.key
+	max := r.core.config.routerMaxInfos
+	if max <= 0 || len(r.infos) < max || key == r.core.crypto.publicKey {
+		return true
+	}
+	needed := make(map[publicKey]struct{})
+	for _, k := range r._backwardsAncestry(r.core.crypto.publicKey) {
+		needed[k] = struct{}{}
+	}
+	for _, anc := range r.ancs {
+		for _, k := range anc {
+			needed[k] = struct{}{}
+		}
+	}
+	var worst, worstLeaving publicKey
+	var found, foundLeaving bool
+	for k, info := range r.infos {
+		if k == r.core.crypto.publicKey {
+			continue
+		}
+		if _, isIn := r.pinned[k]; isIn {
+			continue
+		}
+		if info.isLeaving(k) {
+			// A peer's ancestry can still list a root that left, but nothing routes through it
+			if !foundLeaving || worstLeaving.less(k) {
+				worstLeaving, foundLeaving = k, true
+			}
+			continue
+		}
+		if _, isIn := needed[k]; isIn {
+			continue
+		}
+		if !found || worst.less(k) {
+			worst, found = k, true
+		}
+	}
+	current := len(r.infos)
+	now := r._now()
+	switch {
+	case now.Sub(r._signedTime(ann, now)) >= r.core.config.routerTimeout:
+		// It would expire as soon as it's stored (see WithSignedExpiry), so it's not worth dropping anything for
+	case foundLeaving && !ann.isLeaving():
+		r._evict(worstLeaving, current)
+		return true
+	case found && (verdict == AnnounceKeep || key.less(worst)):
+		r._evict(worst, current)
+		return true
+	case verdict == AnnounceKeep:
+		// Nothing can be evicted, but this one goes over the limit anyway
+		if r.capacityHandler != nil {
+			r.capacityHandler(current, max, nil)
+		}
+		return true
+	}
+	if r.capacityHandler != nil {
+		r.capacityHandler(current, max, key.toEd())
+	}
+	return false
+}
+
+// _evict drops an info to make room for a new one, see _makeRoom.
+func (r *router) _evict(key publicKey, current int) {
+	r._expire(key)
+	atomic.AddInt64(&r.core.metrics.annEvicted, 1)
+	if r.capacityHandler != nil {
+		r.capacityHandler(current, r.core.config.routerMaxInfos, key.toEd())
+	}
+}
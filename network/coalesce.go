@@ -0,0 +1,149 @@
+package network
+
+import "time"
+
+// How long we wait before asking a destination again whether it can split coalesced traffic.
+// The first request is often lost while we look up a path, so we start out asking again quickly, and back off for nodes that never answer.
+const (
+	coalesceProbeMin = time.Second
+	coalesceProbeMax = time.Minute
+)
+
+// coalescer buffers small packets to one destination, see WithCoalescing.
+// It's only used from within the PacketConn's actor.
+type coalescer struct {
+	capable bool          // the destination answered a probe, so it can split coalesced traffic
+	probed  time.Time     // when we last sent the destination a probe
+	wait    time.Duration // how long after probed we probe again
+	used    time.Time     // when we last wrote to the destination
+	buf     []byte        // length-prefixed payloads waiting to be sent
+	count   int           // number of payloads in buf
+	timer   *time.Timer
+}
+
+// _coalesce adds a standard packet to the destination's buffer, or sends it right away if the destination hasn't told us it can split coalesced traffic.
+// Takes ownership of data.
+func (pc *PacketConn) _coalesce(dest publicKey, data []byte) {
+	defer freeBytes(data)
+	now := time.Now()
+	c := pc.coalescers[dest]
+	if c == nil {
+		pc._sweepCoalescers(now)
+		c = new(coalescer)
+		pc.coalescers[dest] = c
+	}
+	c.used = now
+	if !c.capable {
+		if now.Sub(c.probed) > c.wait {
+			c.probed = now
+			c.wait *= 2
+			if c.wait < coalesceProbeMin {
+				c.wait = coalesceProbeMin
+			} else if c.wait > coalesceProbeMax {
+				c.wait = coalesceProbeMax
+			}
+			pc.sendTraffic(dest, trafficKindCoalesceReq, nil)
+		}
+		pc.sendTraffic(dest, trafficKindStandard, data)
+		return
+	}
+	size := pc.core.config.coalesceSize
+	if mtu := pc.packetMTU(); size == 0 || uint64(size) > mtu {
+		size = int(mtu)
+	}
+	record := wireSizeUint(uint64(len(data))) + len(data)
+	if len(c.buf)+record > size {
+		pc._flushCoalesced(c, dest)
+	}
+	if record > size {
+		pc.sendTraffic(dest, trafficKindStandard, data)
+		return
+	}
+	c.buf = wireAppendUint(c.buf, uint64(len(data)))
+	c.buf = append(c.buf, data...)
+	c.count++
+	if c.timer == nil {
+		c.timer = time.AfterFunc(pc.core.config.coalesceDelay, func() {
+			pc.actor.Act(nil, func() {
+				pc._flushCoalesced(c, dest)
+			})
+		})
+	}
+}
+
+// _flushCoalesced sends whatever is in the buffer.
+// A lone packet is sent as standard traffic, since there's nothing to gain from wrapping it.
+func (pc *PacketConn) _flushCoalesced(c *coalescer, dest publicKey) {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	switch c.count {
+	case 0:
+		return
+	case 1:
+		payload := c.buf
+		var length uint64
+		wireChopUint(&length, &payload)
+		pc.sendTraffic(dest, trafficKindStandard, payload)
+	default:
+		pc.sendTraffic(dest, trafficKindCoalesced, c.buf)
+	}
+	c.buf, c.count = c.buf[:0], 0
+}
+
+// _flushAllCoalesced sends everything that's buffered, e.g. before closing.
+func (pc *PacketConn) _flushAllCoalesced() {
+	for dest, c := range pc.coalescers {
+		pc._flushCoalesced(c, dest)
+	}
+}
+
+// _sweepCoalescers forgets destinations we haven't written to within the path timeout.
+// It runs at most once per path timeout, when we'd otherwise add a new destination.
+func (pc *PacketConn) _sweepCoalescers(now time.Time) {
+	timeout := pc.core.config.pathTimeout
+	if now.Sub(pc.lastSweep) < timeout {
+		return
+	}
+	pc.lastSweep = now
+	for dest, c := range pc.coalescers {
+		if c.count == 0 && now.Sub(c.used) > timeout {
+			delete(pc.coalescers, dest)
+		}
+	}
+}
+
+// _handleCoalesced splits coalesced traffic back into the standard packets it was made from.
+// This is done whether or not coalescing is enabled locally, it's only the sending side that needs to opt in.
+func (pc *PacketConn) _handleCoalesced(tr *traffic) {
+	defer freeTraffic(tr)
+	data := tr.payload
+	for len(data) > 0 {
+		var length uint64
+		if !wireChopUint(&length, &data) || length > uint64(len(data)) {
+			return // Malformed, drop the rest
+		}
+		part := allocTraffic()
+		part.source = tr.source
+		part.dest = tr.dest
+		part.watermark = tr.watermark
+		part.kind = trafficKindStandard
+		part.payload = append(part.payload, data[:length]...)
+		data = data[length:]
+		pc._deliver(part)
+	}
+}
+
+// _handleCoalesceReq lets the sender know that we can split coalesced traffic.
+func (pc *PacketConn) _handleCoalesceReq(tr *traffic) {
+	pc.sendTraffic(tr.source, trafficKindCoalesceAck, nil)
+	freeTraffic(tr)
+}
+
+func (pc *PacketConn) _handleCoalesceAck(tr *traffic) {
+	if c := pc.coalescers[tr.source]; c != nil {
+		c.capable = true
+	}
+	freeTraffic(tr)
+}
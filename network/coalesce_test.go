@@ -0,0 +1,202 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// newCoalescePair connects a with the given options to b with the defaults, and waits until a can send coalesced traffic to b (if it's enabled).
+func newCoalescePair(tb testing.TB, options ...Option) (a, b *PacketConn, addrB types.Addr) {
+	a, b = newNode(tb, options...), newNode(tb)
+	linkLine(tb, []*PacketConn{a, b})
+	addrB = b.LocalAddr().(types.Addr)
+	keyB := b.core.crypto.publicKey
+	buf := make([]byte, b.MTU())
+	for start := time.Now(); time.Since(start) < 30*time.Second; {
+		if !sendUntilReceived(tb, a.WriteTo, b, []byte{0xff}) {
+			break
+		}
+		ready := a.core.config.coalesceDelay == 0
+		phony.Block(&a.actor, func() {
+			if c := a.coalescers[keyB]; c != nil && c.capable {
+				ready = true
+			}
+		})
+		if ready {
+			for {
+				// Drain anything else that was sent while we were waiting
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				_, _, err := b.ReadFromCtx(ctx, buf)
+				cancel()
+				if err != nil {
+					return a, b, addrB
+				}
+			}
+		}
+	}
+	tb.Fatal("timeout")
+	return
+}
+
+func TestCoalescing(t *testing.T) {
+	// A long delay, so nothing is sent until we flush
+	a, b, addrB := newCoalescePair(t, WithCoalescing(time.Minute, 0))
+	keyB := b.core.crypto.publicKey
+	for idx := 0; idx < 10; idx++ {
+		if _, err := a.WriteTo([]byte{byte(idx), byte(idx)}, addrB); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var count int
+	phony.Block(&a.actor, func() {
+		count = a.coalescers[keyB].count
+		a._flushAllCoalesced()
+	})
+	if count != 10 {
+		t.Fatalf("expected 10 buffered packets, got %d", count)
+	}
+	buf := make([]byte, 16)
+	for idx := 0; idx < 10; idx++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		n, from, err := b.ReadFromCtx(ctx, buf)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 || buf[0] != byte(idx) || buf[1] != byte(idx) || from.String() != a.LocalAddr().String() {
+			t.Fatalf("unexpected packet %d: %x from %s", idx, buf[:n], from)
+		}
+	}
+}
+
+func TestCoalescedMalformed(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv)
+	defer pc.Close()
+	tr := allocTraffic()
+	tr.source = pc.core.crypto.publicKey
+	tr.dest = pc.core.crypto.publicKey
+	tr.kind = trafficKindCoalesced
+	tr.payload = append(tr.payload, 1, 'a', 2, 'b', 'c', 5, 'd')
+	pc.handleTraffic(nil, tr)
+	buf := make([]byte, 16)
+	for _, expected := range []string{"a", "bc"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		n, _, err := pc.ReadFromCtx(ctx, buf)
+		cancel()
+		if err != nil || string(buf[:n]) != expected {
+			t.Fatalf("expected %q, got %q %v", expected, buf[:n], err)
+		}
+	}
+	// The truncated record at the end is dropped
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if n, _, err := pc.ReadFromCtx(ctx, buf); err == nil {
+		t.Fatalf("unexpected packet %q", buf[:n])
+	}
+}
+
+// BenchmarkCoalescing sends b.N packets as fast as possible, and reports the fraction that made it.
+func BenchmarkCoalescing(b *testing.B) {
+	for _, size := range []int{16, 1024} {
+		for _, delay := range []time.Duration{0, 2 * time.Millisecond} {
+			b.Run(fmt.Sprintf("size=%d/delay=%s", size, delay), func(b *testing.B) {
+				var options []Option
+				if delay > 0 {
+					options = append(options, WithCoalescing(delay, 0))
+				}
+				src, dst, addr := newCoalescePair(b, options...)
+				msg := make([]byte, size)
+				done := make(chan int)
+				go func() {
+					buf := make([]byte, dst.MTU())
+					var count int
+					for count < b.N {
+						ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+						_, _, err := dst.ReadFromCtx(ctx, buf)
+						cancel()
+						if err != nil {
+							break
+						}
+						count++
+					}
+					done <- count
+				}()
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for idx := 0; idx < b.N; idx++ {
+					if _, err := src.WriteTo(msg, addr); err != nil {
+						b.Fatal(err)
+					}
+				}
+				count := <-done
+				b.StopTimer()
+				b.ReportMetric(float64(count)/float64(b.N), "delivered")
+			})
+		}
+	}
+}
+
+// BenchmarkCoalescingLatency measures the round trip time of a packet that's echoed back, with one packet in flight at a time.
+// Coalescing only delays packets here (by up to the delay), there's never anything else to send with them.
+func BenchmarkCoalescingLatency(b *testing.B) {
+	for _, size := range []int{16, 1024} {
+		for _, delay := range []time.Duration{0, 2 * time.Millisecond} {
+			b.Run(fmt.Sprintf("size=%d/delay=%s", size, delay), func(b *testing.B) {
+				var options []Option
+				if delay > 0 {
+					options = append(options, WithCoalescing(delay, 0))
+				}
+				src, dst, addr := newCoalescePair(b, options...)
+				go func() {
+					buf := make([]byte, dst.MTU())
+					for {
+						n, from, err := dst.ReadFrom(buf)
+						if err != nil {
+							return
+						}
+						if _, err := dst.WriteTo(buf[:n], from); err != nil {
+							return
+						}
+					}
+				}()
+				msg := make([]byte, size)
+				buf := make([]byte, src.MTU())
+				for start := time.Now(); ; {
+					// The first replies may be dropped while dst looks up a path back to src
+					if time.Since(start) > 30*time.Second {
+						b.Fatal("timeout")
+					}
+					if _, err := src.WriteTo(msg, addr); err != nil {
+						b.Fatal(err)
+					}
+					ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+					_, _, err := src.ReadFromCtx(ctx, buf)
+					cancel()
+					if err == nil {
+						break
+					}
+				}
+				b.ResetTimer()
+				for idx := 0; idx < b.N; idx++ {
+					if _, err := src.WriteTo(msg, addr); err != nil {
+						b.Fatal(err)
+					}
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					_, _, err := src.ReadFromCtx(ctx, buf)
+					cancel()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
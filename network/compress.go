@@ -0,0 +1,116 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// frameCompressed is set in the type byte of a frame whose body is compressed, see WithFrameCompression.
+// The body is then the uvarint length of the uncompressed body, and the compressed bytes.
+const frameCompressed = 0x80
+
+// frameCompressible returns true for the protocol packets we compress.
+// Traffic and broadcasts carry payloads, which are usually encrypted, so compressing them would only cost time.
+func frameCompressible(pType wirePacketType) bool {
+	switch pType {
+	case wireDummy, wireKeepAlive, wireTraffic, wireProtoBroadcast:
+		return false
+	}
+	return true
+}
+
+// frameDeflater compresses the bodies of the frames sent over one connection, see WithFrameCompression.
+// The window carries over from one frame to the next, which is where most of the savings are, since one announce has little to compress on its own.
+// Each frame is flushed, so the peer can decompress it as soon as it arrives.
+type frameDeflater struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newFrameDeflater() *frameDeflater {
+	d := new(frameDeflater)
+	d.w, _ = flate.NewWriter(&d.buf, flate.BestSpeed)
+	return d
+}
+
+// deflate returns a compressed copy of the frame in bs, which it frees.
+// Both come from allocBytes, and start with the frame's length.
+func (d *frameDeflater) deflate(bs []byte) []byte {
+	_, n := binary.Uvarint(bs)
+	pType, body := bs[n], bs[n+1:]
+	_, _ = d.w.Write(body)
+	_ = d.w.Flush()
+	size := uint64(1 + wireSizeUint(uint64(len(body))) + d.buf.Len())
+	out := binary.AppendUvarint(allocBytes(0), size)
+	out = append(out, pType|frameCompressed)
+	out = wireAppendUint(out, uint64(len(body)))
+	out = append(out, d.buf.Bytes()...)
+	d.buf.Reset()
+	freeBytes(bs)
+	return out
+}
+
+// frameInflater decompresses the frames from a peer that compresses them, see frameDeflater.
+type frameInflater struct {
+	in  frameInput
+	buf []byte
+	r   io.Reader
+	max uint64
+}
+
+func newFrameInflater(max uint64) *frameInflater {
+	f := &frameInflater{max: max}
+	f.r = flate.NewReader(&f.in)
+	return f
+}
+
+// inflate returns the uncompressed frame for the payload in bs (from its type byte on), in a new buffer from allocBytes.
+func (f *frameInflater) inflate(bs []byte) ([]byte, error) {
+	pType, body := bs[0]&^frameCompressed, bs[1:]
+	var size uint64
+	if !wireChopUint(&size, &body) {
+		return nil, types.ErrDecodeTruncated
+	}
+	if size+1 > f.max {
+		return nil, types.ErrOversizedMessage
+	}
+	// The decompressor may not have read the end of the last frame's flush yet, so keep that in front of this one
+	n := copy(f.buf, f.in.bs)
+	f.buf = append(f.buf[:n], body...)
+	f.in.bs = f.buf
+	out := allocBytes(int(size) + 1)
+	out[0] = pType
+	if _, err := io.ReadFull(f.r, out[1:]); err != nil {
+		freeBytes(out)
+		return nil, types.ErrDecode
+	}
+	return out, nil
+}
+
+// frameInput feeds the frames given to a frameInflater to its decompressor.
+// It's only ever asked for what's in the frames, since each one is flushed, so running out means the frame was bad.
+type frameInput struct {
+	bs []byte
+}
+
+func (in *frameInput) Read(b []byte) (int, error) {
+	if len(in.bs) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(b, in.bs)
+	in.bs = in.bs[n:]
+	return n, nil
+}
+
+func (in *frameInput) ReadByte() (byte, error) {
+	if len(in.bs) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := in.bs[0]
+	in.bs = in.bs[1:]
+	return b, nil
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+func TestFrameCompressionSync(t *testing.T) {
+	// A burst of announces for 5k nodes, each the parent of the next, which is the order _sendAnnounces sends an ancestry in
+	// Most of an announce is keys and signatures, so the savings come from each parent being the key of the announce before
+	const count = 5000
+	keys := make([]crypto, count)
+	for idx := range keys {
+		_, priv, _ := ed25519.GenerateKey(nil)
+		keys[idx].init(priv)
+	}
+	var frames [][]byte
+	var plain int
+	for idx := range keys {
+		node, parent := &keys[idx], &keys[0]
+		if idx > 0 {
+			parent = &keys[idx-1]
+		}
+		res := routerSigRes{routerSigReq: routerSigReq{seq: uint64(rand.Intn(1000)), nonce: rand.Uint64()}, port: peerPort(rand.Intn(16) + 1)}
+		if idx == 0 {
+			res.port = 0
+		}
+		res.psig = parent.privateKey.sign(res.bytesForSig(node.publicKey, parent.publicKey))
+		ann := &routerAnnounce{key: node.publicKey, parent: parent.publicKey, routerSigRes: res}
+		signTestAnnounce(node, ann, time.Now())
+		frame := binary.AppendUvarint(allocBytes(0), uint64(ann.size()+1))
+		frame, _ = wireEncode(frame, byte(wireProtoAnnounce), ann)
+		frames = append(frames, frame)
+		plain += len(frame)
+	}
+	deflater, inflater := newFrameDeflater(), newFrameInflater(1<<20)
+	var compressed int
+	for _, frame := range frames {
+		_, n := binary.Uvarint(frame)
+		want := append([]byte(nil), frame[n:]...)
+		frame = deflater.deflate(frame)
+		compressed += len(frame)
+		_, n = binary.Uvarint(frame)
+		got, err := inflater.inflate(frame[n:])
+		freeBytes(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("frame changed")
+		}
+		freeBytes(got)
+	}
+	if ratio := float64(compressed) / float64(plain); ratio > 0.98 {
+		t.Fatalf("%d bytes compressed to %d (%.2f)", plain, compressed, ratio)
+	}
+}
+
+func TestFrameCompressionMixed(t *testing.T) {
+	// Only a compresses, and b can still read everything it sends, unless b is from before compression was added, in which case a doesn't compress at all
+	for _, features := range []uint64{featuresAll, 0} {
+		a := newNode(t, WithFrameCompression(func(key ed25519.PublicKey, conn net.Conn) bool { return true }))
+		b := newNode(t, withFeatures(features))
+		linkLine(t, []*PacketConn{a, b})
+		for _, pair := range [][2]*PacketConn{{a, b}, {b, a}} {
+			if !sendUntilReceived(t, pair[0].WriteTo, pair[1], []byte("test")) {
+				t.Fatal("timeout")
+			}
+		}
+		inflating := func(pc *PacketConn) bool {
+			var inflate bool
+			phony.Block(&pc.core.peers, func() {
+				for _, ps := range pc.core.peers.peers {
+					for p := range ps {
+						inflate = p.inflate != nil
+					}
+				}
+			})
+			return inflate
+		}
+		if inflating(a) || inflating(b) != (features&featureCompression != 0) {
+			t.Fatalf("expected b to get compressed frames only if it supports them, with features %d", features)
+		}
+	}
+}
+
+func TestFrameCompressionUnasked(t *testing.T) {
+	// b never says it can decompress frames, so a compressed frame is a decode error, even from a peer that says it can
+	pubA, _, _ := ed25519.GenerateKey(nil)
+	pubB, privB, _ := ed25519.GenerateKey(nil)
+	b, _ := NewPacketConn(privB, withFeatures(featuresAll&^featureCompression))
+	defer b.Close()
+	cA, cB := newDummyConn(pubA, pubB)
+	defer cA.Close()
+	done := make(chan error, 1)
+	go func() { done <- b.HandleConn(pubA, cB, 0) }()
+	go io.Copy(ioutil.Discard, cA) // Whatever b sends
+	if _, err := cA.Write(peerHelloFrame(featuresAll)); err != nil {
+		t.Fatal(err)
+	}
+	req := routerSigReq{seq: 1, nonce: 1}
+	frame := binary.AppendUvarint(allocBytes(0), uint64(req.size()+1))
+	frame, _ = wireEncode(frame, byte(wireProtoSigReq), &req)
+	if _, err := cA.Write(newFrameDeflater().deflate(frame)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, types.ErrDecode) {
+			t.Fatalf("expected a decode error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection is still up")
+	}
+}
@@ -2,6 +2,7 @@ package network
 
 import (
 	"crypto/ed25519"
+	"net"
 	"time"
 )
 
@@ -15,10 +16,69 @@ type config struct {
 	pathNotify         func(ed25519.PublicKey)
 	pathTimeout        time.Duration
 	pathThrottle       time.Duration
+	ecmp               bool
+	alternates         bool
+	closeDrainTimeout  time.Duration
+	drainGrace         time.Duration
+	routerMaxInfos     int
+	features           uint64
+	linkCost           func(key ed25519.PublicKey, conn net.Conn) uint16
+	signedExpiry       bool
+	clockOffset        time.Duration
+	frameCompression   func(key ed25519.PublicKey, conn net.Conn) bool
+	maxPathLength      int
+	pathTooLong        func(ed25519.PublicKey)
+	peerInboundRate    uint64
+	peerMaxConns       int
+	peerMaxConnsPerKey int
+	peerMaxPending     int
+	peerSetupTimeout   time.Duration
+	traceHandler       func(TraceEvent)
+	peerFilter         func(ed25519.PublicKey) bool
+	routeQueryRate     uint64
+	routeQueryFilter   func(from, dest ed25519.PublicKey) bool
+	watermarkSlack     uint64
+	coalesceDelay      time.Duration
+	coalesceSize       int
+	seqStore           SeqStore
+	startupListen      time.Duration
+	rootJitter         time.Duration
+	unreachable        bool
+	fragmentSize       uint64
+	fragmentBuffer     uint64
+	parentMargin       int
+	parentHold         time.Duration
+	keyedPorts         uint64
+	maxPort            uint64
+	routerCacheSize    int
+	convergedThreshold time.Duration
+	leaf               bool
+	recvQueueSize      uint64
+	eagerAnnounce      bool
+	announceFilter     func(key, parent ed25519.PublicKey, seq uint64) AnnounceVerdict
+	announceFilterSlow func(key ed25519.PublicKey, took time.Duration)
+	expectedRoot       ed25519.PublicKey
+	expectedRootWait   time.Duration
+	frameMAC           func(key ed25519.PublicKey, conn net.Conn) bool
+	peerProbeInterval  time.Duration
+	parentLossMargin   float64
+	parentRTTMargin    time.Duration
 }
 
+// Option configures a PacketConn, see NewPacketConn.
+// Functions passed in options, like the handlers set with the PacketConn's Set*Handler methods, are called from inside the PacketConn's actors, so they should not block.
 type Option func(*config)
 
+const (
+	watermarkMaxSlack = 2               // see WithWatermarkSlack
+	watermarkGrace    = 5 * time.Second // how long after our path changes that the watermark slack applies
+)
+
+// allowPeer returns false if the peer filter rejects the key.
+func (c *config) allowPeer(key publicKey) bool {
+	return c.peerFilter == nil || c.peerFilter(key.toEd())
+}
+
 func configDefaults() Option {
 	return func(c *config) {
 		c.routerRefresh = 4 * time.Minute
@@ -30,6 +90,17 @@ func configDefaults() Option {
 		c.pathNotify = func(key ed25519.PublicKey) {}
 		c.pathTimeout = time.Minute
 		c.pathThrottle = time.Second
+		c.closeDrainTimeout = time.Second
+		c.drainGrace = 5 * time.Second
+		c.features = featuresAll
+		c.maxPathLength = 64
+		c.maxPort = wireMaxPort
+		c.pathTooLong = func(key ed25519.PublicKey) {}
+		c.announceFilterSlow = func(key ed25519.PublicKey, took time.Duration) {}
+		c.peerSetupTimeout = 10 * time.Second
+		c.routeQueryRate = 16
+		c.convergedThreshold = 30 * time.Second
+		c.recvQueueSize = 4 * 1048576
 	}
 }
 
@@ -45,6 +116,24 @@ func WithRouterTimeout(duration time.Duration) Option {
 	}
 }
 
+// WithSignedExpiry makes other nodes' infos time out relative to when the node signed them (default false, relative to when we got them), so every node with the same router timeout expires an info at about the same time.
+// Whether an info is accepted still only depends on what's in it, so nodes with different clocks agree on which info wins, and one that had already timed out when we got it is accepted and then expires right away.
+// It assumes clocks agree to well within the router timeout, and a time in the future counts as now.
+// Infos that came through a node that doesn't support the announcement extension (see routerAnnounceExt) have no time, so they still time out relative to when we got them.
+func WithSignedExpiry(enabled bool) Option {
+	return func(c *config) {
+		c.signedExpiry = enabled
+	}
+}
+
+// WithRouterCacheSize limits how many paths the router keeps cached for next hop selection (default 0, no limit), dropping the least recently used ones when it's full.
+// Paths are only cached for our peers and ourself, so this only matters for nodes with lots of peers.
+func WithRouterCacheSize(size int) Option {
+	return func(c *config) {
+		c.routerCacheSize = size
+	}
+}
+
 func WithPeerKeepAliveDelay(duration time.Duration) Option {
 	return func(c *config) {
 		c.peerKeepAliveDelay = duration
@@ -86,3 +175,368 @@ func WithPathThrottle(duration time.Duration) Option {
 		c.pathThrottle = duration
 	}
 }
+
+// WithECMP spreads traffic over equal cost next hops, hashing the source and destination keys (and the flow from PacketOptions) so each flow sticks to one link.
+// When disabled (the default), the lowest key / best priority / longest lived link is always used.
+func WithECMP(enabled bool) Option {
+	return func(c *config) {
+		c.ecmp = enabled
+	}
+}
+
+// WithLoopFreeAlternates lets traffic use another peer when the best next hop's queue is saturated (it's started dropping packets), as long as that peer is also strictly closer to the destination than we are.
+// That's the same condition every next hop has to meet, so the watermark still rules out loops.
+// When disabled (the default), traffic waits for (or is dropped by) the best next hop's queue.
+func WithLoopFreeAlternates(enabled bool) Option {
+	return func(c *config) {
+		c.alternates = enabled
+	}
+}
+
+// WithUnreachableReports makes us tell the source of traffic we drop, because we have no next hop for it or our queue to the next hop is full, that its destination is unreachable.
+// Reports are sent at most once per second per destination, see PacketConn.SetUnreachableHandler for the sending side.
+// When disabled (the default), dropped traffic is only noticed by the sender through timeouts (and path lookups).
+func WithUnreachableReports(enabled bool) Option {
+	return func(c *config) {
+		c.unreachable = enabled
+	}
+}
+
+// WithEagerAnnounce makes us send announcements as soon as an info changes, instead of waiting for the next maintenance period (the default, once a second).
+// The same announcements are sent either way (each peer gets our ancestry and theirs, once per info), so changes reach the edge of the tree up to a second sooner per hop.
+// The cost is bandwidth under churn: an info that changes again within the second is sent twice instead of once, which the announces.sent metric shows.
+func WithEagerAnnounce(enabled bool) Option {
+	return func(c *config) {
+		c.eagerAnnounce = enabled
+	}
+}
+
+// WithParentHysteresis makes us keep our parent when our info is refreshed, instead of switching to whichever peer with the same root answered our request first (the default).
+// We only switch if the other peer would put us more than margin hops closer to the root, or if our parent changed less than hold ago, so a node that just joined can still settle on a good parent before it sticks.
+// Switching to a better root, or away from a parent we can no longer use, is never held back.
+func WithParentHysteresis(margin int, hold time.Duration) Option {
+	return func(c *config) {
+		c.parentMargin = margin
+		c.parentHold = hold
+	}
+}
+
+// WithLeafMode makes us a leaf node, for clients that want to send and receive traffic but never relay it.
+// We decline every peer's request to be their parent, and drop any traffic that isn't from or to us (with an unreachable report, see WithUnreachableReports).
+// Peers notice the declined response, so they never pick us as a parent or use us as a next hop for anyone else.
+// A leaf still prefers any peer's root over becoming the root itself.
+func WithLeafMode(enabled bool) Option {
+	return func(c *config) {
+		c.leaf = enabled
+	}
+}
+
+// WithRecvQueueSize sets the most bytes of packets that can wait to be returned by ReadFrom (default 4 megabytes, 0 for no limit).
+// If the application stops reading, packets are dropped instead of stalling the router, oldest first from the source using the most space, and counted in the drops.recv_queue metric.
+// Packets are dropped the same way once the oldest has waited more than 25ms, whatever the limit.
+func WithRecvQueueSize(size uint64) Option {
+	return func(c *config) {
+		c.recvQueueSize = size
+	}
+}
+
+// WithCloseDrainTimeout sets how long Close waits for queued traffic to be sent to peers, before telling them we're leaving and closing connections.
+func WithCloseDrainTimeout(duration time.Duration) Option {
+	return func(c *config) {
+		c.closeDrainTimeout = duration
+	}
+}
+
+// WithDrainGrace sets how long Drain waits, after telling peers we're draining, before it closes the PacketConn (default 5 seconds).
+func WithDrainGrace(duration time.Duration) Option {
+	return func(c *config) {
+		c.drainGrace = duration
+	}
+}
+
+// WithRouterMaxInfos limits how many infos the router stores (default 0, no limit).
+// When a new info doesn't fit, an info from a leaving root is dropped to make room if there is one.
+// Otherwise the evictable info with the highest key is dropped, which may be the new one, see AnnounceVerdict.
+// Our own info, our ancestry and our peers' ancestries are never dropped, since we need them to pick a parent and route, and neither are infos the announce filter said to keep, so those can go over the limit.
+// See PacketConn.SetCapacityHandler to find out when the limit is reached.
+func WithRouterMaxInfos(count int) Option {
+	return func(c *config) {
+		c.routerMaxInfos = count
+	}
+}
+
+// WithLinkCosts sets a function that gives the cost of each new connection (default nil, every link costs the same), e.g. more for a slow or metered link.
+// Distances count the cost of the links on the tree instead of hops, we prefer the parent that's cheapest to reach the root through, and the next hop is the one with the lowest cost to reach plus its distance to the destination.
+// Each node signs the cost of the link to its parent as it sees it, in the announcement extension (see routerAnnounceExt).
+// A cost of 0 counts as 1, and infos from nodes that don't use link costs, or that came through nodes that don't support the extension, count the link as 1 too.
+// Every node should use it, since traffic that crosses nodes that disagree about distances may be dropped by the watermark.
+func WithLinkCosts(cost func(key ed25519.PublicKey, conn net.Conn) uint16) Option {
+	return func(c *config) {
+		c.linkCost = cost
+	}
+}
+
+// WithFrameCompression sets a function that decides which connections we compress protocol frames over with flate (default nil, none of them).
+// It's meant for slow links, where the announces sent to a new peer can take a while. Traffic and broadcasts are never compressed, since their payloads are usually encrypted.
+// Most of an announce is keys and signatures, so expect announce bursts to shrink by only a few percent, and small frames to grow by a few bytes.
+// The window is shared by every frame sent over the connection, so each one costs a few hundred KiB of memory for the compressor, and the peer needs about 40 KiB to decompress.
+// Frames are only compressed for peers that say they can decompress them in their hello (see features.go), which every node that has this option does, so only the sending side needs to enable it.
+// A compressed frame from a peer that we didn't say that to is a decode error, which closes the connection.
+func WithFrameCompression(useCompression func(key ed25519.PublicKey, conn net.Conn) bool) Option {
+	return func(c *config) {
+		c.frameCompression = useCompression
+	}
+}
+
+// WithMaxPathLength sets the deepest a node can be in the spanning tree, in hops from the root (default 64).
+// We won't pick a parent that would put us deeper than this, so the tree stays within the limit even if nodes disagree about it.
+// Paths to other nodes that are longer than this are ignored, see WithPathTooLong, and writes to them return types.ErrPathTooLong until the path times out.
+func WithMaxPathLength(length int) Option {
+	return func(c *config) {
+		c.maxPathLength = length
+	}
+}
+
+// WithPathTooLong sets a function to call when we get a path to a node that's longer than the max path length, so we won't send traffic to it.
+func WithPathTooLong(handler func(key ed25519.PublicKey)) Option {
+	return func(c *config) {
+		c.pathTooLong = handler
+	}
+}
+
+// WithKeyedPorts derives the port we use for each peer from its key, as a number from 1 to space (default 0, ports are assigned in connection order).
+// Paths through us are made of ports, so this keeps them working after we restart, as long as our peers get the same ports back.
+// If the derived port is already in use by another peer, or isn't below the limit set by WithMaxPort, the lowest free port is used instead. Ports are kept small on the wire, so space is limited to about a million.
+func WithKeyedPorts(space uint64) Option {
+	return func(c *config) {
+		if space >= wireMaxPort {
+			space = wireMaxPort - 1
+		}
+		c.keyedPorts = space
+	}
+}
+
+// WithMaxPort sets the limit that ports must be below (default and highest 1<<20, lowest 2).
+// We never give a peer a port at or above the limit, so a node with more peers than that refuses the extra connections with types.ErrBadPort.
+// Announcements and signature responses with a port at or above it are dropped, and counted in the drops.announce_port metric, so a peer can't make us carry (or sign) huge ports.
+// Nodes that use a lower limit than their peers won't store infos for nodes with more peers than that, so it should be the same across a network.
+func WithMaxPort(max uint64) Option {
+	return func(c *config) {
+		switch {
+		case max < 2:
+			max = 2 // Room for port 1
+		case max > wireMaxPort:
+			max = wireMaxPort // Nothing higher can be decoded
+		}
+		c.maxPort = max
+	}
+}
+
+// WithPeerInboundRate limits how many bytes per second we read from each peer connection, with bursts of up to one second's worth (default 0, unlimited).
+// A peer over its limit has to wait, so it can't keep the router busy enough to delay other peers' traffic.
+// This should be well above peerMaxMessageSize divided by the peer timeout, or a peer sending large messages may time out while it waits.
+func WithPeerInboundRate(bytesPerSecond uint64) Option {
+	return func(c *config) {
+		c.peerInboundRate = bytesPerSecond
+	}
+}
+
+// WithPeerMaxConns limits the number of connections passed to HandleConn that can be in use at once, across all peers (default 0, unlimited).
+// HandleConn returns types.ErrTooManyPeers for connections over the limit.
+func WithPeerMaxConns(count int) Option {
+	return func(c *config) {
+		c.peerMaxConns = count
+	}
+}
+
+// WithPeerMaxConnsPerKey limits the number of connections to the same peer key that can be in use at once (default 0, unlimited).
+// HandleConn returns types.ErrTooManyPeerConns for connections over the limit.
+func WithPeerMaxConnsPerKey(count int) Option {
+	return func(c *config) {
+		c.peerMaxConnsPerKey = count
+	}
+}
+
+// WithPeerMaxPending limits the number of connections that haven't finished setup, i.e. the peer hasn't proven that it has the key passed to HandleConn yet (default 0, unlimited).
+// HandleConn returns types.ErrTooManyPendingPeers for connections over the limit.
+func WithPeerMaxPending(count int) Option {
+	return func(c *config) {
+		c.peerMaxPending = count
+	}
+}
+
+// WithPeerSetupTimeout sets how long a peer has to prove that it has the key passed to HandleConn, by signing a challenge, before the connection is closed (default 10 seconds, 0 to wait forever).
+// HandleConn returns types.ErrPeerSetupTimeout in that case.
+func WithPeerSetupTimeout(duration time.Duration) Option {
+	return func(c *config) {
+		c.peerSetupTimeout = duration
+	}
+}
+
+// WithTraceHandler sets a function to call when we handle traffic sent with PacketConn.WriteToTraced (default nil, traced traffic is handled like any other).
+func WithTraceHandler(handler func(TraceEvent)) Option {
+	return func(c *config) {
+		c.traceHandler = handler
+	}
+}
+
+// WithPeerFilter sets a function that decides which peer keys we accept connections from (default nil, any key is accepted).
+// It's checked when HandleConn is called, before any protocol traffic is exchanged, and again once the peer proves that it has the key.
+// HandleConn returns types.ErrPeerNotAllowed if the filter returns false.
+func WithPeerFilter(filter func(key ed25519.PublicKey) bool) Option {
+	return func(c *config) {
+		c.peerFilter = filter
+	}
+}
+
+// WithAnnounceFilter sets a function that decides what we do with infos, given the node's key, its parent and its seq (default nil, every valid info is AnnounceEvictable).
+// A rejected info is dropped as if we never received it, so it's neither stored nor passed on to our peers, and counted in the drops.announce_filter metric.
+// Our own info is never filtered. Rejecting an info in our own ancestry cuts us off from the root, so filters should be used with care.
+// The filter is called from the router's actor, so it needs to be fast: calls that take over a millisecond are counted in the announces.filter_slow metric, and passed to the handler set by WithAnnounceFilterSlow.
+func WithAnnounceFilter(filter func(key, parent ed25519.PublicKey, seq uint64) AnnounceVerdict) Option {
+	return func(c *config) {
+		c.announceFilter = filter
+	}
+}
+
+// WithAnnounceFilterSlow sets a function to call with the key and duration whenever the announce filter takes over a millisecond, see WithAnnounceFilter.
+func WithAnnounceFilterSlow(handler func(key ed25519.PublicKey, took time.Duration)) Option {
+	return func(c *config) {
+		c.announceFilterSlow = handler
+	}
+}
+
+// WithFrameMAC sets a function that decides which connections authenticate every frame with a MAC (default nil, none of them do).
+// It's meant for transports with no protection of their own, like plain TCP, so a middlebox can't inject or change frames once the peer has proven its key.
+// Connections that are already encrypted and authenticated (e.g. TLS) don't need it.
+// Each side asks for a MAC in its hello (see features.go), and if the function says to use one but the peer's hello doesn't ask for it too, the connection is closed with types.ErrNoMAC, so both ends of a connection need it.
+// After the hellos, each side signs an ephemeral X25519 key, and MAC keys for each direction are derived from the shared secret.
+// Every frame is then followed by a 16 byte HMAC-SHA256 of its number, length and payload, and the connection is closed with types.ErrBadMAC on the first one that doesn't match.
+// The hellos themselves aren't authenticated, but a middlebox that removes the request from one can only stop the connection, not turn the MAC off.
+func WithFrameMAC(useMAC func(key ed25519.PublicKey, conn net.Conn) bool) Option {
+	return func(c *config) {
+		c.frameMAC = useMAC
+	}
+}
+
+// WithPeerProbes makes us send a probe to each peer every interval (default 0, never), to measure the link's round trip time and loss (see PeerInfo.Quality).
+// A probe is a keepalive with one extra byte, which the peer echoes back, and one that isn't answered before the next is sent counts as lost.
+// Peers answer probes whether or not they send any themselves, and older nodes just ignore them.
+func WithPeerProbes(interval time.Duration) Option {
+	return func(c *config) {
+		c.peerProbeInterval = interval
+	}
+}
+
+// WithParentQuality makes us prefer the parent with the better link, between peers that offer the same root, instead of whichever answered our request first (the default).
+// A link is only better if its measured loss is more than lossMargin lower, or (with similar loss) its round trip time is more than rttMargin lower, and a margin of 0 ignores that measurement.
+// It needs WithPeerProbes to measure anything, and a link has no say until a few probes have been sent over it.
+// Switching to a better root is never held back by link quality.
+func WithParentQuality(lossMargin float64, rttMargin time.Duration) Option {
+	return func(c *config) {
+		c.parentLossMargin = lossMargin
+		c.parentRTTMargin = rttMargin
+	}
+}
+
+// WithRouteQueryRate limits how many route queries (sent by other nodes' PacketConn.TraceRoute) we answer per second, with bursts of up to one second's worth (default 16, 0 to never answer).
+func WithRouteQueryRate(perSecond uint64) Option {
+	return func(c *config) {
+		c.routeQueryRate = perSecond
+	}
+}
+
+// WithRouteQueryFilter sets a function that decides which route queries we answer, given the querying node and the destination it asked about (default nil, answer all of them).
+// For example, a node that only wants to reveal its next hop for the querier's own traffic could only answer queries about nodes it has seen traffic between.
+func WithRouteQueryFilter(filter func(from, dest ed25519.PublicKey) bool) Option {
+	return func(c *config) {
+		c.routeQueryFilter = filter
+	}
+}
+
+// WithWatermarkSlack lets us forward traffic that's up to slack hops past its watermark, for 5 seconds after our own root or path changes (default 0, at most 2).
+// Traffic that was in flight when we moved in the tree would otherwise be dropped, because its watermark was set using distances that no longer hold.
+// The watermark is what stops routing loops, which is why the slack is small and only lasts a short time.
+func WithWatermarkSlack(slack uint64) Option {
+	return func(c *config) {
+		if slack > watermarkMaxSlack {
+			slack = watermarkMaxSlack
+		}
+		c.watermarkSlack = slack
+	}
+}
+
+// WithCoalescing holds small packets written with WriteTo for up to maxDelay (default 0, disabled), and sends the ones for the same destination as a single packet of at most maxSize bytes (0 for the MTU).
+// The receiver splits them up again, so each is still returned by its own ReadFrom call.
+// Coalesced packets are only sent to destinations that have answered a probe saying they can split them, so older nodes keep getting packets one at a time.
+// This trades up to maxDelay of extra latency for less per-packet overhead, which mostly helps applications that send lots of tiny packets to the same few nodes.
+func WithCoalescing(maxDelay time.Duration, maxSize int) Option {
+	return func(c *config) {
+		c.coalesceDelay = maxDelay
+		c.coalesceSize = maxSize
+	}
+}
+
+// WithFragmentation lets WriteTo send standard packets of up to maxSize bytes (default 0, disabled), by splitting anything that doesn't fit in one packet into fragments, and reassembles fragmented packets sent to us.
+// Fragments that arrive are held in a reassembly buffer of up to bufferSize bytes (0 for 4 times maxSize), with the oldest incomplete packets dropped to make room, and the rest of a packet has to arrive within 5 seconds of its first fragment.
+// If any fragment is lost, so is the whole packet. Both ends need to enable this, older nodes (and nodes with it disabled) drop fragments.
+// A packet can have at most 256 fragments, so maxSize is also limited to 256 times what fits in one packet, see PacketConn.MTU.
+func WithFragmentation(maxSize, bufferSize uint64) Option {
+	return func(c *config) {
+		if bufferSize == 0 {
+			bufferSize = 4 * maxSize
+		}
+		c.fragmentSize = maxSize
+		c.fragmentBuffer = bufferSize
+	}
+}
+
+// WithConvergedThreshold sets how long our parent has to stay the same before we count as converged (default 30 seconds), see PacketConn.SetConvergedHandler and the router.converged metric.
+func WithConvergedThreshold(duration time.Duration) Option {
+	return func(c *config) {
+		c.convergedThreshold = duration
+	}
+}
+
+// SeqStore saves the seq of our own router info, so a restarted node can pick up where it left off, see WithSeqStore.
+// Both methods are called from the router's actor, so they should not block for long.
+type SeqStore interface {
+	Load(key ed25519.PublicKey) (seq uint64, ok bool)
+	Store(key ed25519.PublicKey, seq uint64)
+}
+
+// WithStartupListen makes a new node wait before becoming the root of its own tree (default 0, it does so right away).
+// In the meantime, it can pick a parent from whatever its peers tell it, so a node that joins an existing network doesn't announce itself as a root first.
+func WithStartupListen(duration time.Duration) Option {
+	return func(c *config) {
+		c.startupListen = duration
+	}
+}
+
+// WithExpectedRoot makes a new node wait up to the given duration for a path to the root it expects (usually the root of the network it's joining), instead of becoming the root of its own tree first.
+// Until then, it also won't settle for a parent under a worse root than the expected one, so a cold start in a known topology doesn't pass through roots it would only leave again.
+// After the wait (or if our own key is better than the expected root), this has no effect, so an isolated node still becomes its own root. It stacks with WithStartupListen, whichever is longer.
+func WithExpectedRoot(key ed25519.PublicKey, wait time.Duration) Option {
+	return func(c *config) {
+		c.expectedRoot = key
+		c.expectedRootWait = wait
+	}
+}
+
+// WithRootJitter adds up to the given delay before a node becomes the root of its own tree, at startup or after losing its parent (default 0).
+// The delay is derived from the node's key, with lower keys (which make better roots) waiting less, so when many nodes start at once the best root tends to be announced first and the others join its tree instead of fighting it out.
+// Announcements spread about one hop per second, so the jitter needs to be at least a second or two per hop across the network to make much difference.
+func WithRootJitter(max time.Duration) Option {
+	return func(c *config) {
+		c.rootJitter = max
+	}
+}
+
+// WithSeqStore sets where the seq of our own router info is saved (default nil, nothing is saved).
+// The seq normally starts over from 1 when a node restarts, and other nodes reject our info until we learn our old seq back from them (see PacketConn.SetSelfRevivedHandler).
+// With a store, the stored seq is loaded when the PacketConn is created, and every new seq is stored before we announce it.
+func WithSeqStore(store SeqStore) Option {
+	return func(c *config) {
+		c.seqStore = store
+	}
+}
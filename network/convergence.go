@@ -0,0 +1,68 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"sync/atomic"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// How far back the router.parent_changes_recent metric counts, and the most changes it remembers.
+const (
+	parentChangeWindow = 10 * time.Minute
+	parentChangeRing   = 64
+)
+
+// SetConvergedHandler sets a function to call once our parent has stayed the same for the threshold set by WithConvergedThreshold, or unsets it if the handler is nil.
+// It's called again after each parent change that's followed by another stable period. If we're the root, the parent is our own key.
+// Parents are only checked during maintenance, so the handler may be called up to a second late.
+func (pc *PacketConn) SetConvergedHandler(handler func(parent ed25519.PublicKey)) {
+	phony.Block(&pc.core.router, func() {
+		pc.core.router.convergedHandler = handler
+	})
+}
+
+// _parentChanged records a change to our parent, it's called from _update.
+func (r *router) _parentChanged(parent publicKey) {
+	now := time.Now()
+	r.parentTime = now
+	r.converged = false
+	m := &r.core.metrics
+	atomic.AddInt64(&m.parentChanges, 1)
+	atomic.StoreInt64(&m.parentTime, now.UnixNano())
+	atomic.StoreInt64(&m.converged, 0)
+	var rootTime int64
+	if parent == r.core.crypto.publicKey {
+		rootTime = now.UnixNano()
+	}
+	atomic.StoreInt64(&m.rootTime, rootTime)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.parentRing[m.parentIdx%parentChangeRing] = now
+	m.parentIdx++
+}
+
+// _checkConverged calls the converged handler if our parent has been stable for long enough, it's called during maintenance.
+func (r *router) _checkConverged() {
+	self, isIn := r.infos[r.core.crypto.publicKey]
+	if r.converged || !isIn || time.Since(r.parentTime) < r.core.config.convergedThreshold {
+		return
+	}
+	r.converged = true
+	atomic.StoreInt64(&r.core.metrics.converged, 1)
+	if r.convergedHandler != nil {
+		r.convergedHandler(self.parent.toEd())
+	}
+}
+
+// recentParentChanges returns how many times our parent changed within parentChangeWindow, up to parentChangeRing.
+// The caller must hold the mutex.
+func (m *metrics) recentParentChanges(now time.Time) (count int64) {
+	for _, t := range m.parentRing {
+		if !t.IsZero() && now.Sub(t) < parentChangeWindow {
+			count++
+		}
+	}
+	return
+}
@@ -7,6 +7,7 @@ import (
 
 	//"fmt"
 	"net"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -72,6 +73,112 @@ func TestTwoNodes(t *testing.T) {
 	}
 }
 
+func TestOutOfBand(t *testing.T) {
+	a, b := newPair(t)
+	pubA, pubB := nodeKey(a), nodeKey(b)
+	if err := b.SetOutOfBandHandler(OutOfBandKindMin-1, func(ed25519.PublicKey, []byte) {}); err == nil {
+		t.Fatal("expected an error for a reserved kind")
+	}
+	const kind = OutOfBandKindMin + 1
+	msg := []byte("test")
+	done := make(chan struct{})
+	var once sync.Once
+	err := b.SetOutOfBandHandler(kind, func(fromKey ed25519.PublicKey, data []byte) {
+		if !bytes.Equal(fromKey, pubA) || !bytes.Equal(data, msg) {
+			panic("wrong out-of-band packet")
+		}
+		once.Do(func() { close(done) })
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	timer := time.NewTimer(6 * time.Second)
+	defer timer.Stop()
+	for {
+		if err := a.SendOutOfBand(kind, pubB, msg); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-timer.C:
+			t.Fatal("timeout")
+		case <-done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func TestSetPeerPriority(t *testing.T) {
+	a := newNode(t)
+	linkNodes(t, a, newNode(t))
+	var peers []DebugPeerInfo
+	for len(peers) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		peers = a.Debug.GetPeers()
+	}
+	if err := a.SetPeerPriority(peers[0].Port+1, 1); err == nil {
+		t.Fatal("expected an error for an unknown port")
+	}
+	if err := a.SetPeerPriority(peers[0].Port, 1); err != nil {
+		t.Fatal(err)
+	}
+	if peers = a.Debug.GetPeers(); peers[0].Priority != 1 {
+		t.Fatal("priority was not updated")
+	}
+}
+
+type encryptedDummyConn struct {
+	*dummyConn
+}
+
+func (c encryptedDummyConn) Encryption() string { return "test" }
+
+func TestPeers(t *testing.T) {
+	a, b := newNode(t), newNode(t)
+	pubA, pubB := nodeKey(a), nodeKey(b)
+	cA, cB := newDummyConn(pubA, pubB)
+	defer cA.Close()
+	defer cB.Close()
+	go a.HandleConn(pubB, encryptedDummyConn{cA}, 2)
+	go b.HandleConn(pubA, cB, 0)
+	var peersA, peersB []PeerInfo
+	for len(peersA) == 0 || len(peersB) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		peersA, peersB = a.Peers(), b.Peers()
+	}
+	if pa := peersA[0]; !pa.Key.Equal(pubB) || pa.Priority != 2 || !pa.Encrypted || pa.Encryption != "test" {
+		t.Fatalf("unexpected peer info: %+v", pa)
+	}
+	if pb := peersB[0]; !pb.Key.Equal(pubA) || pb.Encrypted || pb.Uptime <= 0 {
+		t.Fatalf("unexpected peer info: %+v", pb)
+	}
+}
+
+func TestCloseGoodbye(t *testing.T) {
+	a, b := newNode(t), newNode(t)
+	linkNodes(t, a, b)
+	keyB := b.core.crypto.publicKey
+	knowsB := func() (isIn bool) {
+		phony.Block(&a.core.router, func() {
+			// If b was the root, it leaves its info behind as a leaving announcement, which we treat as gone
+			var info routerInfo
+			info, isIn = a.core.router.infos[keyB]
+			isIn = isIn && !info.isLeaving(keyB)
+		})
+		return
+	}
+	for !knowsB() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.Close()
+	// Without a goodbye, we would keep b's info until it times out
+	for begin := time.Now(); knowsB(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(begin) > time.Second {
+			t.Fatal("info was not expired after goodbye")
+		}
+	}
+}
+
 func TestLineNetwork(t *testing.T) {
 	var conns []*PacketConn
 	for idx := 0; idx < 8; idx++ {
@@ -280,6 +387,122 @@ func TestRandomTreeNetwork(t *testing.T) {
 	}
 }
 
+func TestRootLeaving(t *testing.T) {
+	var conns []*PacketConn
+	for idx := 0; idx < 5; idx++ {
+		conns = append(conns, newNode(t))
+	}
+	// Nodes are in a line sorted by key, so the root is at one end and most nodes only hear about it leaving from the announcement
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].core.crypto.publicKey.less(conns[j].core.crypto.publicKey)
+	})
+	linkLine(t, conns)
+	root := conns[0]
+	rest := conns[1:]
+	getRoot := func(conn *PacketConn) (key publicKey) {
+		phony.Block(&conn.core.router, func() {
+			key, _ = conn.core.router._getRootAndDists(conn.core.crypto.publicKey)
+		})
+		return
+	}
+	if !getRoot(rest[0]).equal(root.core.crypto.publicKey) {
+		t.Fatal("wrong root")
+	}
+	root.Close()
+	start := time.Now()
+	for {
+		if time.Since(start) > time.Second {
+			t.Fatal("network did not reconverge within a second")
+		}
+		newRoot := getRoot(rest[0])
+		agreed := !newRoot.equal(root.core.crypto.publicKey)
+		for _, conn := range rest[1:] {
+			agreed = agreed && getRoot(conn).equal(newRoot)
+		}
+		if agreed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBroadcastGrid(t *testing.T) {
+	const side = 4
+	var conns []*PacketConn
+	for idx := 0; idx < side*side; idx++ {
+		conns = append(conns, newNode(t))
+	}
+	for idx, conn := range conns {
+		if idx%side != side-1 {
+			linkNodes(t, conn, conns[idx+1])
+		}
+		if idx+side < len(conns) {
+			linkNodes(t, conn, conns[idx+side])
+		}
+	}
+	waitForRoot(conns, 30*time.Second)
+	// Wait for everyone to agree on which links are part of the tree
+	onTree := func(a, b *PacketConn) (is bool) {
+		phony.Block(&a.core.router, func() {
+			is = a.core.router.blooms._isOnTree(b.core.crypto.publicKey)
+		})
+		return
+	}
+	for agreed := 0; agreed < 2; {
+		var treeLinks int
+		symmetric := true
+		for idx, conn := range conns {
+			for _, jdx := range []int{idx - side, idx - 1, idx + 1, idx + side} {
+				if jdx < 0 || jdx >= len(conns) || (jdx == idx-1 && idx%side == 0) || (jdx == idx+1 && jdx%side == 0) {
+					continue
+				}
+				if onTree(conn, conns[jdx]) {
+					treeLinks++
+					symmetric = symmetric && onTree(conns[jdx], conn)
+				}
+			}
+		}
+		if symmetric && treeLinks == 2*(len(conns)-1) {
+			agreed++
+		} else {
+			agreed = 0
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	var mutex sync.Mutex
+	var received, transmissions int
+	for _, conn := range conns[1:] {
+		conn.SetBroadcastHandler(func(from ed25519.PublicKey, data []byte) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if !from.Equal(conns[0].PrivateKey().Public().(ed25519.PublicKey)) || string(data) != "test" {
+				panic("bad broadcast")
+			}
+			received++
+		})
+		conn.SetWireMiddleware(func(_ ed25519.PublicKey, pType WireType, data []byte, dir WireDirection) ([]byte, bool) {
+			if pType == WireBroadcast && dir == WireRecv {
+				mutex.Lock()
+				defer mutex.Unlock()
+				transmissions++
+			}
+			return data, true
+		})
+	}
+	if err := conns[0].Broadcast([]byte("test"), 255); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if received != len(conns)-1 {
+		t.Fatalf("expected %d nodes to receive the broadcast, got %d", len(conns)-1, received)
+	}
+	if transmissions != len(conns)-1 {
+		t.Fatalf("expected %d transmissions, got %d", len(conns)-1, transmissions)
+	}
+}
+
 // waitForRoot is a helper function that waits until all nodes are using the same root
 // that should usually mean the network has settled into a stable state, at least for static network tests
 func waitForRoot(conns []*PacketConn, timeout time.Duration) {
@@ -383,12 +606,10 @@ func (d *dummyConn) Close() error {
 
 func (d *dummyConn) LocalAddr() net.Addr {
 	panic("Not implemented: LocalAddr")
-	return nil
 }
 
 func (d *dummyConn) RemoteAddr() net.Addr {
 	panic("Not implemented: RemoteAddr")
-	return nil
 }
 
 func (d *dummyConn) SetDeadline(t time.Time) error {
@@ -403,5 +624,108 @@ func (d *dummyConn) SetReadDeadline(t time.Time) error {
 
 func (d *dummyConn) SetWriteDeadline(t time.Time) error {
 	panic("Not implemented: SetWriteDeadline")
-	return nil
+}
+
+func TestPathTooLong(t *testing.T) {
+	// A line sorted by key, where only the root has a lower limit, so the last node's path is too long for it but not for anyone else
+	const maxLength = 2
+	var privs []ed25519.PrivateKey
+	for idx := 0; idx < maxLength+2; idx++ {
+		_, priv, _ := ed25519.GenerateKey(nil)
+		privs = append(privs, priv)
+	}
+	sort.Slice(privs, func(i, j int) bool {
+		return bytes.Compare(privs[i].Public().(ed25519.PublicKey), privs[j].Public().(ed25519.PublicKey)) < 0
+	})
+	var conns []*PacketConn
+	for idx, priv := range privs {
+		var options []Option
+		if idx == 0 {
+			options = append(options, WithMaxPathLength(maxLength))
+		}
+		conn, err := NewPacketConn(priv, options...)
+		if err != nil {
+			panic(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	linkLine(t, conns)
+	if !sendUntilReceived(t, conns[0].WriteTo, conns[maxLength], []byte("test")) {
+		t.Fatal("no traffic to a node at the limit")
+	}
+	far := conns[maxLength+1].LocalAddr()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		_, err := conns[0].WriteTo([]byte("test"), far)
+		if errors.Is(err, types.ErrPathTooLong) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(start) > 30*time.Second {
+			t.Fatal("writes past the limit never failed")
+		}
+	}
+}
+
+func TestMaxPathLength(t *testing.T) {
+	// A line sorted by key, so depth in the tree is the index in the line, with 1 node past the limit
+	const maxLength = 4
+	var conns []*PacketConn
+	for idx := 0; idx < maxLength+2; idx++ {
+		conns = append(conns, newNode(t, WithMaxPathLength(maxLength)))
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].core.crypto.publicKey.less(conns[j].core.crypto.publicKey)
+	})
+	for idx := 1; idx < len(conns); idx++ {
+		// Not linkLine, since the node past the limit never agrees on the root
+		linkNodes(t, conns[idx-1], conns[idx])
+	}
+	converged := func() bool {
+		for idx, conn := range conns {
+			var root publicKey
+			var path []peerPort
+			phony.Block(&conn.core.router, func() {
+				root, path = conn.core.router._getRootAndPath(conn.core.crypto.publicKey)
+			})
+			if len(path) > maxLength {
+				// This can happen briefly, if a parent moves further from the root, until the node picks another parent
+				return false
+			}
+			expected := conns[0]
+			if idx > maxLength {
+				// Too far, so it should be its own root
+				expected = conn
+			}
+			if !root.equal(expected.core.crypto.publicKey) {
+				return false
+			}
+		}
+		return true
+	}
+	start := time.Now()
+	for count := 0; count < 3; {
+		if time.Since(start) > 30*time.Second {
+			t.Fatal("network did not converge")
+		}
+		if converged() {
+			count++
+		} else {
+			count = 0
+		}
+		time.Sleep(time.Second)
+	}
+	for idx, conn := range conns {
+		expected := idx
+		if idx > maxLength {
+			expected = 0
+		}
+		if dist := conn.RootDistance(); dist != expected {
+			t.Errorf("node %d is %d hops from the root, expected %d", idx, dist, expected)
+		}
+	}
+	if depth := conns[maxLength-1].Debug.GetSelf().MaxDepth; depth != maxLength {
+		t.Errorf("expected a max depth of %d, got %d", maxLength, depth)
+	}
 }
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"math"
+	"net"
+)
+
+// linkCostDefault is the cost of a link when a node doesn't say otherwise, see WithLinkCosts.
+// With every link at this cost, distances are the same as hop counts.
+const linkCostDefault = 1
+
+// getLinkCost returns the cost of a new link to the key, or 0 if we don't use link costs, see WithLinkCosts.
+func (c *config) getLinkCost(key publicKey, conn net.Conn) uint64 {
+	if c.linkCost == nil {
+		return 0
+	}
+	if cost := uint64(c.linkCost(key.toEd(), conn)); cost > 0 {
+		return cost
+	}
+	return linkCostDefault
+}
+
+// infoCost returns the cost of the link from the info's node to its parent, as the node sees it.
+// Nodes that don't use link costs sign 0, and infos from nodes that don't support the announcement extension have none, which both count as the default.
+func infoCost(info *routerInfo) uint64 {
+	if info.cost == 0 || info.cost > math.MaxUint16 {
+		return linkCostDefault
+	}
+	return info.cost
+}
+
+// _getPathCosts returns the total cost from the root to each node on the key's path, in the same order as the ports from _getRootAndPath.
+func (r *router) _getPathCosts(key publicKey, hops int) []uint64 {
+	costs := make([]uint64, hops)
+	next := key
+	for idx := hops - 1; idx >= 0; idx-- {
+		info := r.infos[next]
+		costs[idx] = infoCost(&info)
+		next = info.parent
+	}
+	for idx := 1; idx < hops; idx++ {
+		costs[idx] += costs[idx-1]
+	}
+	return costs
+}
+
+// _getRootCost returns the total cost of the links from the key's root to the key, see WithLinkCosts.
+func (r *router) _getRootCost(key publicKey) uint64 {
+	_, path := r._getRootAndPath(key)
+	if len(path) == 0 {
+		return 0
+	}
+	costs := r._getPathCosts(key, len(path))
+	return costs[len(costs)-1]
+}
+
+// costDist is _getDist with link costs: the cost from the key up to where its path meets the destination's, plus the hops from there down to the destination.
+// We only know the costs of links in the ancestry of nodes that we have infos for, so the destination's side counts each hop at the default cost.
+func costDist(keyCosts []uint64, prefix, destHops int) uint64 {
+	dist := uint64(destHops-prefix) * linkCostDefault
+	if len(keyCosts) > prefix {
+		dist += keyCosts[len(keyCosts)-1]
+		if prefix > 0 {
+			dist -= keyCosts[prefix-1]
+		}
+	}
+	return dist
+}
+
+// _compareCosts returns -1 if a is a cheaper parent than b, counting the link to them, 1 if it's more expensive, and 0 if they cost the same (or we don't use link costs).
+func (r *router) _compareCosts(a, b publicKey) int {
+	if r.core.config.linkCost == nil {
+		return 0
+	}
+	cost := func(key publicKey) uint64 {
+		link := r._bestLink(key, false)
+		if link == nil {
+			return math.MaxUint64
+		}
+		return r._getRootCost(key) + link.cost
+	}
+	ca, cb := cost(a), cost(b)
+	switch {
+	case ca < cb:
+		return -1
+	case cb < ca:
+		return 1
+	}
+	return 0
+}
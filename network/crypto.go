@@ -3,6 +3,8 @@ package network
 import (
 	"crypto/ed25519"
 
+	"github.com/Arceliar/phony"
+
 	"github.com/Arceliar/ironwood/types"
 )
 
@@ -16,9 +18,48 @@ type publicKey [publicKeySize]byte
 type privateKey [privateKeySize]byte
 type signature [signatureSize]byte
 
+// Signer signs protocol messages for a PacketConn, e.g. with a key that's held in an HSM, see NewPacketConnWithSigner.
+// Sign is given the whole message (ed25519 doesn't sign digests), and must return an ed25519 signature that verifies with Public.
+// Most messages are signed from inside the router's actor, so a slow Sign holds up routing, but signature requests from peers (the most common case) are answered from a separate actor.
+// If Sign returns an error, the message is dropped, and the router tries again the next time it would have sent one.
+type Signer interface {
+	Public() ed25519.PublicKey
+	Sign(message []byte) ([]byte, error)
+}
+
+// keySigner is the Signer for a key that's held in memory, used by NewPacketConn.
+type keySigner struct {
+	key privateKey
+}
+
+func (s *keySigner) Public() ed25519.PublicKey {
+	return ed25519.PrivateKey(s.key[:]).Public().(ed25519.PublicKey)
+}
+
+func (s *keySigner) Sign(message []byte) ([]byte, error) {
+	sig := s.key.sign(message)
+	return sig[:], nil
+}
+
 type crypto struct {
-	privateKey privateKey
+	privateKey privateKey // only set if we have a keySigner, see PacketConn.PrivateKey
 	publicKey  publicKey
+	signer     Signer
+	signing    phony.Inbox // used to sign messages that don't depend on router state, so a slow signer doesn't hold up the router
+}
+
+// sign signs the message with the signer.
+func (c *crypto) sign(message []byte) (signature, error) {
+	var sig signature
+	bs, err := c.signer.Sign(message)
+	if err != nil {
+		return sig, err
+	}
+	if len(bs) != signatureSize {
+		return sig, types.ErrBadSigner
+	}
+	copy(sig[:], bs)
+	return sig, nil
 }
 
 func (key *privateKey) sign(message []byte) signature {
@@ -59,6 +100,30 @@ func (key publicKey) addr() types.Addr {
 func (c *crypto) init(secret ed25519.PrivateKey) {
 	copy(c.privateKey[:], secret)
 	copy(c.publicKey[:], secret.Public().(ed25519.PublicKey))
+	c.signer = &keySigner{key: c.privateKey}
+}
+
+// initSigner sets up crypto for a Signer, and checks that its signatures verify before we send any to peers.
+func (c *crypto) initSigner(signer Signer) error {
+	if ks, ok := signer.(*keySigner); ok {
+		c.init(ks.key[:])
+		return nil
+	}
+	pub := signer.Public()
+	if len(pub) != publicKeySize {
+		return types.ErrBadKey
+	}
+	copy(c.publicKey[:], pub)
+	c.signer = signer
+	msg := []byte("ironwood signer check")
+	sig, err := c.sign(msg)
+	if err != nil {
+		return err
+	}
+	if !c.publicKey.verify(msg, &sig) {
+		return types.ErrBadSigner
+	}
+	return nil
 }
 
 func (key publicKey) toEd() ed25519.PublicKey {
@@ -1,8 +1,14 @@
 package network
 
 import (
+	"context"
 	"crypto/ed25519"
+	"errors"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/Arceliar/ironwood/types"
 )
 
 func TestSign(t *testing.T) {
@@ -46,3 +52,74 @@ func BenchmarkVerify(b *testing.B) {
 		}
 	}
 }
+
+// testSigner holds its key outside of the PacketConn, like an HSM would.
+type testSigner struct {
+	key   ed25519.PrivateKey
+	count int32 // number of calls to Sign
+	fail  int32 // if non-zero, Sign returns an error
+}
+
+func (s *testSigner) Public() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+func (s *testSigner) Sign(message []byte) ([]byte, error) {
+	atomic.AddInt32(&s.count, 1)
+	if atomic.LoadInt32(&s.fail) != 0 {
+		return nil, errors.New("signer failed")
+	}
+	time.Sleep(time.Millisecond) // Slower than an in-memory key
+	return ed25519.Sign(s.key, message), nil
+}
+
+func TestSigner(t *testing.T) {
+	_, privA, _ := ed25519.GenerateKey(nil)
+	_, privC, _ := ed25519.GenerateKey(nil)
+	signer := &testSigner{key: privA}
+	a, err := NewPacketConnWithSigner(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if a.PrivateKey() != nil {
+		t.Fatal("expected no private key")
+	}
+	b := newNode(t)
+	pubA, pubB := signer.Public(), nodeKey(b)
+	linkLine(t, []*PacketConn{a, b})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := b.Ping(ctx, pubA); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&signer.count) == 0 {
+		t.Fatal("signer was never used")
+	}
+	// A failing signer shouldn't break anything that's already set up
+	atomic.StoreInt32(&signer.fail, 1)
+	if err := a.Broadcast([]byte("test"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Ping(ctx, pubA); err != nil {
+		t.Fatal(err)
+	}
+	// A signer that doesn't match its public key is rejected up front
+	if _, err := NewPacketConnWithSigner(&testSigner{key: privC, fail: 1}); err == nil {
+		t.Fatal("expected an error from a failing signer")
+	}
+	bad := &badKeySigner{testSigner{key: privC}, pubB}
+	if _, err := NewPacketConnWithSigner(bad); !errors.Is(err, types.ErrBadSigner) {
+		t.Fatalf("expected ErrBadSigner, got %v", err)
+	}
+}
+
+// badKeySigner claims a different public key than the one it signs with.
+type badKeySigner struct {
+	testSigner
+	pub ed25519.PublicKey
+}
+
+func (s *badKeySigner) Public() ed25519.PublicKey {
+	return s.pub
+}
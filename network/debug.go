@@ -1,8 +1,10 @@
 package network
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/Arceliar/phony"
@@ -19,6 +21,8 @@ func (d *Debug) init(c *core) {
 type DebugSelfInfo struct {
 	Key            ed25519.PublicKey
 	RoutingEntries uint64
+	RootDistance   uint64 // Hops from us to the root of the tree
+	MaxDepth       uint64 // Most hops from the root among the nodes we know about (our peers' ancestries, not the whole network)
 }
 
 type DebugPeerInfo struct {
@@ -39,10 +43,18 @@ type DebugTreeInfo struct {
 	Sequence uint64
 }
 
+type DebugChildInfo struct {
+	Key  ed25519.PublicKey
+	Port uint64 // The port the child uses for us, which we signed for it
+}
+
 type DebugPathInfo struct {
 	Key      ed25519.PublicKey
 	Path     []uint64
 	Sequence uint64
+	Hops     uint64  // Tree distance from us to the destination, following Path
+	RXRate   float64 // Estimated bytes per second received from the destination
+	TXRate   float64 // Estimated bytes per second sent to the destination
 }
 
 type DebugBloomInfo struct {
@@ -57,10 +69,30 @@ type DebugLookupInfo struct {
 	Target ed25519.PublicKey
 }
 
+// DebugDiagnosis is what we know about reaching a destination, see Debug.Diagnose.
+type DebugDiagnosis struct {
+	Key       ed25519.PublicKey
+	KnownInfo bool                // We have the destination's tree info, which is only the case for nodes in our own or our peers' ancestries
+	Root      ed25519.PublicKey   // The destination's root, if KnownInfo
+	SameRoot  bool                // Root is our own root, so we're in the same tree
+	HavePath  bool                // A lookup found a path to the destination (see GetPath)
+	Broken    bool                // The path was reported broken, so traffic waits for a new lookup
+	LookupVia []ed25519.PublicKey // Peers that a lookup for the destination would be sent to, because their bloom filters may contain it
+	NextHop   ed25519.PublicKey   // The peer closest to the destination along the path, which traffic is sent to next, if HavePath
+	Problems  []string            // Why traffic to the destination wouldn't be delivered right now, empty if it should be
+}
+
 func (d *Debug) GetSelf() (info DebugSelfInfo) {
 	info.Key = append(info.Key[:0], d.c.crypto.publicKey[:]...)
 	phony.Block(&d.c.router, func() {
-		info.RoutingEntries = uint64(len(d.c.router.infos))
+		r := &d.c.router
+		info.RoutingEntries = uint64(len(r.infos))
+		info.RootDistance = uint64(r._getRootDistance(r.core.crypto.publicKey))
+		for key := range r.infos {
+			if depth := uint64(r._getRootDistance(key)); depth > info.MaxDepth {
+				info.MaxDepth = depth
+			}
+		}
 	})
 	return
 }
@@ -97,22 +129,87 @@ func (d *Debug) GetTree() (infos []DebugTreeInfo) {
 	return
 }
 
+// GetTreeLinks returns our parent in the tree (our own key if we're the root), and the peers that currently have us as their parent, sorted by key.
+func (d *Debug) GetTreeLinks() (parent ed25519.PublicKey, children []DebugChildInfo) {
+	phony.Block(&d.c.router, func() {
+		r := &d.c.router
+		selfKey := r.core.crypto.publicKey
+		if info, isIn := r.infos[selfKey]; isIn {
+			parent = info.parent.toEd()
+		} else {
+			parent = selfKey.toEd()
+		}
+		for key, port := range r._getChildren() {
+			children = append(children, DebugChildInfo{Key: key.toEd(), Port: uint64(port)})
+		}
+	})
+	sort.Slice(children, func(i, j int) bool {
+		return bytes.Compare(children[i].Key, children[j].Key) < 0
+	})
+	return
+}
+
+// PeerPort returns the port we use for a peer, the same one that shows up in paths (see GetPaths) and in DebugPeerInfo.Port, or false if the key isn't one of our peers.
+func (d *Debug) PeerPort(key ed25519.PublicKey) (port uint64, ok bool) {
+	var k publicKey
+	copy(k[:], key)
+	phony.Block(&d.c.router, func() {
+		for p := range d.c.router.peers[k] {
+			port, ok = uint64(p.port), true
+			break
+		}
+	})
+	return
+}
+
+// ParentCandidates returns our current parent, followed by the other peers that lead to the same root (without going through us), which could take over as our parent if the current one goes away.
+// If the list only has our parent, it's a single point of failure for our connection to the root.
+// Returns nil if we're the root.
+func (d *Debug) ParentCandidates() (keys []ed25519.PublicKey) {
+	phony.Block(&d.c.router, func() {
+		for _, key := range d.c.router._getParentCandidates() {
+			keys = append(keys, key.toEd())
+		}
+	})
+	return
+}
+
 func (d *Debug) GetPaths() (infos []DebugPathInfo) {
 	phony.Block(&d.c.router, func() {
+		now := time.Now()
 		for key, pinfo := range d.c.router.pathfinder.paths {
-			var info DebugPathInfo
-			info.Key = append(info.Key[:0], key[:]...)
-			info.Path = make([]uint64, 0, len(pinfo.path))
-			for _, port := range pinfo.path {
-				info.Path = append(info.Path, uint64(port))
-			}
-			info.Sequence = pinfo.seq
-			infos = append(infos, info)
+			infos = append(infos, d._getPathInfo(key, &pinfo, now))
 		}
 	})
 	return
 }
 
+// GetPath returns the path info for a single destination, if we know a path to it.
+func (d *Debug) GetPath(key ed25519.PublicKey) (info DebugPathInfo, ok bool) {
+	var k publicKey
+	copy(k[:], key)
+	phony.Block(&d.c.router, func() {
+		var pinfo pathInfo
+		if pinfo, ok = d.c.router.pathfinder.paths[k]; ok {
+			info = d._getPathInfo(k, &pinfo, time.Now())
+		}
+	})
+	return
+}
+
+func (d *Debug) _getPathInfo(key publicKey, pinfo *pathInfo, now time.Time) (info DebugPathInfo) {
+	info.Key = append(info.Key[:0], key[:]...)
+	info.Path = make([]uint64, 0, len(pinfo.path))
+	for _, port := range pinfo.path {
+		info.Path = append(info.Path, uint64(port))
+	}
+	info.Sequence = pinfo.seq
+	info.Hops = d.c.router._getHops(pinfo.path, d.c.crypto.publicKey)
+	info.RXRate = pinfo.rx.get(now)
+	info.TXRate = pinfo.tx.get(now)
+	return
+}
+
 func (d *Debug) GetBlooms() (infos []DebugBloomInfo) {
 	phony.Block(&d.c.router, func() {
 		for key, binfo := range d.c.router.blooms.blooms {
@@ -126,6 +223,58 @@ func (d *Debug) GetBlooms() (infos []DebugBloomInfo) {
 	return
 }
 
+// Diagnose explains why traffic to a destination may not be getting through, e.g. after an unreachable report (see PacketConn.SetUnreachableHandler).
+// It only reflects our own state, nodes further along the path may still drop the traffic.
+func (d *Debug) Diagnose(key ed25519.PublicKey) (info DebugDiagnosis) {
+	var k publicKey
+	copy(k[:], key)
+	info.Key = append(info.Key[:0], k[:]...)
+	phony.Block(&d.c.router, func() {
+		r := &d.c.router
+		if k == d.c.crypto.publicKey {
+			return // Delivered locally
+		}
+		selfRoot, _ := r._getRootAndPath(d.c.crypto.publicKey)
+		if _, isIn := r.infos[k]; isIn {
+			info.KnownInfo = true
+			root, _ := r._getRootAndPath(k)
+			info.Root = root.toEd()
+			info.SameRoot = root == selfRoot
+		}
+		xform := r.blooms.xKey(k)
+		for pk, pbi := range r.blooms.blooms {
+			if pbi.onTree && pbi.recv.filter.Test(xform[:]) {
+				info.LookupVia = append(info.LookupVia, pk.toEd())
+			}
+		}
+		sort.Slice(info.LookupVia, func(i, j int) bool {
+			return bytes.Compare(info.LookupVia[i], info.LookupVia[j]) < 0
+		})
+		pinfo, isIn := r.pathfinder.paths[k]
+		switch {
+		case !isIn && len(info.LookupVia) == 0:
+			info.Problems = append(info.Problems, "no path, and no peer's bloom filter contains the destination, so a lookup won't find it")
+		case !isIn:
+			info.Problems = append(info.Problems, "no path, waiting for a lookup to find one")
+		default:
+			info.HavePath = true
+			info.Broken = pinfo.broken
+			if pinfo.broken {
+				info.Problems = append(info.Problems, "the path was reported broken, waiting for a lookup to find a new one")
+			}
+			if p := r._lookup(pinfo.path, nil); p != nil {
+				info.NextHop = p.key.toEd()
+			} else {
+				info.Problems = append(info.Problems, "no peer is a next hop along the path")
+			}
+		}
+		if info.KnownInfo && !info.SameRoot {
+			info.Problems = append(info.Problems, "the destination is in a different tree")
+		}
+	})
+	return
+}
+
 func (d *Debug) SetDebugLookupLogger(logger func(DebugLookupInfo)) {
 	phony.Block(&d.c.router, func() {
 		d.c.router.pathfinder.logger = func(lookup *pathLookup) {
@@ -0,0 +1,59 @@
+package network
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// routerDrainingCost is added to the cost of a next hop that's draining, so traffic only goes that way if no other peer is closer to the destination than we are.
+const routerDrainingCost = 1 << 32
+
+// Drain tells the network that we're about to shut down, then waits for the grace period set by WithDrainGrace and closes the PacketConn.
+// Our info is signed again with a draining flag, so peers pick another parent if they can, and stop using us as a next hop for traffic that has another way to go.
+// The flag is part of the announcement extension, so nodes that don't support it (see routerAnnounceExt) don't see it and keep using us until we close.
+// We keep forwarding whatever traffic still comes through us in the meantime, so flows have time to move before Close sends its goodbyes.
+// Drain returns types.ErrClosed if the PacketConn is closed before the grace period is up.
+func (pc *PacketConn) Drain() error {
+	if pc.IsClosed() {
+		return types.ErrClosed
+	}
+	phony.Block(&pc.core.router, pc.core.router._drain)
+	timer := time.NewTimer(pc.core.config.drainGrace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-pc.closed:
+		return types.ErrClosed
+	}
+	return pc.Close()
+}
+
+// _drain sets the draining flag, and refreshes our info right away so it goes out with the flag set.
+func (r *router) _drain() {
+	if r.draining {
+		return
+	}
+	r.draining = true
+	r.refresh = true
+	r._fix()
+	r._sendAnnounces()
+}
+
+// _isDraining returns true if the key's info says it's shutting down, see PacketConn.Drain.
+func (r *router) _isDraining(key publicKey) bool {
+	info, isIn := r.infos[key]
+	return isIn && info.draining && key != r.core.crypto.publicKey
+}
+
+// _hopCost returns the cost of sending traffic over p, to a destination at the given distance from the peer, for picking next hops.
+// A draining peer is only used if nothing else is closer to the destination, or if the traffic is for that peer.
+func (r *router) _hopCost(key publicKey, dist uint64, p *peer) uint64 {
+	cost := dist + p.cost
+	if dist != 0 && r._isDraining(key) {
+		cost += routerDrainingCost
+	}
+	return cost
+}
@@ -0,0 +1,77 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+func TestDrain(t *testing.T) {
+	// A square, with the root (the lowest key) opposite c, so c has two equally good parents and next hops to the root
+	var conns []*PacketConn
+	for idx := 0; idx < 4; idx++ {
+		conns = append(conns, newNode(t, WithDrainGrace(10*time.Second)))
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].core.crypto.publicKey.less(conns[j].core.crypto.publicKey)
+	})
+	var keys []ed25519.PublicKey
+	for _, conn := range conns {
+		keys = append(keys, nodeKey(conn))
+	}
+	for _, link := range [][2]int{{0, 1}, {0, 2}, {1, 3}, {2, 3}} {
+		linkNodes(t, conns[link[0]], conns[link[1]])
+	}
+	waitForRoot(conns, 30*time.Second)
+	r := &conns[3].core.router
+	// lookup returns c's parent, and its next hop for traffic to the key
+	lookup := func(key ed25519.PublicKey) (parent, next ed25519.PublicKey) {
+		var dest publicKey
+		copy(dest[:], key)
+		phony.Block(r, func() {
+			parent = r.infos[r.core.crypto.publicKey].parent.toEd()
+			_, path := r._getRootAndPath(dest)
+			watermark := ^uint64(0)
+			if p := r._lookup(path, &watermark); p != nil {
+				next = p.key.toEd()
+			}
+		})
+		return
+	}
+	drainer, other := 1, 2
+	if parent, _ := lookup(keys[0]); parent.Equal(keys[2]) {
+		drainer, other = 2, 1
+	}
+	result := make(chan error, 1)
+	go func() { result <- conns[drainer].Drain() }()
+	var parent, next ed25519.PublicKey
+	for start := time.Now(); time.Since(start) < 4*time.Second; time.Sleep(10 * time.Millisecond) {
+		if parent, next = lookup(keys[0]); parent.Equal(keys[other]) && next.Equal(keys[other]) {
+			break
+		}
+	}
+	if !parent.Equal(keys[other]) {
+		t.Fatal("didn't switch away from a draining parent")
+	}
+	// Traffic for the root goes the other way, but the draining node can still be reached
+	if !next.Equal(keys[other]) {
+		t.Fatal("expected to go around the draining node")
+	}
+	if _, next = lookup(keys[drainer]); !next.Equal(keys[drainer]) {
+		t.Fatal("expected traffic for the draining node to go straight to it")
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("Drain didn't close the PacketConn")
+	}
+	if !conns[drainer].IsClosed() {
+		t.Fatal("expected the draining node to be closed")
+	}
+}
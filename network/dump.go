@@ -0,0 +1,138 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// DebugDump is a snapshot of the router's state, for attaching to bug reports, see Debug.Dump.
+// Keys are hex encoded, and signatures are only included as a (truncated) hash, so they can be compared between dumps without being reusable.
+type DebugDump struct {
+	Time      time.Time
+	Key       string
+	Infos     []DebugDumpInfo
+	Peers     []DebugDumpPeer
+	Requests  []DebugDumpReq // Our outstanding signature requests to each peer
+	Responses []DebugDumpRes // Responses from peers to those requests, which we could use to pick a parent
+	Paths     []DebugDumpPath
+	Rumors    []DebugDumpRumor
+}
+
+type DebugDumpInfo struct {
+	Key      string
+	Parent   string
+	Seq      uint64
+	Nonce    uint64
+	Port     uint64
+	Leaving  bool          // A leaving announcement, treated as if we didn't have the info
+	Expires  time.Duration // Time until the info times out, unless it's updated
+	SigHash  string
+	PSigHash string
+}
+
+type DebugDumpPeer struct {
+	Key       string
+	Port      uint64
+	Priority  uint8
+	Order     uint64
+	Proven    bool
+	OneWay    bool
+	Saturated bool
+}
+
+type DebugDumpReq struct {
+	Key   string
+	Seq   uint64
+	Nonce uint64
+}
+
+type DebugDumpRes struct {
+	Key   string
+	Seq   uint64
+	Nonce uint64
+	Port  uint64
+}
+
+type DebugDumpPath struct {
+	Key    string
+	Path   []uint64
+	Seq    uint64
+	Broken bool
+}
+
+type DebugDumpRumor struct {
+	Key      string // The transformed key that the lookup is for, see WithBloomTransform
+	Attempts uint
+	Backoff  time.Duration
+	Sent     time.Time
+}
+
+// Dump returns the router's state encoded as a DebugDump in JSON.
+// Everything is copied in one turn of the router's actor (which the pathfinder shares), and encoded after the router moves on to other work.
+func (d *Debug) Dump() ([]byte, error) {
+	var dump DebugDump
+	phony.Block(&d.c.router, func() {
+		dump = d.c.router._dump()
+	})
+	return json.Marshal(&dump)
+}
+
+func (r *router) _dump() (dump DebugDump) {
+	now := time.Now()
+	dump.Time = now
+	dump.Key = hex.EncodeToString(r.core.crypto.publicKey[:])
+	dump.Infos = make([]DebugDumpInfo, 0, len(r.infos))
+	for key, info := range r.infos {
+		dump.Infos = append(dump.Infos, DebugDumpInfo{
+			Key:      hex.EncodeToString(key[:]),
+			Parent:   hex.EncodeToString(info.parent[:]),
+			Seq:      info.seq,
+			Nonce:    info.nonce,
+			Port:     uint64(info.port),
+			Leaving:  info.isLeaving(key),
+			Expires:  r.updated[key].Add(r.core.config.routerTimeout).Sub(now),
+			SigHash:  dumpHash(info.sig[:]),
+			PSigHash: dumpHash(info.psig[:]),
+		})
+	}
+	for key, ps := range r.peers {
+		for p := range ps {
+			dump.Peers = append(dump.Peers, DebugDumpPeer{
+				Key:       hex.EncodeToString(key[:]),
+				Port:      uint64(p.port),
+				Priority:  p.rprio,
+				Order:     p.order,
+				Proven:    p.proven,
+				OneWay:    atomic.LoadInt32(&p.oneWay) != 0,
+				Saturated: atomic.LoadInt32(&p.saturated) != 0,
+			})
+		}
+	}
+	for key, req := range r.requests {
+		dump.Requests = append(dump.Requests, DebugDumpReq{hex.EncodeToString(key[:]), req.seq, req.nonce})
+	}
+	for key, res := range r.responses {
+		dump.Responses = append(dump.Responses, DebugDumpRes{hex.EncodeToString(key[:]), res.seq, res.nonce, uint64(res.port)})
+	}
+	for key, info := range r.pathfinder.paths {
+		path := make([]uint64, 0, len(info.path))
+		for _, port := range info.path {
+			path = append(path, uint64(port))
+		}
+		dump.Paths = append(dump.Paths, DebugDumpPath{hex.EncodeToString(key[:]), path, info.seq, info.broken})
+	}
+	for key, rumor := range r.pathfinder.rumors {
+		dump.Rumors = append(dump.Rumors, DebugDumpRumor{hex.EncodeToString(key[:]), rumor.attempts, rumor.backoff, rumor.sendTime})
+	}
+	return
+}
+
+func dumpHash(bs []byte) string {
+	h := sha256.Sum256(bs)
+	return hex.EncodeToString(h[:8])
+}
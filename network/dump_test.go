@@ -0,0 +1,127 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// restoreDump loads a DebugDump into a router that isn't running, so lookups can be reproduced offline.
+// Only what's needed for next hop decisions is restored, the router never starts its actor's timers or sends anything.
+func restoreDump(tb testing.TB, data []byte) *router {
+	var dump DebugDump
+	if err := json.Unmarshal(data, &dump); err != nil {
+		tb.Fatal(err)
+	}
+	key := func(s string) (k publicKey) {
+		bs, err := hex.DecodeString(s)
+		if err != nil || len(bs) != publicKeySize {
+			tb.Fatalf("bad key %q", s)
+		}
+		copy(k[:], bs)
+		return
+	}
+	c := new(core)
+	configDefaults()(&c.config)
+	c.crypto.publicKey = key(dump.Key)
+	r := &c.router
+	r.core = c
+	r.pathfinder.router = r
+	r.peers = make(map[publicKey]map[*peer]struct{})
+	r.infos = make(map[publicKey]routerInfo)
+	r.cache = make(map[publicKey]*routerCacheEntry)
+	r.pathfinder.paths = make(map[publicKey]pathInfo)
+	for _, dinfo := range dump.Infos {
+		var info routerInfo
+		info.parent = key(dinfo.Parent)
+		info.seq = dinfo.Seq
+		info.nonce = dinfo.Nonce
+		info.port = peerPort(dinfo.Port)
+		r.infos[key(dinfo.Key)] = info
+	}
+	for _, dpeer := range dump.Peers {
+		k := key(dpeer.Key)
+		if r.peers[k] == nil {
+			r.peers[k] = make(map[*peer]struct{})
+		}
+		p := &peer{key: k, port: peerPort(dpeer.Port), rprio: dpeer.Priority, order: dpeer.Order, proven: dpeer.Proven}
+		if dpeer.Saturated {
+			p.saturated = 1
+		}
+		r.peers[k][p] = struct{}{}
+	}
+	for _, dpath := range dump.Paths {
+		var info pathInfo
+		for _, port := range dpath.Path {
+			info.path = append(info.path, peerPort(port))
+		}
+		info.seq = dpath.Seq
+		info.broken = dpath.Broken
+		r.pathfinder.paths[key(dpath.Key)] = info
+	}
+	return r
+}
+
+func TestDebugDump(t *testing.T) {
+	// A line, so the middle node has two peers and some paths to look up
+	_, conns := newLine(t, 4)
+	node := conns[1]
+	data, err := node.Debug.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), hex.EncodeToString(node.PrivateKey())) {
+		t.Fatal("dump contains the private key")
+	}
+	restored := restoreDump(t, data)
+	phony.Block(&node.core.router, func() {
+		r := &node.core.router
+		if len(restored.infos) != len(r.infos) {
+			t.Fatalf("restored %d infos, expected %d", len(restored.infos), len(r.infos))
+		}
+		// Every lookup should make the same decision
+		for key := range r.infos {
+			_, path := r._getRootAndPath(key)
+			wA, wB := ^uint64(0), ^uint64(0)
+			pA, pB := r._lookup(path, &wA), restored._lookup(path, &wB)
+			if (pA == nil) != (pB == nil) || wA != wB {
+				t.Fatalf("lookup for %s differs after restore", key.addr())
+			}
+			if pA != nil && (pA.key != pB.key || pA.port != pB.port) {
+				t.Fatalf("lookup for %s picked a different peer after restore", key.addr())
+			}
+		}
+	})
+}
+
+func TestDebugDumpLarge(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv)
+	defer pc.Close()
+	r := &pc.core.router
+	phony.Block(r, func() {
+		// Fake infos, it's only the size that matters here
+		for idx := 0; idx < 10000; idx++ {
+			var key publicKey
+			key[0], key[1], key[2] = 1, byte(idx), byte(idx>>8)
+			r.infos[key] = routerInfo{parent: r.core.crypto.publicKey}
+		}
+	})
+	start := time.Now()
+	data, err := pc.Debug.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dump took %s", elapsed)
+	}
+	var dump DebugDump
+	if err := json.Unmarshal(data, &dump); err != nil || len(dump.Infos) < 10000 {
+		t.Fatalf("bad dump: %d infos, %v", len(dump.Infos), err)
+	}
+}
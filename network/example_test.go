@@ -0,0 +1,45 @@
+package network_test
+
+import (
+	"crypto/ed25519"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/Arceliar/ironwood/network"
+)
+
+// keyExchange is a Handshake that just swaps keys, with no authentication, to keep the example short.
+func keyExchange(self ed25519.PublicKey) network.Handshake {
+	return func(conn net.Conn) (ed25519.PublicKey, uint8, error) {
+		if _, err := conn.Write(self); err != nil {
+			return nil, 0, err
+		}
+		key := make(ed25519.PublicKey, ed25519.PublicKeySize)
+		if _, err := io.ReadFull(conn, key); err != nil {
+			return nil, 0, err
+		}
+		return key, 0, nil
+	}
+}
+
+// This accepts peers over both TCP and a unix socket, which all end up in the same PacketConn.
+func ExamplePacketConn_Serve() {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := network.NewPacketConn(priv)
+	defer pc.Close()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	dir, _ := os.MkdirTemp("", "ironwood")
+	defer os.RemoveAll(dir)
+	unix, err := net.Listen("unix", filepath.Join(dir, "peers.sock"))
+	if err != nil {
+		panic(err)
+	}
+	go pc.Serve(tcp, keyExchange(pub))
+	go pc.Serve(unix, keyExchange(pub))
+	// Peers can now connect to tcp.Addr() or unix.Addr(), and run the same key exchange from their side before calling HandleConn
+}
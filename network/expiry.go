@@ -0,0 +1,24 @@
+package network
+
+import "time"
+
+// _signedTime returns when the announcement's timeout starts, which is when the node signed it with WithSignedExpiry, or now otherwise.
+// A time in the future can't be right, so it's clamped to now, and 0 means the node didn't say.
+func (r *router) _signedTime(ann *routerAnnounce, now time.Time) time.Time {
+	if !r.core.config.signedExpiry || ann.time == 0 || ann.time >= uint64(now.Unix()) {
+		return now
+	}
+	return time.Unix(int64(ann.time), 0)
+}
+
+// _now returns the time as this node's clock has it, see withClockOffset.
+func (r *router) _now() time.Time {
+	return time.Now().Add(r.core.config.clockOffset)
+}
+
+// withClockOffset makes a node act like its clock is off by the offset, so tests can skew clocks between nodes.
+func withClockOffset(offset time.Duration) Option {
+	return func(c *config) {
+		c.clockOffset = offset
+	}
+}
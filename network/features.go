@@ -0,0 +1,50 @@
+package network
+
+// Features are extensions to the wire protocol that are only used on a link if both sides support them.
+// Each side lists its features in a hello, which is a keepalive with a 0 byte after the type, then the feature bits (uvarint).
+// The hello is the first frame we send, and a peer isn't added to the router until its first frame arrives, so the router knows what a peer supports before it sends it anything.
+// Nodes from before features were added ignore keepalives with extra bytes and never send a hello, so they only get the original formats.
+const (
+	featureAnnounceExt   = 1 << iota // node-signed fields after an announcement's signature, see routerAnnounceExt
+	featureCompression               // we can decompress frames, see WithFrameCompression
+	featureTrafficHeader             // kind, class and flow bytes after the traffic watermark, see oldTraffic
+	featureBroadcast                 // understands wireProtoBroadcast, see PacketConn.Broadcast
+	featureGoodbye                   // understands wireProtoGoodbye, see peer._sendGoodbye
+	featureFrameMAC                  // wants a MAC on this connection, only listed if WithFrameMAC says so, see peer.negotiateMAC
+	featuresAll          = featureAnnounceExt | featureCompression | featureTrafficHeader | featureBroadcast | featureGoodbye | featureFrameMAC
+)
+
+// peerHelloMarker follows the type byte of a keepalive that's a hello, which makes it longer than a probe (see peerWriter.sendProbe).
+const peerHelloMarker = 0
+
+// withFeatures limits the features we say we support (default featuresAll), so tests can act like an older node.
+func withFeatures(features uint64) Option {
+	return func(c *config) {
+		c.features = features
+	}
+}
+
+// sendHello is like sendKeepAlive, for the keepalive that lists our features, see peerHelloFeatures.
+// It has to go ahead of probes and keepalives, since the peer only looks for a hello in the first frame.
+func (w *peerWriter) sendHello(features uint64) {
+	w.sendUrgent(peerHelloFrame(features))
+}
+
+// peerHelloFrame returns an encoded hello, including its length.
+func peerHelloFrame(features uint64) []byte {
+	body := wireAppendUint([]byte{byte(wireKeepAlive), peerHelloMarker}, features)
+	return append(wireAppendUint(allocBytes(0), uint64(len(body))), body...)
+}
+
+// peerHelloFeatures returns the features listed in a frame, or 0 if it isn't a hello.
+func peerHelloFeatures(bs []byte) uint64 {
+	if len(bs) < 3 || wirePacketType(bs[0]) != wireKeepAlive || bs[1] != peerHelloMarker {
+		return 0
+	}
+	var features uint64
+	data := bs[2:]
+	if !wireChopUint(&features, &data) {
+		return 0
+	}
+	return features
+}
@@ -0,0 +1,247 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// newFeatureLine connects a line of nodes, each with the given features, and waits for the tree to form.
+func newFeatureLine(tb testing.TB, features []uint64, options ...Option) (keys []ed25519.PublicKey, conns []*PacketConn) {
+	for _, f := range features {
+		conn := newNode(tb, append(options, withFeatures(f))...)
+		keys = append(keys, nodeKey(conn))
+		conns = append(conns, conn)
+	}
+	linkLine(tb, conns)
+	return
+}
+
+func TestOldAnnounceExt(t *testing.T) {
+	// Node 2 acts like it's from before features were added, so it only gets announcements without the extension, and only passes those on
+	_, conns := newFeatureLine(t, []uint64{featuresAll, featuresAll, 0, featuresAll})
+	var root publicKey
+	phony.Block(&conns[0].core.router, func() {
+		root, _ = conns[0].core.router._getRootAndDists(conns[0].core.crypto.publicKey)
+	})
+	// Nodes know their peers' infos, and the root's
+	for at, conn := range conns {
+		for key, ext := range map[int]bool{at - 1: at < 2, at + 1: at < 1} {
+			if key >= 0 && key < len(conns) {
+				waitForInfo(t, conn, conns[key].core.crypto.publicKey, ext)
+			}
+		}
+		switch {
+		case conn.core.crypto.publicKey == root:
+		case at == 2 || root == conns[2].core.crypto.publicKey:
+			waitForInfo(t, conn, root, false)
+		default:
+			// Only roots on the same side of the old node get to us with the extension
+			sameSide := (at < 2) == (root == conns[0].core.crypto.publicKey || root == conns[1].core.crypto.publicKey)
+			waitForInfo(t, conn, root, sameSide)
+		}
+	}
+	// The extension doesn't change which info wins, it's only attached to the same info without it
+	var c crypto
+	_, priv, _ := ed25519.GenerateKey(nil)
+	c.init(priv)
+	res := routerSigRes{routerSigReq: routerSigReq{seq: 1, nonce: 1}}
+	res.psig = c.privateKey.sign(res.bytesForSig(c.publicKey, c.publicKey))
+	ann := &routerAnnounce{key: c.publicKey, parent: c.publicKey, routerSigRes: res}
+	signTestAnnounce(&c, ann, time.Now())
+	if !ann.check() || !ann.withoutExt().check() {
+		t.Fatal("bad signatures")
+	}
+	r := &conns[0].core.router
+	phony.Block(r, func() {
+		if !r._update(ann.withoutExt()) || r._update(ann) || r._update(ann.withoutExt()) {
+			t.Error("expected the first encoding to win")
+		}
+		r._attachExt(ann)
+		if info := r.infos[ann.key]; info.xsig != ann.xsig {
+			t.Error("expected the extension to be attached")
+		}
+		r._attachExt(ann.withoutExt())
+		if info := r.infos[ann.key]; info.xsig != ann.xsig {
+			t.Error("expected the extension to stay attached")
+		}
+	})
+}
+
+func TestOldLinkCosts(t *testing.T) {
+	// The link's cost only gets to the other side if it supports the announcement extension, otherwise it counts as the default
+	for _, features := range []uint64{featuresAll, 0} {
+		_, conns := newFeatureLine(t, []uint64{featuresAll, features}, WithLinkCosts(func(ed25519.PublicKey, net.Conn) uint16 { return 5 }))
+		expected := uint64(5)
+		if features == 0 {
+			expected = linkCostDefault
+		}
+		for idx := range conns {
+			if !sendUntilReceived(t, conns[idx].WriteTo, conns[1-idx], []byte("test")) {
+				t.Fatalf("no traffic from %d to %d", idx, 1-idx)
+			}
+		}
+		// Whichever node is the root sees the other's link to it
+		for idx, conn := range conns {
+			r := &conn.core.router
+			var isRoot bool
+			var cost uint64
+			phony.Block(r, func() {
+				self := r.core.crypto.publicKey
+				root, _ := r._getRootAndDists(self)
+				other := conns[1-idx].core.crypto.publicKey
+				isRoot = root == self
+				cost = r._getRootCost(other)
+			})
+			if isRoot && cost != expected {
+				t.Fatalf("expected a cost of %d with features %d, got %d", expected, features, cost)
+			}
+		}
+	}
+}
+
+func TestOldBroadcast(t *testing.T) {
+	// The middle node acts like it's from before broadcasts were added, so it never gets one, and neither does anything behind it
+	_, conns := newFeatureLine(t, []uint64{featuresAll, featuresAll &^ featureBroadcast, featuresAll})
+	onTree := func(a, b *PacketConn) (is bool) {
+		phony.Block(&a.core.router, func() {
+			is = a.core.router.blooms._isOnTree(b.core.crypto.publicKey)
+		})
+		return
+	}
+	for start := time.Now(); !onTree(conns[0], conns[1]) || !onTree(conns[1], conns[0]) || !onTree(conns[1], conns[2]); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("the line didn't become a tree")
+		}
+	}
+	var received int32
+	for _, conn := range conns[1:] {
+		conn.SetBroadcastHandler(func(ed25519.PublicKey, []byte) {
+			atomic.AddInt32(&received, 1)
+		})
+	}
+	if err := conns[0].Broadcast([]byte("test"), 255); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt32(&received); n != 0 {
+		t.Fatalf("a broadcast was sent to a node that can't decode it, received %d", n)
+	}
+	if len(conns[1].Peers()) != 2 {
+		t.Fatal("a link to the old node went down")
+	}
+}
+
+func TestOldGoodbye(t *testing.T) {
+	// Only peers that list featureGoodbye in their hello are sent one when we close
+	for _, features := range []uint64{featuresAll, 0} {
+		pubA, privA, _ := ed25519.GenerateKey(nil)
+		pubK, _, _ := ed25519.GenerateKey(nil)
+		a, _ := NewPacketConn(privA)
+		var keyK publicKey
+		copy(keyK[:], pubK)
+		cA, cK := newDummyConn(pubA, pubK)
+		go a.HandleConn(pubK, cA, 0)
+		data := make(chan []byte)
+		go func() {
+			bs, _ := io.ReadAll(cK)
+			data <- bs
+		}()
+		hello := wireAppendUint([]byte{byte(wireKeepAlive), peerHelloMarker}, features)
+		cK.Write(append(wireAppendUint(nil, uint64(len(hello))), hello...))
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("peer wasn't added")
+			}
+			var added bool
+			phony.Block(&a.core.router, func() {
+				added = len(a.core.router.peers[keyK]) > 0
+			})
+			if added {
+				break
+			}
+		}
+		a.Close()
+		var goodbye bool
+		for bs := <-data; len(bs) > 0; {
+			size, n := binary.Uvarint(bs)
+			if n <= 0 || uint64(len(bs)-n) < size {
+				t.Fatal("truncated frame")
+			}
+			frame := bs[n : n+int(size)]
+			goodbye = goodbye || (len(frame) > 0 && wirePacketType(frame[0]) == wireProtoGoodbye)
+			bs = bs[n+int(size):]
+		}
+		if goodbye != (features&featureGoodbye != 0) {
+			t.Fatalf("with features %d, expected a goodbye %v, got %v", features, features&featureGoodbye != 0, goodbye)
+		}
+	}
+}
+
+func TestHelloBeforeProbe(t *testing.T) {
+	// The peer only looks for a hello in our first frame, so a probe mustn't go out before it
+	for idx := 0; idx < 20; idx++ {
+		pubA, privA, _ := ed25519.GenerateKey(nil)
+		pubK, _, _ := ed25519.GenerateKey(nil)
+		a, _ := NewPacketConn(privA, WithPeerProbes(time.Millisecond))
+		cA, cK := newDummyConn(pubA, pubK)
+		go a.HandleConn(pubK, cA, 0)
+		r := bufio.NewReader(cK)
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			t.Fatal(err)
+		}
+		if features := peerHelloFeatures(frame); features != featuresAll&^featureFrameMAC {
+			t.Fatalf("expected a hello listing features %d first, got frame %v", featuresAll&^featureFrameMAC, frame)
+		}
+		a.Close()
+	}
+}
+
+// waitForInfo fails the test unless a node gets an info for the key, with or without the extension, within a few seconds.
+func waitForInfo(tb testing.TB, conn *PacketConn, key publicKey, ext bool) {
+	r := &conn.core.router
+	var known, hasExt bool
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		phony.Block(r, func() {
+			var info routerInfo
+			info, known = r.infos[key]
+			hasExt = info.hasExt()
+		})
+		if known && hasExt == ext {
+			return
+		}
+	}
+	tb.Fatalf("expected an info with the extension %v, got known %v, extension %v", ext, known, hasExt)
+}
+
+func TestOldTrafficHeader(t *testing.T) {
+	// The middle node acts like it's from before features were added, so it only knows the original traffic header
+	keys, conns := newFeatureLine(t, []uint64{featuresAll, 0, featuresAll})
+	for _, pair := range [][2]int{{0, 2}, {2, 0}, {0, 1}, {1, 0}} {
+		if !sendUntilReceived(t, writeClass(conns[pair[0]], TrafficClassRealTime), conns[pair[1]], []byte("test")) {
+			t.Fatalf("no traffic from %d to %d", pair[0], pair[1])
+		}
+	}
+	// A ping is a kind of traffic the old header can't carry, so it's dropped rather than sent as a standard packet
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := conns[0].Ping(ctx, keys[2]); err == nil {
+		t.Fatal("a ping got through a node that can't decode it")
+	}
+	if drops := conns[0].Metrics()["drops.old_peer"]; drops == 0 {
+		t.Fatal("expected the ping to be dropped before the old node")
+	}
+}
@@ -0,0 +1,142 @@
+package network
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	fragmentMaxCount = 256             // most fragments a message can be split into, see WithFragmentation
+	fragmentOverhead = 3 * 10          // room for the id, index and count at the start of each fragment
+	fragmentTimeout  = 5 * time.Second // how long we wait for the rest of a message, after its first fragment arrives
+)
+
+// fragmentKey identifies a message that's being reassembled.
+type fragmentKey struct {
+	source publicKey
+	id     uint64
+}
+
+// reassembly holds the fragments of a message we've received so far.
+// It's only used from within the PacketConn's actor.
+type reassembly struct {
+	parts   [][]byte // indexed by fragment, nil until that fragment arrives
+	have    int      // number of non-nil parts
+	size    uint64   // total bytes in parts
+	started time.Time
+}
+
+// fragmentMTU returns the largest message that can be sent with fragmentation, or 0 if it's disabled.
+func (pc *PacketConn) fragmentMTU() uint64 {
+	size := pc.core.config.fragmentSize
+	if size == 0 {
+		return 0
+	}
+	if max := fragmentMaxCount * (pc.packetMTU() - fragmentOverhead); size > max {
+		size = max
+	}
+	return size
+}
+
+// _sendFragments splits a standard packet that's too big for the network into numbered fragments.
+// Takes ownership of data.
+func (pc *PacketConn) _sendFragments(dest publicKey, opts PacketOptions, data []byte) {
+	defer freeBytes(data)
+	pc.fragmentSeq++
+	chunk := int(pc.packetMTU() - fragmentOverhead)
+	count := (len(data) + chunk - 1) / chunk
+	buf := allocBytes(0)
+	defer freeBytes(buf)
+	for idx := 0; idx < count; idx++ {
+		part := data[idx*chunk:]
+		if len(part) > chunk {
+			part = part[:chunk]
+		}
+		buf = wireAppendUint(buf[:0], pc.fragmentSeq)
+		buf = wireAppendUint(buf, uint64(idx))
+		buf = wireAppendUint(buf, uint64(count))
+		buf = append(buf, part...)
+		pc.sendTrafficOptions(dest, trafficKindFragment, opts, buf)
+	}
+}
+
+// _handleFragment adds a fragment to its message, and delivers the message once every fragment has arrived.
+// Fragments may arrive in any order. If any are lost, the rest are dropped after fragmentTimeout, or sooner if the reassembly buffer fills up.
+func (pc *PacketConn) _handleFragment(tr *traffic) {
+	defer freeTraffic(tr)
+	cfg := &pc.core.config
+	if cfg.fragmentSize == 0 {
+		return // Disabled, so we won't hold on to fragments for anyone
+	}
+	var id, index, count uint64
+	data := tr.payload
+	if !wireChopUint(&id, &data) || !wireChopUint(&index, &data) || !wireChopUint(&count, &data) {
+		return
+	}
+	if count == 0 || count > fragmentMaxCount || index >= count {
+		return
+	}
+	key := fragmentKey{tr.source, id}
+	ra := pc.fragments[key]
+	if ra == nil {
+		now := time.Now()
+		pc._sweepFragments(now)
+		ra = &reassembly{parts: make([][]byte, count), started: now}
+		pc.fragments[key] = ra
+	}
+	if uint64(len(ra.parts)) != count || ra.parts[index] != nil {
+		return // Doesn't match the earlier fragments, or a duplicate
+	}
+	if ra.size+uint64(len(data)) > cfg.fragmentSize {
+		pc._dropFragments(key)
+		return
+	}
+	ra.parts[index] = append([]byte(nil), data...)
+	ra.have++
+	ra.size += uint64(len(data))
+	pc.fragmentBytes += uint64(len(data))
+	for pc.fragmentBytes > cfg.fragmentBuffer {
+		// Make room by dropping the oldest message, which may be this one
+		var oldest fragmentKey
+		var oldestTime time.Time
+		for k, r := range pc.fragments {
+			if oldestTime.IsZero() || r.started.Before(oldestTime) {
+				oldest, oldestTime = k, r.started
+			}
+		}
+		pc._dropFragments(oldest)
+	}
+	if pc.fragments[key] != ra || ra.have < len(ra.parts) {
+		return
+	}
+	delete(pc.fragments, key)
+	pc.fragmentBytes -= ra.size
+	msg := allocTraffic()
+	msg.source = tr.source
+	msg.dest = tr.dest
+	msg.watermark = tr.watermark
+	msg.kind = trafficKindStandard
+	for _, part := range ra.parts {
+		msg.payload = append(msg.payload, part...)
+	}
+	pc._deliver(msg)
+}
+
+// _dropFragments forgets a message we won't be able to reassemble.
+func (pc *PacketConn) _dropFragments(key fragmentKey) {
+	if ra := pc.fragments[key]; ra != nil {
+		delete(pc.fragments, key)
+		pc.fragmentBytes -= ra.size
+		atomic.AddInt64(&pc.core.metrics.dropFragments, 1)
+	}
+}
+
+// _sweepFragments drops messages that are still missing fragments after fragmentTimeout.
+// It runs whenever the first fragment of a new message arrives.
+func (pc *PacketConn) _sweepFragments(now time.Time) {
+	for key, ra := range pc.fragments {
+		if now.Sub(ra.started) > fragmentTimeout {
+			pc._dropFragments(key)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// fragmentsToSelf splits msg into count fragments from pc to itself, as _sendFragments would.
+func fragmentsToSelf(pc *PacketConn, id uint64, msg []byte, count int) []*traffic {
+	var trs []*traffic
+	chunk := (len(msg) + count - 1) / count
+	for idx := 0; idx < count; idx++ {
+		part := msg[idx*chunk:]
+		if len(part) > chunk {
+			part = part[:chunk]
+		}
+		tr := allocTraffic()
+		tr.source = pc.core.crypto.publicKey
+		tr.dest = pc.core.crypto.publicKey
+		tr.kind = trafficKindFragment
+		tr.payload = wireAppendUint(tr.payload, id)
+		tr.payload = wireAppendUint(tr.payload, uint64(idx))
+		tr.payload = wireAppendUint(tr.payload, uint64(count))
+		tr.payload = append(tr.payload, part...)
+		trs = append(trs, tr)
+	}
+	return trs
+}
+
+func TestFragmentation(t *testing.T) {
+	a, b := newPair(t, WithPeerMaxMessageSize(1024), WithFragmentation(16384, 0))
+	if a.MTU() != 16384 {
+		t.Fatalf("unexpected MTU %d", a.MTU())
+	}
+	if _, err := a.WriteTo(make([]byte, 16385), b.LocalAddr()); err != types.ErrOversizedMessage {
+		t.Fatalf("expected oversized message, got %v", err)
+	}
+	msg := make([]byte, 10000)
+	rand.Read(msg)
+	if !sendUntilReceived(t, a.WriteTo, b, msg) {
+		t.Fatal("timeout")
+	}
+}
+
+func TestFragmentReordered(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv, WithFragmentation(4096, 0))
+	defer pc.Close()
+	msg := make([]byte, 3000)
+	rand.Read(msg)
+	trs := fragmentsToSelf(pc, 1, msg, 7)
+	rand.Shuffle(len(trs), func(i, j int) { trs[i], trs[j] = trs[j], trs[i] })
+	for _, tr := range trs {
+		pc.handleTraffic(nil, tr)
+	}
+	buf := make([]byte, pc.MTU())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, _, err := pc.ReadFromCtx(ctx, buf)
+	if err != nil || !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("unexpected result: %d bytes, %v", n, err)
+	}
+	phony.Block(&pc.actor, func() {
+		if len(pc.fragments) != 0 || pc.fragmentBytes != 0 {
+			t.Fatalf("reassembly state left over: %d messages, %d bytes", len(pc.fragments), pc.fragmentBytes)
+		}
+	})
+}
+
+func TestFragmentLost(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv, WithFragmentation(4096, 5000))
+	defer pc.Close()
+	msg := make([]byte, 3000)
+	for id := uint64(1); id <= 4; id++ {
+		// Each message is missing a fragment, and only two fit in the buffer at once
+		trs := fragmentsToSelf(pc, id, msg, 3)
+		freeTraffic(trs[1])
+		pc.handleTraffic(nil, trs[0])
+		pc.handleTraffic(nil, trs[2])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if n, _, err := pc.ReadFromCtx(ctx, make([]byte, pc.MTU())); err == nil {
+		t.Fatalf("unexpected message of %d bytes", n)
+	}
+	phony.Block(&pc.actor, func() {
+		if pc.fragmentBytes > 5000 || len(pc.fragments) != 2 {
+			t.Fatalf("unexpected reassembly state: %d messages, %d bytes", len(pc.fragments), pc.fragmentBytes)
+		}
+		pc._sweepFragments(time.Now().Add(fragmentTimeout + time.Second))
+		if len(pc.fragments) != 0 || pc.fragmentBytes != 0 {
+			t.Fatalf("reassembly state left after timeout: %d messages, %d bytes", len(pc.fragments), pc.fragmentBytes)
+		}
+	})
+	if drops := pc.Metrics()["drops.fragments"]; drops != 4 {
+		t.Fatalf("expected 4 drops, got %d", drops)
+	}
+}
@@ -0,0 +1,233 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// handoffVersion is the first byte of the PeerHandoff.MarshalBinary format.
+const handoffVersion = 0
+
+// PeerHandoff is what another PacketConn needs to take over a connection to a peer, see PacketConn.Handoff and PacketConn.ResumeConn.
+// Conn isn't part of MarshalBinary, a new process gets it some other way (e.g. by passing the file descriptor of a *net.TCPConn), and sets it after UnmarshalBinary.
+type PeerHandoff struct {
+	Key      ed25519.PublicKey
+	Conn     net.Conn
+	Port     uint64 // The port we used for the peer, kept by ResumeConn if it's free, so paths through us stay valid
+	Priority uint8
+	Features uint64 // The features we both support, since the peer won't send another hello
+	Request  []byte // Our signature request that the peer hasn't answered yet, if any, in case the answer arrives after the handoff
+	Bloom    []byte // The last bloom filter the peer sent us, since it only sends another when something changes
+	Buffered []byte // Read from Conn but not handled yet, these are handled first by ResumeConn
+}
+
+// MarshalBinary encodes everything but Conn.
+// The format is: version byte, key, port (uvarint), priority byte, features (uvarint), request length (uvarint), request, bloom length (uvarint), bloom, then the buffered bytes.
+func (h *PeerHandoff) MarshalBinary() ([]byte, error) {
+	if len(h.Key) != publicKeySize {
+		return nil, types.ErrBadKey
+	}
+	out := []byte{handoffVersion}
+	out = append(out, h.Key...)
+	out = wireAppendUint(out, h.Port)
+	out = append(out, h.Priority)
+	out = wireAppendUint(out, h.Features)
+	out = wireAppendUint(out, uint64(len(h.Request)))
+	out = append(out, h.Request...)
+	out = wireAppendUint(out, uint64(len(h.Bloom)))
+	out = append(out, h.Bloom...)
+	return append(out, h.Buffered...), nil
+}
+
+// UnmarshalBinary decodes the output of MarshalBinary, leaving Conn unchanged.
+func (h *PeerHandoff) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || data[0] != handoffVersion {
+		return types.ErrDecode
+	}
+	data = data[1:]
+	var tmp PeerHandoff
+	var key publicKey
+	if !wireChopSlice(key[:], &data) {
+		return types.ErrDecodeTruncated
+	} else if !wireChopUint(&tmp.Port, &data) {
+		return types.ErrDecodeTruncated
+	} else if len(data) < 1 {
+		return types.ErrDecodeTruncated
+	}
+	tmp.Priority, data = data[0], data[1:]
+	if !wireChopUint(&tmp.Features, &data) {
+		return types.ErrDecodeTruncated
+	}
+	for _, field := range []*[]byte{&tmp.Request, &tmp.Bloom} {
+		var size uint64
+		if !wireChopUint(&size, &data) || size > uint64(len(data)) {
+			return types.ErrDecodeTruncated
+		}
+		if size > 0 {
+			*field = append([]byte(nil), data[:size]...)
+		}
+		data = data[size:]
+	}
+	if len(data) > 0 {
+		tmp.Buffered = append([]byte(nil), data...)
+	}
+	tmp.Key = key.toEd()
+	tmp.Conn = h.Conn
+	*h = tmp
+	return nil
+}
+
+// Handoff detaches every connection that another process can take over, and then closes the PacketConn, for upgrades without dropping peers.
+// That means a connection that finished setup (see WithPeerSetupTimeout), has a file descriptor (a syscall.Conn, like a *net.TCPConn), and doesn't use WithFrameMAC or WithFrameCompression in either direction, since their state can't be handed over.
+// Each of those stops at a frame boundary, without being closed, and its HandleConn returns types.ErrHandedOff. The rest are closed as usual, with a goodbye.
+// The new process should use the same key, import our infos (see ExportState and WithSeqStore), and pass each PeerHandoff to ResumeConn before the peers time out (see WithPeerTimeout).
+// Peers don't notice anything but a new signature exchange.
+func (pc *PacketConn) Handoff() ([]PeerHandoff, error) {
+	if pc.IsClosed() {
+		return nil, types.ErrClosed
+	}
+	var ps []*peer
+	var handoffs []PeerHandoff
+	phony.Block(&pc.core.peers, func() {
+		for _, kps := range pc.core.peers.peers {
+			for p := range kps {
+				if p.canHandoff() {
+					ps = append(ps, p)
+					handoffs = append(handoffs, PeerHandoff{
+						Key:      p.key.toEd(),
+						Conn:     p.conn,
+						Port:     uint64(p.port),
+						Priority: p.prio,
+						Features: p.features,
+					})
+				}
+			}
+		}
+	})
+	// Detach them all before any leave the router, so it doesn't send anything about their departure to the others
+	var detached []*peer
+	for idx, p := range ps {
+		h := &handoffs[idx]
+		phony.Block(&pc.core.router, func() {
+			r := &pc.core.router
+			if req, isIn := r.requests[p.key]; isIn {
+				if _, isIn := r.responses[p.key]; !isIn {
+					h.Request, _ = req.encode(nil)
+				}
+			}
+			if pbi, isIn := r.blooms.blooms[p.key]; isIn {
+				h.Bloom, _ = pbi.recv.encode(nil)
+			}
+		})
+		p.detach()
+		detached = append(detached, p)
+	}
+	timer := time.NewTimer(pc.core.config.closeDrainTimeout)
+	defer timer.Stop()
+	var done []PeerHandoff
+	for idx, p := range detached {
+		select {
+		case <-p.handedOff:
+			handoffs[idx].Buffered = p.unhandled
+			done = append(done, handoffs[idx])
+		case <-timer.C:
+			// It's stuck, Close deals with it along with the rest
+		}
+	}
+	pc.Close()
+	return done, nil
+}
+
+// ResumeConn takes over a connection from another PacketConn's Handoff, and is otherwise like HandleConn.
+// The peer is added right away, with the same port if it's free, and the buffered bytes are handled before anything else that's read.
+func (pc *PacketConn) ResumeConn(h PeerHandoff) error {
+	if h.Conn == nil {
+		return types.ErrClosed
+	}
+	return pc.handleConn(context.Background(), h.Key, h.Conn, h.Priority, &h)
+}
+
+// canHandoff returns true if the peer's conn can be handed off, see PacketConn.Handoff.
+// It must be called from the peers actor. Only links that finished setup are handed off, since the handler may still be setting up their MAC before that.
+// By then, a peer that compresses frames has sent us some, since its signature response is one.
+func (p *peer) canHandoff() bool {
+	if _, ok := p.conn.(syscall.Conn); !ok {
+		return false
+	}
+	return p.setup && p.recvMAC == nil && p.inflate == nil && p.writer.deflate == nil
+}
+
+// detach stops the writer after the frame it's on, and interrupts the handler's next read, see PacketConn.Handoff.
+func (p *peer) detach() {
+	p.handedOff = make(chan struct{})
+	atomic.StoreInt32(&p.handingOff, 1)
+	close(p.writer.handoff)
+	p.monitor.Act(nil, func() {
+		p.monitor.detached = true
+		p.conn.SetReadDeadline(time.Now())
+	})
+}
+
+// _detached returns true if err is from the read deadline set by detach.
+// If so, it saves what was read of the current frame (head and body), and anything else that's buffered, for the PacketConn that takes over.
+func (p *peer) _detached(err error, rbuf *bufio.Reader, head, body []byte) bool {
+	if atomic.LoadInt32(&p.handingOff) == 0 {
+		return false
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return false
+	}
+	buffered, _ := rbuf.Peek(rbuf.Buffered())
+	unhandled := append([]byte(nil), head...)
+	unhandled = append(unhandled, body...)
+	p.unhandled = append(unhandled, buffered...)
+	p.conn.SetReadDeadline(time.Time{})
+	return true
+}
+
+// resume sets up a peer from a PeerHandoff, before its handler starts.
+func (p *peer) resume(h *PeerHandoff) {
+	p.resumed = true
+	p.features = h.Features
+	p.unhandled = h.Buffered
+	if len(h.Bloom) > 0 {
+		if b := newBloom(); b.decode(h.Bloom) == nil {
+			p.resumeBloom = b
+		}
+	}
+	var req routerSigReq
+	if len(h.Request) == 0 || req.decode(h.Request) != nil {
+		return
+	}
+	r := &p.peers.core.router
+	phony.Block(r, func() {
+		if _, isIn := r.requests[p.key]; !isIn {
+			// Otherwise another link to the key was resumed first, and already brought its request
+			r.requests[p.key] = req
+		}
+	})
+}
+
+// peerFrameHead records the bytes of a frame's length as they're read, in case the handler is handed off before the rest of the frame arrives.
+type peerFrameHead struct {
+	r  io.ByteReader
+	bs []byte
+}
+
+func (h *peerFrameHead) ReadByte() (byte, error) {
+	b, err := h.r.ReadByte()
+	if err == nil {
+		h.bs = append(h.bs, b)
+	}
+	return b, err
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// slowTCPConn reads a few bytes at a time while slow is set, so a handoff usually catches the reader in the middle of a frame.
+type slowTCPConn struct {
+	*net.TCPConn
+	slow *int32
+}
+
+func (c slowTCPConn) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(c.slow) != 0 && len(b) > 7 {
+		b = b[:7]
+		time.Sleep(time.Microsecond)
+	}
+	return c.TCPConn.Read(b)
+}
+
+func TestHandoff(t *testing.T) {
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubB, privB, _ := ed25519.GenerateKey(nil)
+	pubC, privC, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA)
+	b, _ := NewPacketConn(privB)
+	defer b.Close()
+	c, _ := NewPacketConn(privC)
+	defer c.Close()
+	// b is connected to a over TCP, which can be handed off, and c over a dummyConn, which can't
+	var slow int32
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		a.HandleConn(pubB, slowTCPConn{conn.(*net.TCPConn), &slow}, 0)
+	}()
+	connB, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bResult := make(chan error, 1)
+	go func() { bResult <- b.HandleConn(pubA, connB, 0) }()
+	cA, cC := newDummyConn(pubA, pubC)
+	defer cA.Close()
+	go a.HandleConn(pubC, cA, 0)
+	cResult := make(chan error, 1)
+	go func() { cResult <- c.HandleConn(pubA, cC, 0) }()
+	waitForRoot([]*PacketConn{a, b, c}, 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := b.Ping(ctx, pubA); err != nil {
+		t.Fatal(err)
+	}
+	// b keeps sending, and a reads slowly, so the handoff is likely to catch a frame in the middle
+	atomic.StoreInt32(&slow, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		msg := make([]byte, 1024)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			b.WriteTo(msg, types.Addr(pubA))
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// Hand off to a new PacketConn with the same key, as a new process would, going through MarshalBinary
+	state := a.ExportState()
+	handoffs, err := a.Handoff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&slow, 0) // Otherwise b's backlog takes too long to get through
+	if len(handoffs) != 1 || !handoffs[0].Key.Equal(pubB) {
+		t.Fatalf("expected a handoff for b, got %d", len(handoffs))
+	}
+	data, err := handoffs[0].MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := PeerHandoff{Conn: handoffs[0].Conn}
+	if err := h.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	a2, _ := NewPacketConn(privA)
+	defer a2.Close()
+	if err := a2.ImportState(state); err != nil {
+		t.Fatal(err)
+	}
+	go a2.ResumeConn(h)
+	if _, err := b.Ping(ctx, pubA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a2.Ping(ctx, pubB); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-bResult:
+		t.Fatalf("b's connection was dropped: %v", err)
+	default:
+	}
+	if peers := a2.Peers(); len(peers) != 1 || peers[0].Port != h.Port {
+		t.Fatalf("expected b on port %d, got %v", h.Port, peers)
+	}
+	// c can't be handed off, so its connection was closed with a goodbye
+	select {
+	case err := <-cResult:
+		if errors.Is(err, types.ErrHandedOff) {
+			t.Fatal("c's connection was handed off")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("c's connection wasn't closed")
+	}
+}
+
+func TestHandoffMarshal(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	req := routerSigReq{seq: 3, nonce: 7}
+	reqBytes, _ := req.encode(nil)
+	h := PeerHandoff{Key: pub, Port: 42, Priority: 1, Features: featureTrafficHeader, Request: reqBytes, Bloom: []byte{0x01}, Buffered: []byte{0x01, byte(wireKeepAlive)}}
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out PeerHandoff
+	if err := out.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Key.Equal(h.Key) || out.Port != h.Port || out.Priority != h.Priority || out.Features != h.Features || string(out.Request) != string(h.Request) || string(out.Bloom) != string(h.Bloom) || string(out.Buffered) != string(h.Buffered) {
+		t.Fatalf("expected %+v, got %+v", h, out)
+	}
+	for idx := 0; idx < len(data)-len(h.Buffered); idx++ {
+		if err := out.UnmarshalBinary(data[:idx]); !errors.Is(err, types.ErrDecode) {
+			t.Fatalf("expected types.ErrDecode for %d bytes, got %v", idx, err)
+		}
+	}
+}
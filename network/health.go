@@ -0,0 +1,128 @@
+package network
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// healthMaintenanceOverdue is how long the router can go without running maintenance (normally every second) before HealthCheck reports it.
+const healthMaintenanceOverdue = 5 * time.Second
+
+// HealthInfo is the result of PacketConn.HealthCheck.
+type HealthInfo struct {
+	Encode   time.Duration // Time to encode and decode a traffic packet
+	Router   time.Duration // Time spent waiting for the router to handle the packet
+	Delivery time.Duration // Time from the router to the packet reaching the PacketConn's delivery path
+	Peers    int           // Number of peer connections
+	Infos    int           // Number of router infos
+	Queued   int           // Packets queued to send to peers, or waiting to be read
+	// Degenerate states, which are true if something is wrong
+	NoParent           bool // We're not the root, but our parent isn't a peer
+	PeerlessInfos      bool // We have no peers, but still have infos about other nodes
+	MaintenanceOverdue bool // The router's maintenance timer hasn't run in a while
+}
+
+// HealthCheck sends a packet to our own key through the router and back to the PacketConn, to check that the local stack is working.
+// It doesn't need any peers, and the packet is not returned by ReadFrom.
+// Returns types.ErrTimeout if the packet doesn't arrive within the timeout.
+func (pc *PacketConn) HealthCheck(timeout time.Duration) (info HealthInfo, err error) {
+	if pc.IsClosed() {
+		return info, types.ErrClosed
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	arrived := make(chan time.Time, 1)
+	var id uint64
+	phony.Block(&pc.actor, func() {
+		pc.healthSeq++
+		id = pc.healthSeq
+		pc.healthChecks[id] = arrived
+	})
+	defer pc.actor.Act(nil, func() {
+		delete(pc.healthChecks, id)
+	})
+	start := time.Now()
+	tr := allocTraffic()
+	tr.source = pc.core.crypto.publicKey
+	tr.dest = pc.core.crypto.publicKey
+	tr.watermark = ^uint64(0)
+	tr.kind = trafficKindHealthCheck
+	tr.payload = binary.BigEndian.AppendUint64(tr.payload, id)
+	bs, _ := tr.encode(nil)
+	if err := tr.decode(bs); err != nil {
+		freeTraffic(tr)
+		return info, err
+	}
+	encoded := time.Now()
+	type routerState struct {
+		time time.Time
+		info HealthInfo
+	}
+	routed := make(chan routerState, 1)
+	r := &pc.core.router
+	r.act(nil, func() {
+		state := routerState{time: time.Now()}
+		_, tr.path = r._getRootAndPath(r.core.crypto.publicKey)
+		if self, isIn := r.infos[r.core.crypto.publicKey]; isIn && self.parent != r.core.crypto.publicKey {
+			_, isIn := r.peers[self.parent]
+			state.info.NoParent = !isIn
+		}
+		state.info.Peers = len(r.peers)
+		state.info.Infos = len(r.infos)
+		state.info.PeerlessInfos = len(r.peers) == 0 && len(r.infos) > 1
+		state.info.MaintenanceOverdue = state.time.Sub(r.mainTime) > healthMaintenanceOverdue
+		routed <- state
+		r.handleTraffic(nil, tr)
+	})
+	var state routerState
+	select {
+	case state = <-routed:
+	case <-timer.C:
+		return info, types.ErrTimeout
+	}
+	info = state.info
+	info.Encode = encoded.Sub(start)
+	info.Router = state.time.Sub(encoded)
+	select {
+	case arrivedTime := <-arrived:
+		info.Delivery = arrivedTime.Sub(state.time)
+	case <-timer.C:
+		return info, types.ErrTimeout
+	}
+	var ps []*peer
+	phony.Block(&pc.core.peers, func() {
+		for _, kps := range pc.core.peers.peers {
+			for p := range kps {
+				ps = append(ps, p)
+			}
+		}
+	})
+	for _, p := range ps {
+		phony.Block(p, func() {
+			info.Queued += p.queue.count()
+		})
+	}
+	phony.Block(&pc.actor, func() {
+		info.Queued += pc.recvq.count()
+	})
+	return info, nil
+}
+
+func (pc *PacketConn) _handleHealthCheck(tr *traffic) {
+	// Only our own packets count, anyone else could guess an id
+	if len(tr.payload) == 8 && tr.source == pc.core.crypto.publicKey {
+		id := binary.BigEndian.Uint64(tr.payload)
+		if ch, isIn := pc.healthChecks[id]; isIn {
+			delete(pc.healthChecks, id)
+			select {
+			case ch <- time.Now():
+			default:
+			}
+		}
+	}
+	freeTraffic(tr)
+}
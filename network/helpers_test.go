@@ -0,0 +1,88 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// newNode returns a node with the given options, which is closed when the test ends.
+func newNode(tb testing.TB, options ...Option) *PacketConn {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	conn, err := NewPacketConn(priv, options...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// nodeKey returns a node's public key.
+func nodeKey(conn *PacketConn) ed25519.PublicKey {
+	return ed25519.PublicKey(conn.LocalAddr().(types.Addr))
+}
+
+// linkNodes connects two nodes over a dummyConn, and returns a's end of it, which is closed when the test ends.
+func linkNodes(tb testing.TB, a, b *PacketConn) *dummyConn {
+	keyA, keyB := nodeKey(a), nodeKey(b)
+	cA, cB := newDummyConn(keyA, keyB)
+	tb.Cleanup(func() { cA.Close() })
+	go a.HandleConn(keyB, cA, 0)
+	go b.HandleConn(keyA, cB, 0)
+	return cA
+}
+
+// linkLine links each node to the next, waits for them to agree on a root, and returns the links, see linkNodes.
+func linkLine(tb testing.TB, conns []*PacketConn) (links []*dummyConn) {
+	for idx := 1; idx < len(conns); idx++ {
+		links = append(links, linkNodes(tb, conns[idx-1], conns[idx]))
+	}
+	waitForRoot(conns, 30*time.Second)
+	return
+}
+
+// newLine returns a line of n nodes with the given options, and their keys, once they agree on a root.
+func newLine(tb testing.TB, n int, options ...Option) (keys []ed25519.PublicKey, conns []*PacketConn) {
+	for idx := 0; idx < n; idx++ {
+		conn := newNode(tb, options...)
+		keys = append(keys, nodeKey(conn))
+		conns = append(conns, conn)
+	}
+	linkLine(tb, conns)
+	return
+}
+
+// newPair is newLine for two nodes.
+func newPair(tb testing.TB, options ...Option) (a, b *PacketConn) {
+	_, conns := newLine(tb, 2, options...)
+	return conns[0], conns[1]
+}
+
+// sendUntilReceived writes the message to a node until it arrives, retrying while paths are looked up, and returns false if it doesn't within 30 seconds.
+// write is the sender's WriteTo, or anything like it.
+func sendUntilReceived(tb testing.TB, write func([]byte, net.Addr) (int, error), to *PacketConn, msg []byte) bool {
+	buf := make([]byte, to.MTU())
+	for start := time.Now(); time.Since(start) < 30*time.Second; {
+		if _, err := write(msg, to.LocalAddr()); err != nil {
+			tb.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		n, _, err := to.ReadFromCtx(ctx, buf)
+		cancel()
+		if err == nil && string(buf[:n]) == string(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeClass returns a write function for sendUntilReceived that sends in the class.
+func writeClass(from *PacketConn, class TrafficClass) func([]byte, net.Addr) (int, error) {
+	return func(msg []byte, addr net.Addr) (int, error) {
+		return from.WriteToClass(msg, addr, class)
+	}
+}
@@ -0,0 +1,30 @@
+package network
+
+// routerDeclinedPort is the port in a response from a leaf node, see WithLeafMode.
+// Real peer ports start at 1, so the response still proves the leaf's key, but it can't be used to pick the leaf as a parent.
+const routerDeclinedPort = peerPort(0)
+
+// _isLeaf returns true if the peer declined our request, so it won't be our parent or relay traffic for anyone but itself.
+func (r *router) _isLeaf(key publicKey) bool {
+	_, isIn := r.leaves[key]
+	return isIn
+}
+
+// _canRelay returns true if traffic to a destination at the given distance from a peer may be sent to that peer.
+// Leaf peers are only used for traffic addressed to them, which is the only case where the distance is 0.
+func (r *router) _canRelay(key publicKey, dist uint64) bool {
+	return dist == 0 || !r._isLeaf(key)
+}
+
+// _worstRoot returns the root that _fix starts from when looking for a parent.
+// That's normally our own key, but a leaf would rather have any parent than be the root, since nobody will use a leaf as theirs.
+func (r *router) _worstRoot() publicKey {
+	if !r.core.config.leaf {
+		return r.core.crypto.publicKey
+	}
+	var worst publicKey
+	for idx := range worst {
+		worst[idx] = 0xff
+	}
+	return worst
+}
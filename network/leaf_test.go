@@ -0,0 +1,150 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+func TestLeafMode(t *testing.T) {
+	// A ring of relays r1 - x - d - r2, with a leaf connecting r1 and r2
+	// The leaf has the lowest key, so it would be the root if it didn't prefer its peers' root
+	var keys []ed25519.PublicKey
+	var privs []ed25519.PrivateKey
+	for idx := 0; idx < 5; idx++ {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		keys = append(keys, pub)
+		privs = append(privs, priv)
+	}
+	sort.Slice(privs, func(i, j int) bool {
+		return bytes.Compare(privs[i].Public().(ed25519.PublicKey), privs[j].Public().(ed25519.PublicKey)) < 0
+	})
+	var mutex sync.Mutex
+	var events []TraceEvent
+	var leafEvents int
+	var conns []*PacketConn
+	for idx, priv := range privs {
+		keys[idx] = priv.Public().(ed25519.PublicKey)
+		isLeaf := idx == 0
+		handler := func(event TraceEvent) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, event)
+			if isLeaf {
+				leafEvents++
+			}
+		}
+		conn, err := NewPacketConn(priv, WithLeafMode(isLeaf), WithTraceHandler(handler))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	leaf, r1, x, d, r2 := conns[0], conns[1], conns[2], conns[3], conns[4]
+	linkNodes(t, r1, x)
+	linkNodes(t, x, d)
+	linkNodes(t, d, r2)
+	linkNodes(t, leaf, r1)
+	linkNodes(t, leaf, r2)
+	waitForRoot(conns, 30*time.Second)
+	var leafRoot publicKey
+	phony.Block(&leaf.core.router, func() {
+		leafRoot, _ = leaf.core.router._getRootAndDists(leaf.core.crypto.publicKey)
+	})
+	if leafRoot == leaf.core.crypto.publicKey {
+		t.Fatal("leaf is the root")
+	}
+	for _, relay := range []*PacketConn{r1, r2} {
+		r := &relay.core.router
+		phony.Block(r, func() {
+			if !r._isLeaf(leaf.core.crypto.publicKey) {
+				t.Fatal("relay doesn't know about the leaf")
+			}
+		})
+	}
+	for _, conn := range conns {
+		r := &conn.core.router
+		phony.Block(r, func() {
+			for key, info := range r.infos {
+				if info.parent == leaf.core.crypto.publicKey && key != leaf.core.crypto.publicKey {
+					t.Fatalf("%x picked the leaf as its parent", key)
+				}
+			}
+		})
+	}
+	// The leaf can reach the far side of the ring, and the relays can reach each other without going through the leaf
+	send := func(from, to *PacketConn, msg string) {
+		if !sendUntilReceived(t, from.WriteToTraced, to, []byte(msg)) {
+			t.Fatalf("timeout sending %q", msg)
+		}
+	}
+	send(leaf, d, "leaf to d")
+	mutex.Lock()
+	events, leafEvents = nil, 0
+	mutex.Unlock()
+	for idx := 0; idx < 10; idx++ {
+		send(r1, r2, "r1 to r2")
+		send(r2, r1, "r2 to r1")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if leafEvents != 0 {
+		t.Fatalf("leaf handled %d packets between the relays", leafEvents)
+	}
+	for _, event := range events {
+		if event.Next.Equal(keys[0]) {
+			t.Fatalf("packet from %x to %x was forwarded to the leaf", event.Source, event.Dest)
+		}
+	}
+}
+
+func TestLeafStaleResponse(t *testing.T) {
+	// Only a declined response to our current request makes a peer a leaf, and a later one with a real port undoes it
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubK, _, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA, WithPeerSetupTimeout(time.Minute))
+	defer a.Close()
+	var keyK publicKey
+	copy(keyK[:], pubK)
+	cA, cK := newDummyConn(pubA, pubK)
+	defer cK.Close()
+	go a.HandleConn(pubK, cA, 0)
+	go io.Copy(io.Discard, cK)
+	cK.Write([]byte{0x01, byte(wireKeepAlive)})
+	r := &a.core.router
+	var p *peer
+	for start := time.Now(); p == nil; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("peer wasn't added")
+		}
+		phony.Block(r, func() {
+			for q := range r.peers[keyK] {
+				p = q
+			}
+		})
+	}
+	phony.Block(r, func() {
+		req := r.requests[keyK]
+		stale := req
+		stale.nonce++
+		r._handleResponse(p, &routerSigRes{routerSigReq: stale, port: routerDeclinedPort})
+		if r._isLeaf(keyK) {
+			t.Fatal("a stale response made the peer a leaf")
+		}
+		r._handleResponse(p, &routerSigRes{routerSigReq: req, port: routerDeclinedPort})
+		if !r._isLeaf(keyK) {
+			t.Fatal("a declined response didn't make the peer a leaf")
+		}
+		r._handleResponse(p, &routerSigRes{routerSigReq: req, port: 1})
+		if r._isLeaf(keyK) {
+			t.Fatal("a response with a real port didn't clear the leaf")
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"bufio"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+const (
+	frameMACSize      = 16                                   // bytes of HMAC-SHA256 sent after each frame, see WithFrameMAC
+	frameMACHelloSize = curve25519.PointSize + signatureSize // an ephemeral key and our signature on it
+)
+
+var frameMACContext = []byte("ironwood frame mac")
+
+// frameMAC authenticates the frames sent in one direction of a connection.
+// Each frame is numbered, so frames can't be replayed, dropped, or reordered without the next check failing.
+type frameMAC struct {
+	mac     hash.Hash
+	counter uint64
+	sum     [sha256.Size]byte
+}
+
+func newFrameMAC(key []byte) *frameMAC {
+	return &frameMAC{mac: hmac.New(sha256.New, key)}
+}
+
+// tag returns the MAC of the next frame, given its length and payload (type and data).
+// The result is only valid until the next call.
+func (m *frameMAC) tag(size uint64, payload []byte) []byte {
+	var hdr [8 + binary.MaxVarintLen64]byte
+	binary.BigEndian.PutUint64(hdr[:8], m.counter)
+	n := binary.PutUvarint(hdr[8:], size)
+	m.counter++
+	m.mac.Reset()
+	m.mac.Write(hdr[:8+n])
+	m.mac.Write(payload)
+	return m.mac.Sum(m.sum[:0])[:frameMACSize]
+}
+
+// check returns false if the tag doesn't match the next frame.
+func (m *frameMAC) check(size uint64, payload []byte, tag []byte) bool {
+	return hmac.Equal(m.tag(size, payload), tag)
+}
+
+// frameMACHelloBytes returns what the sender of a hello signs: the ephemeral key, bound to the key of the peer it's meant for.
+func frameMACHelloBytes(eph []byte, to publicKey) []byte {
+	out := append([]byte(nil), frameMACContext...)
+	out = append(out, eph...)
+	return append(out, to[:]...)
+}
+
+// frameMACKey derives the key for frames from one side of the connection to the other.
+func frameMACKey(shared []byte, from publicKey, fromEph []byte, to publicKey, toEph []byte) []byte {
+	info := append([]byte(nil), frameMACContext...)
+	info = append(info, from[:]...)
+	info = append(info, fromEph...)
+	info = append(info, to[:]...)
+	info = append(info, toEph...)
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		panic("this should never happen")
+	}
+	return key
+}
+
+// negotiateMAC sends our hello and reads the peer's, before the writer starts, then sets up a MAC and sets p.features.
+// It's only called if we want a MAC (ours includes featureFrameMAC), so it returns types.ErrNoMAC if the peer's first frame isn't a hello that lists featureFrameMAC too.
+func (p *peer) negotiateMAC(ours uint64, rbuf *bufio.Reader) error {
+	// Both sides send first, and the conn may not buffer anything, so send and receive at the same time
+	written := make(chan error, 1)
+	go func() {
+		hello := peerHelloFrame(ours)
+		_, err := p.conn.Write(hello)
+		freeBytes(hello)
+		written <- err
+	}()
+	size, err := binary.ReadUvarint(rbuf)
+	if err != nil {
+		return err
+	}
+	if size > p.peers.core.config.peerMaxMessageSize {
+		return types.ErrOversizedMessage
+	}
+	frame := make([]byte, size)
+	if _, err = io.ReadFull(rbuf, frame); err != nil {
+		return err
+	}
+	if err = <-written; err != nil {
+		return err
+	}
+	theirs := peerHelloFeatures(frame)
+	if theirs&featureFrameMAC == 0 {
+		// They don't want a MAC, or they're from before features were added, and we don't go on without one
+		return types.ErrNoMAC
+	}
+	if err = p.setupMAC(rbuf); err != nil {
+		return err
+	}
+	p.features = ours & theirs
+	return nil
+}
+
+// setupMAC exchanges signed ephemeral keys with the peer, right after the hellos, and derives a MAC key for each direction.
+// It must be called before the writer starts, see WithFrameMAC.
+func (p *peer) setupMAC(r io.Reader) error {
+	ourKey := p.peers.core.crypto.publicKey
+	var ephPriv [curve25519.ScalarSize]byte
+	if _, err := crand.Read(ephPriv[:]); err != nil {
+		return err
+	}
+	ephPub, err := curve25519.X25519(ephPriv[:], curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	sig, err := p.peers.core.crypto.sign(frameMACHelloBytes(ephPub, p.key))
+	if err != nil {
+		return err
+	}
+	hello := append(append([]byte(nil), ephPub...), sig[:]...)
+	// Both sides send first, and the conn may not buffer anything, so send and receive at the same time
+	written := make(chan error, 1)
+	go func() {
+		_, err := p.conn.Write(hello)
+		written <- err
+	}()
+	theirs := make([]byte, frameMACHelloSize)
+	if _, err := io.ReadFull(r, theirs); err != nil {
+		return err
+	}
+	if err := <-written; err != nil {
+		return err
+	}
+	theirEph := theirs[:curve25519.PointSize]
+	var theirSig signature
+	copy(theirSig[:], theirs[curve25519.PointSize:])
+	if !p.key.verify(frameMACHelloBytes(theirEph, ourKey), &theirSig) {
+		return types.ErrDecodeBadSignature
+	}
+	shared, err := curve25519.X25519(ephPriv[:], theirEph)
+	if err != nil {
+		return types.ErrBadKey // A low order point, so the shared secret would be known to anyone
+	}
+	p.writer.mac = newFrameMAC(frameMACKey(shared, ourKey, ephPub, p.key, theirEph))
+	p.recvMAC = newFrameMAC(frameMACKey(shared, p.key, theirEph, ourKey, ephPub))
+	return nil
+}
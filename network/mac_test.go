@@ -0,0 +1,156 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// tamperConn flips a bit in the last byte of the next write, once tamper is set.
+type tamperConn struct {
+	net.Conn
+	tamper int32
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	if atomic.CompareAndSwapInt32(&c.tamper, 1, 0) && len(b) > 0 {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 0x01
+	}
+	return c.Conn.Write(b)
+}
+
+// frameMACOptions returns the options for a node that asks for a MAC on every connection if mac is set.
+func frameMACOptions(mac bool) []Option {
+	if !mac {
+		return nil
+	}
+	return []Option{WithFrameMAC(func(key ed25519.PublicKey, conn net.Conn) bool { return true })}
+}
+
+// newMACPair connects two nodes, each asking for a MAC if its flag is set, and waits until a can send traffic to b.
+// It returns the conn a writes to, and a channel with the result of b's HandleConn.
+func newMACPair(tb testing.TB, macA, macB bool) (a, b *PacketConn, conn *tamperConn, result chan error) {
+	a, b = newNode(tb, frameMACOptions(macA)...), newNode(tb, frameMACOptions(macB)...)
+	pubA, pubB := nodeKey(a), nodeKey(b)
+	cA, cB := newDummyConn(pubA, pubB)
+	tb.Cleanup(func() { cA.Close() })
+	conn = &tamperConn{Conn: cA}
+	result = make(chan error, 1)
+	go a.HandleConn(pubB, conn, 0)
+	go func() { result <- b.HandleConn(pubA, cB, 0) }()
+	waitForRoot([]*PacketConn{a, b}, 30*time.Second)
+	if !sendUntilReceived(tb, a.WriteTo, b, []byte("test")) {
+		tb.Fatal("timeout")
+	}
+	return
+}
+
+func TestFrameMAC(t *testing.T) {
+	a, b, conn, result := newMACPair(t, true, true)
+	// A single flipped bit closes the connection, on the first frame it's in
+	atomic.StoreInt32(&conn.tamper, 1)
+	a.WriteTo([]byte("tampered"), b.LocalAddr())
+	select {
+	case err := <-result:
+		if !errors.Is(err, types.ErrBadMAC) {
+			t.Fatalf("expected types.ErrBadMAC, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("tampered frame was accepted")
+	}
+	if bad := b.Metrics()["peers.bad_mac"]; bad != 1 {
+		t.Fatalf("expected 1 bad MAC, got %d", bad)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	buf := make([]byte, 16)
+	if n, _, err := b.ReadFromCtx(ctx, buf); err == nil {
+		t.Fatalf("unexpected packet %q", buf[:n])
+	}
+}
+
+func TestFrameMACOneSide(t *testing.T) {
+	// If only one side asks for a MAC, that side closes the connection instead of going on without one
+	for _, macA := range []bool{true, false} {
+		a, b := newNode(t, frameMACOptions(macA)...), newNode(t, frameMACOptions(!macA)...)
+		pubA, pubB := nodeKey(a), nodeKey(b)
+		cA, cB := newDummyConn(pubA, pubB)
+		resultA, resultB := make(chan error, 1), make(chan error, 1)
+		go func() { resultA <- a.HandleConn(pubB, cA, 0) }()
+		go func() { resultB <- b.HandleConn(pubA, cB, 0) }()
+		asked, other := resultA, resultB
+		if !macA {
+			asked, other = resultB, resultA
+		}
+		for _, result := range []chan error{asked, other} {
+			select {
+			case err := <-result:
+				if result == asked && !errors.Is(err, types.ErrNoMAC) {
+					t.Fatalf("expected types.ErrNoMAC with it on for a %v and b %v, got %v", macA, !macA, err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("connection wasn't closed with it on for a %v and b %v", macA, !macA)
+			}
+		}
+	}
+}
+
+func TestFrameMACReplay(t *testing.T) {
+	// The same frame and tag, sent again, doesn't check out, since the frame number is part of the MAC
+	key := []byte("key")
+	send, recv := newFrameMAC(key), newFrameMAC(key)
+	payload := []byte{byte(wireKeepAlive)}
+	tag := append([]byte(nil), send.tag(1, payload)...)
+	if !recv.check(1, payload, tag) {
+		t.Fatal("frame didn't check out")
+	}
+	if recv.check(1, payload, tag) {
+		t.Fatal("replayed frame checked out")
+	}
+}
+
+// BenchmarkFrameMAC sends b.N packets as fast as possible, with and without a MAC on each frame.
+func BenchmarkFrameMAC(b *testing.B) {
+	for _, mac := range []bool{false, true} {
+		for _, size := range []int{64, 1024} {
+			b.Run(fmt.Sprintf("mac=%t/size=%d", mac, size), func(b *testing.B) {
+				src, dst, _, _ := newMACPair(b, mac, mac)
+				addr := dst.LocalAddr()
+				msg := make([]byte, size)
+				done := make(chan int)
+				go func() {
+					buf := make([]byte, dst.MTU())
+					var count int
+					for count < b.N {
+						ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+						_, _, err := dst.ReadFromCtx(ctx, buf)
+						cancel()
+						if err != nil {
+							break
+						}
+						count++
+					}
+					done <- count
+				}()
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for idx := 0; idx < b.N; idx++ {
+					if _, err := src.WriteTo(msg, addr); err != nil {
+						b.Fatal(err)
+					}
+				}
+				count := <-done
+				b.StopTimer()
+				b.ReportMetric(float64(count)/float64(b.N), "delivered")
+			})
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics are counters and gauges kept with atomics wherever packets wait or get dropped, so they can be read without going through (or stopping) any actors.
+// The int64 fields must stay at the start of the struct, for 64-bit alignment of the atomics on 32-bit platforms.
+type metrics struct {
+	routerPending   int64        // Messages sent to the router's actor that it hasn't started on yet
+	dropPeerQueue   int64        // Packets dropped from a peer's outbound queue because it was too slow
+	dropRecvQueue   int64        // Packets dropped from the PacketConn's inbound queue because ReadFrom was too slow
+	dropPeerClosing int64        // Packets that were sent to a peer after we said goodbye
+	dropOldPeer     int64        // Traffic other than standard packets, for a peer that only knows the original traffic header, see oldTraffic
+	dropNoRoute     int64        // Traffic that wasn't for us, and had no next hop that satisfied the watermark
+	dropBroadcast   int64        // Broadcasts that were over an origin's rate limit
+	dropBadPort     int64        // Announcements naming us as the parent, over a port we don't use for that peer, or with a port over the limit, see WithMaxPort
+	dropTooDeep     int64        // Announcements whose parent is already at the max path length, see _walkLimit
+	peersPending    int64        // Peer connections that haven't finished setup
+	peersRejected   int64        // Peer connections that were over one of the connection limits, or rejected by the peer filter
+	peersTimedOut   int64        // Peer connections that didn't finish setup before the timeout
+	peersOneWay     int64        // Peer links that currently look one-way, see PacketConn.SetOneWayPeerHandler
+	trafficLFA      int64        // Traffic sent to a loop-free alternate because the best next hop was saturated
+	selfUpdates     int64        // Times our own info changed, each of which is announced to the whole tree
+	dropFragments   int64        // Fragmented messages that timed out, or didn't fit in the reassembly buffer
+	annAccepted     int64        // Infos (including our own) that _update accepted
+	annOldSeq       int64        // Infos that _update rejected for having an older seq than what we have
+	annWorseParent  int64        // Infos that _update rejected for having the same seq as what we have, but a worse parent
+	annNonce        int64        // Infos that _update rejected for having the same seq and parent as what we have, but not a lower nonce (mostly duplicates)
+	parentChanges   int64        // Times our parent changed, including becoming the root
+	parentTime      int64        // Unix nanoseconds of the last parent change
+	rootTime        int64        // Unix nanoseconds of when we last became the root, or 0 if we aren't
+	converged       int64        // 1 if our parent has been stable for the converged threshold, see WithConvergedThreshold
+	annSent         int64        // Announcements sent to peers, see WithEagerAnnounce
+	annFilterSlow   int64        // Calls to the announce filter that took longer than announceSlow
+	dropFiltered    int64        // Announcements rejected by the announce filter
+	dropInfoCap     int64        // Announcements for new infos that didn't fit, see WithRouterMaxInfos
+	annEvicted      int64        // Infos dropped to make room for a new one, see WithRouterMaxInfos
+	peersBadMAC     int64        // Peer connections closed because a frame failed its MAC check, see WithFrameMAC
+	recvq           queueMetrics // The PacketConn's inbound queue
+	mutex           sync.Mutex
+	peers           map[*peer]*queueMetrics // Outbound queue for each peer link
+
+	// Recent parent changes, only used with the mutex held, see recentParentChanges
+	parentRing [parentChangeRing]time.Time
+	parentIdx  int
+}
+
+// queueMetrics tracks the contents of a packetQueue, updated by the queue itself.
+type queueMetrics struct {
+	packets int64
+	bytes   int64
+}
+
+func (m *metrics) init() {
+	m.peers = make(map[*peer]*queueMetrics)
+}
+
+func (m *metrics) addPeer(p *peer) {
+	metrics := new(queueMetrics)
+	p.queue.setMetrics(metrics)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.peers[p] = metrics
+}
+
+func (m *metrics) removePeer(p *peer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.peers, p)
+}
+
+// Metrics returns a snapshot of internal queue depths and drop counters, for use with e.g. expvar or Prometheus.
+// This doesn't wait for any of the actors, so it's cheap enough to call often, but the values may be slightly inconsistent with each other.
+func (pc *PacketConn) Metrics() map[string]int64 {
+	m := &pc.core.metrics
+	now := time.Now()
+	stats := map[string]int64{
+		"router.pending":           atomic.LoadInt64(&m.routerPending),
+		"pconn.recv_queue.packets": atomic.LoadInt64(&m.recvq.packets),
+		"pconn.recv_queue.bytes":   atomic.LoadInt64(&m.recvq.bytes),
+		"drops.peer_queue":         atomic.LoadInt64(&m.dropPeerQueue),
+		"drops.recv_queue":         atomic.LoadInt64(&m.dropRecvQueue),
+		"drops.peer_closing":       atomic.LoadInt64(&m.dropPeerClosing),
+		"drops.old_peer":           atomic.LoadInt64(&m.dropOldPeer),
+		"drops.no_route":           atomic.LoadInt64(&m.dropNoRoute),
+		"drops.broadcast_rate":     atomic.LoadInt64(&m.dropBroadcast),
+		"drops.announce_port":      atomic.LoadInt64(&m.dropBadPort),
+		"drops.announce_depth":     atomic.LoadInt64(&m.dropTooDeep),
+		"peers.pending":            atomic.LoadInt64(&m.peersPending),
+		"peers.rejected":           atomic.LoadInt64(&m.peersRejected),
+		"peers.setup_timeouts":     atomic.LoadInt64(&m.peersTimedOut),
+		"peers.one_way":            atomic.LoadInt64(&m.peersOneWay),
+		"traffic.alternate":        atomic.LoadInt64(&m.trafficLFA),
+		"router.self_updates":      atomic.LoadInt64(&m.selfUpdates),
+		"drops.fragments":          atomic.LoadInt64(&m.dropFragments),
+		"announces.accepted":       atomic.LoadInt64(&m.annAccepted),
+		"announces.old_seq":        atomic.LoadInt64(&m.annOldSeq),
+		"announces.worse_parent":   atomic.LoadInt64(&m.annWorseParent),
+		"announces.stale_nonce":    atomic.LoadInt64(&m.annNonce),
+		"router.parent_changes":    atomic.LoadInt64(&m.parentChanges),
+		"router.parent_age_ms":     sinceMillis(now, atomic.LoadInt64(&m.parentTime)),
+		"router.root_ms":           sinceMillis(now, atomic.LoadInt64(&m.rootTime)),
+		"router.converged":         atomic.LoadInt64(&m.converged),
+		"announces.sent":           atomic.LoadInt64(&m.annSent),
+		"announces.filter_slow":    atomic.LoadInt64(&m.annFilterSlow),
+		"drops.announce_filter":    atomic.LoadInt64(&m.dropFiltered),
+		"drops.announce_cap":       atomic.LoadInt64(&m.dropInfoCap),
+		"announces.evicted":        atomic.LoadInt64(&m.annEvicted),
+		"peers.bad_mac":            atomic.LoadInt64(&m.peersBadMAC),
+	}
+	var packets, bytes int64
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats["router.parent_changes_recent"] = m.recentParentChanges(now)
+	for p, qm := range m.peers {
+		name := fmt.Sprintf("peer.%x.%d.queue", p.key[:], p.order)
+		stats[name+".packets"] = atomic.LoadInt64(&qm.packets)
+		stats[name+".bytes"] = atomic.LoadInt64(&qm.bytes)
+		packets += stats[name+".packets"]
+		bytes += stats[name+".bytes"]
+	}
+	stats["peers.queue.packets"] = packets
+	stats["peers.queue.bytes"] = bytes
+	return stats
+}
+
+// sinceMillis returns the milliseconds from a time in unix nanoseconds until now, or 0 if the time is 0.
+func sinceMillis(now time.Time, nanos int64) int64 {
+	if nanos == 0 {
+		return 0
+	}
+	return int64(now.Sub(time.Unix(0, nanos)) / time.Millisecond)
+}
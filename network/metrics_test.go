@@ -0,0 +1,52 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+func TestMetrics(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv)
+	defer pc.Close()
+	// Stall the router, so messages back up behind it
+	r := &pc.core.router
+	release := make(chan struct{})
+	r.Act(nil, func() { <-release })
+	for idx := 0; idx < 10; idx++ {
+		r.act(nil, func() {})
+	}
+	if n := pc.Metrics()["router.pending"]; n < 10 {
+		t.Fatalf("expected at least 10 pending router messages, got %d", n)
+	}
+	close(release)
+	phony.Block(r, func() {})
+	if n := pc.Metrics()["router.pending"]; n != 0 {
+		t.Fatalf("expected no pending router messages, got %d", n)
+	}
+	// Nobody is reading, so packets back up in the inbound queue
+	for idx := 0; idx < 5; idx++ {
+		testDeliver(pc, byte(idx))
+	}
+	phony.Block(&pc.actor, func() {})
+	m := pc.Metrics()
+	if m["pconn.recv_queue.packets"] != 5 || m["pconn.recv_queue.bytes"] == 0 {
+		t.Fatalf("unexpected inbound queue metrics: %v", m)
+	}
+	buf := make([]byte, 16)
+	for idx := 0; idx < 5; idx++ {
+		if err := pc.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := pc.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m = pc.Metrics()
+	if m["pconn.recv_queue.packets"] != 0 || m["pconn.recv_queue.bytes"] != 0 {
+		t.Fatalf("unexpected inbound queue metrics: %v", m)
+	}
+}
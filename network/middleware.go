@@ -0,0 +1,78 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+)
+
+// WireType is the type of a packet sent between peers, as passed to a WireMiddleware.
+type WireType uint8
+
+const (
+	WireSigReq      = WireType(wireProtoSigReq)
+	WireSigRes      = WireType(wireProtoSigRes)
+	WireAnnounce    = WireType(wireProtoAnnounce)
+	WireBloomFilter = WireType(wireProtoBloomFilter)
+	WirePathLookup  = WireType(wireProtoPathLookup)
+	WirePathNotify  = WireType(wireProtoPathNotify)
+	WirePathBroken  = WireType(wireProtoPathBroken)
+	WireTraffic     = WireType(wireTraffic)
+	WireBroadcast   = WireType(wireProtoBroadcast)
+)
+
+// WireDirection says whether a packet passed to a WireMiddleware is being sent to the peer or was received from it.
+type WireDirection uint8
+
+const (
+	WireSend WireDirection = iota
+	WireRecv
+)
+
+// WireMiddleware is called with the payload of each packet sent to or received from a peer, see PacketConn.SetWireMiddleware.
+// It returns the payload to use instead, which may be data itself, or false to drop the packet.
+type WireMiddleware func(peer ed25519.PublicKey, pType WireType, data []byte, dir WireDirection) ([]byte, bool)
+
+// wireMiddlewareBox lets a nil WireMiddleware be stored in an atomic.Value.
+type wireMiddlewareBox struct {
+	fn WireMiddleware
+}
+
+// SetWireMiddleware sets a function that can change or drop packets between us and our peers, or unsets it if the middleware is nil.
+// It's meant for fault injection in tests, e.g. dropping every announcement sent to one peer, without needing a custom net.Conn.
+// Packets we send are passed to it from the peer's writer, once they're encoded and before they're queued for the conn, and received packets from the peer's reader before they're decoded.
+// Keepalives and goodbyes we send skip the middleware. The data must not be kept after returning, and blocking delays everything else on that link.
+// Corrupted packets are handled like any others, so a received packet that no longer decodes closes the connection.
+func (pc *PacketConn) SetWireMiddleware(middleware WireMiddleware) {
+	pc.core.peers.middleware.Store(wireMiddlewareBox{middleware})
+}
+
+func (ps *peers) getMiddleware() WireMiddleware {
+	box, _ := ps.middleware.Load().(wireMiddlewareBox)
+	return box.fn
+}
+
+// wireSend passes an encoded frame (length, type, payload) through the middleware, and returns the frame to send instead.
+// Takes ownership of frame.
+func (p *peer) wireSend(mw WireMiddleware, pType wirePacketType, frame []byte) ([]byte, bool) {
+	defer freeBytes(frame)
+	_, n := binary.Uvarint(frame)
+	data, ok := mw(p.key.toEd(), WireType(pType), frame[n+1:], WireSend)
+	if !ok {
+		return nil, false
+	}
+	out := binary.AppendUvarint(allocBytes(0), uint64(len(data)+1))
+	out = append(out, byte(pType))
+	return append(out, data...), true
+}
+
+// wireRecv passes a received packet (type, payload) through the middleware, and returns the packet to handle instead.
+// Takes ownership of bs.
+func (p *peer) wireRecv(mw WireMiddleware, bs []byte) ([]byte, bool) {
+	defer freeBytes(bs)
+	data, ok := mw(p.key.toEd(), WireType(bs[0]), bs[1:], WireRecv)
+	if !ok {
+		return nil, false
+	}
+	out := append(allocBytes(0), bs[0])
+	return append(out, data...), true
+}
@@ -0,0 +1,65 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+func TestWireMiddleware(t *testing.T) {
+	// a drops every announcement it sends to b, so b never hears about a's info
+	a, b := newNode(t), newNode(t)
+	pubA, pubB := nodeKey(a), nodeKey(b)
+	var dropped, passed int64
+	a.SetWireMiddleware(func(peer ed25519.PublicKey, pType WireType, data []byte, dir WireDirection) ([]byte, bool) {
+		if !peer.Equal(pubB) {
+			t.Errorf("unexpected peer %x", peer)
+		}
+		if dir == WireSend && pType == WireAnnounce {
+			atomic.AddInt64(&dropped, 1)
+			return nil, false
+		}
+		atomic.AddInt64(&passed, 1)
+		return data, true
+	})
+	linkNodes(t, a, b)
+	knows := func(pc *PacketConn, key ed25519.PublicKey) bool {
+		for _, info := range pc.Debug.GetTree() {
+			if info.Key.Equal(key) {
+				return true
+			}
+		}
+		return false
+	}
+	for start := time.Now(); !knows(a, pubB); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 30*time.Second {
+			t.Fatal("a never heard about b")
+		}
+	}
+	time.Sleep(2 * time.Second) // A couple of maintenance periods, for a to send announcements
+	if knows(b, pubA) {
+		t.Fatal("b heard about a")
+	}
+	if d, p := atomic.LoadInt64(&dropped), atomic.LoadInt64(&passed); d == 0 || p == 0 {
+		t.Fatalf("expected some packets to be dropped and some to pass, got %d and %d", d, p)
+	}
+	// Without the middleware, a's next info gets through
+	a.SetWireMiddleware(nil)
+	count := atomic.LoadInt64(&dropped)
+	r := &a.core.router
+	phony.Block(r, func() {
+		r.refresh = true
+		r._fix()
+	})
+	for start := time.Now(); !knows(b, pubA); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 30*time.Second {
+			t.Fatal("b never heard about a")
+		}
+	}
+	if atomic.LoadInt64(&dropped) != count {
+		t.Fatal("middleware was called after being unset")
+	}
+}
@@ -0,0 +1,72 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"sync/atomic"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// routerProbeInterval is how often we resend each link's challenge, to check that the peer still hears us.
+const routerProbeInterval = 5 * time.Second
+
+// SetOneWayPeerHandler sets a function to call when a peer link starts or stops being one-way, or unsets it if the handler is nil.
+// A link is one-way if the peer hasn't answered a request we sent over it within the peer timeout (see WithPeerTimeout), even though the connection is still open because we keep hearing from them.
+// Traffic from a one-way peer is still forwarded, but we won't use them as our parent, since anything we send them is lost.
+func (pc *PacketConn) SetOneWayPeerHandler(handler func(key ed25519.PublicKey, port uint64, oneWay bool)) {
+	phony.Block(&pc.core.router, func() {
+		pc.core.router.oneWayHandler = handler
+	})
+}
+
+// _probePeers resends the challenge over each link that has proven its key, and marks links that haven't answered the last one in time as one-way.
+// The challenge was only ever sent over that link (see addPeer), so an answer shows that this link works in both directions.
+func (r *router) _probePeers() {
+	now := time.Now()
+	timeout := r.core.config.peerTimeout
+	for _, ps := range r.peers {
+		for p := range ps {
+			if !p.proven {
+				continue
+			}
+			if p.probed.After(p.acked) && now.Sub(p.probed) > timeout {
+				r._setOneWay(p, true)
+			}
+			if now.Sub(p.probed) >= routerProbeInterval {
+				p.probed = now
+				req := p.challenge
+				p.sendSigReq(r, &req)
+			}
+		}
+	}
+}
+
+// _setOneWay updates the link's state, and calls the handler if it changed.
+func (r *router) _setOneWay(p *peer, oneWay bool) {
+	var flag int32
+	if oneWay {
+		flag = 1
+	}
+	if atomic.SwapInt32(&p.oneWay, flag) == flag {
+		return
+	}
+	if oneWay {
+		atomic.AddInt64(&r.core.metrics.peersOneWay, 1)
+	} else {
+		atomic.AddInt64(&r.core.metrics.peersOneWay, -1)
+	}
+	if r.oneWayHandler != nil {
+		r.oneWayHandler(p.key.toEd(), uint64(p.port), oneWay)
+	}
+}
+
+// _isOneWay returns true if every link to the peer is one-way, in which case _fix won't pick it as our parent.
+func (r *router) _isOneWay(key publicKey) bool {
+	for p := range r.peers[key] {
+		if atomic.LoadInt32(&p.oneWay) == 0 {
+			return false
+		}
+	}
+	return true
+}
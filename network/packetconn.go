@@ -1,10 +1,14 @@
 package network
 
 import (
+	"context"
 	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Arceliar/phony"
@@ -19,19 +23,51 @@ func _type_asserts_() {
 type PacketConn struct {
 	actor        phony.Inbox
 	core         *core
-	recv         chan *traffic //read buffer
-	recvReady    uint64
+	recvWaiters  []chan *traffic // blocked reads, in the order they were started, only used from within the actor
 	recvq        packetQueue
+	recvClosed   bool // set by Close, after which nothing new is queued for reads, only used from within the actor
 	readDeadline *deadline
 	closeMutex   sync.Mutex
 	closed       chan struct{}
+	oobHandlers  map[byte]func(from ed25519.PublicKey, data []byte) // kind byte -> handler, only used from within the actor
+	bcastHandler func(from ed25519.PublicKey, data []byte)          // only used from within the actor
+	healthSeq    uint64
+	healthChecks map[uint64]chan time.Time // HealthCheck calls waiting for their packet, only used from within the actor
+	routeSeq     uint64
+	routeQueries map[uint64]routeWait // TraceRoute calls waiting for a reply, only used from within the actor
+	routeLimiter peerRateLimiter      // for route queries from other nodes, only used from within the actor
+	pingSeq      uint64
+	pings        map[uint64]pingWait // Ping calls waiting for a reply, only used from within the actor
+	codec        types.AddrCodecValue
 	Debug        Debug
+
+	// See WithCoalescing, only used from within the actor
+	coalescers map[publicKey]*coalescer
+	lastSweep  time.Time // when _sweepCoalescers last ran
+
+	// See WithFragmentation, only used from within the actor
+	fragmentSeq   uint64
+	fragments     map[fragmentKey]*reassembly
+	fragmentBytes uint64 // total size of the parts in fragments
+
+	unreachableHandler func(dest, from ed25519.PublicKey, reason error) // see SetUnreachableHandler, only used from within the actor
+
+	tooFarMutex sync.Mutex
+	tooFar      map[publicKey]time.Time // destinations whose last path was over the max path length, and when we got it, see WithMaxPathLength
 }
 
 // NewPacketConn returns a *PacketConn struct which implements the types.PacketConn interface.
 func NewPacketConn(secret ed25519.PrivateKey, options ...Option) (*PacketConn, error) {
+	signer := new(keySigner)
+	copy(signer.key[:], secret)
+	return NewPacketConnWithSigner(signer, options...)
+}
+
+// NewPacketConnWithSigner is like NewPacketConn, but all signing is done by the Signer, so the private key doesn't need to be in memory.
+// The signer is checked by signing a test message, and types.ErrBadSigner is returned if the signature doesn't verify.
+func NewPacketConnWithSigner(signer Signer, options ...Option) (*PacketConn, error) {
 	c := new(core)
-	if err := c.init(secret, options...); err != nil {
+	if err := c.init(signer, options...); err != nil {
 		return nil, err
 	}
 	return &c.pconn, nil
@@ -39,62 +75,221 @@ func NewPacketConn(secret ed25519.PrivateKey, options ...Option) (*PacketConn, e
 
 func (pc *PacketConn) init(c *core) {
 	pc.core = c
-	pc.recv = make(chan *traffic, 1)
+	pc.recvq.metrics = &c.metrics.recvq
 	pc.readDeadline = newDeadline()
 	pc.closed = make(chan struct{})
+	pc.oobHandlers = make(map[byte]func(ed25519.PublicKey, []byte))
+	pc.healthChecks = make(map[uint64]chan time.Time)
+	pc.routeQueries = make(map[uint64]routeWait)
+	pc.routeLimiter.rate = float64(c.config.routeQueryRate)
+	pc.coalescers = make(map[publicKey]*coalescer)
+	pc.fragments = make(map[fragmentKey]*reassembly)
+	pc.pings = make(map[uint64]pingWait)
+	pc.tooFar = make(map[publicKey]time.Time)
 	pc.Debug.init(c)
 }
 
-// ReadFrom fulfills the net.PacketConn interface, with a types.Addr returned as the from address.
-// Note that failing to call ReadFrom may cause the connection to block and/or leak memory.
+// ReadFrom fulfills the net.PacketConn interface, with a types.Addr returned as the from address (unless there's a codec, see SetAddrCodec).
+// Packets wait in a queue until they're read, the router never waits for ReadFrom, so a slow reader only loses its own packets (see WithRecvQueueSize).
+// After Close, packets that were already queued are still returned in order, then every call returns types.ErrClosed.
 func (pc *PacketConn) ReadFrom(p []byte) (n int, from net.Addr, err error) {
-	var tr *traffic
-	pc.doPop()
-	select {
-	case <-pc.closed:
-		return 0, nil, types.ErrClosed
-	case <-pc.readDeadline.getCancel():
-		return 0, nil, types.ErrTimeout
-	case tr = <-pc.recv:
+	return pc.ReadFromCtx(context.Background(), p)
+}
+
+// ReadFromCtx is like ReadFrom, but also returns ctx.Err() if the context is cancelled or its deadline expires before a packet arrives.
+// A packet that arrives at the same time as the cancellation is kept for the next read.
+func (pc *PacketConn) ReadFromCtx(ctx context.Context, p []byte) (n int, from net.Addr, err error) {
+	tr, err := pc.recvTraffic(ctx)
+	if err != nil {
+		return 0, nil, err
 	}
 	copy(p, tr.payload)
 	n = len(tr.payload)
 	if len(p) < len(tr.payload) {
 		n = len(p)
 	}
-	fromKey := tr.source // copy, since tr is going back in the pool
-	from = fromKey.addr()
+	from = pc.codec.Encode(tr.source.toEd()) // copy, since tr is going back in the pool
 	freeTraffic(tr)
 	return
 }
 
-// WriteTo fulfills the net.PacketConn interface, with a types.Addr expected as the destination address.
+// WriteTo fulfills the net.PacketConn interface, with a types.Addr (or an address the codec can decode, see SetAddrCodec) expected as the destination address.
 func (pc *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return pc.writeTraffic(trafficKindStandard, PacketOptions{}, p, addr)
+}
+
+// PacketOptions are carried with a packet to every node on the way, see PacketConn.WriteToOptions.
+// The zero value is what WriteTo uses.
+type PacketOptions struct {
+	Class  TrafficClass // Decides what to send first when a queue backs up
+	Flow   uint8        // Hashed along with the source and destination keys by WithECMP, so an application can spread its flows between the same two nodes over different links
+	Traced bool         // Reported by every node that handles it, see WriteToTraced
+}
+
+// WriteToClass is like WriteTo, but sends the packet with the given class, see PacketOptions.
+func (pc *PacketConn) WriteToClass(p []byte, addr net.Addr, class TrafficClass) (n int, err error) {
+	return pc.WriteToOptions(p, addr, PacketOptions{Class: class})
+}
+
+// WriteToOptions is like WriteTo, but sends the packet with the given options.
+// Packets with any options set are never coalesced (see WithCoalescing), but they're split up like any other if they need to be (see WithFragmentation).
+// Returns types.ErrBadClass if the class isn't one of the known ones.
+func (pc *PacketConn) WriteToOptions(p []byte, addr net.Addr, opts PacketOptions) (n int, err error) {
+	if opts.Class >= trafficClasses {
+		return 0, types.ErrBadClass
+	}
+	return pc.writeTraffic(trafficKindStandard, opts, p, addr)
+}
+
+// WriteToCtx is like WriteTo, but returns ctx.Err() instead of sending if the context is already done.
+// Writes are queued without waiting on the network, so there is nothing else to cancel.
+func (pc *PacketConn) WriteToCtx(ctx context.Context, p []byte, addr net.Addr) (n int, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	return pc.WriteTo(p, addr)
+}
+
+// SendOutOfBand sends a packet of the given kind to the destination key, which will be passed to the destination's out-of-band handler for that kind (instead of being returned by ReadFrom).
+// The kind must be at least OutOfBandKindMin, lower values are reserved by the library.
+// Note that out-of-band traffic bypasses any encryption or signing done by a wrapping PacketConn.
+func (pc *PacketConn) SendOutOfBand(kind uint8, toKey ed25519.PublicKey, data []byte) error {
+	if kind < OutOfBandKindMin {
+		return types.ErrBadKind
+	}
+	_, err := pc.writeTraffic(kind, PacketOptions{}, data, types.Addr(toKey))
+	return err
+}
+
+// SetOutOfBandHandler sets a function to handle out-of-band traffic of the given kind, or unsets it if the handler is nil.
+// The kind must be at least OutOfBandKindMin, lower values are reserved by the library.
+// The handler is called from the same actor that delivers traffic to ReadFrom, so it should not block.
+func (pc *PacketConn) SetOutOfBandHandler(kind uint8, handler func(fromKey ed25519.PublicKey, data []byte)) error {
+	if kind < OutOfBandKindMin {
+		return types.ErrBadKind
+	}
+	phony.Block(&pc.actor, func() {
+		if handler != nil {
+			pc.oobHandlers[kind] = handler
+		} else {
+			delete(pc.oobHandlers, kind)
+		}
+	})
+	return nil
+}
+
+// Broadcast floods a packet to every node reachable within ttl hops along the spanning tree, which each receive it via their broadcast handler.
+// Delivery is best-effort, and nodes rate limit how many broadcasts they forward from each origin, so this should be used sparingly.
+// The payload can be at most BroadcastMaxSize bytes.
+func (pc *PacketConn) Broadcast(payload []byte, ttl uint8) error {
+	select {
+	case <-pc.closed:
+		return types.ErrClosed
+	default:
+	}
+	if len(payload) > BroadcastMaxSize {
+		return types.ErrOversizedMessage
+	}
+	bs := append([]byte(nil), payload...)
+	pc.core.router.act(nil, func() {
+		pc.core.router.broadcasts._sendBroadcast(bs, ttl)
+	})
+	return nil
+}
+
+// SetBroadcastHandler sets a function to handle broadcasts sent by other nodes, or unsets it if the handler is nil.
+// The handler is called from the same actor that delivers traffic to ReadFrom, so it should not block.
+func (pc *PacketConn) SetBroadcastHandler(handler func(fromKey ed25519.PublicKey, data []byte)) {
+	phony.Block(&pc.actor, func() {
+		pc.bcastHandler = handler
+	})
+}
+
+// SetSelfRevivedHandler sets a function to call when a peer sends us an old info of our own that's newer than what we have, or unsets it if the handler is nil.
+// That means we apparently went offline (e.g. restarted) and came back, while the network still remembered us, so our info is being refreshed.
+func (pc *PacketConn) SetSelfRevivedHandler(handler func()) {
+	phony.Block(&pc.core.router, func() {
+		pc.core.router.revived = handler
+	})
+}
+
+func (pc *PacketConn) handleBroadcast(from phony.Actor, source publicKey, payload []byte) {
+	pc.actor.Act(from, func() {
+		if pc.bcastHandler != nil {
+			pc.bcastHandler(source.toEd(), append([]byte(nil), payload...))
+		}
+	})
+}
+
+func (pc *PacketConn) writeTraffic(kind byte, opts PacketOptions, p []byte, addr net.Addr) (n int, err error) {
 	select {
 	case <-pc.closed:
 		return 0, types.ErrClosed
 	default:
 	}
-	if _, ok := addr.(types.Addr); !ok {
-		return 0, types.ErrBadAddress
+	if opts.Traced {
+		// The original kind goes in front of the payload, see traffic.untrace
+		opts.Traced = false
+		n, err = pc.writeTraffic(trafficKindTrace, opts, append([]byte{kind}, p...), addr)
+		if n > 0 {
+			n--
+		}
+		return
 	}
-	dest := addr.(types.Addr)
-	if len(dest) != publicKeySize {
-		return 0, types.ErrBadAddress
+	dest, err := pc.codec.Decode(addr)
+	if err != nil {
+		return 0, err
 	}
 	if uint64(len(p)) > pc.MTU() {
 		return 0, types.ErrOversizedMessage
 	}
+	var key publicKey
+	copy(key[:], dest)
+	if pc.isTooFar(key) {
+		return 0, types.ErrPathTooLong
+	}
+	if uint64(len(p)) > pc.packetMTU() {
+		if kind != trafficKindStandard {
+			return 0, types.ErrOversizedMessage
+		}
+		data := append(allocBytes(0), p...)
+		pc.actor.Act(nil, func() {
+			pc._sendFragments(key, opts, data)
+		})
+		return len(p), nil
+	}
+	if kind == trafficKindStandard && opts == (PacketOptions{}) && pc.core.config.coalesceDelay > 0 {
+		data := append(allocBytes(0), p...)
+		pc.actor.Act(nil, func() {
+			pc._coalesce(key, data)
+		})
+		return len(p), nil
+	}
+	pc.sendTrafficOptions(key, kind, opts, p)
+	return len(p), nil
+}
+
+// sendTraffic copies the payload into a new packet from us to the destination, and passes it to the router.
+func (pc *PacketConn) sendTraffic(dest publicKey, kind byte, p []byte) {
+	pc.sendTrafficOptions(dest, kind, PacketOptions{}, p)
+}
+
+// sendTrafficOptions is sendTraffic with options, see PacketConn.WriteToOptions.
+func (pc *PacketConn) sendTrafficOptions(dest publicKey, kind byte, opts PacketOptions, p []byte) {
 	tr := allocTraffic()
 	tr.source = pc.core.crypto.publicKey
-	copy(tr.dest[:], dest)
+	tr.dest = dest
 	tr.watermark = ^uint64(0)
+	tr.kind = kind
+	tr.class = opts.Class
+	tr.flow = opts.Flow
 	tr.payload = append(tr.payload, p...)
 	pc.core.router.sendTraffic(tr)
-	return len(p), nil
 }
 
 // Close shuts down the PacketConn.
+// Traffic that's already queued is sent to peers (up to the timeout set by WithCloseDrainTimeout), followed by a goodbye message, before connections are closed.
+// If we're the root, a leaving announcement is sent first, so other nodes can pick a new root without waiting for our info to time out.
 func (pc *PacketConn) Close() error {
 	pc.closeMutex.Lock()
 	defer pc.closeMutex.Unlock()
@@ -104,20 +299,48 @@ func (pc *PacketConn) Close() error {
 	default:
 	}
 	close(pc.closed)
+	phony.Block(&pc.actor, pc._closeRecv)
+	phony.Block(&pc.actor, pc._flushAllCoalesced)
+	phony.Block(&pc.core.router, pc.core.router._sendLeaving)
+	var ps []*peer
 	phony.Block(&pc.core.peers, func() {
-		for _, ps := range pc.core.peers.peers {
-			for p := range ps {
-				p.conn.Close()
+		for _, kps := range pc.core.peers.peers {
+			for p := range kps {
+				ps = append(ps, p)
 			}
 		}
 	})
+	drained := make(chan struct{}, len(ps))
+	for _, p := range ps {
+		p.drain(func() { drained <- struct{}{} })
+	}
+	timer := time.NewTimer(pc.core.config.closeDrainTimeout)
+	defer timer.Stop()
+drain:
+	for range ps {
+		select {
+		case <-drained:
+		case <-timer.C:
+			break drain
+		}
+	}
+	for _, p := range ps {
+		p.conn.Close()
+	}
 	phony.Block(&pc.core.router, pc.core.router._shutdown)
 	return nil
 }
 
-// LocalAddr returns a types.Addr of the ed25519.PublicKey for this PacketConn.
+// LocalAddr returns a types.Addr of the ed25519.PublicKey for this PacketConn (unless there's a codec, see SetAddrCodec).
 func (pc *PacketConn) LocalAddr() net.Addr {
-	return pc.core.crypto.publicKey.addr()
+	return pc.codec.Encode(pc.core.crypto.publicKey.toEd())
+}
+
+// SetAddrCodec sets a codec to convert between keys and the application's own address type, or removes it if the codec is nil.
+// With a codec, ReadFrom and LocalAddr return the codec's addresses, and WriteTo accepts them as well as a types.Addr.
+// Wrapping PacketConns (e.g. signed or encrypted) use their own codec, so this should be called on the outermost PacketConn.
+func (pc *PacketConn) SetAddrCodec(codec types.AddrCodec) {
+	pc.codec.Store(codec)
 }
 
 // SetDeadline fulfills the net.PacketConn interface. Note that only read deadlines are affected.
@@ -144,9 +367,28 @@ func (pc *PacketConn) SetWriteDeadline(t time.Time) error {
 // HandleConn expects a peer's public key as its first argument, and a net.Conn with TCP-like semantics (reliable ordered delivery) as its second argument.
 // This function blocks while the net.Conn is in use, and returns an error if any occurs.
 // This function returns (almost) immediately if PacketConn.Close() is called.
-// In all cases, the net.Conn is closed before returning.
+// In all cases, the net.Conn is closed before returning, unless it was handed off to another PacketConn (see Handoff), in which case types.ErrHandedOff is returned.
+// It's safe to call from any number of goroutines at once, e.g. one per connection from each of several transports (see Serve).
 func (pc *PacketConn) HandleConn(key ed25519.PublicKey, conn net.Conn, prio uint8) error {
-	defer conn.Close()
+	return pc.HandleConnCtx(context.Background(), key, conn, prio)
+}
+
+// HandleConnCtx is like HandleConn, but the context bounds connection setup.
+// If the context is done before the peer proves that it has the key (by signing a challenge), the net.Conn is closed and ctx.Err() is returned.
+// The same happens with types.ErrPeerSetupTimeout if the peer doesn't prove its key within the setup timeout, see WithPeerSetupTimeout.
+// Once the connection is set up, the context has no further effect.
+func (pc *PacketConn) HandleConnCtx(ctx context.Context, key ed25519.PublicKey, conn net.Conn, prio uint8) error {
+	return pc.handleConn(ctx, key, conn, prio, nil)
+}
+
+// handleConn does the work for HandleConnCtx, and for ResumeConn if resume is non-nil.
+func (pc *PacketConn) handleConn(ctx context.Context, key ed25519.PublicKey, conn net.Conn, prio uint8, resume *PeerHandoff) error {
+	var handedOff bool
+	defer func() {
+		if !handedOff {
+			conn.Close()
+		}
+	}()
 	if len(key) != publicKeySize {
 		return types.ErrBadKey
 	}
@@ -159,17 +401,160 @@ func (pc *PacketConn) HandleConn(key ed25519.PublicKey, conn net.Conn, prio uint
 			pk.addr().String(),
 		)
 	}
-	p, err := pc.core.peers.addPeer(pk, conn, prio)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var port peerPort
+	if resume != nil {
+		port = peerPort(resume.Port)
+	}
+	p, err := pc.core.peers.addPeer(pk, conn, prio, port)
 	if err != nil {
 		return err
 	}
-	err = p.handler()
+	if resume != nil {
+		p.resume(resume)
+	}
+	ready := make(chan struct{})
+	var once sync.Once
+	setupErr := make(chan error, 1)
+	go func() {
+		var timeout <-chan time.Time
+		if pc.core.config.peerSetupTimeout > 0 {
+			timer := time.NewTimer(pc.core.config.peerSetupTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			setupErr <- ctx.Err()
+			conn.Close()
+		case <-timeout:
+			atomic.AddInt64(&pc.core.metrics.peersTimedOut, 1)
+			setupErr <- types.ErrPeerSetupTimeout
+			conn.Close()
+		case <-ready:
+			if !pc.core.config.allowPeer(pk) {
+				// The filter may have changed while the peer was proving its key
+				atomic.AddInt64(&pc.core.metrics.peersRejected, 1)
+				setupErr <- types.ErrPeerNotAllowed
+				conn.Close()
+				return
+			}
+			setupErr <- nil
+		}
+	}()
+	err = p.handler(func() {
+		once.Do(func() {
+			close(ready)
+			pc.core.peers.setupDone(p)
+		})
+	})
+	once.Do(func() { close(ready) })
+	handedOff = errors.Is(err, types.ErrHandedOff)
 	if e := pc.core.peers.removePeer(p); e != nil {
 		return e
 	}
+	if handedOff {
+		close(p.handedOff) // Handoff can collect the rest of the peer's state
+	}
+	if e := <-setupErr; e != nil {
+		return e
+	}
 	return err
 }
 
+// SetPeerPriority changes the priority of the connections to the peer that uses the given port (see Debug.GetPeers).
+// As with HandleConn, lower values are preferred when there are multiple connections to the same peer.
+func (pc *PacketConn) SetPeerPriority(port uint64, prio uint8) error {
+	return pc.core.peers.setPriority(peerPort(port), prio)
+}
+
+// EncryptedConn may be implemented by a net.Conn passed to HandleConn, to report how the link is encrypted in PeerInfo.
+// A *tls.Conn is recognized without needing to implement this.
+type EncryptedConn interface {
+	// Encryption returns a description of the cipher/version in use, or an empty string if the connection isn't encrypted (yet).
+	Encryption() string
+}
+
+// PeerInfo describes one connection to a peer.
+type PeerInfo struct {
+	Key        ed25519.PublicKey
+	Port       uint64
+	Priority   uint8
+	Uptime     time.Duration
+	Encrypted  bool   // True if the transport reports that the connection is encrypted
+	Encryption string // Cipher and/or version reported by the transport, if Encrypted
+	OneWay     bool   // True if the peer stopped answering us over this link, see SetOneWayPeerHandler
+
+	Quality PeerQuality // Measured with probes, if WithPeerProbes is used
+}
+
+// Peers returns a PeerInfo for each connection passed to HandleConn that is still in use.
+// Note that this only describes the link itself, traffic may also be encrypted end-to-end by a wrapping PacketConn.
+func (pc *PacketConn) Peers() (infos []PeerInfo) {
+	phony.Block(&pc.core.peers, func() {
+		for _, kps := range pc.core.peers.peers {
+			for p := range kps {
+				info := PeerInfo{
+					Key:      append(ed25519.PublicKey(nil), p.key[:]...),
+					Port:     uint64(p.port),
+					Priority: p.prio,
+					Uptime:   time.Since(p.since),
+					OneWay:   atomic.LoadInt32(&p.oneWay) != 0,
+					Quality:  p.getQuality(),
+				}
+				switch conn := p.conn.(type) {
+				case *tls.Conn:
+					if state := conn.ConnectionState(); state.HandshakeComplete {
+						info.Encryption = tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+					}
+				case EncryptedConn:
+					info.Encryption = conn.Encryption()
+				}
+				info.Encrypted = info.Encryption != ""
+				infos = append(infos, info)
+			}
+		}
+	})
+	return
+}
+
+// DestStats counts the packets and bytes sent to a destination, and how they were routed.
+type DestStats struct {
+	Key     ed25519.PublicKey
+	Packets uint64
+	Bytes   uint64
+	Path    uint64 // Packets sent along a known path to the destination
+	Lookup  uint64 // Packets sent without a known path, which wait for a path lookup (only the most recent is kept)
+}
+
+// DestStats returns send statistics for each destination we've sent traffic to.
+// Only the most recently used destinations are tracked, so destinations we haven't sent to in a while may be missing.
+func (pc *PacketConn) DestStats() (stats []DestStats) {
+	phony.Block(&pc.core.router, func() {
+		for key, s := range pc.core.router.pathfinder.stats {
+			stats = append(stats, DestStats{
+				Key:     key.toEd(),
+				Packets: s.packets,
+				Bytes:   s.bytes,
+				Path:    s.path,
+				Lookup:  s.lookup,
+			})
+		}
+	})
+	return
+}
+
+// RootDistance returns how many hops we are from the root of the spanning tree, which is 0 if we're the root.
+func (pc *PacketConn) RootDistance() int {
+	var dist int
+	phony.Block(&pc.core.router, func() {
+		dist = pc.core.router._getRootDistance(pc.core.crypto.publicKey)
+	})
+	return dist
+}
+
 // IsClosed returns true if and only if the connection is closed.
 // This is to check if the PacketConn is closed without potentially being stuck on a blocking operation (e.g. a read or write).
 func (pc *PacketConn) IsClosed() bool {
@@ -182,13 +567,50 @@ func (pc *PacketConn) IsClosed() bool {
 }
 
 // PrivateKey() returns the ed25519.PrivateKey used to initialize the PacketConn.
+// It returns nil if the PacketConn was created with NewPacketConnWithSigner, since we don't have the key.
 func (pc *PacketConn) PrivateKey() ed25519.PrivateKey {
+	if _, ok := pc.core.crypto.signer.(*keySigner); !ok {
+		return nil
+	}
 	sk := pc.core.crypto.privateKey
 	return ed25519.PrivateKey(sk[:])
 }
 
 // MTU returns the maximum transmission unit of the PacketConn, i.e. maximum safe message size to send over the network.
+// With WithFragmentation, that's the largest message that will be split into fragments, if it's bigger than what fits in one packet.
 func (pc *PacketConn) MTU() uint64 {
+	if size := pc.fragmentMTU(); size > pc.packetMTU() {
+		return size
+	}
+	return pc.packetMTU()
+}
+
+// setTooFar records whether the last path we got for the destination was over the max path length, see WithMaxPathLength.
+func (pc *PacketConn) setTooFar(key publicKey, tooFar bool) {
+	pc.tooFarMutex.Lock()
+	defer pc.tooFarMutex.Unlock()
+	if tooFar {
+		pc.tooFar[key] = time.Now()
+	} else {
+		delete(pc.tooFar, key)
+	}
+}
+
+// isTooFar returns true if the last path we got for the destination was over the max path length, and it hasn't timed out yet.
+// It's forgotten after the path timeout, like a path would be, so traffic can start a new lookup in case the destination moved closer.
+func (pc *PacketConn) isTooFar(key publicKey) bool {
+	pc.tooFarMutex.Lock()
+	defer pc.tooFarMutex.Unlock()
+	since, isIn := pc.tooFar[key]
+	if isIn && time.Since(since) > pc.core.config.pathTimeout {
+		delete(pc.tooFar, key)
+		return false
+	}
+	return isIn
+}
+
+// packetMTU returns the largest payload that fits in a single packet.
+func (pc *PacketConn) packetMTU() uint64 {
 	var tr traffic
 	tr.watermark = ^uint64(0)
 	overhead := uint64(tr.size()) + 1 // 1 byte type overhead
@@ -201,38 +623,139 @@ func (pc *PacketConn) handleTraffic(from phony.Actor, tr *traffic) {
 	// But concurrent reads can always do things out of order, so that probaby doesn't matter...
 	pc.actor.Act(from, func() {
 		if !tr.dest.equal(pc.core.crypto.publicKey) {
-			// Wrong key, do nothing
-		} else if pc.recvReady > 0 {
-			// Send immediately
-			select {
-			case pc.recv <- tr:
-				pc.recvReady -= 1
-			case <-pc.closed:
-			}
+			freeTraffic(tr) // Wrong key, do nothing
+		} else if tr.kind == trafficKindTrace && !tr.untrace() {
+			freeTraffic(tr) // Malformed, or traced more than once
+		} else if tr.kind == trafficKindHealthCheck {
+			pc._handleHealthCheck(tr)
+		} else if tr.kind == trafficKindRouteQuery {
+			pc._handleRouteQuery(tr)
+		} else if tr.kind == trafficKindRouteReply {
+			pc._handleRouteReply(tr)
+		} else if tr.kind == trafficKindCoalesced {
+			pc._handleCoalesced(tr)
+		} else if tr.kind == trafficKindCoalesceReq {
+			pc._handleCoalesceReq(tr)
+		} else if tr.kind == trafficKindCoalesceAck {
+			pc._handleCoalesceAck(tr)
+		} else if tr.kind == trafficKindPingRequest {
+			pc._handlePingRequest(tr)
+		} else if tr.kind == trafficKindPingReply {
+			pc._handlePingReply(tr)
+		} else if tr.kind == trafficKindUnreachable {
+			pc._handleUnreachable(tr)
+		} else if tr.kind == trafficKindFragment {
+			pc._handleFragment(tr)
+		} else if tr.kind != trafficKindStandard {
+			pc._handleOutOfBand(tr)
 		} else {
-			if info, ok := pc.recvq.peek(); ok && time.Since(info.time) > 25*time.Millisecond {
-				// The queue already has a significant delay
-				// Drop the oldest packet from the larget queue to make room
-				pc.recvq.drop()
-			}
-			pc.recvq.push(tr)
+			pc._deliver(tr)
 		}
 	})
 }
 
-func (pc *PacketConn) doPop() {
+// _deliver passes the packet to the oldest blocked read, or queues it if there isn't one.
+// Packets that arrive after Close are dropped.
+func (pc *PacketConn) _deliver(tr *traffic) {
+	if pc.recvClosed {
+		freeTraffic(tr)
+		return
+	}
+	pc._enqueue(tr)
+}
+
+// _enqueue is _deliver without the check for Close, for packets that were already delivered once.
+func (pc *PacketConn) _enqueue(tr *traffic) {
+	if len(pc.recvWaiters) > 0 {
+		ch := pc.recvWaiters[0]
+		pc.recvWaiters = pc.recvWaiters[1:]
+		ch <- tr // buffered, and only ever sent to once, so this never blocks
+		return
+	}
+	if info, ok := pc.recvq.peek(); ok && time.Since(info.time) > 25*time.Millisecond {
+		// The queue already has a significant delay
+		// Drop the oldest packet from the larget queue to make room
+		if info, ok := pc.recvq.drop(); ok {
+			atomic.AddInt64(&pc.core.metrics.dropRecvQueue, 1)
+			freeTraffic(info.packet.(*traffic))
+		}
+	}
+	pc.recvq.push(tr)
+	for max := pc.core.config.recvQueueSize; max > 0 && pc.recvq.size > max; {
+		// Over the size limit, so drop from the largest queue until it fits, see WithRecvQueueSize
+		info, ok := pc.recvq.drop()
+		if !ok {
+			break
+		}
+		atomic.AddInt64(&pc.core.metrics.dropRecvQueue, 1)
+		freeTraffic(info.packet.(*traffic))
+	}
+}
+
+func (pc *PacketConn) _handleOutOfBand(tr *traffic) {
+	if handler := pc.oobHandlers[tr.kind]; handler != nil {
+		handler(tr.source.toEd(), append([]byte(nil), tr.payload...))
+	}
+	freeTraffic(tr)
+}
+
+// _closeRecv stops queueing packets for reads, and wakes up any blocked reads with a nil packet, since the queue must be empty if there are any.
+func (pc *PacketConn) _closeRecv() {
+	pc.recvClosed = true
+	for _, ch := range pc.recvWaiters {
+		ch <- nil
+	}
+	pc.recvWaiters = nil
+}
+
+// recvTraffic waits for the next packet, or until the PacketConn is closed (and the queue is empty), the read deadline passes, or the context is done.
+// The closed check happens in the actor, in the same order as deliveries, so a read never sees the PacketConn as closed while earlier packets are still queued.
+func (pc *PacketConn) recvTraffic(ctx context.Context) (*traffic, error) {
+	ch := make(chan *traffic, 1)
 	pc.actor.Act(nil, func() {
 		if info, ok := pc.recvq.pop(); ok {
-			select {
-			case pc.recv <- info.packet.(*traffic):
-			case <-pc.closed:
-			default:
-				panic("this should never happen")
-			}
+			ch <- info.packet.(*traffic)
+		} else if pc.recvClosed {
+			ch <- nil
 		} else {
-			pc.recvReady += 1
+			pc.recvWaiters = append(pc.recvWaiters, ch)
+		}
+	})
+	var err error
+	select {
+	case tr := <-ch:
+		if tr == nil {
+			return nil, types.ErrClosed
+		}
+		return tr, nil
+	case <-pc.readDeadline.getCancel():
+		err = types.ErrTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// Give up our place in line, and pass on anything that was delivered to us in the mean time
+	pc.actor.Act(nil, func() {
+		for idx, w := range pc.recvWaiters {
+			if w == ch {
+				pc.recvWaiters = append(pc.recvWaiters[:idx], pc.recvWaiters[idx+1:]...)
+				return
+			}
+		}
+		select {
+		case tr := <-ch:
+			if tr == nil {
+				break
+			}
+			// It was delivered before Close (if we're closed now), and before anything that's queued, so it goes first
+			if len(pc.recvWaiters) > 0 {
+				pc._enqueue(tr)
+			} else {
+				pc.recvq.pushFront(tr)
+			}
+		default:
 		}
 	})
+	return nil, err
 }
 
 type deadline struct {
@@ -283,7 +806,7 @@ func (d *deadline) getCancel() chan struct{} {
 func (pc *PacketConn) SendLookup(key ed25519.PublicKey) {
 	var k publicKey
 	copy(k[:], key)
-	pc.core.router.Act(nil, func() {
+	pc.core.router.act(nil, func() {
 		pc.core.router.pathfinder._rumorSendLookup(k)
 	})
 }
@@ -0,0 +1,453 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+func testDeliver(pc *PacketConn, payload byte) {
+	tr := allocTraffic()
+	tr.source = pc.core.crypto.publicKey
+	tr.dest = pc.core.crypto.publicKey
+	tr.payload = append(tr.payload, payload)
+	pc.handleTraffic(nil, tr)
+}
+
+func TestReadFromCtx(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv)
+	defer pc.Close()
+	buf := make([]byte, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := pc.ReadFromCtx(ctx, buf); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := pc.ReadFromCtx(ctx, buf); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if _, err := pc.WriteToCtx(ctx, buf, pc.LocalAddr()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	testDeliver(pc, 1)
+	if n, _, err := pc.ReadFromCtx(context.Background(), buf); err != nil || n != 1 || buf[0] != 1 {
+		t.Fatalf("unexpected read: %d %v", n, err)
+	}
+}
+
+func TestReadFromCtxConcurrentCancel(t *testing.T) {
+	// Many readers are repeatedly cancelled while packets are delivered, none of the packets should be lost
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv)
+	defer pc.Close()
+	const count = 200
+	received := make(chan byte, count)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for idx := 0; idx < 32; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 16)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				timeout := time.Duration(rand.Intn(1000)) * time.Microsecond
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				n, _, err := pc.ReadFromCtx(ctx, buf)
+				cancel()
+				if err == nil && n == 1 {
+					received <- buf[0]
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(stop)
+	for idx := 0; idx < count; idx++ {
+		testDeliver(pc, byte(idx))
+		select {
+		case b := <-received:
+			if b != byte(idx) {
+				t.Fatalf("expected packet %d, got %d", byte(idx), b)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d was lost", idx)
+		}
+	}
+}
+
+func TestReadFromAfterClose(t *testing.T) {
+	// Packets queued before Close are still returned in order, then reads fail for good
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv)
+	for idx := 0; idx < 8; idx++ {
+		testDeliver(pc, byte(idx))
+	}
+	phony.Block(&pc.actor, func() {}) // Wait for the packets to be queued
+	pc.Close()
+	testDeliver(pc, 8)
+	buf := make([]byte, 16)
+	for idx := 0; idx < 8; idx++ {
+		if n, _, err := pc.ReadFrom(buf); err != nil || n != 1 || buf[0] != byte(idx) {
+			t.Fatalf("unexpected read %d: %d bytes, %v", idx, n, err)
+		}
+	}
+	for idx := 0; idx < 3; idx++ {
+		if n, _, err := pc.ReadFrom(buf); !errors.Is(err, types.ErrClosed) || !errors.Is(err, net.ErrClosed) || n != 0 {
+			t.Fatalf("expected types.ErrClosed, got %d bytes, %v", n, err)
+		}
+	}
+}
+
+func TestReadFromCloseStress(t *testing.T) {
+	// Readers and writers race with Close, every read must be a whole packet or an error, and an error must stick
+	for round := 0; round < 20; round++ {
+		_, priv, _ := ed25519.GenerateKey(nil)
+		pc, _ := NewPacketConn(priv)
+		stop := make(chan struct{})
+		var writers, readers sync.WaitGroup
+		for idx := 0; idx < 4; idx++ {
+			writers.Add(1)
+			go func(idx int) {
+				defer writers.Done()
+				for seq := uint64(0); seq < 1000; seq++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					tr := allocTraffic()
+					tr.source = pc.core.crypto.publicKey
+					tr.dest = pc.core.crypto.publicKey
+					tr.payload = append(tr.payload, byte(idx))
+					tr.payload = wireAppendUint(tr.payload, seq)
+					pc.handleTraffic(nil, tr)
+				}
+			}(idx)
+		}
+		errs := make(chan error, 16)
+		for idx := 0; idx < 16; idx++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				buf := make([]byte, 64)
+				last := make(map[byte]uint64)
+				for {
+					n, from, err := pc.ReadFrom(buf)
+					if err != nil {
+						for again := 0; again < 3; again++ {
+							if n, _, err := pc.ReadFrom(buf); err == nil {
+								errs <- fmt.Errorf("read %d bytes after an error", n)
+								return
+							}
+						}
+						errs <- nil
+						return
+					}
+					var seq uint64
+					data := buf[1:n]
+					if n < 2 || buf[0] >= 4 || !wireChopUint(&seq, &data) || len(data) != 0 {
+						errs <- fmt.Errorf("bad packet of %d bytes", n)
+						return
+					}
+					if !ed25519.PublicKey(from.(types.Addr)).Equal(ed25519.PublicKey(pc.LocalAddr().(types.Addr))) {
+						errs <- fmt.Errorf("packet from %s", from)
+						return
+					}
+					// Each writer's packets are delivered in order, so this reader sees them in order too
+					if prev, isIn := last[buf[0]]; isIn && seq <= prev {
+						errs <- fmt.Errorf("writer %d packet %d after %d", buf[0], seq, prev)
+						return
+					}
+					last[buf[0]] = seq
+				}
+			}()
+		}
+		time.Sleep(time.Duration(rand.Intn(5000)) * time.Microsecond)
+		pc.Close()
+		readers.Wait()
+		close(stop)
+		writers.Wait()
+		for idx := 0; idx < 16; idx++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestRecvQueueSize(t *testing.T) {
+	// Nobody reads, so the oldest packets are dropped once the queue is full
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv, WithRecvQueueSize(1000))
+	defer pc.Close()
+	for idx := 0; idx < 100; idx++ {
+		testDeliver(pc, byte(idx))
+	}
+	var queued int
+	phony.Block(&pc.actor, func() {
+		if pc.recvq.size > 1000 {
+			t.Fatalf("queue holds %d bytes", pc.recvq.size)
+		}
+		queued = pc.recvq.count()
+	})
+	m := pc.Metrics()
+	if drops := m["drops.recv_queue"]; drops == 0 || drops+int64(queued) != 100 {
+		t.Fatalf("expected 100 packets to be queued or dropped, got %d and %d", queued, drops)
+	}
+	buf := make([]byte, 16)
+	for idx := 100 - queued; idx < 100; idx++ {
+		if n, _, err := pc.ReadFrom(buf); err != nil || n != 1 || buf[0] != byte(idx) {
+			t.Fatalf("unexpected read %d: %d bytes, %v", idx, n, err)
+		}
+	}
+}
+
+func TestHandleConnCtx(t *testing.T) {
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubB, _, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA)
+	defer a.Close()
+	cA, cB := newDummyConn(pubA, pubB)
+	defer cB.Close()
+	// Nothing ever handles the other end, so setup never finishes
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.HandleConnCtx(ctx, pubB, cA, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv)
+	defer pc.Close()
+	for idx := 0; idx < 100; idx++ {
+		info, err := pc.HealthCheck(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Peers != 0 || info.Infos != 1 || info.NoParent || info.PeerlessInfos || info.MaintenanceOverdue {
+			t.Fatalf("unexpected health info: %+v", info)
+		}
+	}
+	// The health check packets shouldn't be returned by ReadFrom
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := pc.ReadFromCtx(ctx, make([]byte, 16)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	// Someone else's packets with a live id are ignored, and duplicates of ours can't block the actor
+	arrived := make(chan time.Time, 1)
+	phony.Block(&pc.actor, func() {
+		pc.healthChecks[1] = arrived
+		var other publicKey
+		other[0] = 1
+		for _, source := range []publicKey{other, other, pc.core.crypto.publicKey, pc.core.crypto.publicKey} {
+			tr := allocTraffic()
+			tr.source = source
+			tr.payload = binary.BigEndian.AppendUint64(tr.payload, 1)
+			pc._handleHealthCheck(tr)
+			if _, isIn := pc.healthChecks[1]; isIn != (source != pc.core.crypto.publicKey) {
+				t.Fatalf("unexpected health check state after a packet from %x", source[:4])
+			}
+		}
+	})
+	if len(arrived) != 1 {
+		t.Fatal("expected our own packet to arrive")
+	}
+	pc.Close()
+	if _, err := pc.HealthCheck(time.Second); err == nil {
+		t.Fatal("expected an error after Close")
+	}
+}
+
+func TestDestStats(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv)
+	defer pc.Close()
+	dest, _, _ := ed25519.GenerateKey(nil)
+	for idx := 0; idx < 3; idx++ {
+		if _, err := pc.WriteTo(make([]byte, 10), types.Addr(dest)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := pc.DestStats()
+	if len(stats) != 1 || !stats[0].Key.Equal(dest) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	// There's no path to dest, so everything waits for a lookup
+	if s := stats[0]; s.Packets != 3 || s.Bytes != 30 || s.Path != 0 || s.Lookup != 3 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	for idx := 0; idx < pathfinderMaxDestStats+10; idx++ {
+		key, _, _ := ed25519.GenerateKey(nil)
+		if _, err := pc.WriteTo([]byte{1}, types.Addr(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := pc.DestStats(); len(stats) != pathfinderMaxDestStats {
+		t.Fatalf("expected %d destinations, got %d", pathfinderMaxDestStats, len(stats))
+	}
+}
+
+func TestServe(t *testing.T) {
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubB, privB, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA)
+	b, _ := NewPacketConn(privB)
+	defer a.Close()
+	defer b.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- b.Serve(l, func(conn net.Conn) (ed25519.PublicKey, uint8, error) {
+			return pubA, 0, nil
+		})
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.HandleConn(pubB, conn, 0)
+	waitForRoot([]*PacketConn{a, b}, 30*time.Second)
+	if len(b.Peers()) != 1 {
+		t.Fatal("expected b to have 1 peer")
+	}
+	b.Close()
+	select {
+	case err := <-served:
+		if !errors.Is(err, types.ErrClosed) {
+			t.Fatalf("expected types.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve didn't return after Close")
+	}
+}
+
+// testHashAddr is an address made from (only) the first byte of a hash of the key, so collisions are easy to find.
+type testHashAddr byte
+
+func (a testHashAddr) Network() string { return "hash" }
+func (a testHashAddr) String() string  { return fmt.Sprintf("%02x", byte(a)) }
+
+func testHash(key ed25519.PublicKey) testHashAddr {
+	h := sha256.Sum256(key)
+	return testHashAddr(h[0])
+}
+
+// testHashCodec decodes addresses by checking which of the keys we know about have a matching hash.
+type testHashCodec struct {
+	pc *PacketConn
+}
+
+func (c testHashCodec) EncodeAddr(key ed25519.PublicKey) net.Addr {
+	return testHash(key)
+}
+
+func (c testHashCodec) DecodeAddr(addr net.Addr) (ed25519.PublicKey, error) {
+	a, ok := addr.(testHashAddr)
+	if !ok {
+		return nil, errors.New("not a testHashAddr")
+	}
+	var found ed25519.PublicKey
+	for _, info := range c.pc.Debug.GetTree() {
+		if testHash(info.Key) != a {
+			continue
+		} else if found != nil {
+			return nil, types.ErrAmbiguous
+		}
+		found = info.Key
+	}
+	if found == nil {
+		return nil, errors.New("unknown key")
+	}
+	return found, nil
+}
+
+func TestAddrCodec(t *testing.T) {
+	// Find 2 peer keys that collide, and a key for a that doesn't
+	seen := make(map[testHashAddr]ed25519.PrivateKey)
+	var privB, privC ed25519.PrivateKey
+	for privB == nil {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		if other, isIn := seen[testHash(pub)]; isIn {
+			privB, privC = other, priv
+		}
+		seen[testHash(pub)] = priv
+	}
+	var privA ed25519.PrivateKey
+	for privA == nil {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		if testHash(pub) != testHash(privB.Public().(ed25519.PublicKey)) {
+			privA = priv
+		}
+	}
+	var conns []*PacketConn
+	for _, priv := range []ed25519.PrivateKey{privA, privB, privC} {
+		pc, _ := NewPacketConn(priv)
+		defer pc.Close()
+		conns = append(conns, pc)
+	}
+	a := conns[0]
+	pubA := privA.Public().(ed25519.PublicKey)
+	for _, pc := range conns[1:] {
+		linkNodes(t, a, pc)
+	}
+	waitForRoot(conns, 30*time.Second)
+	a.SetAddrCodec(testHashCodec{a})
+	if addr := a.LocalAddr(); addr != testHash(pubA) {
+		t.Fatalf("unexpected local address: %v", addr)
+	}
+	testDeliver(a, 1)
+	buf := make([]byte, 16)
+	if _, from, err := a.ReadFrom(buf); err != nil || from != testHash(pubA) {
+		t.Fatalf("unexpected read: %v %v", from, err)
+	}
+	if _, err := a.WriteTo([]byte{1}, testHash(privB.Public().(ed25519.PublicKey))); !errors.Is(err, types.ErrAmbiguous) {
+		t.Fatalf("expected types.ErrAmbiguous, got %v", err)
+	}
+	unknown := testHash(pubA) + 1
+	if unknown == testHash(privB.Public().(ed25519.PublicKey)) {
+		unknown++
+	}
+	if _, err := a.WriteTo([]byte{1}, unknown); !errors.Is(err, types.ErrBadAddress) {
+		t.Fatalf("expected types.ErrBadAddress, got %v", err)
+	}
+	if _, err := a.WriteTo([]byte{1}, testHash(pubA)); err != nil {
+		t.Fatal(err)
+	}
+	// A raw key always works
+	if _, err := a.WriteTo([]byte{1}, types.Addr(privB.Public().(ed25519.PublicKey))); err != nil {
+		t.Fatal(err)
+	}
+	a.SetAddrCodec(types.IdentityCodec{})
+	if _, ok := a.LocalAddr().(types.Addr); !ok {
+		t.Fatal("expected a types.Addr with the identity codec")
+	}
+	if _, err := a.WriteTo([]byte{1}, testHash(pubA)); !errors.Is(err, types.ErrBadAddress) {
+		t.Fatalf("expected types.ErrBadAddress, got %v", err)
+	}
+}
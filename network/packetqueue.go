@@ -2,6 +2,7 @@ package network
 
 import (
 	"container/heap"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,16 +32,25 @@ type pqDest struct {
 }
 
 type packetQueue struct {
-	dests []pqDest
-	size  uint64
+	dests   []pqDest
+	size    uint64
+	metrics *queueMetrics // optional, kept up to date with the queue's contents
+}
+
+func (q *packetQueue) _updateMetrics(packets int64, bytes uint64) {
+	if q.metrics != nil {
+		atomic.AddInt64(&q.metrics.packets, packets)
+		atomic.AddInt64(&q.metrics.bytes, packets*int64(bytes))
+	}
 }
 
 // drop will remove a packet from the queue
 // the packet removed will be the oldest packet from the longest stream to the largest destination queue
-// returns true if a packet was removed, false otherwise
-func (q *packetQueue) drop() bool {
+// returns the removed packet and true, or false if the queue was empty
+// the caller is responsible for freeing the packet, if it's traffic
+func (q *packetQueue) drop() (info pqPacketInfo, ok bool) {
 	if q.size == 0 {
-		return false
+		return
 	}
 	var dIdx int
 	for idx := range q.dests {
@@ -56,7 +66,7 @@ func (q *packetQueue) drop() bool {
 		}
 	}
 	source := dest.sources[sIdx]
-	info := source.infos[0]
+	info = source.infos[0]
 	source.size -= info.size
 	if len(source.infos) > 0 {
 		source.infos = source.infos[1:]
@@ -75,22 +85,32 @@ func (q *packetQueue) drop() bool {
 		heap.Remove(q, dIdx)
 	}
 	q.size -= info.size
-	switch p := info.packet.(type) {
-	case *traffic:
-		freeTraffic(p)
-	default:
-		// Nothing to do
-	}
-	return true
+	q._updateMetrics(-1, info.size)
+	return info, true
 }
 
 // push adds a packet with the provided size to a queue for the provided source and destination keys
 // a new queue will be created if needed
 func (q *packetQueue) push(packet pqPacket) {
+	q.insert(packet, time.Now(), false)
+}
+
+// pushFront is like push, but the packet counts as older than anything already in the queue, so pop returns it next.
+// It's for putting back a packet that was taken out too early, see PacketConn.recvTraffic.
+func (q *packetQueue) pushFront(packet pqPacket) {
+	t := time.Now()
+	if info, ok := q.peek(); ok && !info.time.After(t) {
+		t = info.time.Add(-time.Nanosecond)
+	}
+	q.insert(packet, t, true)
+}
+
+// insert adds a packet with the given time, at the end of its source's queue, or at the start if front is set (in which case the time must be older than anything queued).
+func (q *packetQueue) insert(packet pqPacket, t time.Time, front bool) {
 	sKey := packet.sourceKey()
 	dKey := packet.destKey()
 	size := packet.size()
-	info := pqPacketInfo{packet: packet, size: uint64(size), time: time.Now()}
+	info := pqPacketInfo{packet: packet, size: uint64(size), time: t}
 	sIdx, dIdx := -1, -1
 	source, dest := pqSource{key: sKey}, pqDest{key: dKey}
 	for idx, d := range q.dests {
@@ -105,20 +125,34 @@ func (q *packetQueue) push(packet pqPacket) {
 			break
 		}
 	}
-	source.infos = append(source.infos, info)
+	if front {
+		source.infos = append([]pqPacketInfo{info}, source.infos...)
+	} else {
+		source.infos = append(source.infos, info)
+	}
 	source.size += info.size
 	if sIdx < 0 {
 		dest.sources = append(dest.sources, source)
+		sIdx = len(dest.sources) - 1
 	} else {
 		dest.sources[sIdx] = source
 	}
 	dest.size += info.size
+	if front {
+		// Older than everything, so it has to move up the heap, which appending never needs
+		heap.Fix(&dest, sIdx)
+	}
 	if dIdx < 0 {
 		q.dests = append(q.dests, dest)
+		dIdx = len(q.dests) - 1
 	} else {
 		q.dests[dIdx] = dest
 	}
+	if front {
+		heap.Fix(q, dIdx)
+	}
 	q.size += info.size
+	q._updateMetrics(1, info.size)
 }
 
 // pop removes and returns the oldest packet (from across all source/destination pairs)
@@ -130,6 +164,7 @@ func (q *packetQueue) pop() (info pqPacketInfo, ok bool) {
 		source.size -= info.size
 		dest.size -= info.size
 		q.size -= info.size
+		q._updateMetrics(-1, info.size)
 		if len(source.infos) > 1 {
 			source.infos = source.infos[1:]
 			dest.sources[0] = source
@@ -150,6 +185,17 @@ func (q *packetQueue) pop() (info pqPacketInfo, ok bool) {
 	return
 }
 
+// count returns the number of packets in the queue
+func (q *packetQueue) count() int {
+	var count int
+	for _, dest := range q.dests {
+		for _, source := range dest.sources {
+			count += len(source.infos)
+		}
+	}
+	return count
+}
+
 func (q *packetQueue) peek() (info pqPacketInfo, ok bool) {
 	if len(q.dests) > 0 {
 		return q.dests[0].sources[0].infos[0], true
@@ -214,3 +260,71 @@ func (d *pqDest) Pop() interface{} {
 	d.size -= source.size
 	return source
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// classQueue is a packetQueue for each TrafficClass, used for the packets waiting to be sent to a peer.
+// Packets are sent from the most urgent class first, and dropped from the least urgent class first, so real-time traffic jumps ahead of bulk.
+type classQueue struct {
+	classes [trafficClasses]packetQueue
+}
+
+// pqClass returns the queue a packet belongs in, which is best-effort for anything but traffic.
+// Unknown classes are treated as best-effort too, instead of dropping the packet.
+func pqClass(packet pqPacket) int {
+	if tr, ok := packet.(*traffic); ok && tr.class < trafficClasses {
+		return int(tr.class)
+	}
+	return int(TrafficClassBestEffort)
+}
+
+// classOrder lists the classes from the most urgent to the least.
+var classOrder = [trafficClasses]TrafficClass{TrafficClassRealTime, TrafficClassBestEffort, TrafficClassBulk}
+
+func (q *classQueue) setMetrics(metrics *queueMetrics) {
+	for idx := range q.classes {
+		q.classes[idx].metrics = metrics
+	}
+}
+
+func (q *classQueue) push(packet pqPacket) {
+	q.classes[pqClass(packet)].push(packet)
+}
+
+// pop removes and returns the oldest packet of the most urgent class that has any.
+func (q *classQueue) pop() (info pqPacketInfo, ok bool) {
+	for _, class := range classOrder {
+		if info, ok = q.classes[class].pop(); ok {
+			return
+		}
+	}
+	return
+}
+
+// drop removes a packet from the least urgent class that has any, see packetQueue.drop.
+func (q *classQueue) drop() (info pqPacketInfo, ok bool) {
+	for idx := len(classOrder) - 1; idx >= 0; idx-- {
+		if info, ok = q.classes[classOrder[idx]].drop(); ok {
+			return
+		}
+	}
+	return
+}
+
+// peek returns the oldest packet across every class, which is how long the queue has been backed up.
+func (q *classQueue) peek() (info pqPacketInfo, ok bool) {
+	for idx := range q.classes {
+		if i, isIn := q.classes[idx].peek(); isIn && (!ok || i.time.Before(info.time)) {
+			info, ok = i, true
+		}
+	}
+	return
+}
+
+func (q *classQueue) count() int {
+	var count int
+	for idx := range q.classes {
+		count += q.classes[idx].count()
+	}
+	return count
+}
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+func TestClassQueue(t *testing.T) {
+	var q classQueue
+	push := func(class TrafficClass, payload string) {
+		tr := allocTraffic()
+		tr.class = class
+		tr.payload = append(tr.payload, payload...)
+		q.push(tr)
+	}
+	// Oldest first, so the peer's queue looks backed up since the bulk packet
+	push(TrafficClassBulk, "bulk")
+	push(TrafficClassBestEffort, "best-effort")
+	push(TrafficClassRealTime, "real-time")
+	push(TrafficClass(0xff), "unknown")
+	if info, _ := q.peek(); string(info.packet.(*traffic).payload) != "bulk" {
+		t.Fatalf("expected to peek at the oldest packet, got %q", info.packet.(*traffic).payload)
+	}
+	if info, _ := q.drop(); string(info.packet.(*traffic).payload) != "bulk" {
+		t.Fatalf("expected to drop the bulk packet first, got %q", info.packet.(*traffic).payload)
+	}
+	for _, expected := range []string{"real-time", "best-effort", "unknown"} {
+		info, ok := q.pop()
+		if !ok {
+			t.Fatalf("expected %q, but the queue is empty", expected)
+		}
+		if payload := string(info.packet.(*traffic).payload); payload != expected {
+			t.Fatalf("expected %q, got %q", expected, payload)
+		}
+	}
+	if q.count() != 0 {
+		t.Fatalf("expected an empty queue, got %d packets", q.count())
+	}
+}
+
+func TestPacketQueuePushFront(t *testing.T) {
+	// A packet that's put back comes out first, whichever source and destination it's for
+	var q packetQueue
+	push := func(source, dest byte, payload string, front bool) {
+		tr := allocTraffic()
+		tr.source[0], tr.dest[0] = source, dest
+		tr.payload = append(tr.payload, payload...)
+		if front {
+			q.pushFront(tr)
+		} else {
+			q.push(tr)
+		}
+	}
+	push(1, 1, "a", false)
+	push(2, 1, "b", false)
+	push(1, 2, "c", false)
+	push(2, 2, "x", true)
+	push(1, 1, "y", true)
+	for _, expected := range []string{"y", "x", "a", "b", "c"} {
+		info, ok := q.pop()
+		if !ok {
+			t.Fatalf("expected %q, but the queue is empty", expected)
+		}
+		if payload := string(info.packet.(*traffic).payload); payload != expected {
+			t.Fatalf("expected %q, got %q", expected, payload)
+		}
+	}
+	if q.size != 0 || q.count() != 0 {
+		t.Fatalf("expected an empty queue, got %d packets, size %d", q.count(), q.size)
+	}
+}
+
+func TestWriteToClass(t *testing.T) {
+	a, b := newPair(t)
+	if _, err := a.WriteToClass([]byte("test"), b.LocalAddr(), trafficClasses); !errors.Is(err, types.ErrBadClass) {
+		t.Fatalf("expected types.ErrBadClass, got %v", err)
+	}
+	if !sendUntilReceived(t, writeClass(a, TrafficClassRealTime), b, []byte("test")) {
+		t.Fatal("timeout")
+	}
+}
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"math/rand"
 	"time"
 
 	"github.com/Arceliar/ironwood/types"
@@ -8,20 +9,29 @@ import (
 
 const pathfinderTrafficCache = true
 
+const pathfinderMaxBackoff = 30 * time.Second // Longest we'll wait between lookups for a destination that isn't answering, see pathRumor
+
+const pathfinderMaxDestStats = 1024 // Max number of destinations to keep send statistics for, the least recently used are dropped
+
 // WARNING The pathfinder should only be used from within the router's actor, it's not threadsafe
 type pathfinder struct {
 	router *router
 	info   pathNotifyInfo
 	paths  map[publicKey]pathInfo
 	rumors map[publicKey]pathRumor
+	stats  map[publicKey]pathDestStats
 	logger func(*pathLookup)
+	// waiting has channels to close once we get a path to the key, see PacketConn.routePath
+	waiting map[publicKey][]chan struct{}
 }
 
 func (pf *pathfinder) init(r *router) {
 	pf.router = r
-	pf.info.sign(pf.router.core.crypto.privateKey)
+	_ = pf.info.sign(&pf.router.core.crypto) // The signer was checked in crypto.initSigner
 	pf.paths = make(map[publicKey]pathInfo)
 	pf.rumors = make(map[publicKey]pathRumor)
+	pf.stats = make(map[publicKey]pathDestStats)
+	pf.waiting = make(map[publicKey][]chan struct{})
 }
 
 func (pf *pathfinder) _sendLookup(dest publicKey) {
@@ -42,7 +52,7 @@ func (pf *pathfinder) _sendLookup(dest publicKey) {
 }
 
 func (pf *pathfinder) handleLookup(p *peer, lookup *pathLookup) {
-	pf.router.Act(p, func() {
+	pf.router.act(p, func() {
 		if !pf.router.blooms._isOnTree(p.key) {
 			return
 		}
@@ -75,7 +85,9 @@ func (pf *pathfinder) _handleLookup(fromKey publicKey, lookup *pathLookup) {
 		}
 		if !pf.info.equal(notify.info) {
 			//notify.info.seq++
-			notify.info.sign(pf.router.core.crypto.privateKey)
+			if err := notify.info.sign(&pf.router.core.crypto); err != nil {
+				return // The lookup will be sent again
+			}
 			pf.info = notify.info
 		} else {
 			notify.info = pf.info
@@ -85,7 +97,7 @@ func (pf *pathfinder) _handleLookup(fromKey publicKey, lookup *pathLookup) {
 }
 
 func (pf *pathfinder) handleNotify(p *peer, notify *pathNotify) {
-	pf.router.Act(p, func() {
+	pf.router.act(p, func() {
 		pf._handleNotify(p.key, notify)
 	})
 }
@@ -99,6 +111,14 @@ func (pf *pathfinder) _handleNotify(fromKey publicKey, notify *pathNotify) {
 	if notify.dest != pf.router.core.crypto.publicKey {
 		return
 	}
+	if len(notify.info.path) > pf.router.core.config.maxPathLength {
+		// Nobody should have a path this long, unless they don't agree about the limit
+		if notify.check() {
+			pf.router.core.pconn.setTooFar(notify.source, true)
+			pf.router.core.config.pathTooLong(notify.source.toEd())
+		}
+		return
+	}
 	var info pathInfo
 	var isIn bool
 	// Note that we need to res.check() in every case (as soon as success is otherwise inevitable)
@@ -125,10 +145,11 @@ func (pf *pathfinder) _handleNotify(fromKey publicKey, notify *pathNotify) {
 		if !notify.check() {
 			return
 		}
+		pf._resetBackoff(notify.source)
 		key := notify.source
 		var timer *time.Timer
 		timer = time.AfterFunc(pf.router.core.config.pathTimeout, func() {
-			pf.router.Act(nil, func() {
+			pf.router.act(nil, func() {
 				if info := pf.paths[key]; info.timer == timer {
 					timer.Stop()
 					delete(pf.paths, key)
@@ -158,22 +179,29 @@ func (pf *pathfinder) _handleNotify(fromKey publicKey, notify *pathNotify) {
 		defer pf._handleTraffic(tr)
 	}
 	pf.paths[notify.source] = info
+	pf.router.core.pconn.setTooFar(notify.source, false)
+	for _, ch := range pf.waiting[notify.source] {
+		close(ch)
+	}
+	delete(pf.waiting, notify.source)
 	pf.router.core.config.pathNotify(notify.source.toEd())
 }
 
 func (pf *pathfinder) _rumorSendLookup(dest publicKey) {
 	xform := pf.router.blooms.xKey(dest)
 	if rumor, isIn := pf.rumors[xform]; isIn {
-		if time.Since(rumor.sendTime) < pf.router.core.config.pathThrottle {
+		if time.Since(rumor.sendTime) < rumor.backoff {
 			return
 		}
 		rumor.sendTime = time.Now()
+		rumor.attempts++
+		rumor.backoff = pf._backoff(rumor.attempts)
 		rumor.timer.Reset(pf.router.core.config.pathTimeout)
 		pf.rumors[xform] = rumor
 	} else {
 		var timer *time.Timer
 		timer = time.AfterFunc(pf.router.core.config.pathTimeout, func() {
-			pf.router.Act(nil, func() {
+			pf.router.act(nil, func() {
 				if rumor := pf.rumors[xform]; rumor.timer == timer {
 					delete(pf.rumors, xform)
 					timer.Stop()
@@ -185,12 +213,39 @@ func (pf *pathfinder) _rumorSendLookup(dest publicKey) {
 		})
 		pf.rumors[xform] = pathRumor{
 			sendTime: time.Now(),
+			attempts: 1,
+			backoff:  pf._backoff(1),
 			timer:    timer,
 		}
 	}
 	pf._sendLookup(dest)
 }
 
+// _backoff returns how long to wait after the given number of unanswered lookups before sending another.
+// This doubles (starting from pathThrottle, up to pathfinderMaxBackoff) with each attempt, and is randomized so nodes that lost the same destination don't retry in sync.
+func (pf *pathfinder) _backoff(attempts uint) time.Duration {
+	delay := pf.router.core.config.pathThrottle
+	for idx := uint(1); idx < attempts && delay < pathfinderMaxBackoff; idx++ {
+		delay *= 2
+	}
+	if delay > pathfinderMaxBackoff {
+		delay = pathfinderMaxBackoff
+	}
+	// Wait somewhere between half and all of the delay
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// _resetBackoff is called when we hear from a destination, so the next lookup for it (if any) isn't delayed.
+func (pf *pathfinder) _resetBackoff(key publicKey) {
+	xform := pf.router.blooms.xKey(key)
+	if rumor, isIn := pf.rumors[xform]; isIn {
+		rumor.attempts = 0
+		rumor.backoff = 0
+		pf.rumors[xform] = rumor
+	}
+}
+
 func (pf *pathfinder) _handleTraffic(tr *traffic) {
 	const cache = pathfinderTrafficCache // TODO make this unconditional, this is just to easily toggle the cache on/off for now
 	if info, isIn := pf.paths[tr.dest]; isIn {
@@ -203,10 +258,14 @@ func (pf *pathfinder) _handleTraffic(tr *traffic) {
 			}
 			info.traffic = allocTraffic()
 			info.traffic.copyFrom(tr)
-			pf.paths[tr.dest] = info
 		}
+		info.tx.add(len(tr.payload), time.Now())
+		pf.paths[tr.dest] = info
+		pf._recordSend(tr, true)
 		pf.router.handleTraffic(nil, tr)
 	} else {
+		pf._recordSend(tr, false)
+		pf.router._trace(tr, TraceLookup, nil)
 		pf._rumorSendLookup(tr.dest)
 		if cache {
 			xform := pf.router.blooms.xKey(tr.dest)
@@ -223,6 +282,30 @@ func (pf *pathfinder) _handleTraffic(tr *traffic) {
 	}
 }
 
+func (pf *pathfinder) _recordSend(tr *traffic, hasPath bool) {
+	stats, isIn := pf.stats[tr.dest]
+	if !isIn && len(pf.stats) >= pathfinderMaxDestStats {
+		// Make room by dropping the least recently used destination
+		var oldest publicKey
+		var oldestTime time.Time
+		for key, s := range pf.stats {
+			if oldestTime.IsZero() || s.updated.Before(oldestTime) {
+				oldest, oldestTime = key, s.updated
+			}
+		}
+		delete(pf.stats, oldest)
+	}
+	stats.packets++
+	stats.bytes += uint64(len(tr.payload))
+	if hasPath {
+		stats.path++
+	} else {
+		stats.lookup++
+	}
+	stats.updated = time.Now()
+	pf.stats[tr.dest] = stats
+}
+
 func (pf *pathfinder) _doBroken(tr *traffic) {
 	broken := pathBroken{
 		path:      append([]peerPort(nil), tr.from...),
@@ -251,7 +334,7 @@ func (pf *pathfinder) _handleBroken(broken *pathBroken) {
 }
 
 func (pf *pathfinder) handleBroken(p *peer, broken *pathBroken) {
-	pf.router.Act(p, func() {
+	pf.router.act(p, func() {
 		pf._handleBroken(broken)
 	})
 }
@@ -265,6 +348,23 @@ func (pf *pathfinder) _resetTimeout(key publicKey) {
 	}
 }
 
+func (pf *pathfinder) _recordRecv(key publicKey, size int) {
+	// Note: Like _resetTimeout, this should only be called for traffic we actually received from this destination
+	if info, isIn := pf.paths[key]; isIn {
+		info.rx.add(size, time.Now())
+		pf.paths[key] = info
+	}
+}
+
+// pathDestStats counts the traffic we've sent to a destination, see PacketConn.DestStats
+type pathDestStats struct {
+	packets uint64
+	bytes   uint64
+	path    uint64 // Packets sent along a known path
+	lookup  uint64 // Packets without a known path, which are held (replacing any older one) while we look for a path
+	updated time.Time
+}
+
 /************
  * pathInfo *
  ************/
@@ -275,7 +375,57 @@ type pathInfo struct {
 	reqTime time.Time   // Time a request was last sent (to prevent spamming)
 	timer   *time.Timer // time.AfterFunc(cleanup...), reset whenever we receive traffic from this node
 	traffic *traffic
-	broken  bool // Set to true if we receive a pathBroken, which prevents the timer from being reset (we must get a new notify to clear)
+	broken  bool     // Set to true if we receive a pathBroken, which prevents the timer from being reset (we must get a new notify to clear)
+	rx      pathRate // Estimated rate of traffic received from this destination
+	tx      pathRate // Estimated rate of traffic sent to this destination
+}
+
+/************
+ * pathRate *
+ ************/
+
+const (
+	pathRateWindow = time.Second // How long to collect bytes before taking a sample
+	pathRateAlpha  = 0.25        // Weight given to each new sample in the moving average
+)
+
+// pathRate is a passive bandwidth estimate, an exponentially weighted moving average of bytes per second.
+// It only looks at traffic we were already sending or receiving, so it doesn't cost any extra protocol traffic.
+type pathRate struct {
+	rate  float64   // bytes per second, as of the end of the last window
+	bytes uint64    // bytes seen in the current window
+	start time.Time // start of the current window
+}
+
+func (pr *pathRate) sample(now time.Time) (float64, bool) {
+	elapsed := now.Sub(pr.start)
+	if pr.start.IsZero() || elapsed < pathRateWindow {
+		return pr.rate, false
+	}
+	sample := float64(pr.bytes) / elapsed.Seconds()
+	if pr.rate == 0 {
+		// First sample, don't bother averaging it with nothing
+		return sample, true
+	}
+	return pathRateAlpha*sample + (1-pathRateAlpha)*pr.rate, true
+}
+
+func (pr *pathRate) add(size int, now time.Time) {
+	if pr.start.IsZero() {
+		pr.start = now
+	} else if rate, ok := pr.sample(now); ok {
+		pr.rate = rate
+		pr.bytes = 0
+		pr.start = now
+	}
+	pr.bytes += uint64(size)
+}
+
+// get returns the current estimate, including the current window if it's already long enough.
+// It doesn't modify the pathRate, so it's safe to use for debugging/reporting.
+func (pr *pathRate) get(now time.Time) float64 {
+	rate, _ := pr.sample(now)
+	return rate
 }
 
 /*************
@@ -284,8 +434,10 @@ type pathInfo struct {
 
 type pathRumor struct {
 	traffic  *traffic
-	sendTime time.Time   // Time we last sent a rumor (to prevnt spamming)
-	timer    *time.Timer // time.AfterFunc(cleanup...)
+	sendTime time.Time     // Time we last sent a rumor (to prevnt spamming)
+	attempts uint          // Lookups sent since we last heard from the destination
+	backoff  time.Duration // How long to wait after sendTime before sending another lookup, see _backoff
+	timer    *time.Timer   // time.AfterFunc(cleanup...)
 }
 
 /**************
@@ -321,13 +473,13 @@ func (lookup *pathLookup) decode(data []byte) error {
 	var tmp pathLookup
 	orig := data
 	if !wireChopSlice(tmp.source[:], &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if !wireChopSlice(tmp.dest[:], &orig) {
-		return types.ErrDecode
-	} else if !wireChopPath(&tmp.from, &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
+	} else if err := wireChopPath(&tmp.from, &orig); err != nil {
+		return err
 	} else if len(orig) != 0 {
-		return types.ErrDecode
+		return types.ErrDecodeTrailingBytes
 	}
 	*lookup = tmp
 	return nil
@@ -379,8 +531,9 @@ func (info *pathNotifyInfo) bytesForSig() []byte {
 	return out
 }
 
-func (info *pathNotifyInfo) sign(key privateKey) {
-	info.sig = key.sign(info.bytesForSig())
+func (info *pathNotifyInfo) sign(c *crypto) (err error) {
+	info.sig, err = c.sign(info.bytesForSig())
+	return
 }
 
 func (info *pathNotifyInfo) size() int {
@@ -406,13 +559,13 @@ func (info *pathNotifyInfo) decode(data []byte) error {
 	var tmp pathNotifyInfo
 	orig := data
 	if !wireChopUint(&tmp.seq, &orig) {
-		return types.ErrDecode
-	} else if !wireChopPath(&tmp.path, &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
+	} else if err := wireChopPath(&tmp.path, &orig); err != nil {
+		return err
 	} else if !wireChopSlice(tmp.sig[:], &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if len(orig) != 0 {
-		return types.ErrDecode
+		return types.ErrDecodeTrailingBytes
 	}
 	*info = tmp
 	return nil
@@ -463,14 +616,14 @@ func (notify *pathNotify) encode(out []byte) ([]byte, error) {
 func (notify *pathNotify) decode(data []byte) error {
 	var tmp pathNotify
 	orig := data
-	if !wireChopPath(&tmp.path, &orig) {
-		return types.ErrDecode
+	if err := wireChopPath(&tmp.path, &orig); err != nil {
+		return err
 	} else if !wireChopUint(&tmp.watermark, &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if !wireChopSlice(tmp.source[:], &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if !wireChopSlice(tmp.dest[:], &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if err := tmp.info.decode(orig); err != nil {
 		return err
 	}
@@ -525,16 +678,16 @@ func (broken *pathBroken) encode(out []byte) ([]byte, error) {
 func (broken *pathBroken) decode(data []byte) error {
 	var tmp pathBroken
 	orig := data
-	if !wireChopPath(&tmp.path, &orig) {
-		return types.ErrDecode
+	if err := wireChopPath(&tmp.path, &orig); err != nil {
+		return err
 	} else if !wireChopUint(&tmp.watermark, &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if !wireChopSlice(tmp.source[:], &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if !wireChopSlice(tmp.dest[:], &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if len(orig) != 0 {
-		return types.ErrDecode
+		return types.ErrDecodeTrailingBytes
 	}
 	*broken = tmp
 	return nil
@@ -0,0 +1,132 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+func TestPathRate(t *testing.T) {
+	// Simulate a link limited to 100 kB/s, sending 1 kB packets
+	const limit = 100 * 1024
+	const size = 1024
+	const interval = time.Second * size / limit
+	var pr pathRate
+	now := time.Now()
+	for idx := 0; idx < 2000; idx++ {
+		pr.add(size, now)
+		now = now.Add(interval)
+	}
+	rate := pr.get(now)
+	if rate < 0.8*limit || rate > 1.2*limit {
+		t.Fatalf("rate estimate %f not within 20%% of %d", rate, limit)
+	}
+	// The estimate should follow the link if it slows down
+	for idx := 0; idx < 1000; idx++ {
+		pr.add(size, now)
+		now = now.Add(2 * interval)
+	}
+	rate = pr.get(now)
+	if rate < 0.8*limit/2 || rate > 1.2*limit/2 {
+		t.Fatalf("rate estimate %f not within 20%% of %d", rate, limit/2)
+	}
+}
+
+func TestLookupBackoff(t *testing.T) {
+	const base = 20 * time.Millisecond
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv, WithPathThrottle(base))
+	defer pc.Close()
+	destPub, destPriv, _ := ed25519.GenerateKey(nil)
+	var dest publicKey
+	copy(dest[:], destPub)
+	r := &pc.core.router
+	lookups := make(chan time.Time, 16)
+	phony.Block(r, func() {
+		r.pathfinder.logger = func(lookup *pathLookup) {
+			if lookup.dest == dest {
+				lookups <- time.Now()
+			}
+		}
+	})
+	// Keep writing, the writes shouldn't trigger any more lookups than the backoff allows
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			pc.WriteTo([]byte{1}, types.Addr(destPub))
+		}
+	}()
+	var times []time.Time
+	for len(times) < 4 {
+		select {
+		case now := <-lookups:
+			times = append(times, now)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for lookups")
+		}
+	}
+	// The destination answers the 4th lookup
+	phony.Block(r, func() {
+		var sk crypto
+		sk.init(destPriv)
+		notify := pathNotify{
+			watermark: ^uint64(0),
+			source:    dest,
+			dest:      r.core.crypto.publicKey,
+			info:      pathNotifyInfo{seq: 1, path: []peerPort{1}},
+		}
+		notify.info.sign(&sk)
+		r.pathfinder._handleNotify(dest, &notify)
+		if _, isIn := r.pathfinder.paths[dest]; !isIn {
+			t.Error("notify was not accepted")
+		}
+		if rumor := r.pathfinder.rumors[r.blooms.xKey(dest)]; rumor.attempts != 0 {
+			t.Errorf("expected backoff to be reset, got %d attempts", rumor.attempts)
+		}
+	})
+	// Gap n should be at least half of base*2^n, and shorter than base*2^n (plus some slack)
+	for idx := 1; idx < len(times); idx++ {
+		gap := times[idx].Sub(times[idx-1])
+		limit := base << uint(idx-1)
+		if gap < limit/2 || gap > limit+base {
+			t.Errorf("gap %d was %s, expected between %s and %s", idx, gap, limit/2, limit)
+		}
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	a, b := newPair(t)
+	pubA, pubB := nodeKey(a), nodeKey(b)
+	if info := a.Debug.Diagnose(pubA); len(info.Problems) != 0 {
+		t.Fatalf("unexpected problems reaching ourself: %v", info.Problems)
+	}
+	info := a.Debug.Diagnose(pubB)
+	for start := time.Now(); len(info.LookupVia) == 0 && time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		// Blooms are sent during maintenance
+		info = a.Debug.Diagnose(pubB)
+	}
+	if !info.KnownInfo || !info.SameRoot || info.HavePath || len(info.Problems) != 1 {
+		t.Fatalf("unexpected diagnosis before a lookup: %+v", info)
+	}
+	if len(info.LookupVia) != 1 || !info.LookupVia[0].Equal(pubB) {
+		t.Fatalf("expected a lookup to go to b, got %v", info.LookupVia)
+	}
+	// The first packets are dropped while a looks up a path to b
+	if !sendUntilReceived(t, a.WriteTo, b, []byte("test")) {
+		t.Fatal("timeout")
+	}
+	info = a.Debug.Diagnose(pubB)
+	if !info.HavePath || info.Broken || !info.NextHop.Equal(pubB) || len(info.Problems) != 0 {
+		t.Fatalf("unexpected diagnosis after a lookup: %+v", info)
+	}
+}
@@ -2,11 +2,13 @@ package network
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"io"
 
 	//"math"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/Arceliar/phony"
@@ -18,12 +20,19 @@ import (
 
 type peerPort uint64
 
+// peerQueueMaxDelay is how long the oldest packet can wait in a peer's queue before we start dropping packets to make room.
+const peerQueueMaxDelay = 25 * time.Millisecond
+
 type peers struct {
 	phony.Inbox // Used to create/remove peers
 	core        *core
 	ports       map[peerPort]struct{}
 	peers       map[publicKey]map[*peer]struct{}
 	order       uint64 // global counter for (*peer).order
+	conns       int    // number of peer connections, for config.peerMaxConns
+	pending     int    // number of peers that haven't finished setup, for config.peerMaxPending
+
+	middleware atomic.Value // wireMiddlewareBox, see PacketConn.SetWireMiddleware
 }
 
 func (ps *peers) init(c *core) {
@@ -32,7 +41,9 @@ func (ps *peers) init(c *core) {
 	ps.peers = make(map[publicKey]map[*peer]struct{})
 }
 
-func (ps *peers) addPeer(key publicKey, conn net.Conn, prio uint8) (*peer, error) {
+// addPeer creates a peer for a new conn, using the same port as any other conns to that key.
+// Otherwise it uses the given port if it's free (see ResumeConn), or allocates one if that's 0.
+func (ps *peers) addPeer(key publicKey, conn net.Conn, prio uint8, port peerPort) (*peer, error) {
 	var p *peer
 	var err error
 	ps.core.pconn.closeMutex.Lock()
@@ -42,21 +53,34 @@ func (ps *peers) addPeer(key publicKey, conn net.Conn, prio uint8) (*peer, error
 		return nil, types.ErrClosed
 	default:
 	}
+	if !ps.core.config.allowPeer(key) {
+		atomic.AddInt64(&ps.core.metrics.peersRejected, 1)
+		return nil, types.ErrPeerNotAllowed
+	}
 	phony.Block(ps, func() {
-		var port peerPort
+		cfg := &ps.core.config
+		switch {
+		case cfg.peerMaxConns > 0 && ps.conns >= cfg.peerMaxConns:
+			err = types.ErrTooManyPeers
+		case cfg.peerMaxConnsPerKey > 0 && len(ps.peers[key]) >= cfg.peerMaxConnsPerKey:
+			err = types.ErrTooManyPeerConns
+		case cfg.peerMaxPending > 0 && ps.pending >= cfg.peerMaxPending:
+			err = types.ErrTooManyPendingPeers
+		}
+		if err != nil {
+			atomic.AddInt64(&ps.core.metrics.peersRejected, 1)
+			return
+		}
 		if keyPeers, isIn := ps.peers[key]; isIn {
 			for p := range keyPeers {
 				port = p.port
 				break
 			}
 		} else {
-			// Allocate port
-			for idx := 1; ; idx++ { // skip 0
-				if _, isIn := ps.ports[peerPort(idx)]; isIn {
-					continue
+			if _, isIn := ps.ports[port]; isIn || port == 0 || uint64(port) >= ps.core.config.maxPort {
+				if port, err = ps._allocPort(key); err != nil {
+					return
 				}
-				port = peerPort(idx)
-				break
 			}
 			ps.ports[port] = struct{}{}
 			ps.peers[key] = make(map[*peer]struct{})
@@ -68,17 +92,62 @@ func (ps *peers) addPeer(key publicKey, conn net.Conn, prio uint8) (*peer, error
 		p.key = key
 		p.port = port
 		p.prio = prio
+		p.rprio = prio
+		p.cost = ps.core.config.getLinkCost(key, conn)
+		p.since = time.Now()
 		p.monitor.peer = p
 		p.monitor.pDelay = ps.core.config.peerTimeout // It doesn't make sense to start the ping delay any shorter than this
 		p.writer.peer = p
 		p.writer.wbuf = bufio.NewWriter(p.conn)
+		p.writer.frames = make(chan peerFrame, peerWriterFrames)
+		p.writer.urgent = make(chan peerFrame, 2) // room for a probe's reply next to our own keepalive
+		p.writer.stopped = make(chan struct{})
+		p.writer.handoff = make(chan struct{})
 		p.order = ps.order
 		ps.order++
+		ps.core.metrics.addPeer(p)
 		ps.peers[p.key][p] = struct{}{}
+		ps.conns++
+		ps._setPending(ps.pending + 1)
 	})
 	return p, err
 }
 
+// _allocPort returns an unused port for a new peer key.
+// With WithKeyedPorts, that's derived from the key if it's free, otherwise it's the lowest free port.
+func (ps *peers) _allocPort(key publicKey) (peerPort, error) {
+	max := ps.core.config.maxPort
+	if space := ps.core.config.keyedPorts; space > 0 {
+		port := peerPort(1 + binary.BigEndian.Uint64(key[:8])%space)
+		if _, isIn := ps.ports[port]; !isIn && uint64(port) < max {
+			return port, nil
+		}
+	}
+	for idx := uint64(1); idx < max; idx++ { // skip 0
+		if _, isIn := ps.ports[peerPort(idx)]; !isIn {
+			return peerPort(idx), nil
+		}
+	}
+	// Nobody would accept an info with a higher port
+	return 0, types.ErrBadPort
+}
+
+func (ps *peers) _setPending(pending int) {
+	ps.pending = pending
+	atomic.StoreInt64(&ps.core.metrics.peersPending, int64(pending))
+	ps.core.router.act(ps, ps.core.router._checkReady) // WaitReady waits for pending peers
+}
+
+// setupDone is called once the peer has proven its key, so it no longer counts towards config.peerMaxPending.
+func (ps *peers) setupDone(p *peer) {
+	ps.Act(nil, func() {
+		if _, isIn := ps.peers[p.key][p]; isIn && !p.setup {
+			p.setup = true
+			ps._setPending(ps.pending - 1)
+		}
+	})
+}
+
 func (ps *peers) removePeer(p *peer) error {
 	var err error
 	phony.Block(ps, func() {
@@ -87,6 +156,11 @@ func (ps *peers) removePeer(p *peer) error {
 			err = types.ErrPeerNotFound
 		} else {
 			delete(kps, p)
+			ps.core.metrics.removePeer(p)
+			ps.conns--
+			if !p.setup {
+				ps._setPending(ps.pending - 1)
+			}
 			if len(kps) == 0 {
 				delete(ps.peers, p.key)
 				delete(ps.ports, p.port)
@@ -96,21 +170,75 @@ func (ps *peers) removePeer(p *peer) error {
 	return err
 }
 
+func (ps *peers) setPriority(port peerPort, prio uint8) error {
+	var links []*peer
+	phony.Block(ps, func() {
+		for _, kps := range ps.peers {
+			for p := range kps {
+				if p.port != port {
+					break // Every link to a given key uses the same port
+				}
+				for p := range kps {
+					p.prio = prio
+					links = append(links, p)
+				}
+				return
+			}
+		}
+	})
+	if len(links) == 0 {
+		return types.ErrPeerNotFound
+	}
+	// The router has its own copy for next hop selection, so neither actor waits on the other
+	phony.Block(&ps.core.router, func() {
+		for _, p := range links {
+			p.rprio = prio
+		}
+		ps.core.router._resetCache()
+	})
+	return nil
+}
+
 type peer struct {
-	phony.Inbox // Only used to process or send some protocol traffic
-	peers       *peers
-	conn        net.Conn
-	done        chan struct{}
-	key         publicKey
-	port        peerPort
-	prio        uint8
-	queue       packetQueue
-	order       uint64 // order in which peers were connected (relative uptime)
-	monitor     peerMonitor
-	writer      peerWriter
-	ready       bool      // is the writer ready for traffic?
-	srst        time.Time // sigReq send time
-	srrt        time.Time // sigRes receive time
+	phony.Inbox   // Only used to process or send some protocol traffic
+	peers         *peers
+	conn          net.Conn
+	done          chan struct{}
+	key           publicKey
+	port          peerPort
+	prio          uint8 // only used by the peers actor, see rprio
+	queue         classQueue
+	order         uint64    // order in which peers were connected (relative uptime)
+	since         time.Time // time the peer was added
+	monitor       peerMonitor
+	writer        peerWriter
+	ready         bool           // is the writer ready for traffic?
+	srst          time.Time      // sigReq send time
+	srrt          time.Time      // sigRes receive time
+	drained       func()         // if non-nil, send a goodbye and call this once the queue is empty
+	closing       bool           // true if we've sent a goodbye, so we shouldn't send anything else
+	setup         bool           // true once the peer has proven its key, only used by the peers actor
+	challenge     routerSigReq   // the request the peer has to answer to prove its key, only used by the router
+	rprio         uint8          // the router's copy of prio, only used by the router
+	proven        bool           // true once the peer answered the challenge, only used by the router
+	unprovenBloom *bloom         // the last bloom the peer sent before proven, only used by the router
+	proved        func()         // called by the router once the peer answers the challenge
+	probed        time.Time      // when the router last resent the challenge, only used by the router
+	acked         time.Time      // when the challenge was last answered, only used by the router
+	oneWay        int32          // 1 if the last challenge went unanswered, set atomically by the router
+	saturated     int32          // 1 if the queue has started dropping packets, set atomically by the peer's actor
+	features      uint64         // features both sides support, set from their hello before the peer is added to the router
+	cost          uint64         // cost of the link, see WithLinkCosts
+	inflate       *frameInflater // set by the handler when the peer sends its first compressed frame, see WithFrameCompression
+
+	recvMAC *frameMAC    // checks frames from the peer, only used by the handler, see WithFrameMAC
+	quality atomic.Value // PeerQuality, set by the monitor and read by anyone, see WithPeerProbes
+
+	handingOff  int32         // 1 once PacketConn.Handoff has detached the peer, set atomically
+	unhandled   []byte        // read from the conn but not handled, by the handler when it's handed off, or passed to ResumeConn
+	resumed     bool          // true if the conn was taken over from another PacketConn, see ResumeConn
+	resumeBloom *bloom        // the peer's bloom from before it was handed off, see ResumeConn
+	handedOff   chan struct{} // closed by HandleConn once the peer is detached and removed, see PacketConn.Handoff
 }
 
 type peerMonitor struct {
@@ -119,6 +247,8 @@ type peerMonitor struct {
 	keepAliveTimer *time.Timer
 	pDelay         time.Duration
 	deadlined      bool
+	probes         peerProbes
+	detached       bool // see peer.detach, the read deadline is no longer ours to change
 }
 
 func (m *peerMonitor) keepAlive() {
@@ -128,21 +258,19 @@ func (m *peerMonitor) keepAlive() {
 			return
 		default:
 		}
-		m.peer.writer.Act(m, func() {
-			m.peer.writer._write([]byte{0x01, byte(wireKeepAlive)}, wireKeepAlive)
-		})
+		m.peer.writer.sendKeepAlive()
 	})
 }
 
 func (m *peerMonitor) sent(pType wirePacketType) {
-	m.Act(&m.peer.writer, func() {
+	m.Act(nil, func() {
 		if m.keepAliveTimer != nil {
 			// We're sending a packet, so we definitely don't need to send a keepalive after this
 			m.keepAliveTimer.Stop()
 			m.keepAliveTimer = nil
 		}
 		switch {
-		case m.deadlined:
+		case m.deadlined || m.detached:
 			return
 		case pType == wireDummy:
 		case pType == wireKeepAlive:
@@ -158,6 +286,9 @@ func (m *peerMonitor) sent(pType wirePacketType) {
 
 func (m *peerMonitor) recv(pType wirePacketType) {
 	m.Act(nil, func() {
+		if m.detached {
+			return
+		}
 		m.peer.conn.SetReadDeadline(time.Time{})
 		m.deadlined = false
 		switch {
@@ -177,34 +308,81 @@ func (m *peerMonitor) recv(pType wirePacketType) {
 	})
 }
 
+// peerWriterFrames is how many encoded frames can wait for the peer's writer goroutine before the writer actor blocks.
+const peerWriterFrames = 8
+
+// peerWriter encodes packets in its actor, and hands them to run, which does all writes to the conn in its own goroutine.
+// A slow write only holds up the goroutine, and keepalives are written before any other frames that are waiting.
 type peerWriter struct {
 	phony.Inbox
-	peer *peer
-	wbuf *bufio.Writer
-	seq  uint64
+	peer    *peer
+	wbuf    *bufio.Writer // only used by run
+	frames  chan peerFrame
+	urgent  chan peerFrame // keepalives and probes, which skip the frames queue
+	stopped chan struct{}  // closed when run returns
+	deflate *frameDeflater // only used by the actor, for peers with featureCompression, see WithFrameCompression
+	mac     *frameMAC      // only used by run, see WithFrameMAC
+	handoff chan struct{}  // closed by peer.detach, so run stops at a frame boundary
 }
 
-func (w *peerWriter) _write(bs []byte, pType wirePacketType) {
-	w.peer.monitor.sent(pType)
-	// _, _ = w.peer.conn.Write(bs)
-	_, _ = w.wbuf.Write(bs)
-	w.seq++
-	seq := w.seq
-	w.Act(nil, func() {
-		if seq == w.seq {
-			w.peer.pop() // Ask for more traffic to send
+type peerFrame struct {
+	bs    []byte // from allocBytes, or nil to flush the buffer
+	pType wirePacketType
+	done  func() // if non-nil, called once the frame has been flushed to the conn
+}
+
+// _write queues bs (which must come from allocBytes, and is freed once written), blocking if the queue is full.
+func (w *peerWriter) _write(bs []byte, pType wirePacketType, done func()) {
+	select {
+	case w.frames <- peerFrame{bs, pType, done}:
+	case <-w.peer.done:
+		// Nothing will read it, but whatever is waiting on it shouldn't wait forever
+		if bs != nil {
+			freeBytes(bs)
 		}
-	})
+		if done != nil {
+			done()
+		}
+	}
+}
+
+// _flush queues a flush of anything written so far.
+func (w *peerWriter) _flush() {
+	w._write(nil, wireDummy, nil)
+}
+
+// sendKeepAlive queues a keepalive ahead of any other frames, unless there are already enough waiting.
+// It doesn't go through the actor, so it can be called from anywhere.
+func (w *peerWriter) sendKeepAlive() {
+	w.sendUrgent(append(allocBytes(0), 0x01, byte(wireKeepAlive)))
+}
+
+// sendProbe is like sendKeepAlive, for a keepalive that carries a probe's id, see WithPeerProbes.
+// It returns false if there wasn't room for it.
+func (w *peerWriter) sendProbe(id uint8) bool {
+	return w.sendUrgent(append(allocBytes(0), 0x02, byte(wireKeepAlive), id))
+}
+
+func (w *peerWriter) sendUrgent(bs []byte) bool {
+	select {
+	case w.urgent <- peerFrame{bs: bs, pType: wireKeepAlive}:
+		return true
+	default:
+		freeBytes(bs)
+		return false
+	}
 }
 
 func (w *peerWriter) sendPacket(pType wirePacketType, data wireEncodeable, done func()) {
 	w.Act(nil, func() {
+		if tr, ok := data.(*traffic); ok && w.peer.features&featureTrafficHeader == 0 {
+			data = oldTraffic{tr}
+		}
 		bufSize := uint64(data.size() + 1)
 		if bufSize > w.peer.peers.core.config.peerMaxMessageSize {
 			return
 		}
 		writeBuf := allocBytes(0)
-		defer freeBytes(writeBuf)
 		// The +1 is from 1 byte for the pType
 		writeBuf = binary.AppendUvarint(writeBuf[:], bufSize)
 		var err error
@@ -212,39 +390,164 @@ func (w *peerWriter) sendPacket(pType wirePacketType, data wireEncodeable, done
 		if err != nil {
 			panic(err)
 		}
-		w._write(writeBuf, pType)
+		if w.deflate != nil && w.peer.features&featureCompression != 0 && frameCompressible(pType) {
+			writeBuf = w.deflate.deflate(writeBuf)
+		}
 		switch tr := data.(type) {
 		case *traffic:
 			freeTraffic(tr)
+		case oldTraffic:
+			freeTraffic(tr.traffic)
 		default:
 			// Not a special case, don't free anything
 		}
+		var sent func()
 		if done != nil {
-			w.peer.Act(w, done)
+			sent = func() { w.peer.Act(nil, done) }
+		}
+		if mw := w.peer.peers.getMiddleware(); mw != nil {
+			var ok bool
+			if writeBuf, ok = w.peer.wireSend(mw, pType, writeBuf); !ok {
+				if sent != nil {
+					sent() // Whatever is waiting on it shouldn't wait forever
+				}
+				return
+			}
 		}
+		w._write(writeBuf, pType, sent)
 	})
 }
 
-func (p *peer) handler() error {
+// run writes queued frames to the conn until the peer's done channel is closed.
+// The buffer is flushed whenever nothing else is waiting, and the peer is asked for more traffic to send.
+func (w *peerWriter) run() {
+	defer close(w.stopped)
+	for {
+		var frame peerFrame
+		select {
+		case <-w.handoff:
+			// Whatever comes next is written by the PacketConn that takes over the conn
+			_ = w.wbuf.Flush()
+			return
+		case frame = <-w.urgent:
+		default:
+			select {
+			case frame = <-w.urgent:
+			case frame = <-w.frames:
+			case <-w.handoff:
+				_ = w.wbuf.Flush()
+				return
+			case <-w.peer.done:
+				return
+			}
+		}
+		if frame.bs == nil {
+			_ = w.wbuf.Flush()
+			if frame.done != nil {
+				frame.done()
+			}
+			continue
+		}
+		w.peer.monitor.sent(frame.pType)
+		_, _ = w.wbuf.Write(frame.bs)
+		if w.mac != nil {
+			size, n := binary.Uvarint(frame.bs)
+			_, _ = w.wbuf.Write(w.mac.tag(size, frame.bs[n:]))
+		}
+		freeBytes(frame.bs)
+		if frame.done != nil {
+			_ = w.wbuf.Flush()
+			frame.done()
+		}
+		if len(w.urgent) == 0 && len(w.frames) == 0 {
+			w.peer.pop() // Ask for more traffic to send
+		}
+	}
+}
+
+// handler reads and handles packets until an error occurs.
+// The peer isn't added to the router until it sends something, so a connection that never does costs no protocol traffic (other than one keepalive).
+// Once added, the router sends a signature request that only this link has seen, and calls ready (from the router's actor) when the peer signs it with its key.
+// A signed response is checked before it reaches the router, so a connection that can't prove the key it claims is closed with types.ErrDecodeBadSignature.
+func (p *peer) handler(ready func()) error {
+	p.proved = ready
+	var added bool
 	defer func() {
-		p.peers.core.router.removePeer(nil, p)
+		if added {
+			p.peers.core.router.removePeer(nil, p)
+		}
 	}()
 	defer p.monitor.Act(nil, func() {
 		if p.monitor.keepAliveTimer != nil {
 			p.monitor.keepAliveTimer.Stop()
 			p.monitor.keepAliveTimer = nil
 		}
+		p.monitor._stopProbes()
 	})
-	defer close(p.done)
+	var handedOff bool
+	defer func() {
+		close(p.done)
+		if handedOff {
+			// The writer stops at a frame boundary by itself, and the conn isn't ours to close
+			<-p.writer.stopped
+			return
+		}
+		// The writer may be stuck in a write, so close the conn before waiting for it to stop
+		p.conn.Close()
+		<-p.writer.stopped
+	}()
 	p.conn.SetDeadline(time.Time{})
-	// Add peer to the router, to kick off protocol exchanges
-	p.peers.core.router.addPeer(p, p)
-	// Now allocate buffers and start reading / handling packets...
+	ours := p.peers.core.config.features
+	// A resumed conn never used a MAC, see peer.canHandoff
+	if useMAC := p.peers.core.config.frameMAC; useMAC == nil || p.resumed || !useMAC(p.key.toEd(), p.conn) {
+		ours &^= featureFrameMAC
+	}
 	rbuf := bufio.NewReader(p.conn)
+	withMAC := ours&featureFrameMAC != 0
+	if withMAC {
+		if err := p.negotiateMAC(ours, rbuf); err != nil {
+			close(p.writer.stopped) // It never started
+			return err
+		}
+	}
+	if useCompression := p.peers.core.config.frameCompression; useCompression != nil && useCompression(p.key.toEd(), p.conn) {
+		p.writer.deflate = newFrameDeflater()
+	}
+	go p.writer.run()
+	if !withMAC {
+		// Let the other side know we're here (and what we support), in case it's also waiting for us to send something first
+		p.writer.sendHello(ours)
+	}
+	if p.peers.core.config.peerProbeInterval > 0 {
+		p.monitor.probe()
+	}
+	if withMAC {
+		// We already read their hello, see negotiateMAC
+		p.peers.core.router.addPeer(p, p)
+		added = true
+	}
+	// Now start reading / handling packets...
+	if p.resumed {
+		// Finish whatever the old PacketConn started reading, and don't wait for the peer to send something new before telling the router
+		rbuf = bufio.NewReader(io.MultiReader(bytes.NewReader(p.unhandled), p.conn))
+		p.unhandled = nil
+		p.peers.core.router.addPeer(p, p)
+		added = true
+		if p.resumeBloom != nil {
+			p.peers.core.router.blooms.handleBloom(p, p.resumeBloom)
+		}
+	}
+	// The start of the current frame, in case we're handed off in the middle of it
+	head := peerFrameHead{r: rbuf}
+	limiter := peerRateLimiter{rate: float64(p.peers.core.config.peerInboundRate)}
 	for {
 		var usize uint64
 		var err error
-		if usize, err = binary.ReadUvarint(rbuf); err != nil {
+		head.bs = head.bs[:0]
+		if usize, err = binary.ReadUvarint(&head); err != nil {
+			if handedOff = p._detached(err, rbuf, head.bs, nil); handedOff {
+				return types.ErrHandedOff
+			}
 			return err
 		}
 		if usize > p.peers.core.config.peerMaxMessageSize {
@@ -252,10 +555,59 @@ func (p *peer) handler() error {
 		}
 		size := int(usize)
 		bs := allocBytes(size)
-		if _, err = io.ReadFull(rbuf, bs); err != nil {
+		if n, err := io.ReadFull(rbuf, bs); err != nil {
+			handedOff = p._detached(err, rbuf, head.bs, bs[:n])
 			freeBytes(bs)
+			if handedOff {
+				return types.ErrHandedOff
+			}
 			return err
 		}
+		if p.recvMAC != nil {
+			var tag [frameMACSize]byte
+			if _, err = io.ReadFull(rbuf, tag[:]); err != nil {
+				freeBytes(bs)
+				return err
+			}
+			if !p.recvMAC.check(usize, bs, tag[:]) {
+				freeBytes(bs)
+				atomic.AddInt64(&p.peers.core.metrics.peersBadMAC, 1)
+				return types.ErrBadMAC
+			}
+		}
+		if err = limiter.wait(size, p.peers.core.pconn.closed); err != nil {
+			freeBytes(bs)
+			return err
+		}
+		if size > 0 && bs[0]&frameCompressed != 0 {
+			if p.features&featureCompression == 0 {
+				// We never said we could decompress frames, so they shouldn't have sent one, see WithFrameCompression
+				freeBytes(bs)
+				return types.ErrDecode
+			}
+			if p.inflate == nil {
+				p.inflate = newFrameInflater(p.peers.core.config.peerMaxMessageSize)
+			}
+			inflated, err := p.inflate.inflate(bs)
+			freeBytes(bs)
+			if err != nil {
+				return err
+			}
+			bs = inflated
+		}
+		if !added {
+			// Their first frame is a hello, unless they're from before features were added
+			p.features = ours & peerHelloFeatures(bs)
+			// Add peer to the router, to kick off protocol exchanges
+			p.peers.core.router.addPeer(p, p)
+			added = true
+		}
+		if mw := p.peers.getMiddleware(); mw != nil && size > 0 {
+			var ok bool
+			if bs, ok = p.wireRecv(mw, bs); !ok {
+				continue
+			}
+		}
 		phony.Block(p, func() {
 			err = p._handlePacket(bs)
 		})
@@ -266,6 +618,66 @@ func (p *peer) handler() error {
 	}
 }
 
+// peerRateLimiter is a token bucket for the bytes read from a peer, only used by that peer's handler.
+// The PacketConn also uses one to limit how many route queries it answers.
+type peerRateLimiter struct {
+	rate   float64 // bytes per second, or 0 if unlimited
+	tokens float64
+	last   time.Time
+}
+
+func (l *peerRateLimiter) refill(now time.Time) {
+	if l.last.IsZero() {
+		l.tokens = l.rate
+	} else if l.tokens += now.Sub(l.last).Seconds() * l.rate; l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+}
+
+// delay takes size bytes worth of tokens, and returns how long to wait before the tokens would have been available.
+// Messages larger than the bucket go into debt, which later messages have to wait for.
+func (l *peerRateLimiter) delay(now time.Time, size int) time.Duration {
+	l.refill(now)
+	l.tokens -= float64(size)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// allow takes size bytes worth of tokens and returns true, or returns false (without taking any) if there aren't enough.
+func (l *peerRateLimiter) allow(now time.Time, size int) bool {
+	if l.rate == 0 {
+		return true
+	}
+	l.refill(now)
+	if l.tokens < float64(size) {
+		return false
+	}
+	l.tokens -= float64(size)
+	return true
+}
+
+// wait blocks until size bytes are within the rate limit, or returns types.ErrClosed if closed is closed first.
+func (l *peerRateLimiter) wait(size int, closed <-chan struct{}) error {
+	if l.rate == 0 {
+		return nil
+	}
+	d := l.delay(time.Now(), size)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-closed:
+		return types.ErrClosed
+	}
+}
+
 func (p *peer) _handlePacket(bs []byte) error {
 	// Note: this function should be non-blocking.
 	// Individual handlers should send actor messages as needed.
@@ -278,6 +690,9 @@ func (p *peer) _handlePacket(bs []byte) error {
 	case wireDummy:
 		return nil
 	case wireKeepAlive:
+		if len(bs) == 2 {
+			p._handleProbe(bs[1])
+		}
 		return nil
 	case wireProtoSigReq:
 		return p._handleSigReq(bs[1:])
@@ -295,6 +710,11 @@ func (p *peer) _handlePacket(bs []byte) error {
 		return p._handlePathBroken(bs[1:])
 	case wireTraffic:
 		return p._handleTraffic(bs[1:])
+	case wireProtoBroadcast:
+		return p._handleBroadcast(bs[1:])
+	case wireProtoGoodbye:
+		p.peers.core.router.handleGoodbye(p, p)
+		return io.EOF // They shouldn't send anything else
 	default:
 		return types.ErrUnrecognizedMessage
 	}
@@ -327,7 +747,7 @@ func (p *peer) _handleSigRes(bs []byte) error {
 		return err
 	}
 	if !res.check(p.peers.core.crypto.publicKey, p.key) {
-		return types.ErrBadMessage
+		return types.ErrDecodeBadSignature
 	}
 	p.srrt = time.Now()
 	p.peers.core.router.handleResponse(p, p, res)
@@ -344,13 +764,17 @@ func (p *peer) _handleAnnounce(bs []byte) error {
 		return err
 	}
 	if !ann.check() {
-		return types.ErrBadMessage
+		return types.ErrDecodeBadSignature
 	}
 	p.peers.core.router.handleAnnounce(p, p, ann)
 	return nil
 }
 
 func (p *peer) sendAnnounce(from phony.Actor, ann *routerAnnounce) {
+	atomic.AddInt64(&p.peers.core.metrics.annSent, 1)
+	if p.features&featureAnnounceExt == 0 {
+		ann = ann.withoutExt()
+	}
 	p.sendDirect(from, wireProtoAnnounce, ann, nil)
 }
 
@@ -406,13 +830,30 @@ func (p *peer) sendPathBroken(from phony.Actor, broken *pathBroken) {
 
 func (p *peer) _handleTraffic(bs []byte) error {
 	tr := allocTraffic()
-	if err := tr.decode(bs); err != nil {
+	decode := tr.decode
+	if p.features&featureTrafficHeader == 0 {
+		decode = tr.decodeOld
+	}
+	if err := decode(bs); err != nil {
+		freeTraffic(tr)
 		return err // This is just to check that it unmarshals correctly
 	}
 	p.peers.core.router.handleTraffic(p, tr)
 	return nil
 }
 
+func (p *peer) _handleBroadcast(bs []byte) error {
+	b := new(broadcast)
+	if err := b.decode(bs); err != nil {
+		return err
+	}
+	if !b.check() {
+		return types.ErrDecodeBadSignature
+	}
+	p.peers.core.router.broadcasts.handleBroadcast(p, b)
+	return nil
+}
+
 func (p *peer) sendTraffic(from phony.Actor, tr *traffic) {
 	p.sendQueued(from, tr)
 }
@@ -424,30 +865,100 @@ func (p *peer) sendQueued(from phony.Actor, packet pqPacket) {
 }
 
 func (p *peer) _push(packet pqPacket) {
+	if p.closing {
+		// We already sent a goodbye, the remote side won't read this
+		atomic.AddInt64(&p.peers.core.metrics.dropPeerClosing, 1)
+		if tr, ok := packet.(*traffic); ok {
+			freeTraffic(tr)
+		}
+		return
+	}
+	if tr, ok := packet.(*traffic); ok && p.features&featureTrafficHeader == 0 && tr.kind != trafficKindStandard {
+		// The peer can't decode anything but standard traffic, see oldTraffic
+		atomic.AddInt64(&p.peers.core.metrics.dropOldPeer, 1)
+		freeTraffic(tr)
+		return
+	}
 	if p.ready {
 		p.writer.sendPacket(packet.wireType(), packet, nil)
 		p.ready = false
 		return
 	}
 	// We're waiting, so queue the packet up for later
-	if info, ok := p.queue.peek(); ok && time.Since(info.time) > 25*time.Millisecond {
+	if info, ok := p.queue.peek(); ok && time.Since(info.time) > peerQueueMaxDelay {
 		// The queue already has a significant delay
 		// Drop the oldest packet from the larget queue to make room
-		p.queue.drop()
+		if info, ok := p.queue.drop(); ok {
+			atomic.AddInt64(&p.peers.core.metrics.dropPeerQueue, 1)
+			if tr, ok := info.packet.(*traffic); ok {
+				p._dropped(tr)
+			}
+		}
 	}
 	// Add the packet to the queue
 	p.queue.push(packet)
+	p._updateSaturated()
+}
+
+// _dropped frees traffic that was dropped from our queue, after reporting it to the source if WithUnreachableReports is enabled.
+func (p *peer) _dropped(tr *traffic) {
+	if !p.peers.core.config.unreachable {
+		freeTraffic(tr)
+		return
+	}
+	r := &p.peers.core.router
+	r.act(p, func() {
+		r._sendUnreachable(tr, unreachableQueueFull)
+		freeTraffic(tr)
+	})
+}
+
+// _updateSaturated records whether the oldest queued packet has waited long enough that we'd drop packets to make room.
+// The router checks this without going through our actor, when deciding whether to use a loop-free alternate (see WithLoopFreeAlternates).
+func (p *peer) _updateSaturated() {
+	var saturated int32
+	if info, ok := p.queue.peek(); ok && time.Since(info.time) > peerQueueMaxDelay {
+		saturated = 1
+	}
+	atomic.StoreInt32(&p.saturated, saturated)
 }
 
 func (p *peer) pop() {
 	p.Act(nil, func() {
 		if info, ok := p.queue.pop(); ok {
 			p.writer.sendPacket(info.packet.wireType(), info.packet, nil)
+			p._updateSaturated()
+		} else if p.drained != nil {
+			p._sendGoodbye()
 		} else {
 			p.ready = true
-			p.writer.Act(nil, func() {
-				p.writer.wbuf.Flush()
-			})
+			p.writer.Act(nil, p.writer._flush)
+		}
+	})
+}
+
+// drain waits for everything already queued to be sent, then sends a goodbye and calls done.
+func (p *peer) drain(done func()) {
+	p.Act(nil, func() {
+		p.drained = done
+		if p.ready {
+			p.ready = false
+			p._sendGoodbye()
+		}
+	})
+}
+
+// _sendGoodbye tells the peer we're going away, if it supports featureGoodbye.
+// Older peers would treat it as a protocol error, so they just get a flush, and see the connection close afterwards.
+func (p *peer) _sendGoodbye() {
+	done := p.drained
+	p.drained = nil
+	p.closing = true
+	p.writer.Act(p, func() {
+		if p.features&featureGoodbye == 0 {
+			p.writer._write(nil, wireDummy, done)
+			return
 		}
+		p.writer._write(append(allocBytes(0), 0x01, byte(wireProtoGoodbye)), wireProtoGoodbye, done)
 	})
 }
@@ -0,0 +1,703 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+func TestPeerRateLimiter(t *testing.T) {
+	l := peerRateLimiter{rate: 1000}
+	now := time.Now()
+	if d := l.delay(now, 1000); d != 0 {
+		t.Fatalf("expected the first second of burst to be free, got %v", d)
+	}
+	if d := l.delay(now, 500); d != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %v", d)
+	}
+	// The debt from the last message is paid for after 500ms, and the next 250ms pays for this one
+	now = now.Add(750 * time.Millisecond)
+	if d := l.delay(now, 250); d != 0 {
+		t.Fatalf("expected no wait, got %v", d)
+	}
+	// A long idle period only refills up to the burst size
+	now = now.Add(time.Hour)
+	if d := l.delay(now, 2000); d != time.Second {
+		t.Fatalf("expected to wait 1s, got %v", d)
+	}
+	closed := make(chan struct{})
+	close(closed)
+	if err := l.wait(1000, closed); err != types.ErrClosed {
+		t.Fatalf("expected types.ErrClosed, got %v", err)
+	}
+}
+
+func TestPeerLimits(t *testing.T) {
+	const pending = 4
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA, WithPeerMaxPending(pending), WithPeerMaxConnsPerKey(2), WithPeerSetupTimeout(500*time.Millisecond))
+	defer a.Close()
+	// Connections that never send anything, but read what we send so we don't block
+	idle := func(key ed25519.PublicKey) chan error {
+		cA, cB := newDummyConn(pubA, key)
+		go io.Copy(io.Discard, cB)
+		done := make(chan error, 1)
+		go func() {
+			done <- a.HandleConn(key, cA, 0)
+			cB.Close()
+		}()
+		return done
+	}
+	key, _, _ := ed25519.GenerateKey(nil)
+	var results []chan error
+	for idx := 0; idx < 2; idx++ {
+		results = append(results, idle(key))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := <-idle(key); !errors.Is(err, types.ErrTooManyPeerConns) {
+		t.Fatalf("expected types.ErrTooManyPeerConns, got %v", err)
+	}
+	for idx := 2; idx < pending; idx++ {
+		key, _, _ := ed25519.GenerateKey(nil)
+		results = append(results, idle(key))
+	}
+	time.Sleep(100 * time.Millisecond)
+	key, _, _ = ed25519.GenerateKey(nil)
+	if err := <-idle(key); !errors.Is(err, types.ErrTooManyPendingPeers) {
+		t.Fatalf("expected types.ErrTooManyPendingPeers, got %v", err)
+	}
+	for _, done := range results {
+		select {
+		case err := <-done:
+			if !errors.Is(err, types.ErrPeerSetupTimeout) {
+				t.Fatalf("expected types.ErrPeerSetupTimeout, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("idle connection wasn't closed")
+		}
+	}
+	if len(a.Peers()) != 0 {
+		t.Fatal("expected idle peers to be removed")
+	}
+	m := a.Metrics()
+	if m["peers.pending"] != 0 || m["peers.rejected"] != 2 || m["peers.setup_timeouts"] != pending {
+		t.Fatalf("unexpected metrics: %v", m)
+	}
+	// A peer that does finish setup no longer counts as pending
+	for idx := 0; idx < pending+1; idx++ {
+		linkNodes(t, a, newNode(t))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for len(a.Peers()) != idx+1 {
+			time.Sleep(time.Millisecond) // HandleConn hasn't started yet
+		}
+		if err := a.WaitReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Peers goes through the same actor that setup finished in, so it has to come first
+	if ps, m := a.Peers(), a.Metrics(); m["peers.pending"] != 0 || len(ps) != pending+1 {
+		t.Fatalf("expected %d peers, none pending, got %d: %v", pending+1, len(ps), m)
+	}
+}
+
+func TestPeerProof(t *testing.T) {
+	// An attacker claims to have key K, and answers signature requests with its own key instead
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubK, _, _ := ed25519.GenerateKey(nil)
+	_, privM, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA, WithPeerSetupTimeout(time.Second))
+	defer a.Close()
+	var keyA, keyK publicKey
+	var secretM privateKey
+	copy(keyA[:], pubA)
+	copy(keyK[:], pubK)
+	copy(secretM[:], privM)
+	impersonate := func(answer bool) error {
+		cA, cM := newDummyConn(pubA, pubK)
+		defer cM.Close()
+		done := make(chan error, 1)
+		go func() {
+			done <- a.HandleConn(pubK, cA, 0)
+		}()
+		go func() {
+			rbuf := bufio.NewReader(cM)
+			cM.Write([]byte{0x01, byte(wireKeepAlive)})
+			for {
+				size, err := binary.ReadUvarint(rbuf)
+				if err != nil {
+					return
+				}
+				bs := make([]byte, size)
+				if _, err := io.ReadFull(rbuf, bs); err != nil {
+					return
+				}
+				var req routerSigReq
+				if !answer || wirePacketType(bs[0]) != wireProtoSigReq || req.decode(bs[1:]) != nil {
+					continue
+				}
+				res := routerSigRes{routerSigReq: req, port: 1}
+				res.psig = secretM.sign(res.bytesForSig(keyA, keyK))
+				frame := binary.AppendUvarint(nil, uint64(res.size()+1))
+				frame, _ = wireEncode(frame, byte(wireProtoSigRes), &res)
+				cM.Write(frame)
+			}
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection wasn't closed")
+		}
+		return nil
+	}
+	if err := impersonate(true); !errors.Is(err, types.ErrDecodeBadSignature) {
+		t.Fatalf("expected types.ErrDecodeBadSignature, got %v", err)
+	}
+	if err := impersonate(false); !errors.Is(err, types.ErrPeerSetupTimeout) {
+		t.Fatalf("expected types.ErrPeerSetupTimeout, got %v", err)
+	}
+	if m := a.Metrics(); m["peers.pending"] != 0 || len(a.Peers()) != 0 {
+		t.Fatalf("expected no peers, got %d: %v", len(a.Peers()), m)
+	}
+}
+
+func TestUnprovenLink(t *testing.T) {
+	// A link that hasn't answered its challenge sends a bloom, which shouldn't be used until it does
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubK, _, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA, WithPeerSetupTimeout(time.Minute))
+	defer a.Close()
+	var keyK, target publicKey
+	copy(keyK[:], pubK)
+	target[0] = 1
+	cA, cK := newDummyConn(pubA, pubK)
+	defer cK.Close()
+	go a.HandleConn(pubK, cA, 0)
+	go io.Copy(io.Discard, cK)
+	b := newBloom()
+	b.addKey(a.core.router.blooms.xKey(target))
+	frame := binary.AppendUvarint(nil, uint64(b.size()+1))
+	frame, _ = wireEncode(frame, byte(wireProtoBloomFilter), b)
+	cK.Write(append([]byte{0x01, byte(wireKeepAlive)}, frame...))
+	var p *peer
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("bloom wasn't received")
+		}
+		var received bool
+		phony.Block(&a.core.router, func() {
+			for q := range a.core.router.peers[keyK] {
+				p = q
+			}
+			received = p != nil && p.unprovenBloom != nil
+		})
+		if received {
+			break
+		}
+	}
+	xform := a.core.router.blooms.xKey(target)
+	var best *peer
+	var recv bool
+	phony.Block(&a.core.router, func() {
+		r := &a.core.router
+		best = r._bestLink(keyK, false)
+		recv = r.blooms.blooms[keyK].recv.filter.Test(xform[:])
+	})
+	if best != nil || recv {
+		t.Fatalf("unproven link was used: best link %v, bloom applied %v", best, recv)
+	}
+	// Once it answers, it's used, including the bloom it sent before
+	phony.Block(&a.core.router, func() {
+		r := &a.core.router
+		r._handleResponse(p, &routerSigRes{routerSigReq: p.challenge, port: 1})
+		best = r._bestLink(keyK, false)
+		recv = r.blooms.blooms[keyK].recv.filter.Test(xform[:])
+	})
+	if best != p || !recv {
+		t.Fatalf("proven link wasn't used: best link %v, bloom applied %v", best, recv)
+	}
+}
+
+// BenchmarkPeerInboundFairness measures how long a packet from one peer takes to be read, while another peer floods us with traffic.
+// The flooding peer is just a conn that writes pre-encoded traffic, so it costs (almost) nothing to send.
+func BenchmarkPeerInboundFairness(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		rate uint64
+	}{
+		{"unlimited", 0},
+		{"limited", 1 << 20},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			pubA, _, _ := ed25519.GenerateKey(nil)
+			pubB, privB, _ := ed25519.GenerateKey(nil)
+			pubC, privC, _ := ed25519.GenerateKey(nil)
+			victim, _ := NewPacketConn(privB, WithPeerInboundRate(bench.rate))
+			normal, _ := NewPacketConn(privC)
+			defer victim.Close()
+			defer normal.Close()
+			cC, cBC := newDummyConn(pubC, pubB)
+			go normal.HandleConn(pubB, cC, 0)
+			go victim.HandleConn(pubC, cBC, 0)
+			waitForRoot([]*PacketConn{victim, normal}, 30*time.Second)
+			tr := allocTraffic()
+			copy(tr.source[:], pubA)
+			copy(tr.dest[:], pubB)
+			tr.watermark = ^uint64(0)
+			tr.payload = append(tr.payload, make([]byte, 1024)...)
+			var frame []byte
+			frame = binary.AppendUvarint(frame, uint64(tr.size()+1))
+			frame, _ = wireEncode(frame, byte(wireTraffic), tr)
+			var frames []byte
+			for idx := 0; idx < 64; idx++ {
+				frames = append(frames, frame...)
+			}
+			cA, cBA := newDummyConn(pubA, pubB)
+			defer cA.Close()
+			go victim.HandleConn(pubA, cBA, 0)
+			go io.Copy(io.Discard, cA)
+			go func() {
+				for {
+					if _, err := cA.Write(frames); err != nil {
+						return
+					}
+				}
+			}()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fromC := make(chan byte, 1)
+			go func() {
+				buf := make([]byte, 2048)
+				for {
+					n, from, err := victim.ReadFromCtx(ctx, buf)
+					if err != nil {
+						return
+					}
+					if n == 1 && ed25519.PublicKey(from.(types.Addr)).Equal(pubC) {
+						select {
+						case fromC <- buf[0]:
+						default:
+						}
+					}
+				}
+			}()
+			// The first packets may be lost while normal looks for a path
+			send := func(idx int, timeout time.Duration) bool {
+				normal.WriteTo([]byte{byte(idx)}, types.Addr(pubB))
+				timer := time.NewTimer(timeout)
+				defer timer.Stop()
+				for {
+					select {
+					case got := <-fromC:
+						if got == byte(idx) {
+							return true
+						}
+					case <-timer.C:
+						return false
+					}
+				}
+			}
+			for !send(0, 100*time.Millisecond) {
+			}
+			var lost int
+			b.ResetTimer()
+			for idx := 0; idx < b.N; idx++ {
+				if !send(idx, time.Second) {
+					lost++
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(lost)/float64(b.N), "lost/op")
+		})
+	}
+}
+
+func TestUnrecognizedMessage(t *testing.T) {
+	// Types we don't use (including ones older versions used) close the connection without leaving any state
+	// The top bit of the type byte marks a compressed frame, see frameCompressed, so the highest type is 0x7f
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA)
+	defer a.Close()
+	for _, pType := range []wirePacketType{wireProtoBroadcast + 1, 0x42, 0x7f} {
+		pubB, _, _ := ed25519.GenerateKey(nil)
+		cA, cB := newDummyConn(pubA, pubB)
+		go io.Copy(io.Discard, cB)
+		go cB.Write([]byte{0x03, byte(pType), 0x00, 0x00})
+		if err := a.HandleConn(pubB, cA, 0); !errors.Is(err, types.ErrUnrecognizedMessage) {
+			t.Fatalf("type %d: expected types.ErrUnrecognizedMessage, got %v", pType, err)
+		}
+		cB.Close()
+	}
+	// The router forgets a peer asynchronously
+	r := &a.core.router
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		var count int
+		phony.Block(r, func() {
+			count = len(r.peers) + len(r.sent) + len(r.requests)
+		})
+		if count == 0 && len(a.Peers()) == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("state left behind: %d router entries, %d peers", count, len(a.Peers()))
+		}
+	}
+}
+
+// slowConn writes in small chunks with a delay between them, like a slow link.
+type slowConn struct {
+	*dummyConn
+	chunk int
+	delay time.Duration
+}
+
+func (c *slowConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		size := c.chunk
+		if size > len(b) {
+			size = len(b)
+		}
+		time.Sleep(c.delay)
+		var written int
+		written, err = c.dummyConn.Write(b[:size])
+		n += written
+		if err != nil {
+			return
+		}
+		b = b[size:]
+	}
+	return
+}
+
+func TestPeerSlowWriter(t *testing.T) {
+	// A sends 64KB frames over a link that takes most of the peer timeout to drain each one, while B keeps sending small packets that need a response
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubB, privB, _ := ed25519.GenerateKey(nil)
+	opts := []Option{WithPeerTimeout(time.Second), WithPeerKeepAliveDelay(100 * time.Millisecond)}
+	a, _ := NewPacketConn(privA, opts...)
+	b, _ := NewPacketConn(privB, opts...)
+	defer a.Close()
+	defer b.Close()
+	cA, cB := newDummyConn(pubA, pubB)
+	defer cA.Close()
+	errs := make(chan error, 2)
+	go func() { errs <- a.HandleConn(pubB, &slowConn{cA, 4096, 40 * time.Millisecond}, 0) }()
+	go func() { errs <- b.HandleConn(pubA, cB, 0) }()
+	waitForRoot([]*PacketConn{a, b}, 30*time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+				b.WriteTo([]byte("small"), a.LocalAddr())
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			if _, _, err := a.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	big := make([]byte, 64*1024)
+	buf := make([]byte, len(big))
+	for idx := 0; idx < 4; idx++ {
+		big[0] = byte(idx)
+		for received := false; !received; {
+			if _, err := a.WriteTo(big, b.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			b.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for {
+				n, _, err := b.ReadFrom(buf)
+				if err != nil {
+					break // Not sent yet (or dropped while waiting for a path), try again
+				}
+				if n == len(big) && buf[0] == byte(idx) {
+					received = true
+					break
+				}
+			}
+			select {
+			case err := <-errs:
+				t.Fatalf("peer connection closed while sending: %v", err)
+			default:
+			}
+		}
+	}
+}
+
+func TestPeerFilter(t *testing.T) {
+	b, c := newNode(t), newNode(t)
+	pubB, pubC := nodeKey(b), nodeKey(c)
+	a := newNode(t, WithPeerFilter(func(key ed25519.PublicKey) bool {
+		return key.Equal(pubB)
+	}))
+	pubA := nodeKey(a)
+	// C is rejected before anything is sent to it
+	cA, cC := newDummyConn(pubA, pubC)
+	go c.HandleConn(pubA, cC, 0)
+	if err := a.HandleConn(pubC, cA, 0); !errors.Is(err, types.ErrPeerNotAllowed) {
+		t.Fatalf("expected types.ErrPeerNotAllowed, got %v", err)
+	}
+	// B is allowed, and finishes setup
+	linkLine(t, []*PacketConn{a, b})
+	if ps := a.Peers(); len(ps) != 1 || !ps[0].Key.Equal(pubB) {
+		t.Fatalf("unexpected peers: %v", ps)
+	}
+	if m := a.Metrics(); m["peers.rejected"] != 1 || m["peers.pending"] != 0 {
+		t.Fatalf("unexpected metrics: %v", m)
+	}
+}
+
+// oneWayConn stops writing (but pretends it did) once drop is set, and ignores read deadlines if lenient is set.
+type oneWayConn struct {
+	*dummyConn
+	drop    *int32
+	lenient bool
+}
+
+func (c *oneWayConn) Write(b []byte) (n int, err error) {
+	if atomic.LoadInt32(c.drop) != 0 {
+		return len(b), nil
+	}
+	return c.dummyConn.Write(b)
+}
+
+func (c *oneWayConn) SetReadDeadline(t time.Time) error {
+	if c.lenient {
+		return nil
+	}
+	return c.dummyConn.SetReadDeadline(t)
+}
+
+func TestOneWayPeer(t *testing.T) {
+	// B is the root and A's parent, until A's writes to B start vanishing
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubB, privB, _ := ed25519.GenerateKey(nil)
+	if bytes.Compare(pubA, pubB) < 0 {
+		pubA, privA, pubB, privB = pubB, privB, pubA, privA
+	}
+	a, _ := NewPacketConn(privA)
+	b, _ := NewPacketConn(privB)
+	defer a.Close()
+	defer b.Close()
+	events := make(chan bool, 8)
+	a.SetOneWayPeerHandler(func(key ed25519.PublicKey, port uint64, oneWay bool) {
+		events <- oneWay
+	})
+	cA, cB := newDummyConn(pubA, pubB)
+	defer cA.Close()
+	var drop int32
+	go a.HandleConn(pubB, &oneWayConn{cA, &drop, false}, 0)
+	// B can't hear A either, so it needs to not time out, like a transport that doesn't notice
+	go b.HandleConn(pubA, &oneWayConn{cB, new(int32), true}, 0)
+	waitForRoot([]*PacketConn{a, b}, 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := b.Ping(ctx, pubA); err != nil {
+		t.Fatal(err)
+	}
+	// Keep traffic coming from B, so A's side of the link doesn't time out
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+				b.WriteTo([]byte("hello"), a.LocalAddr())
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			if _, _, err := a.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	atomic.StoreInt32(&drop, 1)
+	select {
+	case oneWay := <-events:
+		if !oneWay {
+			t.Fatal("unexpected event")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for a one-way event")
+	}
+	if peers := a.Peers(); len(peers) != 1 || !peers[0].OneWay {
+		t.Fatalf("expected one one-way peer, got %v", peers)
+	}
+	if n := a.Metrics()["peers.one_way"]; n != 1 {
+		t.Fatalf("expected 1 one-way link, got %d", n)
+	}
+	var keyA publicKey
+	copy(keyA[:], pubA)
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		var parent publicKey
+		phony.Block(&a.core.router, func() {
+			parent = a.core.router.infos[keyA].parent
+		})
+		if parent == keyA {
+			break
+		} else if time.Since(start) > 10*time.Second {
+			t.Fatal("still using the one-way peer as a parent")
+		}
+	}
+	// The gauge only counts links that still exist
+	cA.Close()
+	for start := time.Now(); a.Metrics()["peers.one_way"] != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("one-way link still counted after closing")
+		}
+	}
+}
+
+func TestKeyedPorts(t *testing.T) {
+	// A line a - b - c, where a is the root and b restarts, reconnecting to its peers in the other order
+	var privs []ed25519.PrivateKey
+	for idx := 0; idx < 3; idx++ {
+		_, priv, _ := ed25519.GenerateKey(nil)
+		privs = append(privs, priv)
+	}
+	sort.Slice(privs, func(i, j int) bool {
+		return bytes.Compare(privs[i].Public().(ed25519.PublicKey), privs[j].Public().(ed25519.PublicKey)) < 0
+	})
+	var keys []ed25519.PublicKey
+	var conns []*PacketConn
+	for _, priv := range privs {
+		conn, err := NewPacketConn(priv, WithKeyedPorts(1<<16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		keys = append(keys, priv.Public().(ed25519.PublicKey))
+		conns = append(conns, conn)
+	}
+	const a, b, c = 0, 1, 2
+	connect := func(x, y int) {
+		linkNodes(t, conns[x], conns[y])
+	}
+	coords := func() (path []peerPort) {
+		r := &conns[c].core.router
+		phony.Block(r, func() {
+			_, path = r._getRootAndPath(r.core.crypto.publicKey)
+		})
+		return
+	}
+	connect(a, b)
+	connect(b, c)
+	waitForRoot(conns, 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := conns[a].Ping(ctx, keys[c]); err != nil {
+		t.Fatal(err)
+	}
+	before := coords()
+	conns[b].Close()
+	for len(conns[a].Debug.GetPeers()) != 0 || len(conns[c].Debug.GetPeers()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	conns[b], _ = NewPacketConn(privs[b], WithKeyedPorts(1<<16))
+	defer conns[b].Close()
+	connect(c, b)
+	for len(conns[c].Debug.GetPeers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	connect(a, b)
+	waitForRoot(conns, 30*time.Second)
+	if after := coords(); len(after) != len(before) || len(after) != 2 || after[0] != before[0] || after[1] != before[1] {
+		t.Fatalf("c's coords changed from %v to %v", before, after)
+	}
+	// a's old path to c still works, so the first packet gets there without a lookup
+	if _, err := conns[a].WriteTo([]byte("hello"), types.Addr(keys[c])); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := conns[c].ReadFromCtx(ctx, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxPort(t *testing.T) {
+	// Ports 1 and 2 are below the limit, so a third peer doesn't get one, even with keyed ports
+	_, privA, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA, WithMaxPort(3), WithKeyedPorts(1<<16))
+	defer a.Close()
+	pubA := ed25519.PublicKey(a.LocalAddr().(types.Addr))
+	ps := &a.core.peers
+	for idx := 0; idx < 2; idx++ {
+		pubK, _, _ := ed25519.GenerateKey(nil)
+		cA, cK := newDummyConn(pubA, pubK)
+		defer cK.Close()
+		go a.HandleConn(pubK, cA, 0)
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			var count int
+			phony.Block(ps, func() {
+				count = len(ps.ports)
+			})
+			if count == idx+1 {
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("peer wasn't added")
+			}
+		}
+	}
+	phony.Block(ps, func() {
+		for port := range ps.ports {
+			if port == 0 || port >= 3 {
+				t.Fatalf("got port %d", port)
+			}
+		}
+	})
+	pubK, _, _ := ed25519.GenerateKey(nil)
+	cA, cK := newDummyConn(pubA, pubK)
+	defer cK.Close()
+	if err := a.HandleConn(pubK, cA, 0); !errors.Is(err, types.ErrBadPort) {
+		t.Fatalf("expected types.ErrBadPort, got %v", err)
+	}
+	// Announcements with a port over the limit are dropped
+	r := &a.core.router
+	phony.Block(r, func() {
+		var ann routerAnnounce
+		ann.port = 3
+		if r._checkAnnouncePort(&ann) {
+			t.Error("accepted a port over the limit")
+		}
+		ann.port = 2
+		if !r._checkAnnouncePort(&ann) {
+			t.Error("rejected a port under the limit")
+		}
+	})
+	// The limit itself is kept within bounds
+	for max, expected := range map[uint64]uint64{0: 2, 1: 2, 5: 5, wireMaxPort + 1: wireMaxPort} {
+		var c config
+		WithMaxPort(max)(&c)
+		if c.maxPort != expected {
+			t.Errorf("WithMaxPort(%d) set %d, expected %d", max, c.maxPort, expected)
+		}
+	}
+}
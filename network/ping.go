@@ -0,0 +1,91 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// pingRetry is how long Ping waits for a reply before sending another request.
+// The first request can be lost while we (or the destination) look up a path, since a lookup is only resent when there's more traffic.
+const pingRetry = time.Second
+
+// pingWait is a request sent by a Ping call, waiting for the destination's reply.
+type pingWait struct {
+	dest publicKey
+	sent time.Time
+	ch   chan time.Duration
+}
+
+// Ping sends an echo request to dest, routed like any other traffic, and returns how long it took for the destination's reply to come back.
+// Requests are resent every second until a reply arrives, and the time is measured from whichever request was answered first.
+// If we don't have a path to dest yet, the request waits for a lookup, and the time that takes is included, so the first ping to a node is usually slower than the rest.
+// It returns ctx.Err() if the context is done before a reply arrives, e.g. because dest is unreachable, so callers should use a context with a deadline.
+func (pc *PacketConn) Ping(ctx context.Context, dest ed25519.PublicKey) (time.Duration, error) {
+	if pc.IsClosed() {
+		return 0, types.ErrClosed
+	}
+	if len(dest) != publicKeySize {
+		return 0, types.ErrBadAddress
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var key publicKey
+	copy(key[:], dest)
+	arrived := make(chan time.Duration, 1)
+	var ids []uint64
+	defer pc.actor.Act(nil, func() {
+		for _, id := range ids {
+			delete(pc.pings, id)
+		}
+	})
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case rtt := <-arrived:
+			return rtt, nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-pc.closed:
+			return 0, types.ErrClosed
+		case <-timer.C:
+		}
+		var id uint64
+		phony.Block(&pc.actor, func() {
+			pc.pingSeq++
+			id = pc.pingSeq
+			pc.pings[id] = pingWait{key, time.Now(), arrived}
+		})
+		ids = append(ids, id)
+		pc.sendTraffic(key, trafficKindPingRequest, binary.BigEndian.AppendUint64(nil, id))
+		timer.Reset(pingRetry)
+	}
+}
+
+func (pc *PacketConn) _handlePingRequest(tr *traffic) {
+	if len(tr.payload) == 8 {
+		pc.sendTraffic(tr.source, trafficKindPingReply, tr.payload)
+	}
+	freeTraffic(tr)
+}
+
+func (pc *PacketConn) _handlePingReply(tr *traffic) {
+	if len(tr.payload) == 8 {
+		id := binary.BigEndian.Uint64(tr.payload)
+		if wait, isIn := pc.pings[id]; isIn && tr.source == wait.dest {
+			delete(pc.pings, id)
+			select {
+			case wait.ch <- time.Since(wait.sent):
+			default: // Another request from the same call was already answered
+			}
+		}
+	}
+	freeTraffic(tr)
+}
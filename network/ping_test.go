@@ -0,0 +1,29 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	// A line a - b - c
+	keys, conns := newLine(t, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for idx := 0; idx < 3; idx++ {
+		// The first one waits for path lookups in both directions, the rest shouldn't
+		if rtt, err := conns[0].Ping(ctx, keys[2]); err != nil || rtt <= 0 {
+			t.Fatalf("unexpected result: %v %v", rtt, err)
+		}
+	}
+	// Nobody has this key, so the ping can only time out
+	missing, _, _ := ed25519.GenerateKey(nil)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := conns[0].Ping(ctx, missing); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -2,18 +2,39 @@ package network
 
 import "sync"
 
-var bytePool = sync.Pool{New: func() interface{} { return []byte(nil) }}
+// Byte buffers are pooled by size class, so small packets don't hold on to big buffers, and big packets don't throw away small ones.
+// Whoever gets a buffer from allocBytes owns it until they pass it to freeBytes, or hand it off to something that will (e.g. the payload of a traffic, which goes back with freeTraffic once the PacketConn has copied it into the buffer given to ReadFrom, or to an out-of-band handler).
+// Nothing may keep using a buffer after it's freed.
+// Buffers bigger than the largest class are allocated as needed, and left to the garbage collector.
+var byteClasses = [...]int{2048, 16384, 65536}
 
+var bytePools [len(byteClasses)]sync.Pool
+
+// allocBytes returns a buffer with the given length, from the smallest class that fits it.
+// Callers that append to a zero length buffer get at least the smallest class's capacity to work with.
 func allocBytes(size int) []byte {
-	bs := bytePool.Get().([]byte)
-	if cap(bs) < size {
-		bs = make([]byte, size)
+	for class, classSize := range byteClasses {
+		if size <= classSize {
+			if bs, ok := bytePools[class].Get().([]byte); ok {
+				return bs[:size]
+			}
+			return make([]byte, size, classSize)
+		}
 	}
-	return bs[:size]
+	return make([]byte, size)
 }
 
+// freeBytes puts the buffer in the largest class it can hold, if any.
 func freeBytes(bs []byte) {
-	bytePool.Put(bs[:0]) //nolint:staticcheck
+	if cap(bs) > byteClasses[len(byteClasses)-1] {
+		return
+	}
+	for class := len(byteClasses) - 1; class >= 0; class-- {
+		if cap(bs) >= byteClasses[class] {
+			bytePools[class].Put(bs[:0]) //nolint:staticcheck
+			return
+		}
+	}
 }
 
 var trafficPool = sync.Pool{New: func() interface{} { return new(traffic) }}
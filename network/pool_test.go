@@ -0,0 +1,87 @@
+package network
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// BenchmarkForward sends packets from a to c through b, and reports allocations and GC pause time per packet across all three nodes.
+func BenchmarkForward(b *testing.B) {
+	keys, conns := newLine(b, 3)
+	src, dst := conns[0], conns[2]
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := src.Ping(ctx, keys[2]); err != nil {
+		b.Fatal(err)
+	}
+	msg := make([]byte, 1024)
+	done := make(chan int)
+	go func() {
+		buf := make([]byte, dst.MTU())
+		var count int
+		for count < b.N {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			_, _, err := dst.ReadFromCtx(ctx, buf)
+			cancel()
+			if err != nil {
+				break
+			}
+			count++
+		}
+		done <- count
+	}()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		if _, err := src.WriteTo(msg, dst.LocalAddr()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	count := <-done
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-ns/op")
+	b.ReportMetric(float64(count)/float64(b.N), "delivered")
+}
+
+func TestBytePool(t *testing.T) {
+	for _, size := range []int{0, 1, 2048, 2049, 65536, 65537} {
+		bs := allocBytes(size)
+		if len(bs) != size {
+			t.Fatalf("expected length %d, got %d", size, len(bs))
+		}
+		if size <= byteClasses[len(byteClasses)-1] && cap(bs) < byteClasses[0] {
+			t.Fatalf("expected at least the smallest class for size %d, got capacity %d", size, cap(bs))
+		}
+		freeBytes(bs)
+	}
+	// Buffers go back and forth between goroutines, like frames between a peer's reader and writer, run with -race to check ownership
+	ch := make(chan []byte, 64)
+	done := make(chan bool)
+	go func() {
+		var modified bool
+		for bs := range ch {
+			for idx := range bs {
+				modified = modified || bs[idx] != byte(len(bs))
+			}
+			freeBytes(bs)
+		}
+		done <- modified
+	}()
+	for idx := 0; idx < 10000; idx++ {
+		bs := allocBytes(idx % 20000)
+		for jdx := range bs {
+			bs[jdx] = byte(len(bs))
+		}
+		ch <- bs
+	}
+	close(ch)
+	if <-done {
+		t.Fatal("buffer was modified after it was handed off")
+	}
+}
@@ -0,0 +1,151 @@
+package network
+
+import (
+	"math/bits"
+	"time"
+)
+
+// Probes are keepalives with one extra byte, see WithPeerProbes.
+// The byte is the probe's id, and the peer echoes it back in a keepalive with peerProbeReply set.
+// Nodes that don't know about probes ignore the extra byte, like they ignore anything else in a keepalive.
+const (
+	peerProbeReply  = 0x80 // set in the id of a probe's reply
+	peerProbeWindow = 32   // how many of the latest probes the loss estimate covers
+	peerProbeMin    = 4    // how many probes a link needs before WithParentQuality trusts its measurements
+)
+
+// PeerQuality is what we've measured about a link with probes, see WithPeerProbes.
+type PeerQuality struct {
+	Probes uint64        // Probes sent that have been answered or given up on
+	RTT    time.Duration // Smoothed round trip time of the probes answered in time, or 0 if there aren't any yet
+	Loss   float64       // Fraction of the latest probes that weren't answered before the next was sent
+}
+
+// peerProbes keeps track of the probes sent to one peer, only used by the peer's monitor.
+type peerProbes struct {
+	timer   *time.Timer
+	id      uint8     // id of the outstanding probe
+	sent    time.Time // when the outstanding probe was sent, or zero if there isn't one
+	lost    uint32    // a bit for each of the latest probes, set if it was lost
+	quality PeerQuality
+}
+
+// _record adds the result of the outstanding probe, and publishes the new quality for the router.
+func (m *peerMonitor) _record(rtt time.Duration, lost bool) {
+	ps := &m.probes
+	ps.sent = time.Time{}
+	ps.lost <<= 1
+	if lost {
+		ps.lost |= 1
+	} else if ps.quality.RTT == 0 {
+		ps.quality.RTT = rtt
+	} else {
+		ps.quality.RTT += (rtt - ps.quality.RTT) / 8
+	}
+	ps.quality.Probes++
+	window := uint64(peerProbeWindow)
+	if ps.quality.Probes < window {
+		window = ps.quality.Probes
+	}
+	ps.quality.Loss = float64(bits.OnesCount32(ps.lost)) / float64(window)
+	m.peer.quality.Store(ps.quality)
+}
+
+// probe gives up on the outstanding probe, if there is one, and sends the next.
+func (m *peerMonitor) probe() {
+	m.Act(nil, func() {
+		select {
+		case <-m.peer.done:
+			return
+		default:
+		}
+		ps := &m.probes
+		if !ps.sent.IsZero() {
+			m._record(0, true)
+		}
+		next := (ps.id + 1) &^ peerProbeReply
+		if m.peer.writer.sendProbe(next) {
+			ps.id, ps.sent = next, time.Now()
+		}
+		ps.timer = time.AfterFunc(m.peer.peers.core.config.peerProbeInterval, m.probe)
+	})
+}
+
+// probeReply records the round trip time of the outstanding probe, if the reply is for it.
+// A reply that arrives after the next probe was sent has already been counted as lost, so it's ignored.
+func (m *peerMonitor) probeReply(id uint8) {
+	now := time.Now()
+	m.Act(nil, func() {
+		if ps := &m.probes; !ps.sent.IsZero() && id == ps.id {
+			m._record(now.Sub(ps.sent), false)
+		}
+	})
+}
+
+// _stopProbes is called by the handler when the peer is done.
+func (m *peerMonitor) _stopProbes() {
+	if m.probes.timer != nil {
+		m.probes.timer.Stop()
+		m.probes.timer = nil
+	}
+}
+
+// _handleProbe answers a probe, or passes a reply to the monitor.
+// Probes are answered even if we don't send any ourselves, so only the side that wants measurements needs WithPeerProbes.
+func (p *peer) _handleProbe(id uint8) {
+	if id&peerProbeReply == 0 {
+		p.writer.sendProbe(id | peerProbeReply)
+	} else {
+		p.monitor.probeReply(id &^ peerProbeReply)
+	}
+}
+
+// getQuality returns what the monitor last published, which is the zero PeerQuality until a probe finishes.
+func (p *peer) getQuality() PeerQuality {
+	q, _ := p.quality.Load().(PeerQuality)
+	return q
+}
+
+// _linkQuality returns the best measured quality among our links to a peer, and false if none of them has been probed enough.
+func (r *router) _linkQuality(key publicKey) (best PeerQuality, ok bool) {
+	for p := range r.peers[key] {
+		q := p.getQuality()
+		if q.Probes < peerProbeMin {
+			continue
+		}
+		if !ok || q.Loss < best.Loss || (q.Loss == best.Loss && q.RTT < best.RTT) {
+			best, ok = q, true
+		}
+	}
+	return
+}
+
+// _compareLinks returns -1 if the link to a is materially better than the link to b, 1 if it's materially worse, and 0 if neither is (or we don't know), see WithParentQuality.
+func (r *router) _compareLinks(a, b publicKey) int {
+	cfg := &r.core.config
+	if cfg.parentLossMargin <= 0 && cfg.parentRTTMargin <= 0 {
+		return 0
+	}
+	qa, okA := r._linkQuality(a)
+	qb, okB := r._linkQuality(b)
+	if !okA || !okB {
+		return 0
+	}
+	if cfg.parentLossMargin > 0 {
+		switch {
+		case qa.Loss+cfg.parentLossMargin < qb.Loss:
+			return -1
+		case qb.Loss+cfg.parentLossMargin < qa.Loss:
+			return 1
+		}
+	}
+	if cfg.parentRTTMargin > 0 && qa.RTT > 0 && qb.RTT > 0 {
+		switch {
+		case qa.RTT+cfg.parentRTTMargin < qb.RTT:
+			return -1
+		case qb.RTT+cfg.parentRTTMargin < qa.RTT:
+			return 1
+		}
+	}
+	return 0
+}
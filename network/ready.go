@@ -0,0 +1,109 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// WaitReady blocks until the router has settled with its current peers, or the context is done.
+// That means every connection passed to HandleConn has finished setup (see WithPeerSetupTimeout), we have a parent that's one of our peers (or we're the root, and no peer knows a better one), every peer link has answered a signature request, and every peer has been sent the announcements for our ancestry and theirs.
+// If the context is done first, the error wraps ctx.Err() and lists what was still pending.
+// It's mostly useful in tests and orchestration, e.g. to wait for a newly connected node to join the tree.
+func (pc *PacketConn) WaitReady(ctx context.Context) error {
+	r := &pc.core.router
+	ready := make(chan struct{})
+	r.act(nil, func() {
+		r.waitReady = append(r.waitReady, ready)
+		r._checkReady()
+	})
+	select {
+	case <-ready:
+		return nil
+	case <-pc.closed:
+		return types.ErrClosed
+	case <-ctx.Done():
+	}
+	var pending []string
+	phony.Block(r, func() {
+		pending = r._readyPending()
+		for idx, ch := range r.waitReady {
+			if ch == ready {
+				r.waitReady = append(r.waitReady[:idx], r.waitReady[idx+1:]...)
+				break
+			}
+		}
+	})
+	if len(pending) == 0 {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w: waiting for %s", ctx.Err(), strings.Join(pending, ", "))
+}
+
+// _checkReady wakes up any WaitReady calls, if there's nothing pending.
+// It's called after everything the router handles, see router.act.
+func (r *router) _checkReady() {
+	if len(r.waitReady) == 0 || len(r._readyPending()) != 0 {
+		return
+	}
+	for _, ch := range r.waitReady {
+		close(ch)
+	}
+	r.waitReady = nil
+}
+
+// _readyPending returns a description of each thing WaitReady is still waiting for.
+func (r *router) _readyPending() []string {
+	var pending []string
+	selfKey := r.core.crypto.publicKey
+	self, isIn := r.infos[selfKey]
+	switch {
+	case !isIn:
+		return []string{"our own info"}
+	case r.doRoot1 || r.doRoot2:
+		pending = append(pending, "parent selection")
+	case self.parent == selfKey:
+		for k := range r.peers {
+			if root, _ := r._getRootAndDists(k); root.less(r._worstRoot()) {
+				pending = append(pending, fmt.Sprintf("a parent (peer %s knows a better root)", k.addr()))
+			}
+		}
+	default:
+		if _, isIn := r.peers[self.parent]; !isIn {
+			pending = append(pending, fmt.Sprintf("a parent (%s is not a peer)", self.parent.addr()))
+		}
+	}
+	if count := atomic.LoadInt64(&r.core.metrics.peersPending); count > 0 {
+		pending = append(pending, fmt.Sprintf("%d peer connections to finish setup", count))
+	}
+	selfAnc := r._getAncestry(selfKey)
+	for k, ps := range r.peers {
+		_, responded := r.responses[k]
+		responded = responded || r._isLeaf(k) // A leaf declines instead, see WithLeafMode
+		for p := range ps {
+			responded = responded && p.proven
+		}
+		if !responded {
+			pending = append(pending, fmt.Sprintf("a signature response from %s", k.addr()))
+		}
+		sent := r.sent[k]
+		for _, anc := range [][]publicKey{selfAnc, r._getAncestry(k)} {
+			var unsent bool
+			for _, key := range anc {
+				if _, isIn := sent[key]; !isIn {
+					unsent = true
+				}
+			}
+			if unsent {
+				pending = append(pending, fmt.Sprintf("announcements to %s", k.addr()))
+				break
+			}
+		}
+	}
+	return pending
+}
@@ -0,0 +1,77 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+func TestWaitReady(t *testing.T) {
+	a, b := newNode(t, WithPeerSetupTimeout(0)), newNode(t)
+	pubA := nodeKey(a)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Without peers, we're the root as soon as the router starts
+	if err := a.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	linkNodes(t, a, b)
+	for _, conn := range []*PacketConn{a, b} {
+		if err := conn.WaitReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A peer that says something, but never answers our signature request
+	pubC, _, _ := ed25519.GenerateKey(nil)
+	cA, cC := newDummyConn(pubA, pubC)
+	defer cA.Close()
+	go io.Copy(io.Discard, cC)
+	go a.HandleConn(pubC, cA, 0)
+	go cC.Write([]byte{0x01, byte(wireKeepAlive)})
+	time.Sleep(100 * time.Millisecond)
+	short, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := a.WaitReady(short)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "signature response from "+types.Addr(pubC).String()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWaitReadyLine(t *testing.T) {
+	// Each node in a line is ready once its parent is one of its neighbours, see _readyPending
+	var conns []*PacketConn
+	for idx := 0; idx < 5; idx++ {
+		conns = append(conns, newNode(t))
+	}
+	// Not linkLine, which would wait for the root before we wait for anything else
+	for idx := 1; idx < len(conns); idx++ {
+		linkNodes(t, conns[idx-1], conns[idx])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, conn := range conns {
+		if err := conn.WaitReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for idx, conn := range conns {
+		r := &conn.core.router
+		phony.Block(r, func() {
+			self := r.core.crypto.publicKey
+			parent := r.infos[self].parent
+			if _, isIn := r.peers[parent]; !isIn && parent != self {
+				t.Errorf("node %d is ready with a parent that isn't a peer", idx)
+			}
+		})
+	}
+	// Being ready doesn't need the whole line to agree on the root, but it gets there
+	waitForRoot(conns, 30*time.Second)
+}
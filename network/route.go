@@ -0,0 +1,326 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+const (
+	routeStatusNext  = 0 // Forward to the peer in the reply
+	routeStatusLocal = 1 // Deliver locally, i.e. the replying node is the destination
+	routeStatusNone  = 2 // No peer is closer to the destination than the replying node
+)
+
+// TraceRoute asks each node on the way to dest which peer it would forward dest's traffic to, starting with us, and returns the chain of hops (not including us) in order.
+// The last key is dest if it was reached, otherwise the chain is partial and an error says why: types.ErrNoRoute if a hop has no next hop, types.ErrRouteLoop if a hop points back to a node we already visited, types.ErrTooManyHops if dest isn't reached within maxHops, or types.ErrTimeout if we don't get a path to dest or a hop's reply within the timeout.
+// Nodes only answer a limited number of queries, see WithRouteQueryRate and WithRouteQueryFilter.
+func (pc *PacketConn) TraceRoute(dest ed25519.PublicKey, maxHops int, timeout time.Duration) ([]ed25519.PublicKey, error) {
+	if pc.IsClosed() {
+		return nil, types.ErrClosed
+	}
+	if len(dest) != publicKeySize {
+		return nil, types.ErrBadAddress
+	}
+	var query routeQuery
+	copy(query.dest[:], dest)
+	path, err := pc.routePath(query.dest, timeout)
+	if err != nil {
+		return nil, err
+	}
+	query.path = path
+	var hops []ed25519.PublicKey
+	visited := map[publicKey]struct{}{pc.core.crypto.publicKey: {}}
+	current := pc.core.crypto.publicKey
+	for {
+		var reply *routeReply
+		if current == pc.core.crypto.publicKey {
+			reply = new(routeReply)
+			phony.Block(&pc.core.router, func() {
+				*reply = pc.core.router._routeDecision(&query)
+			})
+		} else if reply, err = pc.sendRouteQuery(current, query, timeout); err != nil {
+			return hops, err
+		}
+		switch reply.status {
+		case routeStatusLocal:
+			return hops, nil
+		case routeStatusNone:
+			return hops, types.ErrNoRoute
+		}
+		if _, isIn := visited[reply.next]; isIn {
+			return hops, types.ErrRouteLoop
+		}
+		if len(hops) >= maxHops {
+			return hops, types.ErrTooManyHops
+		}
+		visited[reply.next] = struct{}{}
+		hops = append(hops, reply.next.toEd())
+		current = reply.next
+	}
+}
+
+// routePath returns the path that our traffic to dest would use, waiting up to the timeout for a lookup if we don't have one yet.
+func (pc *PacketConn) routePath(dest publicKey, timeout time.Duration) ([]peerPort, error) {
+	if dest == pc.core.crypto.publicKey {
+		var path []peerPort
+		phony.Block(&pc.core.router, func() {
+			_, path = pc.core.router._getRootAndPath(dest)
+		})
+		return path, nil
+	}
+	var path []peerPort
+	var found bool
+	pf := &pc.core.router.pathfinder
+	notified := make(chan struct{})
+	getPath := func() {
+		if info, isIn := pf.paths[dest]; isIn {
+			path, found = append([]peerPort(nil), info.path...), true
+		}
+	}
+	phony.Block(&pc.core.router, func() {
+		if getPath(); !found {
+			pf.waiting[dest] = append(pf.waiting[dest], notified)
+			pf._rumorSendLookup(dest)
+		}
+	})
+	if found {
+		return path, nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-notified:
+		phony.Block(&pc.core.router, getPath)
+		if found {
+			return path, nil
+		}
+		return nil, types.ErrTimeout // It already expired again
+	case <-timer.C:
+	case <-pc.closed:
+	}
+	phony.Block(&pc.core.router, func() {
+		ws := pf.waiting[dest]
+		for idx, ch := range ws {
+			if ch == notified {
+				ws = append(ws[:idx], ws[idx+1:]...)
+				break
+			}
+		}
+		if len(ws) == 0 {
+			delete(pf.waiting, dest)
+		} else {
+			pf.waiting[dest] = ws
+		}
+	})
+	if pc.IsClosed() {
+		return nil, types.ErrClosed
+	}
+	return nil, types.ErrTimeout
+}
+
+// routeWait is a TraceRoute call waiting for a reply from a hop.
+type routeWait struct {
+	hop publicKey
+	ch  chan *routeReply
+}
+
+// sendRouteQuery sends the query to a hop, with a new id, and waits for that hop's reply.
+func (pc *PacketConn) sendRouteQuery(hop publicKey, query routeQuery, timeout time.Duration) (*routeReply, error) {
+	ch := make(chan *routeReply, 1)
+	phony.Block(&pc.actor, func() {
+		pc.routeSeq++
+		query.id = pc.routeSeq
+		pc.routeQueries[query.id] = routeWait{hop, ch}
+	})
+	defer pc.actor.Act(nil, func() {
+		delete(pc.routeQueries, query.id)
+	})
+	bs, err := query.encode(nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := allocTraffic()
+	tr.source = pc.core.crypto.publicKey
+	tr.dest = hop
+	tr.watermark = ^uint64(0)
+	tr.kind = trafficKindRouteQuery
+	tr.payload = append(tr.payload, bs...)
+	pc.core.router.sendTraffic(tr)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-timer.C:
+		return nil, types.ErrTimeout
+	case <-pc.closed:
+		return nil, types.ErrClosed
+	}
+}
+
+func (pc *PacketConn) _handleRouteQuery(tr *traffic) {
+	defer freeTraffic(tr)
+	cfg := &pc.core.config
+	var query routeQuery
+	if cfg.routeQueryRate == 0 || query.decode(tr.payload) != nil {
+		return
+	}
+	if cfg.routeQueryFilter != nil && !cfg.routeQueryFilter(tr.source.toEd(), query.dest.toEd()) {
+		return
+	}
+	if !pc.routeLimiter.allow(time.Now(), 1) {
+		return
+	}
+	querier := tr.source
+	r := &pc.core.router
+	r.act(&pc.actor, func() {
+		reply := r._routeDecision(&query)
+		bs, err := reply.encode(nil)
+		if err != nil {
+			return
+		}
+		tr := allocTraffic()
+		tr.source = r.core.crypto.publicKey
+		tr.dest = querier
+		tr.watermark = ^uint64(0)
+		tr.kind = trafficKindRouteReply
+		tr.payload = append(tr.payload, bs...)
+		r.pathfinder._handleTraffic(tr)
+	})
+}
+
+func (pc *PacketConn) _handleRouteReply(tr *traffic) {
+	defer freeTraffic(tr)
+	reply := new(routeReply)
+	if reply.decode(tr.payload) != nil {
+		return
+	}
+	if wait, isIn := pc.routeQueries[reply.id]; isIn && tr.source == wait.hop {
+		delete(pc.routeQueries, reply.id)
+		wait.ch <- reply // buffered, and only ever sent to once, so this never blocks
+	}
+}
+
+// _routeDecision runs the same lookup as we would for traffic on the query's path.
+func (r *router) _routeDecision(query *routeQuery) routeReply {
+	reply := routeReply{id: query.id}
+	watermark := ^uint64(0)
+	if p := r._lookup(query.path, &watermark); p != nil {
+		reply.status = routeStatusNext
+		reply.next = p.key
+		reply.port = uint64(p.port)
+		reply.dist = r._getDist(query.path, p.key)
+	} else if query.dest == r.core.crypto.publicKey {
+		reply.status = routeStatusLocal
+	} else {
+		reply.status = routeStatusNone
+	}
+	return reply
+}
+
+/**************
+ * routeQuery *
+ **************/
+
+type routeQuery struct {
+	id   uint64
+	dest publicKey
+	path []peerPort
+}
+
+func (q *routeQuery) size() int {
+	return wireSizeUint(q.id) + len(q.dest) + wireSizePath(q.path)
+}
+
+func (q *routeQuery) encode(out []byte) ([]byte, error) {
+	start := len(out)
+	out = wireAppendUint(out, q.id)
+	out = append(out, q.dest[:]...)
+	out = wireAppendPath(out, q.path)
+	if len(out)-start != q.size() {
+		panic("this should never happen")
+	}
+	return out, nil
+}
+
+func (q *routeQuery) decode(data []byte) error {
+	var tmp routeQuery
+	if !wireChopUint(&tmp.id, &data) {
+		return types.ErrDecodeTruncated
+	} else if !wireChopSlice(tmp.dest[:], &data) {
+		return types.ErrDecodeTruncated
+	} else if err := wireChopPath(&tmp.path, &data); err != nil {
+		return err
+	} else if len(data) != 0 {
+		return types.ErrDecodeTrailingBytes
+	}
+	*q = tmp
+	return nil
+}
+
+/**************
+ * routeReply *
+ **************/
+
+type routeReply struct {
+	id     uint64
+	status byte
+	next   publicKey
+	port   uint64
+	dist   uint64
+}
+
+func (r *routeReply) size() int {
+	size := wireSizeUint(r.id) + 1
+	if r.status == routeStatusNext {
+		size += len(r.next) + wireSizeUint(r.port) + wireSizeUint(r.dist)
+	}
+	return size
+}
+
+func (r *routeReply) encode(out []byte) ([]byte, error) {
+	start := len(out)
+	out = wireAppendUint(out, r.id)
+	out = append(out, r.status)
+	if r.status == routeStatusNext {
+		out = append(out, r.next[:]...)
+		out = wireAppendUint(out, r.port)
+		out = wireAppendUint(out, r.dist)
+	}
+	if len(out)-start != r.size() {
+		panic("this should never happen")
+	}
+	return out, nil
+}
+
+func (r *routeReply) decode(data []byte) error {
+	var tmp routeReply
+	if !wireChopUint(&tmp.id, &data) {
+		return types.ErrDecodeTruncated
+	} else if len(data) < 1 {
+		return types.ErrDecodeTruncated
+	}
+	tmp.status, data = data[0], data[1:]
+	switch tmp.status {
+	case routeStatusNext:
+		if !wireChopSlice(tmp.next[:], &data) {
+			return types.ErrDecodeTruncated
+		} else if !wireChopUint(&tmp.port, &data) {
+			return types.ErrDecodeTruncated
+		} else if !wireChopUint(&tmp.dist, &data) {
+			return types.ErrDecodeTruncated
+		}
+	case routeStatusLocal, routeStatusNone:
+	default:
+		return types.ErrDecode
+	}
+	if len(data) != 0 {
+		return types.ErrDecodeTrailingBytes
+	}
+	*r = tmp
+	return nil
+}
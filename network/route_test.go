@@ -0,0 +1,61 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+func TestTraceRoute(t *testing.T) {
+	// A line a - b - c
+	keys, conns := newLine(t, 3)
+	var hops []ed25519.PublicKey
+	var err error
+	for start := time.Now(); time.Since(start) < 30*time.Second; {
+		// Replies need a path back to us, so the first attempts may time out
+		if hops, err = conns[0].TraceRoute(keys[2], 8, time.Second); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 2 || !hops[0].Equal(keys[1]) || !hops[1].Equal(keys[2]) {
+		t.Fatalf("unexpected hops: %v", hops)
+	}
+	// Stopping early still returns the hops so far
+	if hops, err = conns[0].TraceRoute(keys[2], 1, time.Second); !errors.Is(err, types.ErrTooManyHops) || len(hops) != 1 || !hops[0].Equal(keys[1]) {
+		t.Fatalf("unexpected result: %v %v", hops, err)
+	}
+	if hops, err = conns[0].TraceRoute(keys[0], 8, time.Second); err != nil || len(hops) != 0 {
+		t.Fatalf("unexpected result for our own key: %v %v", hops, err)
+	}
+	// Nobody has this key, so we should time out after a single lookup, without leaving anything behind
+	var unknown publicKey
+	unknown[0] = 1
+	r := &conns[0].core.router
+	var lookups int32
+	phony.Block(r, func() {
+		r.pathfinder.logger = func(lookup *pathLookup) {
+			if lookup.dest == unknown {
+				atomic.AddInt32(&lookups, 1)
+			}
+		}
+	})
+	if _, err = conns[0].TraceRoute(unknown.toEd(), 8, 500*time.Millisecond); !errors.Is(err, types.ErrTimeout) {
+		t.Fatalf("expected types.ErrTimeout, got %v", err)
+	}
+	var waiting int
+	phony.Block(r, func() {
+		waiting = len(r.pathfinder.waiting)
+	})
+	if n := atomic.LoadInt32(&lookups); n != 1 || waiting != 0 {
+		t.Fatalf("expected 1 lookup and no waiters, got %d and %d", n, waiting)
+	}
+}
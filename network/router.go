@@ -1,8 +1,12 @@
 package network
 
 import (
+	"crypto/ed25519"
 	crand "crypto/rand"
 	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	//"fmt"
@@ -41,13 +45,16 @@ type router struct {
 	core       *core
 	pathfinder pathfinder                           // see pathfinder.go
 	blooms     blooms                               // see bloomfilter.go
+	broadcasts broadcasts                           // see broadcast.go
+	epochs     epochs                               // see topology.go
 	peers      map[publicKey]map[*peer]struct{}     // True if we're allowed to send a mirror to this peer (but have not done so already)
 	sent       map[publicKey]map[publicKey]struct{} // tracks which info we've sent to our peer
 	ports      map[peerPort]publicKey               // used in tree lookups
 	infos      map[publicKey]routerInfo
 	timers     map[publicKey]*time.Timer
-	ancs       map[publicKey][]publicKey // Peer ancestry info
-	cache      map[publicKey][]peerPort  // Cache path slice for each peer
+	updated    map[publicKey]time.Time         // when each info was last updated, see ExportState
+	ancs       map[publicKey][]publicKey       // Peer ancestry info
+	cache      map[publicKey]*routerCacheEntry // Cache path slice for each peer
 	requests   map[publicKey]routerSigReq
 	responses  map[publicKey]routerSigRes
 	resSeqs    map[publicKey]uint64
@@ -56,40 +63,158 @@ type router struct {
 	doRoot1    bool
 	doRoot2    bool
 	mainTimer  *time.Timer
+	mainTime   time.Time       // last time maintenance ran
+	selfPath   []peerPort      // our own path from the root, as of the last maintenance
+	pathTime   time.Time       // when selfPath last changed, see WithWatermarkSlack
+	revived    func()          // see PacketConn.SetSelfRevivedHandler
+	waitReady  []chan struct{} // see PacketConn.WaitReady
+	draining   bool            // we're shutting down, so our infos say so, see PacketConn.Drain
+	seqBase    uint64          // our seq from before a restart, see WithSeqStore
+	rootTime   time.Time       // when doRoot1 can turn into doRoot2, see WithRootJitter
+
+	unreachable map[publicKey]time.Time // when we last reported each destination, see WithUnreachableReports
+	parentTime  time.Time               // when our parent last changed, see WithParentHysteresis
+	cacheUses   uint64                  // counts lookups in cache, see routerCacheEntry.used
+	converged   bool                    // true if we've called convergedHandler since our parent last changed
+	visited     map[publicKey]struct{}  // scratch space for _getRootAndPath
+	leaves      map[publicKey]struct{}  // peers that declined our requests, see WithLeafMode
+	pinned      map[publicKey]struct{}  // infos the announce filter said to keep, see WithRouterMaxInfos
+	annDirty    bool                    // an info changed since the last action, see WithEagerAnnounce
+	expectTime  time.Time               // when we stop waiting for the expected root, see WithExpectedRoot
+
+	convergedHandler func(parent ed25519.PublicKey) // see PacketConn.SetConvergedHandler
+
+	oneWayHandler func(key ed25519.PublicKey, port uint64, oneWay bool) // see PacketConn.SetOneWayPeerHandler
+
+	capacityHandler func(current, max int, evicted ed25519.PublicKey) // see PacketConn.SetCapacityHandler
 }
 
 func (r *router) init(c *core) {
 	r.core = c
 	r.pathfinder.init(r)
 	r.blooms.init(r)
+	r.broadcasts.init(r)
+	r.epochs.init(r)
 	r.peers = make(map[publicKey]map[*peer]struct{})
 	r.sent = make(map[publicKey]map[publicKey]struct{})
 	r.ports = make(map[peerPort]publicKey)
 	r.infos = make(map[publicKey]routerInfo)
 	r.timers = make(map[publicKey]*time.Timer)
+	r.updated = make(map[publicKey]time.Time)
 	r.ancs = make(map[publicKey][]publicKey)
-	r.cache = make(map[publicKey][]peerPort)
+	r.cache = make(map[publicKey]*routerCacheEntry)
 	r.requests = make(map[publicKey]routerSigReq)
 	r.responses = make(map[publicKey]routerSigRes)
 	r.resSeqs = make(map[publicKey]uint64)
+	r.leaves = make(map[publicKey]struct{})
+	r.pinned = make(map[publicKey]struct{})
+	if store := c.config.seqStore; store != nil {
+		r.seqBase, _ = store.Load(c.crypto.publicKey.toEd())
+	}
 	// Kick off actor to do initial work / become root
 	r.mainTimer = time.AfterFunc(time.Second, func() {
-		r.Act(nil, r._doMaintenance)
+		r.act(nil, r._doMaintenance)
+	})
+	if wait := r._expectedRootWait(); wait > 0 {
+		r._waitRoot(wait)
+		r.expectTime = r.rootTime
+	} else if c.config.startupListen > 0 || c.config.rootJitter > 0 {
+		r._waitRoot(c.config.startupListen)
+	} else {
+		r.doRoot2 = true
+	}
+	r.act(nil, r._doMaintenance)
+}
+
+// _waitRoot sets doRoot1, so we become root after the given delay (plus jitter), unless we find a parent first.
+func (r *router) _waitRoot(delay time.Duration) {
+	r.doRoot1 = true
+	r.rootTime = time.Now().Add(delay + r._rootJitter())
+	if delay := time.Until(r.rootTime); delay > 0 {
+		// Maintenance only runs once a second, so don't wait for it to notice
+		rootTime := r.rootTime
+		time.AfterFunc(delay, func() {
+			r.act(nil, func() {
+				if r.mainTimer == nil || !r.doRoot1 || r.rootTime != rootTime {
+					return
+				}
+				r.doRoot2 = true
+				r._fix()
+				r._sendAnnounces()
+			})
+		})
+	}
+}
+
+// _expectedRootWait returns how long to wait for the expected root at startup (or the startup listen period, if that's longer), or 0 if there's no reason to wait for it.
+func (r *router) _expectedRootWait() time.Duration {
+	cfg := &r.core.config
+	if len(cfg.expectedRoot) != publicKeySize || cfg.expectedRootWait <= 0 {
+		return 0
+	}
+	var expected publicKey
+	copy(expected[:], cfg.expectedRoot)
+	if !expected.less(r.core.crypto.publicKey) {
+		return 0 // We'd be a better root, so it would join our tree anyway
+	}
+	if cfg.startupListen > cfg.expectedRootWait {
+		return cfg.startupListen
+	}
+	return cfg.expectedRootWait
+}
+
+// _waitingForRoot returns true if we're still waiting for the expected root, and bestRoot is worse than it, see WithExpectedRoot.
+func (r *router) _waitingForRoot(bestRoot publicKey) bool {
+	if r.expectTime.IsZero() || !time.Now().Before(r.expectTime) {
+		return false
+	}
+	var expected publicKey
+	copy(expected[:], r.core.config.expectedRoot)
+	return expected.less(bestRoot)
+}
+
+// _rootJitter returns our delay before becoming root, see WithRootJitter.
+// It's proportional to our key, so lower keys go first.
+func (r *router) _rootJitter() time.Duration {
+	max := r.core.config.rootJitter
+	if max <= 0 {
+		return 0
+	}
+	frac := float64(binary.BigEndian.Uint64(r.core.crypto.publicKey[:8])) / (1 << 64)
+	return time.Duration(frac * float64(max))
+}
+
+// act is like r.Act, but keeps count of how many messages are waiting for the router, see metrics.
+// This should be used for everything sent to the router, other than phony.Block.
+func (r *router) act(from phony.Actor, action func()) {
+	atomic.AddInt64(&r.core.metrics.routerPending, 1)
+	r.Act(from, func() {
+		atomic.AddInt64(&r.core.metrics.routerPending, -1)
+		action()
+		if r.annDirty && r.core.config.eagerAnnounce {
+			r.annDirty = false
+			r._sendAnnounces()
+		}
+		r._checkReady()
 	})
-	r.doRoot2 = true
-	r.Act(nil, r._doMaintenance)
 }
 
 func (r *router) _doMaintenance() {
 	if r.mainTimer == nil {
 		return
 	}
-	r.doRoot2 = r.doRoot2 || r.doRoot1
+	r.mainTime = time.Now()
+	r.doRoot2 = r.doRoot2 || (r.doRoot1 && !r.mainTime.Before(r.rootTime))
 	r._resetCache() // Resets path caches, since that info may no longer be good, TODO? don't wait for maintenance to do this
 	r._updateAncestries()
-	r._fix()           // Selects new parent, if needed
+	r._probePeers()
+	r._fix() // Selects new parent, if needed
+	r._checkSelfPath()
+	r._checkConverged()
 	r._sendAnnounces() // Sends announcements to peers, if needed
 	r.blooms._doMaintenance()
+	r.broadcasts._doMaintenance()
+	r._sweepUnreachable()
 	r.mainTimer.Reset(time.Second)
 }
 
@@ -108,8 +233,20 @@ func (r *router) _resetCache() {
 	}
 }
 
+// _invalidateCache drops the cached paths that depended on the key's info, see _getDist.
+func (r *router) _invalidateCache(key publicKey) {
+	for k, entry := range r.cache {
+		for _, anc := range entry.ancs {
+			if anc == key {
+				delete(r.cache, k)
+				break
+			}
+		}
+	}
+}
+
 func (r *router) addPeer(from phony.Actor, p *peer) {
-	r.Act(from, func() {
+	r.act(from, func() {
 		//r._resetCache()
 		if _, isIn := r.peers[p.key]; !isIn {
 			r.peers[p.key] = make(map[*peer]struct{})
@@ -127,22 +264,36 @@ func (r *router) addPeer(from phony.Actor, p *peer) {
 			}
 		}
 		r.peers[p.key][p] = struct{}{}
+		var isNew bool
 		if _, isIn := r.responses[p.key]; !isIn {
 			if _, isIn := r.requests[p.key]; !isIn {
 				r.requests[p.key] = *r._newReq()
+				isNew = true
 			}
 			req := r.requests[p.key]
 			p.sendSigReq(r, &req)
 		}
-		r.blooms._sendBloom(p)
+		// The peer has to answer a request that was only sent over this link, to prove that it has the key it claims (see peer.handler)
+		if isNew {
+			p.challenge = r.requests[p.key]
+		} else {
+			// Other links to this key may have seen the shared request, so this link gets its own
+			p.challenge = *r._newReq()
+			req := p.challenge
+			p.sendSigReq(r, &req)
+		}
+		// The link isn't used for traffic, lookups, or blooms until it answers the challenge, see _handleResponse
 	})
 }
 
 func (r *router) removePeer(from phony.Actor, p *peer) {
-	r.Act(from, func() {
+	r.act(from, func() {
 		//r._resetCache()
 		ps := r.peers[p.key]
 		delete(ps, p)
+		if atomic.SwapInt32(&p.oneWay, 0) != 0 {
+			atomic.AddInt64(&r.core.metrics.peersOneWay, -1)
+		}
 		if len(ps) == 0 {
 			delete(r.peers, p.key)
 			delete(r.sent, p.key)
@@ -152,13 +303,16 @@ func (r *router) removePeer(from phony.Actor, p *peer) {
 			delete(r.resSeqs, p.key)
 			delete(r.ancs, p.key)
 			delete(r.cache, p.key)
+			delete(r.leaves, p.key)
 			r.blooms._removeInfo(p.key)
-			//r._fix()
+			r._fix()
 		} else {
 			// The bloom the remote node is tracking could be wrong due to a race
 			// TODO? don't send it immediately, reset the "sent" state to blank so we'll resend next maintenance period
 			for p := range ps {
-				r.blooms._sendBloom(p)
+				if p.proven {
+					r.blooms._sendBloom(p)
+				}
 			}
 		}
 	})
@@ -210,38 +364,68 @@ func (r *router) _updateAncestries() {
 }
 
 func (r *router) _fix() {
-	bestRoot := r.core.crypto.publicKey
+	bestRoot := r._worstRoot()
 	bestParent := r.core.crypto.publicKey
 	self := r.infos[r.core.crypto.publicKey]
 	// Check if our current parent leads to a better root than ourself
-	if _, isIn := r.peers[self.parent]; isIn {
-		root, _ := r._getRootAndDists(r.core.crypto.publicKey)
-		if root.less(bestRoot) {
+	if _, isIn := r.peers[self.parent]; isIn && !r._isOneWay(self.parent) {
+		root, dists := r._getRootAndDists(r.core.crypto.publicKey)
+		if root.less(bestRoot) && len(dists)-1 <= r.core.config.maxPathLength {
 			bestRoot, bestParent = root, self.parent
 		}
 	}
 	// Check if we know a better root/parent
 	for pk := range r.responses {
-		if _, isIn := r.infos[pk]; !isIn {
+		if info, isIn := r.infos[pk]; !isIn || info.isLeaving(pk) {
 			// We don't know where this peer is
 			continue
 		}
+		if r._isOneWay(pk) {
+			// They can't hear us, so they'd never get our traffic
+			continue
+		}
 		pRoot, pDists := r._getRootAndDists(pk)
 		if _, isIn := pDists[r.core.crypto.publicKey]; isIn {
 			// This would loop through us already
 			continue
 		}
+		if len(pDists) > r.core.config.maxPathLength {
+			// This would put us too far from the root (pDists includes the peer and its root, so its length is our depth)
+			continue
+		}
 		if pRoot.less(bestRoot) {
 			bestRoot, bestParent = pRoot, pk
 		} else if pRoot != bestRoot {
 			continue // wrong root
 		}
+		if r._isDraining(pk) != r._isDraining(bestParent) {
+			if !r._isDraining(pk) {
+				bestRoot, bestParent = pRoot, pk
+			}
+			continue // Only pick a parent that's shutting down if there's nothing else, see PacketConn.Drain
+		}
+		c := r._compareCosts(pk, bestParent)
+		if c == 0 {
+			c = r._compareLinks(pk, bestParent)
+		}
+		if c < 0 {
+			bestRoot, bestParent = pRoot, pk
+			continue // A cheaper or materially better link, see WithLinkCosts and WithParentQuality
+		} else if c > 0 {
+			continue
+		}
 		if (r.refresh || bestParent != self.parent) && r.resSeqs[pk] < r.resSeqs[bestParent] {
 			// It's time to refresh our self info
 			// If we're going to change to a better parent, now seems like the time...
+			if bestParent == self.parent && !r._allowParentSwitch(self.parent, len(pDists)) {
+				continue // Stick with the parent we have, see WithParentHysteresis
+			}
 			bestRoot, bestParent = pRoot, pk
 		}
 	}
+	if r._waitingForRoot(bestRoot) {
+		return // Nothing we know of is as good as the root we expect, so keep waiting for it
+	}
 	if r.refresh || r.doRoot1 || r.doRoot2 || self.parent != bestParent {
 		res, isIn := r.responses[bestParent]
 		switch {
@@ -256,7 +440,7 @@ func (r *router) _fix() {
 		case r.doRoot2:
 			// Become root
 			if !r._becomeRoot() {
-				panic("this should never happen")
+				break // The signer failed, try again next time
 			}
 			/*
 				self = r.infos[r.core.crypto.publicKey]
@@ -272,7 +456,7 @@ func (r *router) _fix() {
 			r.doRoot2 = false
 			r._sendReqs()
 		case !r.doRoot1:
-			r.doRoot1 = true
+			r._waitRoot(0)
 			// No need to sendReqs in this case
 			//  either we already have a req, or we've already requested one
 			//  so resetting and re-requesting is just a waste of bandwidth
@@ -281,6 +465,7 @@ func (r *router) _fix() {
 			// So this is a no-op
 		}
 	}
+	r.epochs._update()
 }
 
 func (r *router) _sendAnnounces() {
@@ -348,27 +533,91 @@ func (r *router) _newReq() *routerSigReq {
 	nonce := make([]byte, 8)
 	crand.Read(nonce) // If there's an error, there's not much to do...
 	req.nonce = binary.BigEndian.Uint64(nonce)
-	req.seq = r.infos[r.core.crypto.publicKey].seq + 1
+	req.seq = r.infos[r.core.crypto.publicKey].seq
+	if r.seqBase > req.seq {
+		req.seq = r.seqBase
+	}
+	req.seq++
 	return &req
 }
 
+// routerLeavingPort marks a root announcement as a leaving announcement, see _sendLeaving.
+// A normal root announcement always uses port 0.
+const routerLeavingPort = ^peerPort(0)
+
+// _sendLeaving tells the network that we're shutting down, if we're the root, so nodes don't have to wait for our info to time out.
+// This is a root announcement with a new seq and routerLeavingPort, which replaces our info everywhere under the usual _update rules.
+func (r *router) _sendLeaving() {
+	self, isIn := r.infos[r.core.crypto.publicKey]
+	if !isIn || self.parent != r.core.crypto.publicKey || self.isLeaving(r.core.crypto.publicKey) {
+		return
+	}
+	req := r._newReq()
+	res := routerSigRes{
+		routerSigReq: *req,
+		port:         routerLeavingPort,
+	}
+	var err error
+	if res.psig, err = r.core.crypto.sign(res.bytesForSig(r.core.crypto.publicKey, r.core.crypto.publicKey)); err != nil {
+		return // Nodes will have to wait for our info to time out
+	}
+	ann := &routerAnnounce{
+		key:          r.core.crypto.publicKey,
+		parent:       r.core.crypto.publicKey,
+		routerSigRes: res,
+	}
+	if err = r._signAnnounce(ann); err != nil {
+		return
+	}
+	if !ann.check() || !r._update(ann) {
+		panic("this should never happen")
+	}
+	for k, ps := range r.peers {
+		r.sent[k][ann.key] = struct{}{}
+		for p := range ps {
+			p.sendAnnounce(r, ann)
+		}
+	}
+}
+
+// _signAnnounce signs our announcement, including the extension that only peers with featureAnnounceExt get, see routerAnnounceExt.
+func (r *router) _signAnnounce(ann *routerAnnounce) error {
+	var err error
+	if ann.sig, err = r.core.crypto.sign(ann.bytesForSig(ann.key, ann.parent)); err != nil {
+		return err
+	}
+	ann.time = uint64(r._now().Unix())
+	ann.draining = r.draining
+	if link := r._bestLink(ann.parent, false); link != nil && ann.parent != ann.key {
+		ann.cost = link.cost
+	}
+	ann.xsig, err = r.core.crypto.sign(ann.extBytesForSig())
+	return err
+}
+
+// _becomeRoot returns false if the signer failed, in which case nothing changed.
 func (r *router) _becomeRoot() bool {
 	req := r._newReq()
 	res := routerSigRes{
 		routerSigReq: *req,
 		port:         0, // TODO? something else?
 	}
-	res.psig = r.core.crypto.privateKey.sign(res.bytesForSig(r.core.crypto.publicKey, r.core.crypto.publicKey))
+	var err error
+	if res.psig, err = r.core.crypto.sign(res.bytesForSig(r.core.crypto.publicKey, r.core.crypto.publicKey)); err != nil {
+		return false
+	}
 	ann := routerAnnounce{
 		key:          r.core.crypto.publicKey,
 		parent:       r.core.crypto.publicKey,
 		routerSigRes: res,
-		sig:          res.psig,
 	}
-	if !ann.check() {
+	if err = r._signAnnounce(&ann); err != nil {
+		return false
+	}
+	if !ann.check() || !r._update(&ann) {
 		panic("this should never happen")
 	}
-	return r._update(&ann)
+	return true
 }
 
 func (r *router) _handleRequest(p *peer, req *routerSigReq) {
@@ -376,18 +625,55 @@ func (r *router) _handleRequest(p *peer, req *routerSigReq) {
 		routerSigReq: *req,
 		port:         p.port,
 	}
-	res.psig = r.core.crypto.privateKey.sign(res.bytesForSig(p.key, r.core.crypto.publicKey))
-	p.sendSigRes(r, &res)
+	if r.core.config.leaf {
+		res.port = routerDeclinedPort // We still answer, so the peer can check our key
+	}
+	// The response only depends on the request and the peer's port, so the signing actor can take care of it
+	c := &r.core.crypto
+	c.signing.Act(r, func() {
+		sig, err := c.sign(res.bytesForSig(p.key, c.publicKey))
+		if err != nil {
+			return // The peer will ask again
+		}
+		res.psig = sig
+		p.sendSigRes(&c.signing, &res)
+	})
 }
 
 func (r *router) handleRequest(from phony.Actor, p *peer, req *routerSigReq) {
-	r.Act(from, func() {
+	r.act(from, func() {
 		r._handleRequest(p, req)
 	})
 }
 
 func (r *router) _handleResponse(p *peer, res *routerSigRes) {
-	if _, isIn := r.responses[p.key]; !isIn && r.requests[p.key] == res.routerSigReq {
+	if res.routerSigReq == p.challenge {
+		if !p.proven {
+			p.proven = true
+			p.proved()
+			// Now the link can take part in lookups, starting with the bloom it sent before it was proven (it won't send another unless something changes)
+			if p.unprovenBloom != nil {
+				r.blooms._handleBloom(p, p.unprovenBloom)
+				p.unprovenBloom = nil
+			}
+			r.blooms._sendBloom(p)
+		}
+		p.acked = time.Now()
+		r._setOneWay(p, false)
+	}
+	if r.requests[p.key] != res.routerSigReq {
+		return // Stale or unsolicited, so it says nothing about the peer now
+	}
+	if res.port == routerDeclinedPort {
+		r.leaves[p.key] = struct{}{}
+		return
+	}
+	if uint64(res.port) >= r.core.config.maxPort {
+		atomic.AddInt64(&r.core.metrics.dropBadPort, 1)
+		return // We'd be signing a port that we (and nodes with the same limit) won't accept, see WithMaxPort
+	}
+	delete(r.leaves, p.key) // It answered our latest request with a real port, so it isn't a leaf (anymore)
+	if _, isIn := r.responses[p.key]; !isIn {
 		r.resSeqCtr++
 		r.resSeqs[p.key] = r.resSeqCtr
 		r.responses[p.key] = *res
@@ -395,14 +681,29 @@ func (r *router) _handleResponse(p *peer, res *routerSigRes) {
 	}
 }
 
+// _allowParentSwitch returns true if we should switch from our current parent to a peer with the same root, that would put us at the given depth.
+// That's always the case unless WithParentHysteresis is used.
+func (r *router) _allowParentSwitch(parent publicKey, depth int) bool {
+	cfg := &r.core.config
+	if cfg.parentMargin == 0 && cfg.parentHold == 0 {
+		return true
+	}
+	if time.Since(r.parentTime) < cfg.parentHold {
+		return true
+	}
+	_, dists := r._getRootAndDists(parent)
+	return len(dists)-depth > cfg.parentMargin
+}
+
 func (r *router) _useResponse(peerKey publicKey, res *routerSigRes) bool {
-	bs := res.bytesForSig(r.core.crypto.publicKey, peerKey)
-	info := routerInfo{
+	ann := &routerAnnounce{
+		key:          r.core.crypto.publicKey,
 		parent:       peerKey,
 		routerSigRes: *res,
-		sig:          r.core.crypto.privateKey.sign(bs),
 	}
-	ann := info.getAnnounce(r.core.crypto.publicKey)
+	if err := r._signAnnounce(ann); err != nil {
+		return false
+	}
 	if r._update(ann) {
 		/*
 			for _, ps := range r.peers {
@@ -417,7 +718,7 @@ func (r *router) _useResponse(peerKey publicKey, res *routerSigRes) bool {
 }
 
 func (r *router) handleResponse(from phony.Actor, p *peer, res *routerSigRes) {
-	r.Act(from, func() {
+	r.act(from, func() {
 		r._handleResponse(p, res)
 	})
 }
@@ -432,11 +733,13 @@ func (r *router) _update(ann *routerAnnounce) bool {
 		 *********************************/
 		case info.seq > ann.seq:
 			// This is an old seq, so exit
+			atomic.AddInt64(&r.core.metrics.annOldSeq, 1)
 			return false
 		case info.seq < ann.seq:
 			// This is a newer seq, so don't exit
 		case info.parent.less(ann.parent):
 			// same seq, worse (higher) parent
+			atomic.AddInt64(&r.core.metrics.annWorseParent, 1)
 			return false
 		case ann.parent.less(info.parent):
 			// same seq, better (lower) parent, so don't exit
@@ -444,26 +747,38 @@ func (r *router) _update(ann *routerAnnounce) bool {
 			// same seq and parent, lower nonce, so don't exit
 		default:
 			// same seq and parent, same or worse nonce, so exit
+			atomic.AddInt64(&r.core.metrics.annNonce, 1)
 			return false
 		}
 	}
+	atomic.AddInt64(&r.core.metrics.annAccepted, 1)
+	r.annDirty = true
 	// Clean up sent info and cache
 	for _, sent := range r.sent {
 		delete(sent, ann.key)
 	}
-	r._resetCache()
+	r._invalidateCache(ann.key)
 	// Save info
 	info := routerInfo{
-		parent:       ann.parent,
-		routerSigRes: ann.routerSigRes,
-		sig:          ann.sig,
+		parent:            ann.parent,
+		routerSigRes:      ann.routerSigRes,
+		sig:               ann.sig,
+		routerAnnounceExt: ann.routerAnnounceExt,
 	}
 	key := ann.key
 	var timer *time.Timer
+	updated := time.Now()
 	if key == r.core.crypto.publicKey {
+		atomic.AddInt64(&r.core.metrics.selfUpdates, 1)
+		if old, isIn := r.infos[key]; !isIn || old.parent != info.parent {
+			r._parentChanged(info.parent)
+		}
+		if store := r.core.config.seqStore; store != nil {
+			store.Store(key.toEd(), ann.seq)
+		}
 		delay := r.core.config.routerRefresh // TODO? slightly randomize
 		timer = time.AfterFunc(delay, func() {
-			r.Act(nil, func() {
+			r.act(nil, func() {
 				if r.timers[key] == timer {
 					r.refresh = true
 					//r._fix()
@@ -471,16 +786,15 @@ func (r *router) _update(ann *routerAnnounce) bool {
 			})
 		})
 	} else {
-		timer = time.AfterFunc(r.core.config.routerTimeout, func() {
-			r.Act(nil, func() {
+		// Whether we accept an info only depends on what's in it, never on our clock, so nodes that disagree about the time don't hand it back and forth
+		// With WithSignedExpiry, the timeout started when the node signed it, so if that's already passed then the timer fires right away
+		now := r._now()
+		age := now.Sub(r._signedTime(ann, now))
+		updated = updated.Add(-age)
+		timer = time.AfterFunc(r.core.config.routerTimeout-age, func() {
+			r.act(nil, func() {
 				if r.timers[key] == timer {
-					timer.Stop() // Shouldn't matter, but just to be safe...
-					delete(r.infos, key)
-					delete(r.timers, key)
-					for _, sent := range r.sent {
-						delete(sent, key)
-					}
-					r._resetCache()
+					r._expire(key)
 					//r._fix()
 				}
 			})
@@ -490,18 +804,72 @@ func (r *router) _update(ann *routerAnnounce) bool {
 		oldTimer.Stop()
 	}
 	r.timers[ann.key] = timer
+	r.updated[ann.key] = updated
 	r.infos[ann.key] = info
 	return true
 }
 
+func (r *router) _expire(key publicKey) {
+	if timer, isIn := r.timers[key]; isIn {
+		timer.Stop() // Shouldn't matter if this is called by the timer, but just to be safe...
+	}
+	delete(r.infos, key)
+	delete(r.timers, key)
+	delete(r.updated, key)
+	delete(r.pinned, key)
+	for _, sent := range r.sent {
+		delete(sent, key)
+	}
+	r._invalidateCache(key)
+}
+
+// _handleAnnounce stores and passes on an announcement, which has already passed routerAnnounce.check.
+// The signatures prove that the node and its parent agreed on the port, but not that the link still exists, or which peer relayed it.
+// The one case we can check ourselves is when we're the parent, since then the port must be the one we use for that peer now.
+// Any other port is trusted as far as the parent's signature goes, and a stale one is eventually replaced by a newer seq.
 func (r *router) _handleAnnounce(p *peer, ann *routerAnnounce) {
+	if !r._checkAnnouncePort(ann) {
+		atomic.AddInt64(&r.core.metrics.dropBadPort, 1)
+		return
+	}
+	if ann.key != r.core.crypto.publicKey && !ann.isLeaving() {
+		if _, dists := r._getRootAndDists(ann.parent); len(dists) > r.core.config.maxPathLength {
+			// This would put the node deeper than the max path length, as far as we know
+			atomic.AddInt64(&r.core.metrics.dropTooDeep, 1)
+			return
+		}
+	}
+	verdict := r._filterAnnounce(ann)
+	if verdict == AnnounceReject {
+		atomic.AddInt64(&r.core.metrics.dropFiltered, 1)
+		return
+	}
+	if _, isIn := r.infos[ann.key]; !isIn && !r._makeRoom(ann, verdict) {
+		atomic.AddInt64(&r.core.metrics.dropInfoCap, 1)
+		return
+	}
+	leaving := ann.isLeaving() && ann.key != r.core.crypto.publicKey
+	var oldRoot publicKey
+	if leaving {
+		oldRoot, _ = r._getRootAndDists(r.core.crypto.publicKey)
+	}
 	if r._update(ann) {
+		r._pin(ann.key, verdict)
+		if leaving {
+			r._handleLeaving(p, ann, oldRoot == ann.key)
+			return
+		}
 		if ann.key == r.core.crypto.publicKey {
 			// We just updated our own info from a message we received by a peer
 			// That suggests we went offline, so our seq reset when we came back
 			// The info they sent us could have been expired (see below in this function)
 			// So we need to set that an update is required, as if our refresh timer has passed
 			r.refresh = true
+			if r.revived != nil {
+				r.revived()
+			}
+			// Every announcement we send is rejected until we replace this info, so don't wait for maintenance
+			r._fix()
 		}
 		// No point in sending this back to the original sender
 		r.sent[p.key][ann.key] = struct{}{}
@@ -509,11 +877,18 @@ func (r *router) _handleAnnounce(p *peer, ann *routerAnnounce) {
 	} else {
 		// We didn't accept the info, because we alerady know it or something better
 		info := routerInfo{
-			parent:       ann.parent,
-			routerSigRes: ann.routerSigRes,
-			sig:          ann.sig,
+			parent:            ann.parent,
+			routerSigRes:      ann.routerSigRes,
+			sig:               ann.sig,
+			routerAnnounceExt: ann.routerAnnounceExt,
+		}
+		r._attachExt(ann)
+		oldInfo := r.infos[ann.key]
+		if p.features&featureAnnounceExt == 0 {
+			// They can't have the extension, so don't count its absence as worse
+			oldInfo.routerAnnounceExt = routerAnnounceExt{}
 		}
-		if oldInfo := r.infos[ann.key]; info != oldInfo {
+		if info != oldInfo {
 			// They sent something, but it was worse
 			// Should we tell them what we know
 			// Only to the p that sent it, since we'll spam the rest as messages arrive...
@@ -527,48 +902,198 @@ func (r *router) _handleAnnounce(p *peer, ann *routerAnnounce) {
 	}
 }
 
+// _checkAnnouncePort returns false if the announcement says we're the parent of one of our peers, but over a port we don't use for that peer.
+// That happens for infos signed over an old link, if the port was given to a different peer after the link closed.
+// It also returns false if the port isn't below the limit set by WithMaxPort.
+func (r *router) _checkAnnouncePort(ann *routerAnnounce) bool {
+	if uint64(ann.port) >= r.core.config.maxPort && ann.port != routerLeavingPort {
+		return false
+	}
+	if ann.parent != r.core.crypto.publicKey || ann.key == ann.parent {
+		return true
+	}
+	for q := range r.peers[ann.key] {
+		return q.port == ann.port // Every link to a key uses the same port
+	}
+	return true // Not our peer (anymore), so there's nothing to compare with
+}
+
+// _attachExt adds the announcement's extension to the info we have for it, if that's the same info without one.
+// This happens outside of _update, so the extension never changes which of two infos wins, and infos merge the same way on every node.
+func (r *router) _attachExt(ann *routerAnnounce) {
+	info, isIn := r.infos[ann.key]
+	if !isIn || info.hasExt() || !ann.hasExt() {
+		return
+	}
+	if info.parent != ann.parent || info.routerSigRes != ann.routerSigRes || info.sig != ann.sig {
+		return
+	}
+	info.routerAnnounceExt = ann.routerAnnounceExt
+	r.infos[ann.key] = info
+	// Peers that support the extension should get it too, the rest will just see the same info again
+	for _, sent := range r.sent {
+		delete(sent, ann.key)
+	}
+}
+
 func (r *router) handleAnnounce(from phony.Actor, p *peer, ann *routerAnnounce) {
-	r.Act(from, func() {
+	r.act(from, func() {
 		r._handleAnnounce(p, ann)
 	})
 }
 
+func (r *router) _handleLeaving(p *peer, ann *routerAnnounce, wasRoot bool) {
+	// Flood this to everyone else right away, rather than waiting for maintenance
+	// Nodes only forward it the first time, since _update rejects copies, so the flood stops on its own
+	for k, ps := range r.peers {
+		r.sent[k][ann.key] = struct{}{}
+		if k == p.key {
+			continue
+		}
+		for q := range ps {
+			q.sendAnnounce(r, ann)
+		}
+	}
+	if wasRoot {
+		if r.core.config.rootJitter > 0 {
+			// Everyone just lost the same root, so spread out who replaces it
+			r._waitRoot(0)
+			r._fix() // We may already know another way to a different root
+			return
+		}
+		// Our root is gone, so there's no point in the usual delay before self-rooting
+		r.doRoot2 = true
+		r._fix()
+		r._sendAnnounces()
+	}
+}
+
+func (r *router) handleGoodbye(from phony.Actor, p *peer) {
+	r.act(from, func() {
+		// The peer is shutting down cleanly, so there's no reason to wait for their info to time out
+		// Expiring it now lets us pick a new parent immediately, if they were our parent
+		// If they sent a leaving announcement, keep it until it times out, so older infos for them aren't accepted again
+		if info, isIn := r.infos[p.key]; !isIn || !info.isLeaving(p.key) {
+			r._expire(p.key)
+		}
+		r._fix()
+	})
+}
+
 func (r *router) sendTraffic(tr *traffic) {
 	// This must be non-blocking, to prevent deadlocks between read/write paths in the encrypted package
 	// Basically, WriteTo and ReadFrom can't be allowed to block each other, but they could if we allowed backpressure here
 	// There may be a better way to handle this, but it practice it probably won't be an issue (we'll throw the packet in a queue somewhere, or drop it)
-	r.Act(nil, func() {
+	r.act(nil, func() {
 		r.pathfinder._handleTraffic(tr)
 	})
 }
 
 func (r *router) handleTraffic(from phony.Actor, tr *traffic) {
-	r.Act(from, func() {
-		if p := r._lookup(tr.path, &tr.watermark); p != nil {
+	r.act(from, func() {
+		watermark := tr.watermark
+		p := r._lookupFlow(tr.path, &tr.watermark, tr)
+		if self := r.core.crypto.publicKey; r.core.config.leaf && tr.source != self && tr.dest != self {
+			p = nil // We don't relay, see WithLeafMode
+		}
+		if p != nil {
+			r._trace(tr, TraceForwarded, p)
 			p.sendTraffic(r, tr)
 		} else if tr.dest == r.core.crypto.publicKey {
+			r._trace(tr, TraceDelivered, nil)
 			r.pathfinder._resetTimeout(tr.source)
+			r.pathfinder._resetBackoff(tr.source)
+			r.pathfinder._recordRecv(tr.source, len(tr.payload))
 			r.core.pconn.handleTraffic(r, tr)
 		} else {
 			// Not addressed to us, and we don't know a next hop.
 			// The path is broken, so do something about that.
+			atomic.AddInt64(&r.core.metrics.dropNoRoute, 1)
+			r._trace(tr, TraceDropped, nil)
 			r.pathfinder._doBroken(tr)
+			reason := byte(unreachableNoRoute)
+			if dist := r._getDist(tr.path, r.core.crypto.publicKey); dist >= watermark && dist-watermark >= r._watermarkSlack() {
+				reason = unreachableLoop
+			}
+			r._sendUnreachable(tr, reason)
+			freeTraffic(tr)
 		}
 	})
 }
 
+// _getChildren returns the port of each peer that currently has us as its parent.
+// Infos are only accepted if the response from us checks out (see _handleAnnounce), and the port must still belong to one of our links to the peer.
+// A child that picks a new parent stops being listed as soon as we _update its info.
+func (r *router) _getChildren() map[publicKey]peerPort {
+	selfKey := r.core.crypto.publicKey
+	children := make(map[publicKey]peerPort)
+	for key, ps := range r.peers {
+		info, isIn := r.infos[key]
+		if !isIn || info.parent != selfKey {
+			continue
+		}
+		for p := range ps {
+			if p.port == info.port {
+				children[key] = info.port
+			}
+		}
+	}
+	return children
+}
+
+// _getParentCandidates returns our current parent, followed by any other peers that _fix could switch to without changing roots, closest to the root first (then by key).
+// That's peers that lead to our root without going through us, which aren't one-way, and wouldn't put us over the max path length.
+// Switching still needs a response from the peer, but we ask every peer for one whenever our info is refreshed.
+// Returns nil if we're the root.
+func (r *router) _getParentCandidates() []publicKey {
+	selfKey := r.core.crypto.publicKey
+	self, isIn := r.infos[selfKey]
+	if !isIn || self.parent == selfKey {
+		return nil
+	}
+	root, _ := r._getRootAndDists(selfKey)
+	var candidates []publicKey
+	depths := make(map[publicKey]int)
+	for pk := range r.peers {
+		if pk == self.parent || r._isOneWay(pk) {
+			continue
+		}
+		if info, isIn := r.infos[pk]; !isIn || info.isLeaving(pk) {
+			continue
+		}
+		pRoot, pDists := r._getRootAndDists(pk)
+		if _, isIn := pDists[selfKey]; isIn || pRoot != root || len(pDists) > r.core.config.maxPathLength {
+			continue
+		}
+		candidates = append(candidates, pk)
+		depths[pk] = len(pDists)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if depths[a] != depths[b] {
+			return depths[a] < depths[b]
+		}
+		return a.less(b)
+	})
+	if _, isIn := r.peers[self.parent]; isIn {
+		candidates = append([]publicKey{self.parent}, candidates...)
+	}
+	return candidates
+}
+
 func (r *router) _getRootAndDists(dest publicKey) (publicKey, map[publicKey]uint64) {
 	// This returns the distances from the destination's root for the destination and each of its ancestors
 	// Note that we skip any expired infos
+	// Chains longer than the max path length are cut off as if they hit a dead end, see _walkLimit
 	dists := make(map[publicKey]uint64)
 	next := dest
 	var root publicKey
 	var dist uint64
-	for {
+	for limit := r._walkLimit(); len(dists) < limit; {
 		if _, isIn := dists[next]; isIn {
 			break
 		}
-		if info, isIn := r.infos[next]; isIn {
+		if info, isIn := r.infos[next]; isIn && !info.isLeaving(next) {
 			root = next
 			dists[next] = dist
 			dist++
@@ -580,17 +1105,46 @@ func (r *router) _getRootAndDists(dest publicKey) (publicKey, map[publicKey]uint
 	return root, dists
 }
 
+// _getRootDistance returns the number of hops from the key's root to the key, based on the infos we know.
+func (r *router) _getRootDistance(key publicKey) int {
+	_, dists := r._getRootAndDists(key)
+	if len(dists) == 0 {
+		return 0
+	}
+	return len(dists) - 1
+}
+
+// _walkLimit returns the most infos that _getRootAndPath or _getRootAndDists will follow.
+// That's enough for a node one hop past the max path length (plus its root), so callers can still tell that it's too deep.
+// Otherwise, a long enough chain of (individually valid) infos would make every lookup walk the whole thing.
+func (r *router) _walkLimit() int {
+	return r.core.config.maxPathLength + 2
+}
+
 func (r *router) _getRootAndPath(dest publicKey) (publicKey, []peerPort) {
 	var ports []peerPort
-	visited := make(map[publicKey]struct{})
+	if r.visited == nil {
+		r.visited = make(map[publicKey]struct{})
+	}
+	visited := r.visited // Reused to avoid allocating, so it must be empty when we return
+	defer func() {
+		for k := range visited {
+			delete(visited, k)
+		}
+	}()
 	var root publicKey
 	next := dest
+	limit := r._walkLimit()
 	for {
 		if _, isIn := visited[next]; isIn {
 			// We hit a loop
 			return dest, nil
 		}
-		if info, isIn := r.infos[next]; isIn {
+		if len(visited) >= limit {
+			// Too deep to be a valid path, treat this like a dead end
+			return dest, nil
+		}
+		if info, isIn := r.infos[next]; isIn && !info.isLeaving(next) {
 			root = next
 			visited[next] = struct{}{}
 			if next == info.parent {
@@ -611,70 +1165,230 @@ func (r *router) _getRootAndPath(dest publicKey) (publicKey, []peerPort) {
 	return root, ports
 }
 
+// routerCacheEntry is a path in router.cache.
+type routerCacheEntry struct {
+	path  []peerPort
+	costs []uint64    // total cost from the root to each node on the path, only with WithLinkCosts
+	ancs  []publicKey // every key whose info was used to find the path, see _invalidateCache
+	used  uint64      // value of router.cacheUses when this was last used, see WithRouterCacheSize
+}
+
+// _getCachedPath returns the key's path from the root, from the cache if possible.
+// If the cache is full (see WithRouterCacheSize), the least recently used path is dropped to make room.
+func (r *router) _getCachedPath(key publicKey) []peerPort {
+	r.cacheUses++
+	if entry, isIn := r.cache[key]; isIn {
+		entry.used = r.cacheUses
+		return entry.path
+	}
+	if size := r.core.config.routerCacheSize; size > 0 && len(r.cache) >= size {
+		var oldest publicKey
+		oldestUse := ^uint64(0)
+		for k, entry := range r.cache {
+			if entry.used < oldestUse {
+				oldest, oldestUse = k, entry.used
+			}
+		}
+		delete(r.cache, oldest)
+	}
+	entry := &routerCacheEntry{used: r.cacheUses}
+	_, entry.path = r._getRootAndPath(key)
+	if r.core.config.linkCost != nil {
+		entry.costs = r._getPathCosts(key, len(entry.path))
+	}
+	entry.ancs = r._backwardsAncestry(key)
+	if len(entry.ancs) == 0 {
+		entry.ancs = append(entry.ancs, key)
+	} else if last := entry.ancs[len(entry.ancs)-1]; r.infos[last].parent != last {
+		// A dead end or a loop, it may be fixed by an update to wherever we stopped
+		entry.ancs = append(entry.ancs, r.infos[last].parent)
+	}
+	r.cache[key] = entry
+	return entry.path
+}
+
 func (r *router) _getDist(destPath []peerPort, key publicKey) uint64 {
 	// We cache the keyPath to avoid allocating slices for every lookup
-	var keyPath []peerPort
-	if cached, isIn := r.cache[key]; isIn {
-		keyPath = cached
-	} else {
-		_, keyPath = r._getRootAndPath(key)
-		r.cache[key] = keyPath
+	keyPath := r._getCachedPath(key)
+	prefix := pathPrefix(keyPath, destPath)
+	if r.core.config.linkCost != nil {
+		return costDist(r.cache[key].costs, prefix, len(destPath))
+	}
+	return uint64(len(keyPath) + len(destPath) - 2*prefix)
+}
+
+// _getHops is like _getDist, but always counts hops, even with WithLinkCosts.
+func (r *router) _getHops(destPath []peerPort, key publicKey) uint64 {
+	_, keyPath := r._getRootAndPath(key)
+	return uint64(len(keyPath) + len(destPath) - 2*pathPrefix(keyPath, destPath))
+}
+
+// pathPrefix returns how many ports two paths have in common from the root, which is the depth of the last node that's on both.
+func pathPrefix(a, b []peerPort) int {
+	var idx int
+	for idx < len(a) && idx < len(b) && a[idx] == b[idx] {
+		idx++
 	}
-	end := len(destPath)
-	if len(keyPath) < end {
-		end = len(keyPath)
+	return idx
+}
+
+// _checkSelfPath notes when our root or path changes, so packets that were already in flight get some slack, see WithWatermarkSlack.
+func (r *router) _checkSelfPath() {
+	_, path := r._getRootAndPath(r.core.crypto.publicKey)
+	changed := len(path) != len(r.selfPath)
+	for idx := 0; !changed && idx < len(path); idx++ {
+		changed = path[idx] != r.selfPath[idx]
 	}
-	dist := uint64(len(keyPath) + len(destPath))
-	for idx := 0; idx < end; idx++ {
-		if keyPath[idx] == destPath[idx] {
-			dist -= 2
-		} else {
-			break
-		}
+	if changed {
+		r.selfPath = path
+		r.pathTime = time.Now()
+	}
+}
+
+// _watermarkSlack returns how far past the watermark our distance can be, while still forwarding the packet.
+func (r *router) _watermarkSlack() uint64 {
+	if r.core.config.watermarkSlack == 0 || time.Since(r.pathTime) > watermarkGrace {
+		return 0
 	}
-	return dist
+	return r.core.config.watermarkSlack
 }
 
 func (r *router) _lookup(path []peerPort, watermark *uint64) *peer {
+	return r._lookupFlow(path, watermark, nil)
+}
+
+func (r *router) _lookupFlow(path []peerPort, watermark *uint64, flow *traffic) *peer {
 	// Look up the next hop (in treespace) towards the destination
+	// If ECMP is enabled and a flow is given, ties are broken by hashing the flow instead of by key
 	var bestPeer *peer
-	bestDist := ^uint64(0)
+	limit := ^uint64(0) // next hops (and alternates) have to be strictly closer than this
 	if watermark != nil {
 		if dist := r._getDist(path, r.core.crypto.publicKey); dist < *watermark {
-			bestDist = dist // Self dist, so other nodes must be strictly better by distance
+			limit = dist // Self dist, so other nodes must be strictly better by distance
 			*watermark = dist
+		} else if dist-*watermark < r._watermarkSlack() {
+			// Our path changed recently, so the packet may have been fine when it was sent
+			// The watermark is left as-is, and the next hop still has to be strictly closer than us
+			limit = dist
 		} else {
 			return nil
 		}
 	}
 	tiebreak := func(key publicKey) bool {
-		// If distances match, keep the peer with the lowest key, just so there's some kind of consistency
+		// If costs match, keep the peer with the lowest key, just so there's some kind of consistency
 		return bestPeer != nil && key.less(bestPeer.key)
 	}
-	for k, ps := range r.peers {
-		if dist := r._getDist(path, k); dist < bestDist || (dist == bestDist && tiebreak(k)) {
-			for p := range ps {
-				// Set the next hop to any peer object for this peer
-				bestPeer = p
-				bestDist = dist
-				break
-			}
+	// With link costs, the next hop has to be closer to the destination than we are, but the cheapest way there also counts the link to it
+	// Peers that are draining cost extra, see PacketConn.Drain
+	bestCost := ^uint64(0)
+	for k := range r.peers {
+		dist := r._getDist(path, k)
+		if !r._canRelay(k, dist) || dist >= limit {
+			continue
+		}
+		// Only keys with a proven link count, see peer.challenge
+		p := r._bestLink(k, false)
+		if p == nil {
+			continue
+		}
+		if cost := r._hopCost(k, dist, p); cost < bestCost || (cost == bestCost && tiebreak(k)) {
+			bestPeer = p
+			bestCost = cost
 		}
 	}
-	if bestPeer != nil {
-		for p := range r.peers[bestPeer.key] {
-			// Find the best peer object for this peer
-			switch {
-			case p.prio < bestPeer.prio:
-				bestPeer = p // Better priority
-			case p.prio == bestPeer.prio && p.order < bestPeer.order:
-				bestPeer = p // Up for longer
-			}
+	if bestPeer != nil && flow != nil && r.core.config.ecmp {
+		bestPeer = r._ecmpPeer(path, limit, bestCost, flow)
+	}
+	if bestPeer != nil && watermark != nil && r.core.config.alternates && atomic.LoadInt32(&bestPeer.saturated) != 0 {
+		if alt := r._alternatePeer(path, limit); alt != nil {
+			atomic.AddInt64(&r.core.metrics.trafficLFA, 1)
+			return alt
 		}
 	}
 	return bestPeer
 }
 
+// _bestLink returns the best priority / longest lived link to the peer, optionally skipping links with saturated queues.
+// Links that haven't proven the peer's key yet are always skipped, so this returns nil if there are none that have.
+func (r *router) _bestLink(key publicKey, unsaturated bool) *peer {
+	var best *peer
+	for p := range r.peers[key] {
+		if !p.proven || (unsaturated && atomic.LoadInt32(&p.saturated) != 0) {
+			continue
+		}
+		switch {
+		case best == nil:
+			best = p
+		case p.rprio < best.rprio:
+			best = p // Better priority
+		case p.rprio == best.rprio && p.order < best.order:
+			best = p // Up for longer
+		}
+	}
+	return best
+}
+
+// _alternatePeer returns the closest (then lowest key) peer with an unsaturated link, among peers that are strictly closer to the destination than limit (our own distance).
+// Any such peer satisfies the watermark, so the packet can't loop back to us.
+func (r *router) _alternatePeer(path []peerPort, limit uint64) *peer {
+	var best *peer
+	bestDist := limit
+	for k := range r.peers {
+		dist := r._getDist(path, k)
+		if !r._canRelay(k, dist) || (dist != 0 && r._isDraining(k)) || dist > bestDist || (dist == bestDist && (best == nil || !k.less(best.key))) {
+			continue
+		}
+		if p := r._bestLink(k, true); p != nil {
+			best, bestDist = p, dist
+		}
+	}
+	return best
+}
+
+func (r *router) _ecmpPeer(path []peerPort, limit, bestCost uint64, flow *traffic) *peer {
+	// Every peer closer than limit (so it satisfies the watermark) at bestCost is an equally good next hop
+	// The candidates are sorted, so every packet in the flow hashes to the same choice
+	var keys []publicKey
+	for k := range r.peers {
+		dist := r._getDist(path, k)
+		if !r._canRelay(k, dist) || dist >= limit {
+			continue
+		}
+		if p := r._bestLink(k, false); p != nil && r._hopCost(k, dist, p) == bestCost {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].less(keys[j])
+	})
+	h := ecmpHash(flow.source, flow.dest, flow.flow)
+	key := keys[h%uint64(len(keys))]
+	// Spread over the best priority links to that peer too, e.g. if there are parallel links to the same node
+	var links []*peer
+	for p := range r.peers[key] {
+		switch {
+		case !p.proven:
+		case len(links) == 0 || p.rprio < links[0].rprio:
+			links = append(links[:0], p)
+		case p.rprio == links[0].rprio:
+			links = append(links, p)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].order < links[j].order
+	})
+	return links[(h>>32)%uint64(len(links))]
+}
+
+func ecmpHash(source, dest publicKey, hint uint8) uint64 {
+	h := fnv.New64a()
+	// The hint goes first, the last byte written to an FNV hash barely changes its high bits
+	h.Write([]byte{hint})
+	h.Write(source[:])
+	h.Write(dest[:])
+	return h.Sum64()
+}
+
 func (r *router) _getAncestry(key publicKey) []publicKey {
 	// Returns the ancestry starting with the root side, ordering is important for how we send over the network / GC info...
 	anc := r._backwardsAncestry(key)
@@ -695,7 +1409,7 @@ func (r *router) _backwardsAncestry(key publicKey) []publicKey {
 				return anc
 			}
 		}
-		if info, isIn := r.infos[here]; isIn {
+		if info, isIn := r.infos[here]; isIn && !info.isLeaving(here) {
 			anc = append(anc, here)
 			here = info.parent
 			continue
@@ -715,7 +1429,11 @@ type routerSigReq struct {
 }
 
 func (req *routerSigReq) bytesForSig(node, parent publicKey) []byte {
-	out := make([]byte, 0, publicKeySize*2+8+8)
+	return req.appendForSig(make([]byte, 0, publicKeySize*2+8+8), node, parent)
+}
+
+// appendForSig is like bytesForSig, but appends to out, so checks can use a buffer from allocBytes.
+func (req *routerSigReq) appendForSig(out []byte, node, parent publicKey) []byte {
 	out = append(out, node[:]...)
 	out = append(out, parent[:]...)
 	out, _ = req.encode(out)
@@ -743,9 +1461,9 @@ func (req *routerSigReq) chop(data *[]byte) error {
 	var tmp routerSigReq
 	orig := *data
 	if !wireChopUint(&tmp.seq, &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if !wireChopUint(&tmp.nonce, &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	}
 	*req = tmp
 	*data = orig
@@ -757,7 +1475,7 @@ func (req *routerSigReq) decode(data []byte) error {
 	if err := tmp.chop(&data); err != nil {
 		return err
 	} else if len(data) != 0 {
-		return types.ErrDecode
+		return types.ErrDecodeTrailingBytes
 	}
 	*req = tmp
 	return nil
@@ -774,14 +1492,19 @@ type routerSigRes struct {
 }
 
 func (res *routerSigRes) check(node, parent publicKey) bool {
-	bs := res.bytesForSig(node, parent)
+	bs := res.appendForSig(allocBytes(0), node, parent)
+	defer freeBytes(bs)
 	return parent.verify(bs, &res.psig)
 }
 
 func (res *routerSigRes) bytesForSig(node, parent publicKey) []byte {
-	bs := res.routerSigReq.bytesForSig(node, parent)
-	bs = wireAppendUint(bs, uint64(res.port))
-	return bs
+	return res.appendForSig(make([]byte, 0, publicKeySize*2+8+8+8), node, parent)
+}
+
+func (res *routerSigRes) appendForSig(out []byte, node, parent publicKey) []byte {
+	out = res.routerSigReq.appendForSig(out, node, parent)
+	out = wireAppendUint(out, uint64(res.port))
+	return out
 }
 
 func (res *routerSigRes) size() int {
@@ -813,9 +1536,11 @@ func (res *routerSigRes) chop(data *[]byte) error {
 	if err := tmp.routerSigReq.chop(&orig); err != nil {
 		return err
 	} else if !wireChopUint((*uint64)(&tmp.port), &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
+	} else if tmp.port >= wireMaxPort && tmp.port != routerLeavingPort {
+		return types.ErrBadPort
 	} else if !wireChopSlice(tmp.psig[:], &orig) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	}
 	*res = tmp
 	*data = orig
@@ -827,7 +1552,7 @@ func (res *routerSigRes) decode(data []byte) error {
 	if err := tmp.chop(&data); err != nil {
 		return err
 	} else if len(data) != 0 {
-		return types.ErrDecode
+		return types.ErrDecodeTrailingBytes
 	}
 	*res = tmp
 	return nil
@@ -842,14 +1567,69 @@ type routerAnnounce struct {
 	parent publicKey
 	routerSigRes
 	sig signature
+	routerAnnounceExt
+}
+
+// routerAnnounceExt is what a node says about itself beyond the original announcement, which only goes to peers that support featureAnnounceExt.
+// The node signs it with xsig, over what it signed with sig and these fields, so nodes that don't know about it can still check the original signatures.
+// An info without it is treated as not draining, signed when it arrived, and at the default link cost.
+type routerAnnounceExt struct {
+	time     uint64    // unix seconds when the node signed this, see WithSignedExpiry
+	draining bool      // the node is shutting down, see PacketConn.Drain
+	cost     uint64    // cost of the link to the parent, see WithLinkCosts
+	xsig     signature // zero if the announcement has no extension
+}
+
+// hasExt returns true if the announcement came with the extension.
+func (ext *routerAnnounceExt) hasExt() bool {
+	return ext.xsig != signature{}
+}
+
+// isLeaving returns true if this is a leaving announcement, see router._sendLeaving
+func (ann *routerAnnounce) isLeaving() bool {
+	return ann.key == ann.parent && ann.port == routerLeavingPort
 }
 
 func (ann *routerAnnounce) check() bool {
-	if ann.port == 0 && ann.key != ann.parent {
+	if (ann.port == 0 || ann.port == routerLeavingPort) && ann.key != ann.parent {
 		return false
 	}
-	bs := ann.bytesForSig(ann.key, ann.parent)
-	return ann.key.verify(bs, &ann.sig) && ann.parent.verify(bs, &ann.psig)
+	bs := ann.appendForSig(allocBytes(0), ann.key, ann.parent)
+	defer func() { freeBytes(bs) }()
+	if !ann.parent.verify(bs, &ann.psig) || !ann.key.verify(bs, &ann.sig) {
+		return false
+	}
+	if !ann.hasExt() {
+		return true
+	}
+	bs = ann.appendExt(bs)
+	return ann.key.verify(bs, &ann.xsig)
+}
+
+// extBytesForSig returns what the node signs with xsig.
+func (ann *routerAnnounce) extBytesForSig() []byte {
+	return ann.appendExt(ann.bytesForSig(ann.key, ann.parent))
+}
+
+// appendExt appends the extension's fields, which are encoded in the same order after sig, followed by xsig.
+func (ann *routerAnnounce) appendExt(out []byte) []byte {
+	out = wireAppendUint(out, ann.time)
+	if ann.draining {
+		out = wireAppendUint(out, 1)
+	} else {
+		out = wireAppendUint(out, 0)
+	}
+	return wireAppendUint(out, ann.cost)
+}
+
+// withoutExt returns the announcement as a peer without featureAnnounceExt expects it.
+func (ann *routerAnnounce) withoutExt() *routerAnnounce {
+	if !ann.hasExt() {
+		return ann
+	}
+	tmp := *ann
+	tmp.routerAnnounceExt = routerAnnounceExt{}
+	return &tmp
 }
 
 func (ann *routerAnnounce) size() int {
@@ -857,6 +1637,12 @@ func (ann *routerAnnounce) size() int {
 	size += len(ann.parent)
 	size += ann.routerSigRes.size()
 	size += len(ann.sig)
+	if ann.hasExt() {
+		size += wireSizeUint(ann.time)
+		size += 1 // draining
+		size += wireSizeUint(ann.cost)
+		size += len(ann.xsig)
+	}
 	return size
 }
 
@@ -870,6 +1656,10 @@ func (ann *routerAnnounce) encode(out []byte) ([]byte, error) {
 		return nil, err
 	}
 	out = append(out, ann.sig[:]...)
+	if ann.hasExt() {
+		out = ann.appendExt(out)
+		out = append(out, ann.xsig[:]...)
+	}
 	end := len(out)
 	if end-start != ann.size() {
 		panic("this should never happen")
@@ -880,20 +1670,49 @@ func (ann *routerAnnounce) encode(out []byte) ([]byte, error) {
 func (ann *routerAnnounce) decode(data []byte) error {
 	var tmp routerAnnounce
 	if !wireChopSlice(tmp.key[:], &data) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if !wireChopSlice(tmp.parent[:], &data) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if err := tmp.routerSigRes.chop(&data); err != nil {
 		return err
 	} else if !wireChopSlice(tmp.sig[:], &data) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
+	} else if len(data) == 0 {
+		// No extension
+	} else if len(data) < 3+len(tmp.xsig) {
+		return types.ErrDecodeTrailingBytes // Too short to be an extension
+	} else if err := tmp.routerAnnounceExt.chop(&data); err != nil {
+		return err
 	} else if len(data) != 0 {
-		return types.ErrDecode
+		return types.ErrDecodeTrailingBytes
 	}
 	*ann = tmp
 	return nil
 }
 
+func (ext *routerAnnounceExt) chop(data *[]byte) error {
+	var tmp routerAnnounceExt
+	var draining uint64
+	orig := *data
+	if !wireChopUint(&tmp.time, &orig) {
+		return types.ErrDecodeTruncated
+	} else if !wireChopUint(&draining, &orig) {
+		return types.ErrDecodeTruncated
+	} else if draining > 1 {
+		return types.ErrDecode
+	} else if !wireChopUint(&tmp.cost, &orig) {
+		return types.ErrDecodeTruncated
+	} else if !wireChopSlice(tmp.xsig[:], &orig) {
+		return types.ErrDecodeTruncated
+	} else if !tmp.hasExt() {
+		return types.ErrDecode // It would encode as no extension at all
+	}
+	tmp.draining = draining == 1
+	*ext = tmp
+	*data = orig
+	return nil
+}
+
 /***************
  * routerInfo *
  ***************/
@@ -904,14 +1723,21 @@ type routerInfo struct {
 	parent publicKey
 	routerSigRes
 	sig signature
+	routerAnnounceExt
+}
+
+// isLeaving returns true if this info (for the given key) is from a leaving announcement, in which case it's treated as if we didn't have it
+func (info *routerInfo) isLeaving(key publicKey) bool {
+	return info.parent == key && info.port == routerLeavingPort
 }
 
 func (info *routerInfo) getAnnounce(key publicKey) *routerAnnounce {
 	return &routerAnnounce{
-		key:          key,
-		parent:       info.parent,
-		routerSigRes: info.routerSigRes,
-		sig:          info.sig,
+		key:               key,
+		parent:            info.parent,
+		routerSigRes:      info.routerSigRes,
+		sig:               info.sig,
+		routerAnnounceExt: info.routerAnnounceExt,
 	}
 }
 
@@ -0,0 +1,1308 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+func TestECMP(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, err := NewPacketConn(priv, WithECMP(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	r := &pc.core.router
+	phony.Block(r, func() {
+		// Two equal links to the same peer
+		var key publicKey
+		key[0] = 1
+		linkA := &peer{key: key, port: 1, proven: true}
+		linkB := &peer{key: key, port: 1, order: 1, proven: true}
+		r.peers[key] = map[*peer]struct{}{linkA: {}, linkB: {}}
+		defer delete(r.peers, key)
+		counts := make(map[*peer]int)
+		for idx := 0; idx < 1000; idx++ {
+			var tr traffic
+			tr.source[0], tr.source[1] = byte(idx), byte(idx>>8)
+			tr.dest[2] = byte(idx)
+			p := r._lookupFlow(nil, nil, &tr)
+			for jdx := 0; jdx < 5; jdx++ {
+				if q := r._lookupFlow(nil, nil, &tr); q != p {
+					t.Fatal("flow changed links")
+				}
+			}
+			counts[p]++
+		}
+		if counts[linkA] < 400 || counts[linkB] < 400 {
+			t.Fatalf("unbalanced link use: %d vs %d", counts[linkA], counts[linkB])
+		}
+		// The application's flow hints spread flows between the same two nodes too
+		counts = make(map[*peer]int)
+		for hint := 0; hint < 256; hint++ {
+			var tr traffic
+			tr.source[0], tr.dest[0], tr.flow = 1, 2, uint8(hint)
+			p := r._lookupFlow(nil, nil, &tr)
+			if q := r._lookupFlow(nil, nil, &tr); q != p {
+				t.Fatal("flow changed links")
+			}
+			counts[p]++
+		}
+		if counts[linkA] < 96 || counts[linkB] < 96 {
+			t.Fatalf("unbalanced link use with flow hints: %d vs %d", counts[linkA], counts[linkB])
+		}
+		// Without a flow, we should keep the old deterministic choice
+		for idx := 0; idx < 10; idx++ {
+			if p := r._lookup(nil, nil); p != linkA {
+				t.Fatal("expected the longest lived link")
+			}
+		}
+	})
+}
+
+func TestUpdateTotalOrder(t *testing.T) {
+	// Every node must agree on which of two announcements for the same key is better.
+	// So, _update's accept/reject decision needs to be a strict total order over the fields it compares.
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, err := NewPacketConn(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	r := &pc.core.router
+	var key publicKey
+	key[0] = 1
+	newAnn := func() *routerAnnounce {
+		// Small ranges, so ties are common
+		ann := &routerAnnounce{key: key}
+		ann.seq = uint64(rand.Intn(3))
+		ann.nonce = uint64(rand.Intn(3))
+		ann.parent[0] = byte(rand.Intn(3))
+		return ann
+	}
+	same := func(a, b *routerAnnounce) bool {
+		return a.seq == b.seq && a.nonce == b.nonce && a.parent == b.parent
+	}
+	phony.Block(r, func() {
+		defer r._expire(key)
+		// better returns true if b replaces an existing a
+		better := func(a, b *routerAnnounce) bool {
+			r._expire(key)
+			if !r._update(a) {
+				t.Fatal("failed to store the first announcement")
+			}
+			return r._update(b)
+		}
+		for idx := 0; idx < 10000; idx++ {
+			a, b, c := newAnn(), newAnn(), newAnn()
+			ab, ba := better(a, b), better(b, a)
+			switch {
+			case better(a, a):
+				t.Fatalf("announcement replaced itself: %+v", a)
+			case ab && ba:
+				t.Fatalf("not antisymmetric: %+v %+v", a, b)
+			case !ab && !ba && !same(a, b):
+				t.Fatalf("not total: %+v %+v", a, b)
+			case ab && better(b, c) && !better(a, c):
+				t.Fatalf("not transitive: %+v %+v %+v", a, b, c)
+			}
+		}
+	})
+}
+
+func TestRouterMaxInfos(t *testing.T) {
+	// a has room for 3 infos, its own and 2 others
+	var keys []publicKey
+	for idx := 0; idx < 5; idx++ {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		var key publicKey
+		copy(key[:], pub)
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].less(keys[j])
+	})
+	_, privA, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA, WithRouterMaxInfos(3), WithSignedExpiry(true))
+	defer a.Close()
+	waitForRoot([]*PacketConn{a}, 30*time.Second)
+	var evicted []int
+	a.SetCapacityHandler(func(current, max int, key ed25519.PublicKey) {
+		if current != 3 || max != 3 {
+			t.Errorf("unexpected capacity: %d of %d", current, max)
+		}
+		for idx, k := range keys {
+			if bytes.Equal(key, k[:]) {
+				evicted = append(evicted, idx)
+			}
+		}
+	})
+	r := &a.core.router
+	from := &peer{key: keys[0]}
+	announce := func(key publicKey) {
+		ann := &routerAnnounce{key: key, parent: key}
+		ann.seq = 1
+		r._handleAnnounce(from, ann)
+	}
+	expect := func(step string, idxs ...int) {
+		var found []int
+		for idx, k := range keys {
+			if _, isIn := r.infos[k]; isIn {
+				found = append(found, idx)
+			}
+		}
+		if fmt.Sprint(found) != fmt.Sprint(idxs) {
+			t.Fatalf("%s: expected nodes %v, got %v", step, idxs, found)
+		}
+	}
+	phony.Block(r, func() {
+		r.sent[from.key] = make(map[publicKey]struct{})
+		announce(keys[3])
+		announce(keys[2])
+		expect("room for both", 2, 3)
+		announce(keys[4])
+		expect("full, the new info has the highest key", 2, 3)
+		announce(keys[0])
+		expect("full, a lower key", 0, 2)
+		// A lower key that would expire as soon as it's stored doesn't push anything out
+		ann := &routerAnnounce{key: keys[1], parent: keys[1]}
+		ann.seq = 1
+		ann.time = uint64(time.Now().Add(-2 * r.core.config.routerTimeout).Unix())
+		r._handleAnnounce(from, ann)
+		expect("full, an expired info", 0, 2)
+		announce(keys[2])
+		expect("already stored", 0, 2)
+	})
+	if fmt.Sprint(evicted) != "[4 3 1]" {
+		t.Fatalf("expected the capacity handler to see nodes [4 3 1] dropped, got %v", evicted)
+	}
+}
+
+// signTestAnnounce signs ann as its node would, with the extension signed at the given time.
+func signTestAnnounce(c *crypto, ann *routerAnnounce, signed time.Time) {
+	ann.sig = c.privateKey.sign(ann.bytesForSig(ann.key, ann.parent))
+	ann.time = uint64(signed.Unix())
+	ann.xsig = c.privateKey.sign(ann.extBytesForSig())
+}
+
+func TestLinkCosts(t *testing.T) {
+	// A triangle where the direct link from a to c is expensive, so traffic should go through b
+	var keys []ed25519.PublicKey
+	var conns []*PacketConn
+	for idx := 0; idx < 3; idx++ {
+		idx := idx
+		conn := newNode(t, WithLinkCosts(func(key ed25519.PublicKey, _ net.Conn) uint16 {
+			if (idx == 0 && key.Equal(keys[2])) || (idx == 2 && key.Equal(keys[0])) {
+				return 10
+			}
+			return 1
+		}))
+		keys = append(keys, nodeKey(conn))
+		conns = append(conns, conn)
+	}
+	for _, link := range [][2]int{{0, 1}, {1, 2}, {0, 2}} {
+		linkNodes(t, conns[link[0]], conns[link[1]])
+	}
+	waitForRoot(conns, 30*time.Second)
+	// Whoever the root is, the expensive link shouldn't be on the tree once parents settle
+	var c publicKey
+	copy(c[:], keys[2])
+	r := &conns[0].core.router
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		settled := true
+		parents := make(map[publicKey]publicKey)
+		for idx, conn := range conns {
+			phony.Block(&conn.core.router, func() {
+				self := conn.core.crypto.publicKey
+				parent := conn.core.router.infos[self].parent
+				if idx != 1 && parent.toEd().Equal(keys[2-idx]) {
+					settled = false
+				}
+				parents[self] = parent
+			})
+		}
+		// a's lookup uses its own view of everyone's parent, which lags behind theirs
+		phony.Block(r, func() {
+			for key, parent := range parents {
+				if info, isIn := r.infos[key]; !isIn || info.parent != parent {
+					settled = false
+				}
+			}
+		})
+		if settled {
+			break
+		} else if time.Since(start) > 30*time.Second {
+			t.Fatal("the expensive link is still on the tree")
+		}
+	}
+	var next *peer
+	phony.Block(r, func() {
+		_, path := r._getRootAndPath(c)
+		watermark := ^uint64(0)
+		next = r._lookup(path, &watermark)
+	})
+	if next == nil || !next.key.toEd().Equal(keys[1]) {
+		t.Fatal("expected to go through b")
+	}
+}
+
+// testRootAnnounce returns a root announcement for the node, with the extension signed at the given time.
+func testRootAnnounce(c *crypto, seq uint64, signed time.Time) *routerAnnounce {
+	res := routerSigRes{routerSigReq: routerSigReq{seq: seq, nonce: 1}}
+	res.psig = c.privateKey.sign(res.bytesForSig(c.publicKey, c.publicKey))
+	ann := &routerAnnounce{key: c.publicKey, parent: c.publicKey, routerSigRes: res}
+	signTestAnnounce(c, ann, signed)
+	return ann
+}
+
+// hasTestInfo returns the seq of the router's info for the key, or false if it has none.
+func hasTestInfo(r *router, key publicKey) (seq uint64, isIn bool) {
+	phony.Block(r, func() {
+		var info routerInfo
+		info, isIn = r.infos[key]
+		seq = info.seq
+	})
+	return
+}
+
+func TestSignedExpiry(t *testing.T) {
+	now := time.Now()
+	var x, y, z crypto
+	for _, c := range []*crypto{&x, &y, &z} {
+		_, priv, _ := ed25519.GenerateKey(nil)
+		c.init(priv)
+	}
+	// Two nodes get the same infos in opposite orders, so only the signed times can make them expire in the same order
+	for _, reversed := range []bool{false, true} {
+		now = time.Now()
+		anns := []*routerAnnounce{testRootAnnounce(&x, 1, now.Add(-4*time.Second)), testRootAnnounce(&y, 1, now.Add(-2*time.Second))}
+		if reversed {
+			anns[0], anns[1] = anns[1], anns[0]
+		}
+		_, priv, _ := ed25519.GenerateKey(nil)
+		pc, _ := NewPacketConn(priv, WithSignedExpiry(true), WithRouterTimeout(6*time.Second))
+		defer pc.Close()
+		r := &pc.core.router
+		phony.Block(r, func() {
+			for _, ann := range anns {
+				r._update(ann)
+			}
+			r._update(testRootAnnounce(&z, 1, now.Add(time.Hour)))
+			// The age we dump and export counts from the signed time too
+			if age := time.Since(r.updated[x.publicKey]); age < 4*time.Second {
+				t.Errorf("expected x's info to be at least 4s old, got %v", age)
+			}
+		})
+		time.Sleep(time.Until(now.Add(2500 * time.Millisecond)))
+		if _, isIn := hasTestInfo(r, x.publicKey); isIn {
+			t.Fatal("the info signed first didn't expire first")
+		}
+		if _, isIn := hasTestInfo(r, y.publicKey); !isIn {
+			t.Fatal("the info signed last expired too soon")
+		}
+		if _, isIn := hasTestInfo(r, z.publicKey); !isIn {
+			t.Fatal("an info signed in the future wasn't clamped to when we got it")
+		}
+	}
+	// One that timed out before we got it is still accepted, since that can't depend on our clock, but it expires right away
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv, WithSignedExpiry(true), WithRouterTimeout(time.Minute))
+	defer pc.Close()
+	r := &pc.core.router
+	var accepted bool
+	phony.Block(r, func() {
+		accepted = r._update(testRootAnnounce(&x, 1, now.Add(-2*time.Minute)))
+	})
+	if !accepted {
+		t.Fatal("rejected an info because of when it was signed")
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, isIn := hasTestInfo(r, x.publicKey); !isIn {
+			break
+		} else if time.Since(start) > time.Second {
+			t.Fatal("an info that had already timed out didn't expire")
+		}
+	}
+}
+
+func TestSignedExpirySkew(t *testing.T) {
+	// b's clock is ahead of a's by more than the router timeout allows for some infos, so a thinks one is fresh when b thinks it timed out
+	const timeout, skew = 20 * time.Second, 10 * time.Second
+	var keys []ed25519.PublicKey
+	var conns []*PacketConn
+	for _, offset := range []time.Duration{0, skew} {
+		conn := newNode(t, WithSignedExpiry(true), WithRouterTimeout(timeout), WithRouterRefresh(2*time.Second), withClockOffset(offset))
+		keys = append(keys, nodeKey(conn))
+		conns = append(conns, conn)
+	}
+	linkLine(t, conns)
+	ra, rb := &conns[0].core.router, &conns[1].core.router
+	var x crypto
+	_, priv, _ := ed25519.GenerateKey(nil)
+	x.init(priv)
+	// b has an older info for x that it thinks is fresh, and a has a newer one, signed 12 seconds ago by a's clock and 22 by b's
+	now := time.Now()
+	inject := func(r *router, ann *routerAnnounce) {
+		phony.Block(r, func() {
+			from := &peer{key: x.publicKey}
+			r.sent[from.key] = make(map[publicKey]struct{})
+			r._handleAnnounce(from, ann)
+		})
+	}
+	inject(rb, testRootAnnounce(&x, 1, now.Add(skew)))
+	newer := testRootAnnounce(&x, 2, now.Add(-12*time.Second))
+	inject(ra, newer)
+	// If b rejected the newer one, it would send its older one back, which a would reject and answer with the newer one again, forever
+	phony.Block(rb, func() {
+		for p := range rb.peers[ra.core.crypto.publicKey] {
+			rb._handleAnnounce(p, newer)
+			break
+		}
+	})
+	time.Sleep(2 * time.Second)
+	if seq, isIn := hasTestInfo(ra, x.publicKey); !isIn || seq != 2 {
+		t.Fatalf("expected a to keep the newer info, got seq %d (%v)", seq, isIn)
+	}
+	if _, isIn := hasTestInfo(rb, x.publicKey); isIn {
+		t.Fatal("expected b to accept the newer info and expire it")
+	}
+}
+
+func TestWatermarkLoop(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, err := NewPacketConn(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	r := &pc.core.router
+	phony.Block(r, func() {
+		// We're the root, with a peer at port 1 that's closer to the destination
+		var key publicKey
+		key[0] = 1
+		next := &peer{key: key, port: 1, proven: true}
+		r.peers[key] = map[*peer]struct{}{next: {}}
+		r.cache[key] = &routerCacheEntry{path: []peerPort{1}}
+		defer delete(r.peers, key)
+		defer delete(r.cache, key)
+		dest := []peerPort{1, 5}
+		watermark := ^uint64(0)
+		if p := r._lookup(dest, &watermark); p != next {
+			t.Fatal("expected to forward to the peer")
+		}
+		if watermark != 2 {
+			t.Fatalf("expected watermark to be tightened to 2, got %d", watermark)
+		}
+		// A crafted loop sends the packet back to us, it must be dropped instead of forwarded again
+		if p := r._lookup(dest, &watermark); p != nil {
+			t.Fatal("looped packet was forwarded")
+		}
+		if watermark != 2 {
+			t.Fatalf("watermark changed on drop, got %d", watermark)
+		}
+	})
+}
+
+func TestWatermarkSlack(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, err := NewPacketConn(priv, WithWatermarkSlack(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	r := &pc.core.router
+	phony.Block(r, func() {
+		// Same setup as TestWatermarkLoop, but the packet was sent before our path changed
+		var key publicKey
+		key[0] = 1
+		next := &peer{key: key, port: 1, proven: true}
+		r.peers[key] = map[*peer]struct{}{next: {}}
+		r.cache[key] = &routerCacheEntry{path: []peerPort{1}}
+		defer delete(r.peers, key)
+		defer delete(r.cache, key)
+		dest := []peerPort{1, 5}
+		watermark := uint64(1)
+		if p := r._lookup(dest, &watermark); p != nil {
+			t.Fatal("forwarded past the watermark without a path change")
+		}
+		r.pathTime = time.Now()
+		if p := r._lookup(dest, &watermark); p != next {
+			t.Fatal("expected to forward within the slack")
+		}
+		if watermark != 1 {
+			t.Fatalf("watermark changed by slack, got %d", watermark)
+		}
+		watermark = 0
+		if p := r._lookup(dest, &watermark); p != nil {
+			t.Fatal("forwarded past the slack")
+		}
+		watermark = 1
+		r.pathTime = time.Now().Add(-2 * watermarkGrace)
+		if p := r._lookup(dest, &watermark); p != nil {
+			t.Fatal("forwarded after the grace period")
+		}
+	})
+}
+
+func TestLoopFreeAlternate(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, err := NewPacketConn(priv, WithLoopFreeAlternates(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	r := &pc.core.router
+	phony.Block(r, func() {
+		// We're the root, 3 hops from the destination
+		// Peer 1 is the best next hop, peer 2 is worse but still closer than us, and peer 3 is further away than we are
+		dest := []peerPort{1, 5, 7}
+		links := make(map[byte]*peer)
+		for idx, path := range [][]peerPort{{1, 5}, {1}, {2}} {
+			var key publicKey
+			key[0] = byte(idx + 1)
+			p := &peer{key: key, port: path[0], proven: true}
+			links[key[0]] = p
+			r.peers[key] = map[*peer]struct{}{p: {}}
+			r.cache[key] = &routerCacheEntry{path: path}
+			defer delete(r.peers, key)
+			defer delete(r.cache, key)
+		}
+		lookup := func() *peer {
+			watermark := ^uint64(0)
+			return r._lookupFlow(dest, &watermark, new(traffic))
+		}
+		if p := lookup(); p != links[1] {
+			t.Fatal("expected the best next hop")
+		}
+		atomic.StoreInt32(&links[1].saturated, 1)
+		if p := lookup(); p != links[2] {
+			t.Fatal("expected the loop-free alternate")
+		}
+		// Never a peer that's further from the destination than we are, even if everything closer is saturated
+		atomic.StoreInt32(&links[2].saturated, 1)
+		if p := lookup(); p != links[1] {
+			t.Fatal("expected the saturated best next hop")
+		}
+		r.core.config.alternates = false
+		atomic.StoreInt32(&links[2].saturated, 0)
+		if p := lookup(); p != links[1] {
+			t.Fatal("used an alternate while disabled")
+		}
+	})
+}
+
+func TestLoopFreeAlternateSaturatedLink(t *testing.T) {
+	// A diamond, where s has two equal cost next hops towards the root d, and the link to the one it prefers is saturated
+	var conns []*PacketConn
+	for idx := 0; idx < 4; idx++ {
+		conns = append(conns, newNode(t, WithLoopFreeAlternates(true)))
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].core.crypto.publicKey.less(conns[j].core.crypto.publicKey)
+	})
+	var keys []ed25519.PublicKey
+	for _, conn := range conns {
+		keys = append(keys, nodeKey(conn))
+	}
+	const d, x, y, s = 0, 1, 2, 3
+	for _, link := range [][2]int{{s, x}, {s, y}, {x, d}, {y, d}} {
+		linkNodes(t, conns[link[0]], conns[link[1]])
+	}
+	waitForRoot(conns, 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := conns[s].Ping(ctx, keys[d]); err != nil {
+		t.Fatal(err)
+	}
+	// Mark the link to x (the lower key, so the preferred next hop) as saturated, rather than relying on how fast a slow link drains
+	// Only pushing or popping traffic on that link would clear it, and none should be sent there
+	var keyX publicKey
+	copy(keyX[:], keys[x])
+	r := &conns[s].core.router
+	phony.Block(r, func() {
+		for p := range r.peers[keyX] {
+			atomic.StoreInt32(&p.saturated, 1)
+		}
+	})
+	before := conns[s].Metrics()["traffic.alternate"]
+	const count = 100
+	msg := make([]byte, 1024)
+	for idx := 0; idx < count; idx++ {
+		if _, err := conns[s].WriteTo(msg, types.Addr(keys[d])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 2048)
+	for received := 0; received < count; received++ {
+		// Nothing is slow or full, so every packet should arrive by way of y
+		if _, _, err := conns[d].ReadFromCtx(ctx, buf); err != nil {
+			t.Fatalf("only %d of %d packets were delivered: %v", received, count, err)
+		}
+	}
+	if alt := conns[s].Metrics()["traffic.alternate"] - before; alt < count {
+		t.Fatalf("expected %d packets to use the alternate, got %d", count, alt)
+	}
+	for idx, conn := range conns {
+		if drops := conn.Metrics()["drops.no_route"]; drops != 0 {
+			t.Fatalf("node %d dropped %d packets with no route", idx, drops)
+		}
+	}
+}
+
+func TestAnnouncePort(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, err := NewPacketConn(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	r := &pc.core.router
+	var child crypto
+	_, childPriv, _ := ed25519.GenerateKey(nil)
+	child.init(childPriv)
+	// An info for our peer that we signed as its parent
+	announce := func(port peerPort) *routerAnnounce {
+		res := routerSigRes{routerSigReq: routerSigReq{seq: 1, nonce: 1}, port: port}
+		res.psig = r.core.crypto.privateKey.sign(res.bytesForSig(child.publicKey, r.core.crypto.publicKey))
+		ann := &routerAnnounce{key: child.publicKey, parent: r.core.crypto.publicKey, routerSigRes: res}
+		ann.sig = child.privateKey.sign(ann.bytesForSig(ann.key, ann.parent))
+		if !ann.check() {
+			t.Fatal("bad signatures")
+		}
+		return ann
+	}
+	phony.Block(r, func() {
+		p := &peer{key: child.publicKey, port: 3}
+		r.peers[p.key] = map[*peer]struct{}{p: {}}
+		r.sent[p.key] = make(map[publicKey]struct{})
+		defer delete(r.peers, p.key)
+		defer delete(r.sent, p.key)
+		defer r._expire(p.key)
+		// Signed over an old link, with a port that we now use for something else
+		r._handleAnnounce(p, announce(2))
+		if _, isIn := r.infos[p.key]; isIn {
+			t.Fatal("accepted an info with the wrong port")
+		}
+		r._handleAnnounce(p, announce(3))
+		if _, isIn := r.infos[p.key]; !isIn {
+			t.Fatal("rejected an info with the right port")
+		}
+	})
+	if drops := pc.Metrics()["drops.announce_port"]; drops != 1 {
+		t.Fatalf("expected 1 drop, got %d", drops)
+	}
+}
+
+func TestSelfRevived(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv)
+	defer pc.Close()
+	var revived int
+	pc.SetSelfRevivedHandler(func() { revived++ })
+	r := &pc.core.router
+	phony.Block(r, func() {
+		var key publicKey
+		key[0] = 1
+		p := &peer{key: key, port: 1}
+		r.sent[key] = make(map[publicKey]struct{})
+		defer delete(r.sent, key)
+		// A peer sends an info of ours from before a restart, with a higher seq than we have now
+		self := r.core.crypto.publicKey
+		var res routerSigRes
+		res.seq = r.infos[self].seq + 10
+		res.psig = r.core.crypto.privateKey.sign(res.bytesForSig(self, self))
+		ann := &routerAnnounce{key: self, parent: self, routerSigRes: res, sig: res.psig}
+		r._handleAnnounce(p, ann)
+		if revived != 1 || !r.refresh {
+			t.Fatalf("expected 1 revived call and a refresh, got %d %v", revived, r.refresh)
+		}
+		// Hearing the same thing again isn't news
+		r._handleAnnounce(p, ann)
+		if revived != 1 {
+			t.Fatalf("expected 1 revived call, got %d", revived)
+		}
+	})
+}
+
+func TestRouterMaxInfosLeaving(t *testing.T) {
+	// a has room for 3 infos, and infos from leaving roots are the first to go when it's full
+	var nodes []*crypto
+	for idx := 0; idx < 5; idx++ {
+		c := new(crypto)
+		_, priv, _ := ed25519.GenerateKey(nil)
+		c.init(priv)
+		nodes = append(nodes, c)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].publicKey.less(nodes[j].publicKey)
+	})
+	_, privA, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA, WithRouterMaxInfos(3))
+	defer a.Close()
+	waitForRoot([]*PacketConn{a}, 30*time.Second)
+	var evictions int
+	a.SetCapacityHandler(func(current, max int, key ed25519.PublicKey) {
+		evictions++
+	})
+	r := &a.core.router
+	from := &peer{key: nodes[0].publicKey}
+	announce := func(c *crypto, port peerPort) {
+		res := routerSigRes{routerSigReq: routerSigReq{seq: 1, nonce: 1}, port: port}
+		res.psig = c.privateKey.sign(res.bytesForSig(c.publicKey, c.publicKey))
+		ann := &routerAnnounce{key: c.publicKey, parent: c.publicKey, routerSigRes: res}
+		signTestAnnounce(c, ann, time.Now())
+		r._handleAnnounce(from, ann)
+	}
+	expect := func(step string, idxs ...int) {
+		var found []int
+		for idx, c := range nodes {
+			if _, isIn := r.infos[c.publicKey]; isIn {
+				found = append(found, idx)
+			}
+		}
+		if fmt.Sprint(found) != fmt.Sprint(idxs) {
+			t.Fatalf("%s: expected nodes %v, got %v", step, idxs, found)
+		}
+	}
+	phony.Block(r, func() {
+		r.sent[from.key] = make(map[publicKey]struct{})
+		announce(nodes[1], routerLeavingPort)
+		announce(nodes[2], routerLeavingPort)
+		expect("leaving", 1, 2)
+		announce(nodes[4], 0)
+		expect("full, higher key than the leaving infos", 1, 4)
+		announce(nodes[3], 0)
+		expect("full, one leaving info left", 3, 4)
+		announce(nodes[0], 0)
+		expect("full, no leaving infos", 0, 3)
+		// A peer's ancestry is kept, even if it has the highest key
+		r.ancs[from.key] = []publicKey{nodes[3].publicKey}
+		announce(nodes[1], 0)
+		expect("full, the rest is a peer's ancestry", 0, 3)
+		delete(r.ancs, from.key)
+	})
+	if evictions != 4 {
+		t.Fatalf("expected 3 evictions and 1 dropped info, got %d", evictions)
+	}
+}
+
+func BenchmarkAnnounce(b *testing.B) {
+	// Encode, decode, and check an announcement, as for each one we receive and pass on
+	var c crypto
+	_, priv, _ := ed25519.GenerateKey(nil)
+	c.init(priv)
+	res := routerSigRes{routerSigReq: routerSigReq{seq: 1, nonce: 2}}
+	res.psig = c.privateKey.sign(res.bytesForSig(c.publicKey, c.publicKey))
+	ann := routerAnnounce{key: c.publicKey, parent: c.publicKey, routerSigRes: res, sig: res.psig}
+	b.ReportAllocs()
+	for idx := 0; idx < b.N; idx++ {
+		bs, _ := ann.encode(allocBytes(0))
+		var received routerAnnounce
+		if err := received.decode(bs); err != nil {
+			b.Fatal(err)
+		}
+		if !received.check() {
+			b.Fatal("check failed")
+		}
+		freeBytes(bs)
+	}
+}
+
+func TestTreeLinks(t *testing.T) {
+	// A star, with every leaf connected to the hub
+	var keys []ed25519.PublicKey
+	var conns []*PacketConn
+	for idx := 0; idx < 5; idx++ {
+		conn := newNode(t)
+		keys = append(keys, nodeKey(conn))
+		conns = append(conns, conn)
+	}
+	hub := conns[0]
+	for idx := 1; idx < len(conns); idx++ {
+		linkNodes(t, hub, conns[idx])
+	}
+	waitForRoot(conns, 30*time.Second)
+	ports := make(map[string]uint64)
+	for _, info := range hub.Debug.GetPeers() {
+		ports[string(info.Key)] = info.Port
+		if port, ok := hub.Debug.PeerPort(info.Key); !ok || port != info.Port {
+			t.Fatalf("expected port %d, got %d %v", info.Port, port, ok)
+		}
+	}
+	if _, ok := hub.Debug.PeerPort(keys[0]); ok {
+		t.Fatal("found a port for a key that isn't a peer")
+	}
+	hubParent, children := hub.Debug.GetTreeLinks()
+	expected := make(map[string]bool)
+	for idx := 1; idx < len(conns); idx++ {
+		parent, _ := conns[idx].Debug.GetTreeLinks()
+		switch {
+		case parent.Equal(keys[0]):
+			expected[string(keys[idx])] = true
+		case parent.Equal(keys[idx]) && hubParent.Equal(keys[idx]):
+			// This leaf is the root, so it's the hub's parent instead
+		default:
+			t.Fatalf("unexpected parent for leaf %d", idx)
+		}
+	}
+	if len(children) != len(expected) {
+		t.Fatalf("expected %d children, got %d", len(expected), len(children))
+	}
+	for _, child := range children {
+		if !expected[string(child.Key)] || child.Port != ports[string(child.Key)] {
+			t.Fatalf("unexpected child %v", child)
+		}
+	}
+}
+
+func TestParentCandidates(t *testing.T) {
+	// The root r has children a and b, c is connected to both of them, and d only to a
+	var conns []*PacketConn
+	for idx := 0; idx < 5; idx++ {
+		conns = append(conns, newNode(t))
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].core.crypto.publicKey.less(conns[j].core.crypto.publicKey)
+	})
+	var keys []ed25519.PublicKey
+	for _, conn := range conns {
+		keys = append(keys, nodeKey(conn))
+	}
+	const root, a, b, c, d = 0, 1, 2, 3, 4
+	for _, link := range [][2]int{{root, a}, {root, b}, {c, a}, {c, b}, {d, a}} {
+		linkNodes(t, conns[link[0]], conns[link[1]])
+	}
+	waitForRoot(conns, 30*time.Second)
+	if candidates := conns[root].Debug.ParentCandidates(); candidates != nil {
+		t.Fatalf("expected no candidates for the root, got %d", len(candidates))
+	}
+	if candidates := conns[d].Debug.ParentCandidates(); len(candidates) != 1 || !candidates[0].Equal(keys[a]) {
+		t.Fatalf("expected only a for d, got %d candidates", len(candidates))
+	}
+	parent, _ := conns[c].Debug.GetTreeLinks()
+	candidates := conns[c].Debug.ParentCandidates()
+	if len(candidates) != 2 || !candidates[0].Equal(parent) {
+		t.Fatalf("expected c's parent and one backup, got %d candidates", len(candidates))
+	}
+	// a's child d can never be a candidate, and c is only one if it doesn't go through a
+	expected := 1
+	if parent.Equal(keys[b]) {
+		expected = 2
+	}
+	if candidates := conns[a].Debug.ParentCandidates(); len(candidates) != expected || !candidates[0].Equal(keys[root]) {
+		t.Fatalf("expected %d candidates for a, got %d", expected, len(candidates))
+	}
+}
+
+type testSeqStore struct {
+	mutex sync.Mutex
+	seqs  map[string]uint64
+}
+
+func (s *testSeqStore) Load(key ed25519.PublicKey) (uint64, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seq, ok := s.seqs[string(key)]
+	return seq, ok
+}
+
+func (s *testSeqStore) Store(key ed25519.PublicKey, seq uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seqs[string(key)] = seq
+}
+
+func TestSeqStore(t *testing.T) {
+	for _, withStore := range []bool{true, false} {
+		name := "without store"
+		if withStore {
+			name = "with store"
+		}
+		t.Run(name, func(t *testing.T) {
+			pubA, privA, _ := ed25519.GenerateKey(nil)
+			pubB, privB, _ := ed25519.GenerateKey(nil)
+			var options []Option
+			if withStore {
+				options = append(options, WithSeqStore(&testSeqStore{seqs: make(map[string]uint64)}))
+			}
+			b, _ := NewPacketConn(privB)
+			defer b.Close()
+			var keyA publicKey
+			copy(keyA[:], pubA)
+			connect := func() (*PacketConn, func()) {
+				a, _ := NewPacketConn(privA, options...)
+				cA, cB := newDummyConn(pubA, pubB)
+				go a.HandleConn(pubB, cA, 0)
+				go b.HandleConn(pubA, cB, 0)
+				return a, func() {
+					a.Close()
+					cA.Close()
+				}
+			}
+			// Returns a's info, once it's been replaced since old and b agrees with a about it
+			agreed := func(a *PacketConn, old routerInfo) routerInfo {
+				waitForRoot([]*PacketConn{a, b}, 30*time.Second)
+				for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+					var infoA, infoB routerInfo
+					phony.Block(&a.core.router, func() {
+						infoA = a.core.router.infos[keyA]
+					})
+					phony.Block(&b.core.router, func() {
+						infoB = b.core.router.infos[keyA]
+					})
+					if infoA == infoB && infoA != old {
+						return infoA
+					}
+				}
+				t.Fatal("timeout")
+				return old
+			}
+			a, cleanup := connect()
+			old := agreed(a, routerInfo{})
+			cleanup()
+			// b still has a's old info, since it hasn't timed out yet
+			a, cleanup = connect()
+			defer cleanup()
+			var revived bool
+			a.SetSelfRevivedHandler(func() { revived = true })
+			start := time.Now()
+			agreed(a, old)
+			t.Logf("converged after %s", time.Since(start))
+			phony.Block(&a.core.router, func() {
+				if withStore && revived {
+					t.Fatal("learned our own info from b, even though we had a stored seq")
+				}
+			})
+		})
+	}
+}
+
+func TestParentHysteresis(t *testing.T) {
+	// The root r has children a and b, and c is connected to both of them at the same depth
+	for _, test := range []struct {
+		name     string
+		options  []Option
+		switches bool
+	}{
+		{"disabled", nil, true},
+		{"margin", []Option{WithParentHysteresis(1, 0)}, false},
+		{"hold", []Option{WithParentHysteresis(1, time.Hour)}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var conns []*PacketConn
+			for idx := 0; idx < 4; idx++ {
+				conns = append(conns, newNode(t, test.options...))
+			}
+			sort.Slice(conns, func(i, j int) bool {
+				return conns[i].core.crypto.publicKey.less(conns[j].core.crypto.publicKey)
+			})
+			const root, a, b, c = 0, 1, 2, 3
+			for _, link := range [][2]int{{root, a}, {root, b}, {c, a}, {c, b}} {
+				linkNodes(t, conns[link[0]], conns[link[1]])
+			}
+			// Convergence doesn't depend on this
+			waitForRoot(conns, 30*time.Second)
+			r := &conns[c].core.router
+			var switched bool
+			for idx := 0; idx < 10 && !switched; idx++ {
+				// Make the other peer look like it answered first, and refresh
+				time.Sleep(10 * time.Millisecond)
+				phony.Block(r, func() {
+					selfKey := r.core.crypto.publicKey
+					parent := r.infos[selfKey].parent
+					for k := range r.peers {
+						if k != parent {
+							r.resSeqs[k] = 0
+						}
+					}
+					r.refresh = true
+					r._fix()
+					switched = r.infos[selfKey].parent != parent
+				})
+			}
+			if switched != test.switches {
+				t.Fatalf("expected switched %v, got %v", test.switches, switched)
+			}
+		})
+	}
+}
+
+func TestRouterCache(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv, WithRouterCacheSize(3))
+	defer pc.Close()
+	r := &pc.core.router
+	phony.Block(r, func() {
+		selfKey := r.core.crypto.publicKey
+		if r.infos[selfKey].parent != selfKey {
+			t.Fatal("expected to be the root")
+		}
+		var seq uint64
+		update := func(key, parent byte, port peerPort) {
+			seq++
+			ann := routerAnnounce{key: publicKey{key}, parent: publicKey{parent}, routerSigRes: routerSigRes{routerSigReq: routerSigReq{seq: seq}, port: port}}
+			if parent == 0 {
+				ann.parent = selfKey
+			}
+			if !r._update(&ann) {
+				t.Fatal("update rejected")
+			}
+		}
+		check := func(key byte, expected ...peerPort) {
+			path := r._getCachedPath(publicKey{key})
+			if len(path) != len(expected) {
+				t.Fatalf("unexpected path for %d: %v", key, path)
+			}
+			for idx := range path {
+				if path[idx] != expected[idx] {
+					t.Fatalf("unexpected path for %d: %v", key, path)
+				}
+			}
+		}
+		// Node 2 is a child of 1, which is one of our children, and 4 is missing its parent 5
+		update(1, 0, 1)
+		update(2, 1, 2)
+		update(3, 0, 3)
+		update(4, 5, 6)
+		check(2, 1, 2)
+		check(4)
+		// Unrelated changes leave the cached path alone
+		update(3, 0, 7)
+		if _, isIn := r.cache[publicKey{2}]; !isIn {
+			t.Fatal("path for 2 was dropped")
+		}
+		update(1, 0, 8)
+		check(2, 8, 2)
+		update(5, 0, 9)
+		check(4, 9, 6)
+		// The cache only has room for 3 paths, so the least recently used (2's) is dropped
+		check(3, 7)
+		check(1, 8)
+		if _, isIn := r.cache[publicKey{2}]; isIn || len(r.cache) != 3 {
+			t.Fatalf("unexpected cache size %d", len(r.cache))
+		}
+	})
+}
+
+// BenchmarkLookupChurn finds the next hop towards a destination, after an update to an info that's not on the way to any of our peers.
+// Before routerCacheEntry.ancs, every update dropped every cached path, which is what the reset case does.
+func BenchmarkLookupChurn(b *testing.B) {
+	for _, reset := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reset=%v", reset), func(b *testing.B) {
+			_, priv, _ := ed25519.GenerateKey(nil)
+			pc, _ := NewPacketConn(priv)
+			defer pc.Close()
+			r := &pc.core.router
+			phony.Block(r, func() {
+				// We're the root, with 64 peers that each have a chain of 8 descendants and 64 other children
+				selfKey := r.core.crypto.publicKey
+				var seq uint64
+				update := func(key, parent publicKey, port peerPort) {
+					seq++
+					r.infos[key] = routerInfo{parent: parent, routerSigRes: routerSigRes{routerSigReq: routerSigReq{seq: seq}, port: port}}
+				}
+				var leaves []publicKey
+				for idx := 0; idx < 64; idx++ {
+					key := publicKey{1, byte(idx)}
+					update(key, selfKey, peerPort(idx+1))
+					r.peers[key] = map[*peer]struct{}{{key: key, port: peerPort(idx + 1)}: {}}
+					parent := key
+					for depth := 0; depth < 8; depth++ {
+						child := publicKey{2, byte(idx), byte(depth)}
+						update(child, parent, 1)
+						parent = child
+					}
+					for jdx := 0; jdx < 64; jdx++ {
+						leaf := publicKey{3, byte(idx), byte(jdx)}
+						update(leaf, key, peerPort(jdx+2))
+						leaves = append(leaves, leaf)
+					}
+				}
+				_, dest := r._getRootAndPath(publicKey{2, 63, 7})
+				b.ResetTimer()
+				for idx := 0; idx < b.N; idx++ {
+					leaf := leaves[idx%len(leaves)]
+					info := r.infos[leaf]
+					info.seq++
+					r.infos[leaf] = info
+					if reset {
+						r._resetCache()
+					} else {
+						r._invalidateCache(leaf)
+					}
+					watermark := ^uint64(0)
+					if r._lookup(dest, &watermark) == nil {
+						b.Fatal("no next hop")
+					}
+				}
+				b.StopTimer()
+				for key := range r.peers {
+					delete(r.peers, key) // Fake peers, which Close can't send anything to
+				}
+			})
+		})
+	}
+}
+
+// deepChain adds infos for a chain of nodes under us, returning the keys from the top of the chain down.
+func deepChain(r *router, depth int) []publicKey {
+	var keys []publicKey
+	parent := r.core.crypto.publicKey
+	for idx := 0; idx < depth; idx++ {
+		key := publicKey{4, byte(idx), byte(idx >> 8)}
+		r.infos[key] = routerInfo{parent: parent, routerSigRes: routerSigRes{port: 1}}
+		keys = append(keys, key)
+		parent = key
+	}
+	return keys
+}
+
+func TestDeepChain(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv, WithMaxPathLength(16))
+	defer pc.Close()
+	r := &pc.core.router
+	phony.Block(r, func() {
+		selfKey := r.core.crypto.publicKey
+		if r.infos[selfKey].parent != selfKey {
+			t.Fatal("expected to be the root")
+		}
+		keys := deepChain(r, 20)
+		// Anything up to the max path length still has a path
+		if root, path := r._getRootAndPath(keys[15]); root != selfKey || len(path) != 16 {
+			t.Fatalf("expected a path of 16 hops, got %d", len(path))
+		}
+		if root, dists := r._getRootAndDists(keys[15]); root != selfKey || len(dists) != 17 {
+			t.Fatalf("expected 17 dists, got %d", len(dists))
+		}
+		// One hop further is still followed, so callers can tell it's too deep, but anything past that is treated as unreachable
+		if _, path := r._getRootAndPath(keys[16]); len(path) != 17 {
+			t.Fatalf("expected a path of 17 hops, got %d", len(path))
+		}
+		if root, path := r._getRootAndPath(keys[17]); root != keys[17] || path != nil {
+			t.Fatalf("expected no path, got %d hops", len(path))
+		}
+		if len(r.visited) != 0 {
+			t.Fatal("scratch map wasn't cleared")
+		}
+		// We won't accept a new info under the deepest allowed node
+		p := &peer{key: publicKey{5}}
+		r.sent[p.key] = make(map[publicKey]struct{})
+		defer delete(r.sent, p.key)
+		ann := routerAnnounce{key: publicKey{6}, parent: keys[15], routerSigRes: routerSigRes{routerSigReq: routerSigReq{seq: 1}, port: 1}}
+		r._handleAnnounce(p, &ann)
+		if _, isIn := r.infos[ann.key]; isIn {
+			t.Fatal("accepted an info that's too deep")
+		}
+		ann.parent = keys[14]
+		r._handleAnnounce(p, &ann)
+		if _, isIn := r.infos[ann.key]; !isIn {
+			t.Fatal("rejected an info that's deep enough")
+		}
+	})
+	if drops := pc.Metrics()["drops.announce_depth"]; drops != 1 {
+		t.Fatalf("expected 1 drop, got %d", drops)
+	}
+}
+
+// BenchmarkDeepChain looks up the path to the bottom of a chain that's much longer than the max path length, which stops after the first 65 hops.
+func BenchmarkDeepChain(b *testing.B) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	pc, _ := NewPacketConn(priv)
+	defer pc.Close()
+	r := &pc.core.router
+	phony.Block(r, func() {
+		keys := deepChain(r, 10000)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for idx := 0; idx < b.N; idx++ {
+			r._getRootAndPath(keys[len(keys)-1])
+		}
+	})
+}
+
+func TestAnnounceFilter(t *testing.T) {
+	// a rejects b's info, and takes long enough doing it to be counted as slow
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubB, privB, _ := ed25519.GenerateKey(nil)
+	var calls, slowCalls int64
+	filter := func(key, parent ed25519.PublicKey, seq uint64) AnnounceVerdict {
+		if key.Equal(pubA) {
+			t.Error("filter was called for our own info")
+		}
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(2 * announceSlow)
+		if key.Equal(pubB) {
+			return AnnounceReject
+		}
+		return AnnounceEvictable
+	}
+	slow := func(key ed25519.PublicKey, took time.Duration) {
+		if took > announceSlow {
+			atomic.AddInt64(&slowCalls, 1)
+		}
+	}
+	a, _ := NewPacketConn(privA, WithAnnounceFilter(filter), WithAnnounceFilterSlow(slow))
+	b, _ := NewPacketConn(privB)
+	defer a.Close()
+	defer b.Close()
+	linkNodes(t, a, b)
+	for start := time.Now(); a.Metrics()["drops.announce_filter"] == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 30*time.Second {
+			t.Fatal("a never rejected b's info")
+		}
+	}
+	for _, info := range a.Debug.GetTree() {
+		if info.Key.Equal(pubB) {
+			t.Fatal("a stored b's info")
+		}
+	}
+	m := a.Metrics()
+	if slow := m["announces.filter_slow"]; slow == 0 || slow > atomic.LoadInt64(&calls) {
+		t.Fatalf("expected each of the %d filter calls to be slow, got %d", atomic.LoadInt64(&calls), slow)
+	}
+	if handled := atomic.LoadInt64(&slowCalls); handled != m["announces.filter_slow"] {
+		t.Fatalf("expected the handler to get each of the %d slow calls, got %d", m["announces.filter_slow"], handled)
+	}
+	// b doesn't filter, so it still learns about a
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		var found bool
+		for _, info := range b.Debug.GetTree() {
+			found = found || info.Key.Equal(pubA)
+		}
+		if found {
+			break
+		}
+		if time.Since(start) > 30*time.Second {
+			t.Fatal("b never heard about a")
+		}
+	}
+}
+
+func TestAnnounceFilterCap(t *testing.T) {
+	// a has room for 3 infos, its own and 2 others, and each verdict decides what happens when it's full
+	var nodes []*crypto
+	for idx := 0; idx < 6; idx++ {
+		c := new(crypto)
+		_, priv, _ := ed25519.GenerateKey(nil)
+		c.init(priv)
+		nodes = append(nodes, c)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].publicKey.less(nodes[j].publicKey)
+	})
+	verdicts := map[publicKey]AnnounceVerdict{
+		nodes[0].publicKey: AnnounceKeep,
+		nodes[5].publicKey: AnnounceReject,
+	}
+	filter := func(key, parent ed25519.PublicKey, seq uint64) AnnounceVerdict {
+		var k publicKey
+		copy(k[:], key)
+		return verdicts[k] // Evictable by default
+	}
+	_, privA, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA, WithRouterMaxInfos(3), WithAnnounceFilter(filter))
+	defer a.Close()
+	waitForRoot([]*PacketConn{a}, 30*time.Second)
+	r := &a.core.router
+	from := &peer{key: nodes[5].publicKey} // Never sent anything back, since every info is new or better
+	announce := func(c *crypto) {
+		res := routerSigRes{routerSigReq: routerSigReq{seq: 1, nonce: 1}}
+		res.psig = c.privateKey.sign(res.bytesForSig(c.publicKey, c.publicKey))
+		ann := &routerAnnounce{key: c.publicKey, parent: c.publicKey, routerSigRes: res}
+		signTestAnnounce(c, ann, time.Now())
+		r._handleAnnounce(from, ann)
+	}
+	stored := func() (keys []publicKey) {
+		for _, c := range nodes {
+			if _, isIn := r.infos[c.publicKey]; isIn {
+				keys = append(keys, c.publicKey)
+			}
+		}
+		return
+	}
+	expect := func(step string, idxs ...int) {
+		keys := stored()
+		ok := len(keys) == len(idxs)
+		for idx := 0; ok && idx < len(idxs); idx++ {
+			ok = keys[idx] == nodes[idxs[idx]].publicKey
+		}
+		if !ok {
+			t.Fatalf("%s: expected nodes %v, got %d infos", step, idxs, len(keys))
+		}
+	}
+	phony.Block(r, func() {
+		r.sent[from.key] = make(map[publicKey]struct{})
+		announce(nodes[5])
+		expect("rejected")
+		announce(nodes[2])
+		announce(nodes[3])
+		expect("evictable", 2, 3)
+		announce(nodes[4])
+		expect("evictable, full, higher key", 2, 3)
+		announce(nodes[1])
+		expect("evictable, full, lower key", 1, 2)
+		announce(nodes[0])
+		expect("keep, full", 0, 1)
+		announce(nodes[4])
+		expect("evictable, full of a kept info and a lower key", 0, 1)
+	})
+	m := a.Metrics()
+	if m["drops.announce_filter"] != 1 || m["drops.announce_cap"] != 2 || m["announces.evicted"] != 2 {
+		t.Fatalf("unexpected metrics: %d filtered, %d over the cap, %d evicted", m["drops.announce_filter"], m["drops.announce_cap"], m["announces.evicted"])
+	}
+}
+
+func TestExpectedRoot(t *testing.T) {
+	var keys []ed25519.PublicKey
+	var privs []ed25519.PrivateKey
+	for idx := 0; idx < 3; idx++ {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		keys = append(keys, pub)
+		privs = append(privs, priv)
+	}
+	sort.Slice(privs, func(i, j int) bool {
+		return bytes.Compare(privs[i].Public().(ed25519.PublicKey), privs[j].Public().(ed25519.PublicKey)) < 0
+	})
+	for idx := range privs {
+		keys[idx] = privs[idx].Public().(ed25519.PublicKey)
+	}
+	// keys[0] is missing, so keys[1] waits for it, but falls back to being the root
+	root, _ := NewPacketConn(privs[1], WithExpectedRoot(keys[0], time.Second))
+	defer root.Close()
+	// keys[2] expects keys[1], and joins its tree without becoming a root first
+	node, _ := NewPacketConn(privs[2], WithExpectedRoot(keys[1], time.Minute))
+	defer node.Close()
+	time.Sleep(1500 * time.Millisecond)
+	if m := node.Metrics(); m["router.self_updates"] != 0 {
+		t.Fatalf("node updated its info %d times before it had any peers", m["router.self_updates"])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := root.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	linkNodes(t, root, node)
+	if err := node.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if parent, _ := node.Debug.GetTreeLinks(); !parent.Equal(keys[1]) {
+		t.Fatalf("unexpected parent %x", parent)
+	}
+	if changes := node.Metrics()["router.parent_changes"]; changes != 1 {
+		t.Fatalf("expected 1 parent change, got %d", changes)
+	}
+}
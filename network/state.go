@@ -0,0 +1,129 @@
+package network
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// stateVersion is the first byte of the ExportState format, so it can change later without misreading old state.
+const stateVersion = 0
+
+// ExportState returns a snapshot of the router's known infos, which can be passed to ImportState after a restart to speed up convergence.
+// The format is: version byte, export time (uvarint unix nanoseconds), then for each info its age (uvarint milliseconds), length (uvarint), and encoded announcement.
+func (pc *PacketConn) ExportState() []byte {
+	var out []byte
+	phony.Block(&pc.core.router, func() {
+		out = pc.core.router._exportState()
+	})
+	return out
+}
+
+// ImportState seeds the router with infos from ExportState.
+// Signatures are checked again, and infos that would have timed out by now are skipped.
+// If our own info is included, its seq is kept, and our info is refreshed right away so the old one isn't used.
+// Returns types.ErrDecode if the data is malformed, in which case nothing is imported.
+func (pc *PacketConn) ImportState(data []byte) error {
+	if pc.IsClosed() {
+		return types.ErrClosed
+	}
+	exported, entries, err := stateDecode(data)
+	if err != nil {
+		return err
+	}
+	phony.Block(&pc.core.router, func() {
+		pc.core.router._importState(exported, entries)
+	})
+	return nil
+}
+
+type stateEntry struct {
+	age time.Duration
+	ann routerAnnounce
+}
+
+func (r *router) _exportState() []byte {
+	now := time.Now()
+	out := []byte{stateVersion}
+	out = wireAppendUint(out, uint64(now.UnixNano()))
+	for key, info := range r.infos {
+		age := now.Sub(r.updated[key])
+		ann := info.getAnnounce(key)
+		out = wireAppendUint(out, uint64(age.Milliseconds()))
+		out = wireAppendUint(out, uint64(ann.size()))
+		out, _ = ann.encode(out)
+	}
+	return out
+}
+
+func stateDecode(data []byte) (exported time.Time, entries []stateEntry, err error) {
+	if len(data) < 1 || data[0] != stateVersion {
+		return exported, nil, types.ErrDecode
+	}
+	data = data[1:]
+	var ns uint64
+	if !wireChopUint(&ns, &data) {
+		return exported, nil, types.ErrDecodeTruncated
+	}
+	exported = time.Unix(0, int64(ns))
+	for len(data) > 0 {
+		var age, size uint64
+		var bs []byte
+		if !wireChopUint(&age, &data) {
+			return exported, nil, types.ErrDecodeTruncated
+		} else if !wireChopUint(&size, &data) || size > uint64(len(data)) {
+			return exported, nil, types.ErrDecodeTruncated
+		} else if !wireChopBytes(&bs, &data, int(size)) {
+			return exported, nil, types.ErrDecodeTruncated
+		}
+		var entry stateEntry
+		if err := entry.ann.decode(bs); err != nil {
+			return exported, nil, err
+		}
+		entry.age = time.Duration(age) * time.Millisecond
+		entries = append(entries, entry)
+	}
+	return exported, entries, nil
+}
+
+func (r *router) _importState(exported time.Time, entries []stateEntry) {
+	now := time.Now()
+	elapsed := now.Sub(exported)
+	if elapsed < 0 {
+		elapsed = 0 // Clock went backwards, assume no time has passed
+	}
+	var importedSelf bool
+	for idx := range entries {
+		entry := &entries[idx]
+		ann := &entry.ann
+		if !ann.check() {
+			continue
+		}
+		age := entry.age + elapsed
+		isSelf := ann.key == r.core.crypto.publicKey
+		if !isSelf && age >= r.core.config.routerTimeout {
+			// This would have expired by now
+			continue
+		}
+		if isSelf {
+			// Even if this doesn't replace our current info, other nodes may still have it, so we need a newer seq
+			if ann.seq >= r.infos[ann.key].seq {
+				r._update(ann)
+				importedSelf = true
+			}
+		} else if r._update(ann) && now.Add(-age).Before(r.updated[ann.key]) {
+			// Expire it when it would have if we never restarted, unless its signed time says sooner (see WithSignedExpiry)
+			r.timers[ann.key].Reset(r.core.config.routerTimeout - age)
+			r.updated[ann.key] = now.Add(-age)
+		}
+	}
+	if importedSelf {
+		// Our old info may point to a parent that isn't a peer anymore
+		// Replace it right away, so the next seq we use is higher than anything that other nodes may still have
+		r.refresh = true
+		r.doRoot2 = true
+		r._fix()
+	}
+}
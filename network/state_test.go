@@ -0,0 +1,64 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+func TestExportImportState(t *testing.T) {
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubB, privB, _ := ed25519.GenerateKey(nil)
+	a, _ := NewPacketConn(privA)
+	b, _ := NewPacketConn(privB)
+	defer b.Close()
+	var keyB publicKey
+	copy(keyB[:], pubB)
+	cA, cB := newDummyConn(pubA, pubB)
+	go a.HandleConn(pubB, cA, 0)
+	go b.HandleConn(pubA, cB, 0)
+	waitForRoot([]*PacketConn{a, b}, 30*time.Second)
+	state := a.ExportState()
+	var oldSeq uint64
+	phony.Block(&a.core.router, func() {
+		oldSeq = a.core.router.infos[a.core.crypto.publicKey].seq
+	})
+	a.Close()
+	cA.Close()
+	cB.Close()
+	// Restart with the same key
+	a, _ = NewPacketConn(privA)
+	defer a.Close()
+	if err := a.ImportState(state); err != nil {
+		t.Fatal(err)
+	}
+	phony.Block(&a.core.router, func() {
+		r := &a.core.router
+		if _, isIn := r.infos[keyB]; !isIn {
+			t.Error("peer info was not imported")
+		}
+		if seq := r.infos[r.core.crypto.publicKey].seq; seq <= oldSeq {
+			t.Errorf("expected our seq to be higher than %d, got %d", oldSeq, seq)
+		}
+	})
+	// Infos that would have timed out are dropped
+	c, _ := NewPacketConn(privA, WithRouterTimeout(time.Millisecond))
+	defer c.Close()
+	time.Sleep(10 * time.Millisecond)
+	if err := c.ImportState(state); err != nil {
+		t.Fatal(err)
+	}
+	phony.Block(&c.core.router, func() {
+		if _, isIn := c.core.router.infos[keyB]; isIn {
+			t.Error("expired info was imported")
+		}
+	})
+	if err := c.ImportState(state[:len(state)-1]); !errors.Is(err, types.ErrDecode) {
+		t.Fatalf("expected types.ErrDecode for truncated state, got %v", err)
+	}
+}
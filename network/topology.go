@@ -0,0 +1,73 @@
+package network
+
+import (
+	"crypto/ed25519"
+)
+
+// TopologyEpoch is sent by PacketConn.TopologyEpochs when our root or our path to it changes.
+// Paths that other nodes had to us are probably broken after that, until they look us up again, so packets sent to or from us around then may have been lost.
+type TopologyEpoch struct {
+	Epoch   uint64            // Counts the changes since the PacketConn was created, starting at 1
+	OldRoot ed25519.PublicKey // Our root before the change, or before the oldest change coalesced into this one
+	NewRoot ed25519.PublicKey // Our root after the change
+}
+
+// TopologyEpochs returns a channel that receives a TopologyEpoch each time our root or our path to it changes, e.g. when we lose our parent and self-root.
+// This is best-effort: if nothing has received the last one yet, it's replaced by the new one, so a burst of changes arrives as its latest epoch.
+// Every call returns the same channel, so it's meant for one receiver, which would typically retransmit or re-handshake whatever was in flight.
+func (pc *PacketConn) TopologyEpochs() <-chan TopologyEpoch {
+	return pc.core.router.epochs.ch
+}
+
+/**********
+ * epochs *
+ **********/
+
+// epochs keeps track of changes to our ancestry, see PacketConn.TopologyEpochs.
+// WARNING This should only be used from within the router's actor, it's not threadsafe
+type epochs struct {
+	router *router
+	epoch  uint64
+	path   []publicKey // our ancestry as of the last epoch, root first
+	ch     chan TopologyEpoch
+}
+
+func (es *epochs) init(r *router) {
+	es.router = r
+	es.path = []publicKey{r.core.crypto.publicKey} // We start out as our own root, so that isn't a change
+	es.ch = make(chan TopologyEpoch, 1)
+}
+
+// _update is called at the end of router._fix, and starts a new epoch if our ancestry changed, without ever blocking.
+func (es *epochs) _update() {
+	path := es.router._getAncestry(es.router.core.crypto.publicKey)
+	if len(path) == 0 {
+		return
+	}
+	if len(path) == len(es.path) {
+		same := true
+		for idx := range path {
+			if path[idx] != es.path[idx] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+	es.epoch++
+	e := TopologyEpoch{
+		Epoch:   es.epoch,
+		OldRoot: es.path[0].toEd(),
+		NewRoot: path[0].toEd(),
+	}
+	es.path = path
+	select {
+	case old := <-es.ch:
+		e.OldRoot = old.OldRoot
+	default:
+	}
+	// The router is the only sender, so there's room now
+	es.ch <- e
+}
@@ -0,0 +1,52 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestTopologyEpochs(t *testing.T) {
+	a, b := newNode(t), newNode(t)
+	pubA, pubB := nodeKey(a), nodeKey(b)
+	// The node with the worse key is the one whose root changes, the other stays its own root
+	var keyA, keyB publicKey
+	copy(keyA[:], pubA)
+	copy(keyB[:], pubB)
+	child, childKey, root := a, pubA, pubB
+	if keyA.less(keyB) {
+		child, childKey, root = b, pubB, pubA
+	}
+	expect := func(conn *PacketConn, epoch uint64, oldRoot, newRoot ed25519.PublicKey) {
+		select {
+		case e := <-conn.TopologyEpochs():
+			if e.Epoch != epoch || !e.OldRoot.Equal(oldRoot) || !e.NewRoot.Equal(newRoot) {
+				t.Fatalf("expected epoch %d from %x to %x, got %d from %x to %x", epoch, oldRoot, newRoot, e.Epoch, e.OldRoot, e.NewRoot)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for epoch %d", epoch)
+		}
+	}
+	var epoch uint64
+	for flap := 0; flap < 3; flap++ {
+		cA, cB := newDummyConn(pubA, pubB)
+		go a.HandleConn(pubB, cA, 0)
+		go b.HandleConn(pubA, cB, 0)
+		epoch++
+		expect(child, epoch, childKey, root)
+		// The parent went away without a goodbye, so the child self-roots once it gives up on it
+		cA.Close()
+		cB.Close()
+		epoch++
+		expect(child, epoch, root, childKey)
+	}
+	// Nothing else should have changed, for either node
+	time.Sleep(2 * time.Second)
+	for _, conn := range []*PacketConn{a, b} {
+		select {
+		case e := <-conn.TopologyEpochs():
+			t.Fatalf("unexpected epoch %d", e.Epoch)
+		default:
+		}
+	}
+}
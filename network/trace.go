@@ -0,0 +1,80 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"net"
+)
+
+// TraceDecision is what a node did with a traced packet.
+type TraceDecision uint8
+
+const (
+	TraceForwarded TraceDecision = iota // Sent to the peer closest to the destination, which is closer than we are
+	TraceDelivered                      // Addressed to us
+	TraceDropped                        // Not for us, and no peer is closer to the destination than the watermark allows
+	TraceLookup                         // Sent by us, but we don't know a path yet, so it waits for a lookup
+)
+
+func (d TraceDecision) String() string {
+	switch d {
+	case TraceForwarded:
+		return "forwarded"
+	case TraceDelivered:
+		return "delivered"
+	case TraceDropped:
+		return "dropped"
+	case TraceLookup:
+		return "lookup"
+	}
+	return "unknown"
+}
+
+// TraceEvent describes how one node handled a packet sent with PacketConn.WriteToTraced, see WithTraceHandler.
+type TraceEvent struct {
+	Source    ed25519.PublicKey
+	Dest      ed25519.PublicKey
+	Decision  TraceDecision
+	Watermark uint64            // After this node updated it
+	Next      ed25519.PublicKey // Peer the packet was forwarded to, if Decision is TraceForwarded
+	Port      uint64            // Port used for Next
+	Dist      uint64            // Distance in the tree from Next to the destination's path
+}
+
+// WriteToTraced is like WriteTo, but every node that handles the packet and has a trace handler (see WithTraceHandler) reports what it did with it.
+// Events are only reported locally on each node, they aren't sent anywhere.
+// The packet carries the kind it was sent as in an extra byte, so it has to fit in a single packet with a byte to spare, and it's never fragmented or coalesced.
+// Traced packets are a kind of traffic that peers without featureTrafficHeader can't carry, so they're dropped before they reach a node that doesn't support it.
+// The encrypted and signed PacketConns have their own WriteToTraced, which traces the packet they send.
+func (pc *PacketConn) WriteToTraced(p []byte, addr net.Addr) (n int, err error) {
+	return pc.WriteToOptions(p, addr, PacketOptions{Traced: true})
+}
+
+// _trace reports what we did with a traced packet, if there's a trace handler.
+// This needs to be called before sending the traffic anywhere else, since the traffic may be reused afterwards.
+func (r *router) _trace(tr *traffic, decision TraceDecision, next *peer) {
+	if r.core.config.traceHandler == nil || tr.kind != trafficKindTrace {
+		return
+	}
+	event := TraceEvent{
+		Source:    tr.source.toEd(),
+		Dest:      tr.dest.toEd(),
+		Decision:  decision,
+		Watermark: tr.watermark,
+	}
+	if next != nil {
+		event.Next = next.key.toEd()
+		event.Port = uint64(next.port)
+		event.Dist = r._getDist(tr.path, next.key)
+	}
+	r.core.config.traceHandler(event)
+}
+
+// untrace turns a traced packet back into the kind it was sent as, once it reaches the destination.
+func (tr *traffic) untrace() bool {
+	if len(tr.payload) < 1 {
+		return false
+	}
+	tr.kind = tr.payload[0]
+	tr.payload = append(tr.payload[:0], tr.payload[1:]...)
+	return tr.kind != trafficKindTrace
+}
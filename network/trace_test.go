@@ -0,0 +1,81 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+func TestTrace(t *testing.T) {
+	// A line a - b - c, where a sends a traced packet to c
+	type event struct {
+		node int
+		TraceEvent
+	}
+	events := make(chan event, 64)
+	var keys []ed25519.PublicKey
+	var conns []*PacketConn
+	for idx := 0; idx < 3; idx++ {
+		node := idx
+		conn := newNode(t, WithTraceHandler(func(e TraceEvent) {
+			select {
+			case events <- event{node, e}:
+			default:
+			}
+		}))
+		keys = append(keys, nodeKey(conn))
+		conns = append(conns, conn)
+	}
+	linkLine(t, conns)
+	// Untraced traffic to the same destination should never show up in the events
+	conns[0].WriteTo([]byte("untraced"), types.Addr(keys[2]))
+	for {
+		if n, err := conns[0].WriteToTraced([]byte("traced"), types.Addr(keys[2])); err != nil || n != 6 {
+			t.Fatalf("unexpected write: %d %v", n, err)
+		}
+		var forwarded []event
+		var delivered bool
+		timeout := time.After(100 * time.Millisecond)
+	wait:
+		for {
+			select {
+			case e := <-events:
+				switch e.Decision {
+				case TraceForwarded:
+					forwarded = append(forwarded, e)
+				case TraceDelivered:
+					if e.node != 2 {
+						t.Fatalf("delivered to node %d", e.node)
+					}
+					delivered = true
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+		if !delivered {
+			continue // Still looking for a path
+		}
+		if len(forwarded) != 2 {
+			t.Fatalf("expected 2 forwarding events, got %d", len(forwarded))
+		}
+		for idx, e := range forwarded {
+			if e.node != idx || !e.Next.Equal(keys[idx+1]) || !e.Source.Equal(keys[0]) || !e.Dest.Equal(keys[2]) {
+				t.Fatalf("unexpected event: %+v", e)
+			}
+		}
+		break
+	}
+	buf := make([]byte, 16)
+	for {
+		n, _, err := conns[2].ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) == "traced" {
+			break
+		}
+	}
+}
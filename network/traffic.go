@@ -6,12 +6,45 @@ import "github.com/Arceliar/ironwood/types"
  * traffic *
  ***********/
 
+// The kind is a byte after the watermark, followed by the class and flow (see PacketOptions), which are left out for peers from before they were added, see oldTraffic.
+// Traffic kinds below OutOfBandKindMin are reserved for the library.
+// Kinds from OutOfBandKindMin up are for applications, see PacketConn.SetOutOfBandHandler.
+const (
+	trafficKindStandard    = 0  // Normal traffic, delivered via ReadFrom
+	trafficKindHealthCheck = 1  // Sent to ourself by PacketConn.HealthCheck
+	trafficKindTrace       = 2  // Sent by PacketConn.WriteToTraced, the first byte of the payload is the original kind
+	trafficKindRouteQuery  = 3  // Sent by PacketConn.TraceRoute, asks for the next hop towards a destination
+	trafficKindRouteReply  = 4  // Answer to a trafficKindRouteQuery
+	trafficKindCoalesced   = 5  // Several standard packets, each prefixed by its length, see WithCoalescing
+	trafficKindCoalesceReq = 6  // Asks whether the destination can split trafficKindCoalesced traffic
+	trafficKindCoalesceAck = 7  // Answer to a trafficKindCoalesceReq, older nodes drop the request instead
+	trafficKindPingRequest = 8  // Sent by PacketConn.Ping, echoed back as a trafficKindPingReply
+	trafficKindPingReply   = 9  // Answer to a trafficKindPingRequest, with the same payload
+	trafficKindUnreachable = 10 // Sent back to the source of dropped traffic, see WithUnreachableReports
+	trafficKindFragment    = 11 // Part of a standard packet that was too big for the network, see WithFragmentation
+	OutOfBandKindMin       = 128
+)
+
+// TrafficClass decides which packets are sent first when a peer's queue backs up, see PacketConn.WriteToClass.
+// The class goes with the packet, so every node on the way queues it the same way.
+type TrafficClass uint8
+
+const (
+	TrafficClassBestEffort TrafficClass = 0 // The default, used by WriteTo and everything the library sends
+	TrafficClassRealTime   TrafficClass = 1 // Sent before anything else that's queued, and dropped last, meant for small latency sensitive flows (e.g. voice)
+	TrafficClassBulk       TrafficClass = 2 // Sent only when nothing else is queued, and dropped first, meant for transfers that care about throughput rather than latency
+	trafficClasses                      = 3
+)
+
 type traffic struct {
 	path      []peerPort // *not* zero terminated
 	from      []peerPort
 	source    publicKey
 	dest      publicKey
 	watermark uint64
+	kind      byte
+	class     TrafficClass
+	flow      uint8 // see PacketOptions
 	payload   []byte
 }
 
@@ -29,6 +62,9 @@ func (tr *traffic) size() int {
 	size += len(tr.source)
 	size += len(tr.dest)
 	size += wireSizeUint(tr.watermark)
+	size += 1 // kind
+	size += 1 // class
+	size += 1 // flow
 	size += len(tr.payload)
 	return size
 }
@@ -40,6 +76,7 @@ func (tr *traffic) encode(out []byte) ([]byte, error) {
 	out = append(out, tr.source[:]...)
 	out = append(out, tr.dest[:]...)
 	out = wireAppendUint(out, tr.watermark)
+	out = append(out, tr.kind, byte(tr.class), tr.flow)
 	out = append(out, tr.payload...)
 	end := len(out)
 	if end-start != tr.size() {
@@ -49,25 +86,65 @@ func (tr *traffic) encode(out []byte) ([]byte, error) {
 }
 
 func (tr *traffic) decode(data []byte) error {
+	return tr.decodeHeader(data, true)
+}
+
+// decodeOld is decode for traffic from a peer that doesn't support featureTrafficHeader, which is always standard best effort traffic.
+func (tr *traffic) decodeOld(data []byte) error {
+	return tr.decodeHeader(data, false)
+}
+
+func (tr *traffic) decodeHeader(data []byte, header bool) error {
 	var tmp traffic
 	tmp.path = tr.path[:0]
 	tmp.from = tr.from[:0]
-	if !wireChopPath(&tmp.path, &data) {
-		return types.ErrDecode
-	} else if !wireChopPath(&tmp.from, &data) {
-		return types.ErrDecode
+	if err := wireChopPath(&tmp.path, &data); err != nil {
+		return err
+	} else if err := wireChopPath(&tmp.from, &data); err != nil {
+		return err
 	} else if !wireChopSlice(tmp.source[:], &data) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if !wireChopSlice(tmp.dest[:], &data) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
 	} else if !wireChopUint(&tmp.watermark, &data) {
-		return types.ErrDecode
+		return types.ErrDecodeTruncated
+	}
+	if header {
+		if len(data) < 3 {
+			return types.ErrDecodeTruncated
+		}
+		tmp.kind, tmp.class, tmp.flow, data = data[0], TrafficClass(data[1]), data[2], data[3:]
 	}
 	tmp.payload = append(tr.payload[:0], data...)
 	*tr = tmp
 	return nil
 }
 
+// oldTraffic encodes traffic without the kind, class and flow, for peers that don't support featureTrafficHeader.
+// Only standard traffic is sent this way, see peer._push, and the class and flow are lost from there on.
+type oldTraffic struct {
+	*traffic
+}
+
+func (tr oldTraffic) size() int {
+	return tr.traffic.size() - 3
+}
+
+func (tr oldTraffic) encode(out []byte) ([]byte, error) {
+	start := len(out)
+	out = wireAppendPath(out, tr.path)
+	out = wireAppendPath(out, tr.from)
+	out = append(out, tr.source[:]...)
+	out = append(out, tr.dest[:]...)
+	out = wireAppendUint(out, tr.watermark)
+	out = append(out, tr.payload...)
+	end := len(out)
+	if end-start != tr.size() {
+		panic("this should never happen")
+	}
+	return out, nil
+}
+
 // Functions needed for pqPacket
 
 func (tr *traffic) wireType() wirePacketType {
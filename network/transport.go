@@ -0,0 +1,46 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"net"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// Handshake is run on each connection accepted by Serve, to learn the peer's key and the priority to use for the link (see HandleConn).
+// This is where any authentication should happen, e.g. checking a TLS certificate against the key.
+// If it returns an error, the connection is closed.
+type Handshake func(conn net.Conn) (key ed25519.PublicKey, prio uint8, err error)
+
+// Serve accepts connections from the listener, runs the handshake on each of them, and then handles each one with HandleConn.
+// Serve can be called once per transport (e.g. TCP, TLS, and an in-memory listener), and every transport feeds peers into the same PacketConn.
+// Each connection gets its own goroutine, so a slow handshake doesn't hold up the listener.
+// Returns when the listener returns an error, or immediately with types.ErrClosed if the PacketConn is closed, in which case the listener is closed too.
+func (pc *PacketConn) Serve(listener net.Listener, handshake Handshake) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-pc.closed:
+			listener.Close()
+		case <-done:
+		}
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if pc.IsClosed() {
+				return types.ErrClosed
+			}
+			return err
+		}
+		go func() {
+			key, prio, err := handshake(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			pc.HandleConn(key, conn, prio)
+		}()
+	}
+}
@@ -0,0 +1,88 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	"github.com/Arceliar/phony"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+// unreachableInterval is how often we report each unreachable destination, see WithUnreachableReports.
+const unreachableInterval = time.Second
+
+// Reasons sent in a trafficKindUnreachable report, each surfaced as the matching types.Error.
+const (
+	unreachableNoRoute   = 1 // types.ErrNoRoute
+	unreachableLoop      = 2 // types.ErrRouteLoop
+	unreachableQueueFull = 3 // types.ErrQueueFull
+)
+
+var unreachableErrors = map[byte]error{
+	unreachableNoRoute:   types.ErrNoRoute,
+	unreachableLoop:      types.ErrRouteLoop,
+	unreachableQueueFull: types.ErrQueueFull,
+}
+
+// SetUnreachableHandler sets a function to call when a node on the way to a destination reports that it dropped our traffic, or unsets it if the handler is nil.
+// Reports are only sent by nodes that enable WithUnreachableReports, and the reason is types.ErrNoRoute, types.ErrRouteLoop (the packet was sent back the way it came) or types.ErrQueueFull.
+// Reports aren't signed, so they're only a hint that something went wrong, e.g. to fail fast instead of waiting for a timeout.
+func (pc *PacketConn) SetUnreachableHandler(handler func(dest, from ed25519.PublicKey, reason error)) {
+	phony.Block(&pc.actor, func() {
+		pc.unreachableHandler = handler
+	})
+}
+
+// _sendUnreachable reports a dropped packet back to its source, at most once per unreachableInterval per destination.
+// The report is sent along the path the packet came from, so it doesn't need a lookup.
+// The caller keeps ownership of tr.
+func (r *router) _sendUnreachable(tr *traffic, reason byte) {
+	selfKey := r.core.crypto.publicKey
+	if !r.core.config.unreachable || tr.kind == trafficKindUnreachable || tr.source == selfKey {
+		return
+	}
+	now := time.Now()
+	if now.Sub(r.unreachable[tr.dest]) < unreachableInterval {
+		return
+	}
+	if r.unreachable == nil {
+		r.unreachable = make(map[publicKey]time.Time)
+	}
+	r.unreachable[tr.dest] = now
+	rep := allocTraffic()
+	rep.path = append(rep.path[:0], tr.from...)
+	_, from := r._getRootAndPath(selfKey)
+	rep.from = append(rep.from[:0], from...)
+	rep.source = selfKey
+	rep.dest = tr.source
+	rep.watermark = ^uint64(0)
+	rep.kind = trafficKindUnreachable
+	rep.payload = append(rep.payload, reason)
+	rep.payload = append(rep.payload, tr.dest[:]...)
+	r.handleTraffic(r, rep)
+}
+
+// _sweepUnreachable forgets destinations we can report again, it's called during maintenance.
+func (r *router) _sweepUnreachable() {
+	now := time.Now()
+	for dest, sent := range r.unreachable {
+		if now.Sub(sent) >= unreachableInterval {
+			delete(r.unreachable, dest)
+		}
+	}
+}
+
+func (pc *PacketConn) _handleUnreachable(tr *traffic) {
+	defer freeTraffic(tr)
+	var dest publicKey
+	if len(tr.payload) != 1+len(dest) || pc.unreachableHandler == nil {
+		return
+	}
+	reason, isIn := unreachableErrors[tr.payload[0]]
+	if !isIn {
+		return
+	}
+	copy(dest[:], tr.payload[1:])
+	pc.unreachableHandler(dest.toEd(), tr.source.toEd(), reason)
+}
@@ -0,0 +1,66 @@
+package network
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+type unreachableReport struct {
+	dest, from ed25519.PublicKey
+	reason     error
+}
+
+func TestUnreachable(t *testing.T) {
+	// A line a - b - c, where b loses its link to c
+	var keys []ed25519.PublicKey
+	var conns []*PacketConn
+	for idx := 0; idx < 3; idx++ {
+		conn := newNode(t, WithUnreachableReports(true))
+		keys = append(keys, nodeKey(conn))
+		conns = append(conns, conn)
+	}
+	links := linkLine(t, conns)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	rtt, err := conns[0].Ping(ctx, keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := make(chan unreachableReport, 4)
+	conns[0].SetUnreachableHandler(func(dest, from ed25519.PublicKey, reason error) {
+		reports <- unreachableReport{dest, from, reason}
+	})
+	links[1].Close()
+	for len(conns[1].Debug.GetPeers()) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	for idx := 0; idx < 2; idx++ {
+		// Only the first one is reported, the second is rate limited
+		if _, err := conns[0].WriteTo([]byte("hello"), types.Addr(keys[2])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case rep := <-reports:
+		if !rep.dest.Equal(keys[2]) || !rep.from.Equal(keys[1]) {
+			t.Fatalf("unexpected report for %x from %x", rep.dest, rep.from)
+		}
+		if !errors.Is(rep.reason, types.ErrNoRoute) && !errors.Is(rep.reason, types.ErrRouteLoop) {
+			t.Fatalf("unexpected reason: %v", rep.reason)
+		}
+		t.Logf("reported after %s, rtt was %s", time.Since(start), rtt)
+	case <-time.After(time.Second):
+		t.Fatal("no report")
+	}
+	select {
+	case rep := <-reports:
+		t.Fatalf("unexpected second report: %v", rep.reason)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,6 +1,10 @@
 package network
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+
+	"github.com/Arceliar/ironwood/types"
+)
 
 type wirePacketType byte
 
@@ -15,6 +19,14 @@ const (
 	wireProtoPathNotify
 	wireProtoPathBroken
 	wireTraffic
+	wireProtoGoodbye
+	wireProtoBroadcast
+)
+
+// Limits on what we're willing to decode. These must be the same on every node, or nodes could disagree about which infos are valid.
+const (
+	wireMaxPort       = 1 << 20 // Ports must be below this, except for routerLeavingPort, see peers.addPeer
+	wireMaxPathLength = 4096    // Max number of ports in a path
 )
 
 func wireChopSlice(out []byte, data *[]byte) bool {
@@ -85,28 +97,31 @@ func wireAppendPath(dest []byte, path []peerPort) []byte {
 	return dest
 }
 
-func wireDecodePath(source []byte) (path []peerPort, length int) {
+func wireDecodePath(source []byte) (path []peerPort, length int, err error) {
 	bs := source
 	for {
 		var u uint64
 		if !wireChopUint(&u, &bs) {
-			return nil, -1 // TODO correct value
+			return nil, -1, types.ErrDecodeTruncated
 		}
 		if u == 0 {
 			break
 		}
+		if u >= wireMaxPort || len(path) >= wireMaxPathLength {
+			return nil, -1, types.ErrDecodeOverLength
+		}
 		path = append(path, peerPort(u))
 	}
 	length = len(source) - len(bs)
 	return
 }
 
-func wireChopPath(out *[]peerPort, data *[]byte) bool {
-	path, length := wireDecodePath(*data)
-	if length < 0 {
-		return false
+func wireChopPath(out *[]peerPort, data *[]byte) error {
+	path, length, err := wireDecodePath(*data)
+	if err != nil {
+		return err
 	}
 	*out = append(*out, path...)
 	*data = (*data)[length:]
-	return true
+	return nil
 }
@@ -0,0 +1,288 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Arceliar/ironwood/types"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the wire format golden files in testdata")
+
+type wireTestMessage interface {
+	wireEncodeable
+	decode(data []byte) error
+}
+
+type wireTestCase struct {
+	name  string
+	value wireTestMessage
+	new   func() wireTestMessage
+}
+
+func wireTestKey(b byte) (key publicKey) {
+	for idx := range key {
+		key[idx] = b + byte(idx)
+	}
+	return
+}
+
+func wireTestSig(b byte) (sig signature) {
+	for idx := range sig {
+		sig[idx] = b ^ byte(idx)
+	}
+	return
+}
+
+func wireTestBloom() *bloom {
+	b := newBloom()
+	b.addKey(wireTestKey(1))
+	b.addKey(wireTestKey(2))
+	return b
+}
+
+func wireTestCases() []wireTestCase {
+	const max = ^uint64(0)
+	newReq := func() wireTestMessage { return new(routerSigReq) }
+	newRes := func() wireTestMessage { return new(routerSigRes) }
+	newAnn := func() wireTestMessage { return new(routerAnnounce) }
+	newTraffic := func() wireTestMessage { return new(traffic) }
+	newLookup := func() wireTestMessage { return new(pathLookup) }
+	newNotify := func() wireTestMessage { return new(pathNotify) }
+	newBroken := func() wireTestMessage { return new(pathBroken) }
+	newBroadcast := func() wireTestMessage { return new(broadcast) }
+	res := routerSigRes{
+		routerSigReq: routerSigReq{seq: 1, nonce: 2},
+		port:         3,
+		psig:         wireTestSig(4),
+	}
+	return []wireTestCase{
+		{"sigreq_zero", &routerSigReq{}, newReq},
+		{"sigreq_max", &routerSigReq{seq: max, nonce: max}, newReq},
+		{"sigres", &res, newRes},
+		{"sigres_maxport", &routerSigRes{routerSigReq: routerSigReq{seq: max, nonce: max}, port: peerPort(max), psig: wireTestSig(5)}, newRes},
+		{"announce", &routerAnnounce{key: wireTestKey(6), parent: wireTestKey(7), routerSigRes: res, sig: wireTestSig(8)}, newAnn},
+		{"announce_root", &routerAnnounce{key: wireTestKey(9), parent: wireTestKey(9), sig: wireTestSig(10)}, newAnn},
+		{"announce_ext", &routerAnnounce{key: wireTestKey(6), parent: wireTestKey(7), routerSigRes: res, sig: wireTestSig(8), routerAnnounceExt: routerAnnounceExt{time: 1700000000, draining: true, cost: 300, xsig: wireTestSig(27)}}, newAnn},
+		{"traffic_empty", &traffic{}, newTraffic},
+		{"traffic", &traffic{
+			path:      []peerPort{1, 2, 3},
+			from:      []peerPort{4, 5},
+			source:    wireTestKey(11),
+			dest:      wireTestKey(12),
+			watermark: 13,
+			kind:      OutOfBandKindMin,
+			class:     TrafficClassRealTime,
+			flow:      14,
+			payload:   []byte("test"),
+		}, newTraffic},
+		{"traffic_max", &traffic{
+			path:      []peerPort{wireMaxPort - 1},
+			from:      []peerPort{wireMaxPort - 1},
+			watermark: max,
+			kind:      0xff,
+			class:     0xff,
+			flow:      0xff,
+		}, newTraffic},
+		{"lookup", &pathLookup{source: wireTestKey(14), dest: wireTestKey(15), from: []peerPort{1, 128, 16384}}, newLookup},
+		{"lookup_empty", &pathLookup{}, newLookup},
+		{"notify", &pathNotify{
+			path:      []peerPort{6, 7},
+			watermark: max,
+			source:    wireTestKey(16),
+			dest:      wireTestKey(17),
+			info:      pathNotifyInfo{seq: 18, path: []peerPort{8, 9}, sig: wireTestSig(19)},
+		}, newNotify},
+		{"notify_empty", &pathNotify{}, newNotify},
+		{"broken", &pathBroken{path: []peerPort{10}, watermark: 20, source: wireTestKey(21), dest: wireTestKey(22)}, newBroken},
+		{"broadcast", &broadcast{source: wireTestKey(23), seq: 24, ttl: 25, sig: wireTestSig(26), payload: []byte("test")}, newBroadcast},
+		{"broadcast_empty", &broadcast{}, newBroadcast},
+		{"bloom_empty", newBloom(), func() wireTestMessage { return newBloom() }},
+		{"bloom", wireTestBloom(), func() wireTestMessage { return newBloom() }},
+	}
+}
+
+func wireTestEqual(a, b wireTestMessage) bool {
+	if ba, ok := a.(*bloom); ok {
+		bb, ok := b.(*bloom)
+		return ok && ba.filter.Equal(bb.filter)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func wireTestEncode(t testing.TB, msg wireTestMessage) []byte {
+	bs, err := msg.encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != msg.size() {
+		t.Fatalf("encoded %d bytes, but size() is %d", len(bs), msg.size())
+	}
+	return bs
+}
+
+func TestWireGolden(t *testing.T) {
+	for _, tc := range wireTestCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			bs := wireTestEncode(t, tc.value)
+			golden := filepath.Join("testdata", "wire", tc.name+".hex")
+			if *updateGolden {
+				if err := os.WriteFile(golden, []byte(hex.EncodeToString(bs)+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := hex.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bs, want) {
+				t.Fatalf("wire format changed\n got: %x\nwant: %x", bs, want)
+			}
+			decoded := tc.new()
+			if err := decoded.decode(want); err != nil {
+				t.Fatal(err)
+			}
+			if !wireTestEqual(tc.value, decoded) {
+				t.Fatalf("decode(encode(x)) != x")
+			}
+		})
+	}
+}
+
+// wireFuzz checks that decoding never panics, and that anything we manage to decode survives a round trip.
+func wireFuzz(f *testing.F, newMsg func() wireTestMessage) {
+	for _, tc := range wireTestCases() {
+		if reflect.TypeOf(tc.value) == reflect.TypeOf(newMsg()) {
+			f.Add(wireTestEncode(f, tc.value))
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := newMsg()
+		if err := msg.decode(data); err != nil {
+			return
+		}
+		bs := wireTestEncode(t, msg)
+		again := newMsg()
+		if err := again.decode(bs); err != nil {
+			t.Fatalf("failed to decode re-encoded message: %v", err)
+		}
+		if !wireTestEqual(msg, again) {
+			t.Fatalf("decode(encode(x)) != x")
+		}
+	})
+}
+
+// wireTestHugePath encodes a path of the given length, all using the given port, followed by the path terminator.
+func wireTestHugePath(length int, port uint64) []byte {
+	var bs []byte
+	for idx := 0; idx < length; idx++ {
+		bs = wireAppendUint(bs, port)
+	}
+	return wireAppendUint(bs, 0)
+}
+
+func TestWireLimits(t *testing.T) {
+	res := routerSigRes{port: wireMaxPort}
+	bs := wireTestEncode(t, &res)
+	if err := new(routerSigRes).decode(bs); !errors.Is(err, types.ErrBadPort) {
+		t.Fatalf("expected types.ErrBadPort, got %v", err)
+	}
+	res.port = routerLeavingPort
+	bs = wireTestEncode(t, &res)
+	if err := new(routerSigRes).decode(bs); err != nil {
+		t.Fatalf("leaving port was rejected: %v", err)
+	}
+	ann := routerAnnounce{key: wireTestKey(1), parent: wireTestKey(2), routerSigRes: res}
+	if ann.check() {
+		t.Fatal("leaving port was accepted from a non-root")
+	}
+	for _, path := range [][]byte{
+		wireTestHugePath(1, wireMaxPort),
+		wireTestHugePath(1, ^uint64(0)),
+		wireTestHugePath(wireMaxPathLength+1, 1),
+	} {
+		if _, _, err := wireDecodePath(path); !errors.Is(err, types.ErrDecodeOverLength) {
+			t.Fatalf("expected types.ErrDecodeOverLength, got %v", err)
+		}
+	}
+	path := wireTestHugePath(wireMaxPathLength, wireMaxPort-1)
+	if decoded, length, err := wireDecodePath(path); err != nil || length != len(path) || len(decoded) != wireMaxPathLength {
+		t.Fatal("longest valid path was rejected")
+	}
+}
+
+func TestWireDecodeErrors(t *testing.T) {
+	for _, tc := range wireTestCases() {
+		if strings.HasPrefix(tc.name, "traffic") || strings.HasPrefix(tc.name, "broadcast") {
+			continue // Payloads take the rest of the message
+		}
+		bs := wireTestEncode(t, tc.value)
+		for _, test := range []struct {
+			bs  []byte
+			err error
+		}{
+			{bs[:len(bs)-1], types.ErrDecodeTruncated},
+			{append(bs, 0), types.ErrDecodeTrailingBytes},
+		} {
+			err := tc.new().decode(test.bs)
+			if !errors.Is(err, test.err) || !errors.Is(err, types.ErrDecode) {
+				t.Fatalf("%s: expected %v, got %v", tc.name, test.err, err)
+			}
+		}
+	}
+	ann := routerAnnounce{key: wireTestKey(1), parent: wireTestKey(1), sig: wireTestSig(2)}
+	err := new(peer)._handleAnnounce(wireTestEncode(t, &ann))
+	if !errors.Is(err, types.ErrDecodeBadSignature) || !errors.Is(err, types.ErrBadMessage) {
+		t.Fatalf("expected types.ErrDecodeBadSignature, got %v", err)
+	}
+}
+
+func FuzzRouterSigReq(f *testing.F) {
+	wireFuzz(f, func() wireTestMessage { return new(routerSigReq) })
+}
+
+func FuzzRouterSigRes(f *testing.F) {
+	f.Add(wireTestEncode(f, &routerSigRes{port: wireMaxPort}))
+	wireFuzz(f, func() wireTestMessage { return new(routerSigRes) })
+}
+
+func FuzzRouterAnnounce(f *testing.F) {
+	wireFuzz(f, func() wireTestMessage { return new(routerAnnounce) })
+}
+
+func FuzzTraffic(f *testing.F) {
+	f.Add(wireTestHugePath(wireMaxPathLength+1, 1))
+	f.Add(wireTestHugePath(1, ^uint64(0)))
+	wireFuzz(f, func() wireTestMessage { return new(traffic) })
+}
+
+func FuzzPathLookup(f *testing.F) {
+	wireFuzz(f, func() wireTestMessage { return new(pathLookup) })
+}
+
+func FuzzPathNotify(f *testing.F) {
+	wireFuzz(f, func() wireTestMessage { return new(pathNotify) })
+}
+
+func FuzzPathBroken(f *testing.F) {
+	wireFuzz(f, func() wireTestMessage { return new(pathBroken) })
+}
+
+func FuzzBroadcast(f *testing.F) {
+	wireFuzz(f, func() wireTestMessage { return new(broadcast) })
+}
+
+func FuzzBloom(f *testing.F) {
+	wireFuzz(f, func() wireTestMessage { return newBloom() })
+}
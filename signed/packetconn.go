@@ -1,6 +1,7 @@
 package signed
 
 import (
+	"context"
 	"crypto/ed25519"
 	"net"
 
@@ -12,6 +13,7 @@ type PacketConn struct {
 	*network.PacketConn
 	secret ed25519.PrivateKey
 	public ed25519.PublicKey
+	codec  types.AddrCodecValue
 }
 
 // NewPacketConn returns a *PacketConn struct which implements the types.PacketConn interface.
@@ -21,12 +23,16 @@ func NewPacketConn(secret ed25519.PrivateKey, options ...network.Option) (*Packe
 		return nil, err
 	}
 	pub := secret.Public().(ed25519.PublicKey)
-	return &PacketConn{pc, secret, pub}, nil
+	return &PacketConn{PacketConn: pc, secret: secret, public: pub}, nil
 }
 
 func (pc *PacketConn) ReadFrom(p []byte) (n int, from net.Addr, err error) {
+	return pc.ReadFromCtx(context.Background(), p)
+}
+
+func (pc *PacketConn) ReadFromCtx(ctx context.Context, p []byte) (n int, from net.Addr, err error) {
 	for {
-		if n, from, err = pc.PacketConn.ReadFrom(p); err != nil {
+		if n, from, err = pc.PacketConn.ReadFromCtx(ctx, p); err != nil {
 			return
 		}
 		fromKey := ed25519.PublicKey(from.(types.Addr))
@@ -35,19 +41,33 @@ func (pc *PacketConn) ReadFrom(p []byte) (n int, from net.Addr, err error) {
 			continue // error?
 		}
 		n = copy(p, msg)
+		from = pc.codec.Encode(fromKey)
 		return
 	}
 }
 
 func (pc *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	switch addr.(type) {
-	case types.Addr:
-	default:
-		return 0, types.ErrBadAddress
+	return pc.WriteToOptions(p, addr, network.PacketOptions{})
+}
+
+// WriteToClass is like WriteTo, but sends the packet with the given class, see network.PacketConn.WriteToClass.
+func (pc *PacketConn) WriteToClass(p []byte, addr net.Addr, class network.TrafficClass) (n int, err error) {
+	return pc.WriteToOptions(p, addr, network.PacketOptions{Class: class})
+}
+
+// WriteToTraced is like WriteTo, but every node that handles the signed packet reports what it did with it, see network.PacketConn.WriteToTraced.
+func (pc *PacketConn) WriteToTraced(p []byte, addr net.Addr) (n int, err error) {
+	return pc.WriteToOptions(p, addr, network.PacketOptions{Traced: true})
+}
+
+// WriteToOptions is like WriteTo, but sends the packet with the given options, see network.PacketConn.WriteToOptions.
+func (pc *PacketConn) WriteToOptions(p []byte, addr net.Addr, opts network.PacketOptions) (n int, err error) {
+	toKey, err := pc.codec.Decode(addr)
+	if err != nil {
+		return 0, err
 	}
-	toKey := ed25519.PublicKey(addr.(types.Addr))
 	msg := pc.sign(nil, toKey, p)
-	n, err = pc.PacketConn.WriteTo(msg, addr)
+	n, err = pc.PacketConn.WriteToOptions(msg, types.Addr(toKey), opts)
 	n -= len(msg) - len(p) // subtract overhead
 	if n < 0 {
 		n = 0
@@ -55,6 +75,22 @@ func (pc *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return
 }
 
+func (pc *PacketConn) WriteToCtx(ctx context.Context, p []byte, addr net.Addr) (n int, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	return pc.WriteTo(p, addr)
+}
+
+func (pc *PacketConn) LocalAddr() net.Addr {
+	return pc.codec.Encode(pc.public)
+}
+
+// SetAddrCodec sets a codec for the application's own address type, see network.PacketConn.SetAddrCodec.
+func (pc *PacketConn) SetAddrCodec(codec types.AddrCodec) {
+	pc.codec.Store(codec)
+}
+
 func (pc *PacketConn) sign(dest, toKey ed25519.PublicKey, msg []byte) []byte {
 	sigBytes := make([]byte, 0, 65535)
 	sigBytes = append(sigBytes, toKey...)
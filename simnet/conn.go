@@ -0,0 +1,269 @@
+package simnet
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// connSegments is how many writes can be in flight in each direction before Write blocks.
+	connSegments = 64
+	// connRetransmit is the extra delay for a lost write, on top of one round trip, like a minimum TCP retransmission timeout.
+	connRetransmit = 200 * time.Millisecond
+)
+
+// LinkOptions configures the simulated conditions on a link, in each direction.
+type LinkOptions struct {
+	Latency   time.Duration // One way delay
+	Jitter    time.Duration // Up to this much extra random delay for each write
+	Loss      float64       // Probability that a write is lost and has to be retransmitted
+	Bandwidth int64         // Bytes per second, or 0 if unlimited
+}
+
+type addr string
+
+func (a addr) Network() string { return "simnet" }
+func (a addr) String() string  { return string(a) }
+
+type segment struct {
+	data []byte
+	at   time.Time // when the segment can be read
+}
+
+// pipe is one direction of a link.
+type pipe struct {
+	opts     LinkOptions
+	rand     *rand.Rand
+	segments chan segment  // closed by the writer on Close, after it's done writing
+	done     chan struct{} // closed by the reader on Close
+	busy     time.Time     // when the link finishes sending what was already written, for opts.Bandwidth
+	last     time.Time     // delivery time of the last segment, so they're read in order
+}
+
+func newPipe(opts LinkOptions, seed int64) *pipe {
+	return &pipe{
+		opts:     opts,
+		rand:     rand.New(rand.NewSource(seed)),
+		segments: make(chan segment, connSegments),
+		done:     make(chan struct{}),
+	}
+}
+
+// deliveryTime returns when a write of size bytes at now can be read, only called by the writer.
+func (p *pipe) deliveryTime(now time.Time, size int) time.Time {
+	start := now
+	if p.busy.After(start) {
+		start = p.busy
+	}
+	if p.opts.Bandwidth > 0 {
+		start = start.Add(time.Duration(int64(size) * int64(time.Second) / p.opts.Bandwidth))
+	}
+	p.busy = start
+	at := start.Add(p.opts.Latency)
+	if p.opts.Jitter > 0 {
+		at = at.Add(time.Duration(p.rand.Int63n(int64(p.opts.Jitter))))
+	}
+	if p.opts.Loss > 0 && p.rand.Float64() < p.opts.Loss {
+		at = at.Add(2*p.opts.Latency + connRetransmit)
+	}
+	if at.Before(p.last) {
+		at = p.last // TCP-like, a delayed segment also delays everything after it
+	}
+	p.last = at
+	return at
+}
+
+// deadline is a read or write deadline, which can change while something is waiting on it.
+type deadline struct {
+	mutex   sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+	}
+	d.changed = make(chan struct{})
+}
+
+// get returns the deadline's timer (nil if there's no deadline), and a channel that's closed if the deadline changes.
+func (d *deadline) get() (*time.Timer, <-chan struct{}) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	if d.t.IsZero() {
+		return nil, d.changed
+	}
+	return time.NewTimer(time.Until(d.t)), d.changed
+}
+
+// conn is one end of a link, it implements net.Conn with TCP-like semantics.
+type conn struct {
+	local, remote addr
+	send, recv    *pipe
+	closeOnce     sync.Once
+	closed        chan struct{}
+	readMutex     sync.Mutex
+	readBuf       []byte
+	pending       *segment // read from recv, but not delivered yet
+	writeMutex    sync.Mutex
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newConnPair(keyA, keyB string, opts LinkOptions, rng *rand.Rand) (*conn, *conn) {
+	toA := newPipe(opts, rng.Int63())
+	toB := newPipe(opts, rng.Int63())
+	a := &conn{local: addr(keyA), remote: addr(keyB), send: toB, recv: toA, closed: make(chan struct{})}
+	b := &conn{local: addr(keyB), remote: addr(keyA), send: toA, recv: toB, closed: make(chan struct{})}
+	return a, b
+}
+
+// wait blocks until the timer fires, and returns a timeout error if the deadline is reached first.
+func (c *conn) wait(until *time.Timer, d *deadline) error {
+	defer until.Stop()
+	for {
+		timer, changed := d.get()
+		var timeout <-chan time.Time
+		if timer != nil {
+			timeout = timer.C
+		}
+		select {
+		case <-until.C:
+			stopTimer(timer)
+			return nil
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		case <-changed:
+			stopTimer(timer)
+		case <-c.closed:
+			stopTimer(timer)
+			return io.ErrClosedPipe
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (c *conn) Read(b []byte) (n int, err error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	for len(c.readBuf) == 0 {
+		if c.pending == nil {
+			timer, changed := c.readDeadline.get()
+			var timeout <-chan time.Time
+			if timer != nil {
+				timeout = timer.C
+			}
+			select {
+			case seg, ok := <-c.recv.segments:
+				stopTimer(timer)
+				if !ok {
+					return 0, io.EOF
+				}
+				c.pending = &seg
+			case <-timeout:
+				return 0, os.ErrDeadlineExceeded
+			case <-changed:
+				stopTimer(timer)
+				continue
+			case <-c.closed:
+				stopTimer(timer)
+				return 0, io.ErrClosedPipe
+			}
+		}
+		if err := c.wait(time.NewTimer(time.Until(c.pending.at)), &c.readDeadline); err != nil {
+			return 0, err
+		}
+		c.readBuf, c.pending = c.pending.data, nil
+	}
+	n = copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *conn) Write(b []byte) (n int, err error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	seg := segment{data: append([]byte(nil), b...)}
+	seg.at = c.send.deliveryTime(time.Now(), len(b))
+	for {
+		timer, changed := c.writeDeadline.get()
+		var timeout <-chan time.Time
+		if timer != nil {
+			timeout = timer.C
+		}
+		select {
+		case c.send.segments <- seg:
+			stopTimer(timer)
+			return len(b), nil
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-changed:
+			stopTimer(timer)
+		case <-c.send.done:
+			stopTimer(timer)
+			return 0, io.ErrClosedPipe
+		case <-c.closed:
+			stopTimer(timer)
+			return 0, io.ErrClosedPipe
+		}
+	}
+}
+
+// Close closes this end of the link, the other end can still read anything that was already written, and then gets io.EOF.
+func (c *conn) Close() error {
+	err := io.ErrClosedPipe
+	c.closeOnce.Do(func() {
+		err = nil
+		close(c.closed)
+		close(c.recv.done)
+		c.writeMutex.Lock()
+		defer c.writeMutex.Unlock()
+		close(c.send.segments)
+	})
+	return err
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
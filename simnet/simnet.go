@@ -0,0 +1,164 @@
+// Package simnet runs network.PacketConns over simulated in-memory links, for tests and simulations.
+package simnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Arceliar/ironwood/network"
+	"github.com/Arceliar/ironwood/types"
+)
+
+// ErrLinked is returned by Network.Link if the nodes are already linked.
+var ErrLinked = errors.New("nodes are already linked")
+
+// Network keeps track of simulated nodes and the links between them.
+type Network struct {
+	mutex   sync.Mutex
+	options []network.Option
+	rand    *rand.Rand
+	nodes   map[*network.PacketConn]ed25519.PublicKey
+	links   map[[2]*network.PacketConn][2]*conn
+}
+
+// NewNetwork returns an empty Network, using the given options for every node it creates.
+func NewNetwork(options ...network.Option) *Network {
+	return &Network{
+		options: options,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		nodes:   make(map[*network.PacketConn]ed25519.PublicKey),
+		links:   make(map[[2]*network.PacketConn][2]*conn),
+	}
+}
+
+// Seed resets the random source used for link jitter and loss, so a simulation can be repeated.
+// It only affects links created after it's called.
+func (n *Network) Seed(seed int64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.rand = rand.New(rand.NewSource(seed))
+}
+
+// CreateNode returns a new PacketConn with a fresh key.
+func (n *Network) CreateNode() (*network.PacketConn, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := network.NewPacketConn(priv, n.options...)
+	if err != nil {
+		return nil, err
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.nodes[pc] = pub
+	return pc, nil
+}
+
+// linkKey returns the nodes in a consistent order, so a link can be found either way around.
+func (n *Network) linkKey(a, b *network.PacketConn) [2]*network.PacketConn {
+	if bytes.Compare(n.nodes[a], n.nodes[b]) > 0 {
+		a, b = b, a
+	}
+	return [2]*network.PacketConn{a, b}
+}
+
+// Link connects two nodes created by CreateNode, calling HandleConn on each side in a new goroutine.
+func (n *Network) Link(a, b *network.PacketConn, opts LinkOptions) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	keyA, keyB := n.nodes[a], n.nodes[b]
+	if keyA == nil || keyB == nil || a == b {
+		return types.ErrBadAddress
+	}
+	lk := n.linkKey(a, b)
+	if _, isIn := n.links[lk]; isIn {
+		return ErrLinked
+	}
+	cA, cB := newConnPair(types.Addr(keyA).String(), types.Addr(keyB).String(), opts, n.rand)
+	n.links[lk] = [2]*conn{cA, cB}
+	go a.HandleConn(keyB, cA, 0)
+	go b.HandleConn(keyA, cB, 0)
+	return nil
+}
+
+// Unlink closes the link between two nodes.
+func (n *Network) Unlink(a, b *network.PacketConn) error {
+	n.mutex.Lock()
+	lk := n.linkKey(a, b)
+	conns, isIn := n.links[lk]
+	delete(n.links, lk)
+	n.mutex.Unlock()
+	if !isIn {
+		return types.ErrPeerNotFound
+	}
+	conns[0].Close()
+	conns[1].Close()
+	return nil
+}
+
+// Close closes every link and node in the network.
+func (n *Network) Close() error {
+	n.mutex.Lock()
+	links, nodes := n.links, n.nodes
+	n.links = make(map[[2]*network.PacketConn][2]*conn)
+	n.nodes = make(map[*network.PacketConn]ed25519.PublicKey)
+	n.mutex.Unlock()
+	for _, conns := range links {
+		conns[0].Close()
+		conns[1].Close()
+	}
+	for pc := range nodes {
+		pc.Close()
+	}
+	return nil
+}
+
+// Pair returns two new nodes, using the given options, connected to each other over a net.Pipe.
+// It waits until both are ready (see PacketConn.WaitReady) and have a path to each other, or the context is done.
+// Closing either node closes the pipe.
+func Pair(ctx context.Context, options ...network.Option) (a, b *network.PacketConn, err error) {
+	pubA, privA, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubB, privB, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a, err = network.NewPacketConn(privA, options...); err != nil {
+		return nil, nil, err
+	}
+	if b, err = network.NewPacketConn(privB, options...); err != nil {
+		a.Close()
+		return nil, nil, err
+	}
+	cA, cB := net.Pipe()
+	go a.HandleConn(pubB, cA, 0)
+	go b.HandleConn(pubA, cB, 0)
+	fail := func(err error) (*network.PacketConn, *network.PacketConn, error) {
+		a.Close()
+		b.Close()
+		return nil, nil, err
+	}
+	if err := a.WaitReady(ctx); err != nil {
+		return fail(err)
+	}
+	if err := b.WaitReady(ctx); err != nil {
+		return fail(err)
+	}
+	// A ping each way makes sure both sides have a path, so the first packet either sends isn't lost to a lookup
+	if _, err := a.Ping(ctx, pubB); err != nil {
+		return fail(err)
+	}
+	if _, err := b.Ping(ctx, pubA); err != nil {
+		return fail(err)
+	}
+	return a, b, nil
+}
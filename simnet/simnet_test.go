@@ -0,0 +1,422 @@
+package simnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/ironwood/network"
+	"github.com/Arceliar/ironwood/types"
+)
+
+func TestConn(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	a, b := newConnPair("a", "b", LinkOptions{Latency: latency}, rand.New(rand.NewSource(1)))
+	defer a.Close()
+	start := time.Now()
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(latency / 2))
+	buf := make([]byte, 16)
+	if _, err := b.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
+	if err, ok := error(os.ErrDeadlineExceeded).(net.Error); !ok || !err.Timeout() {
+		t.Fatal("deadline error isn't a timeout")
+	}
+	b.SetReadDeadline(time.Time{})
+	n, err := b.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("unexpected read: %q %v", buf[:n], err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Fatalf("read after %v, expected at least %v", elapsed, latency)
+	}
+	// Anything written before Close can still be read
+	a.Write([]byte("bye"))
+	a.Close()
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "bye" {
+		t.Fatalf("unexpected read: %q %v", buf[:n], err)
+	}
+	if _, err := b.Read(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestRandomGraph(t *testing.T) {
+	// Every node can reach every other node once the network converges, even with some loss
+	const count = 20
+	sim := NewNetwork()
+	defer sim.Close()
+	sim.Seed(1)
+	var nodes []*network.PacketConn
+	for idx := 0; idx < count; idx++ {
+		node, err := sim.CreateNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	opts := LinkOptions{Latency: time.Millisecond, Jitter: time.Millisecond, Loss: 0.01}
+	rng := rand.New(rand.NewSource(1))
+	for idx := 1; idx < count; idx++ {
+		// Link to an earlier node, so the graph is connected, and sometimes one more
+		if err := sim.Link(nodes[idx], nodes[rng.Intn(idx)], opts); err != nil {
+			t.Fatal(err)
+		}
+		if other := rng.Intn(idx); rng.Intn(2) == 0 {
+			if err := sim.Link(nodes[idx], nodes[other], opts); err != nil && !errors.Is(err, ErrLinked) {
+				t.Fatal(err)
+			}
+		}
+	}
+	type pair struct{ from, to int }
+	received := make(chan pair, count*count)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for idx := range nodes {
+		go func(to int) {
+			buf := make([]byte, 16)
+			for {
+				n, _, err := nodes[to].ReadFromCtx(ctx, buf)
+				if err != nil {
+					return
+				}
+				if n == 1 {
+					received <- pair{int(buf[0]), to}
+				}
+			}
+		}(idx)
+	}
+	waiting := make(map[pair]struct{})
+	for from := range nodes {
+		for to := range nodes {
+			if from != to {
+				waiting[pair{from, to}] = struct{}{}
+			}
+		}
+	}
+	timeout := time.After(time.Minute)
+	for len(waiting) > 0 {
+		for p := range waiting {
+			nodes[p.from].WriteTo([]byte{byte(p.from)}, nodes[p.to].LocalAddr())
+		}
+		wait := time.After(250 * time.Millisecond)
+	recv:
+		for {
+			select {
+			case p := <-received:
+				delete(waiting, p)
+			case <-wait:
+				break recv
+			case <-timeout:
+				t.Fatalf("%d of %d pairs couldn't exchange traffic", len(waiting), count*(count-1))
+			}
+		}
+	}
+	if err := sim.Unlink(nodes[1], nodes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Unlink(nodes[0], nodes[1]); !errors.Is(err, types.ErrPeerNotFound) {
+		t.Fatalf("expected types.ErrPeerNotFound, got %v", err)
+	}
+}
+
+// startStorm starts count nodes at once in a random graph, and returns the average number of times each node's own info changed before the network converged.
+func startStorm(t *testing.T, count int, options ...network.Option) float64 {
+	sim := NewNetwork(options...)
+	defer sim.Close()
+	sim.Seed(1)
+	var nodes []*network.PacketConn
+	for idx := 0; idx < count; idx++ {
+		node, err := sim.CreateNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	opts := LinkOptions{Latency: time.Millisecond, Jitter: time.Millisecond}
+	rng := rand.New(rand.NewSource(1))
+	for idx := 1; idx < count; idx++ {
+		if err := sim.Link(nodes[idx], nodes[rng.Intn(idx)], opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := sim.Link(nodes[idx], nodes[rng.Intn(idx)], opts); err != nil && !errors.Is(err, ErrLinked) {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, node := range nodes {
+		if err := node.WaitReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var updates int64
+	for _, node := range nodes {
+		updates += node.Metrics()["router.self_updates"]
+	}
+	return float64(updates) / float64(count)
+}
+
+func TestStartStorm(t *testing.T) {
+	const count = 100
+	before := startStorm(t, count)
+	// Announcements move about a hop per second, so the jitter needs to be a few seconds for the best root to get around first
+	after := startStorm(t, count, network.WithStartupListen(time.Second), network.WithRootJitter(5*time.Second))
+	t.Logf("self updates per node: %.2f by default, %.2f with a listen period and jitter", before, after)
+	if after > before*3/4 {
+		t.Fatalf("expected at least a quarter fewer self updates per node, got %.2f vs %.2f", after, before)
+	}
+}
+
+func TestConvergenceMetrics(t *testing.T) {
+	// A line of nodes, each of which should settle on a parent and report it
+	const count = 10
+	sim := NewNetwork(network.WithConvergedThreshold(3 * time.Second))
+	defer sim.Close()
+	sim.Seed(1)
+	converged := make(chan ed25519.PublicKey, count)
+	var nodes []*network.PacketConn
+	for idx := 0; idx < count; idx++ {
+		node, err := sim.CreateNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := ed25519.PublicKey(node.LocalAddr().(types.Addr))
+		node.SetConvergedHandler(func(parent ed25519.PublicKey) {
+			converged <- key
+		})
+		nodes = append(nodes, node)
+		if idx > 0 {
+			if err := sim.Link(nodes[idx-1], node, LinkOptions{Latency: time.Millisecond}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	timeout := time.After(time.Minute)
+	for len(seen) < count {
+		select {
+		case key := <-converged:
+			seen[string(key)] = true
+		case <-timeout:
+			t.Fatalf("only %d of %d nodes converged", len(seen), count)
+		}
+	}
+	// A node can converge and then switch parents again, while the rest of the line is still settling
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		var stable int
+		for _, node := range nodes {
+			stable += int(node.Metrics()["router.converged"])
+		}
+		if stable == count {
+			break
+		}
+		if time.Since(start) > time.Minute {
+			t.Fatalf("only %d of %d nodes are converged at once", stable, count)
+		}
+	}
+	for idx, node := range nodes {
+		// There are no loops in a line, so each info a node hears about gets to it once, along a single path
+		m := node.Metrics()
+		if m["announces.accepted"] < 1 || m["router.parent_changes"] < 1 {
+			t.Fatalf("node %d accepted %d announces and changed parents %d times", idx, m["announces.accepted"], m["router.parent_changes"])
+		}
+		if rejected := m["announces.old_seq"] + m["announces.worse_parent"] + m["announces.stale_nonce"]; rejected != 0 {
+			t.Fatalf("node %d rejected %d announces", idx, rejected)
+		}
+	}
+}
+
+// readyStorm is like startStorm, but returns how long it took every node to be ready, and how many announcements were sent on the way.
+func readyStorm(t *testing.T, count int, options ...network.Option) (time.Duration, int64) {
+	sim := NewNetwork(options...)
+	defer sim.Close()
+	sim.Seed(1)
+	var nodes []*network.PacketConn
+	for idx := 0; idx < count; idx++ {
+		node, err := sim.CreateNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	start := time.Now()
+	opts := LinkOptions{Latency: 10 * time.Millisecond, Jitter: time.Millisecond}
+	rng := rand.New(rand.NewSource(1))
+	for idx := 1; idx < count; idx++ {
+		if err := sim.Link(nodes[idx], nodes[rng.Intn(idx)], opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := sim.Link(nodes[idx], nodes[rng.Intn(idx)], opts); err != nil && !errors.Is(err, ErrLinked) {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, node := range nodes {
+		if err := node.WaitReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	var sent int64
+	for _, node := range nodes {
+		sent += node.Metrics()["announces.sent"]
+	}
+	return elapsed, sent
+}
+
+func TestEagerAnnounce(t *testing.T) {
+	const count = 100
+	lazyTime, lazySent := readyStorm(t, count)
+	eagerTime, eagerSent := readyStorm(t, count, network.WithEagerAnnounce(true))
+	t.Logf("ready after %v with %d announcements by default, %v with %d eagerly", lazyTime, lazySent, eagerTime, eagerSent)
+	// Eager announcements are the same ones, just sent sooner, so there are only more when an info changes twice within a second
+	// Flooding every info to every peer would be far more than this
+	if eagerSent > lazySent*3 {
+		t.Fatalf("expected at most 3 times as many announcements, got %d vs %d", eagerSent, lazySent)
+	}
+}
+
+func TestPair(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, b, err := Pair(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	defer b.Close()
+	if _, err := a.WriteTo([]byte("hello"), b.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, b.MTU())
+	n, from, err := b.ReadFromCtx(ctx, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" || from.String() != a.LocalAddr().String() {
+		t.Fatalf("unexpected packet %q from %s", buf[:n], from)
+	}
+}
+
+func TestParentQuality(t *testing.T) {
+	// A node with two possible parents, offering the same root, with a fast but lossy link to one and a slower clean link to the other
+	// The lossy link usually answers first, so it's the parent we'd pick by default
+	sim := NewNetwork(
+		network.WithPeerProbes(50*time.Millisecond),
+		network.WithParentQuality(0.1, 0),
+	)
+	defer sim.Close()
+	sim.Seed(1)
+	var nodes []*network.PacketConn
+	for idx := 0; idx < 4; idx++ {
+		node, err := sim.CreateNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(nodes[i].LocalAddr().(types.Addr), nodes[j].LocalAddr().(types.Addr)) < 0
+	})
+	root, lossy, clean, node := nodes[0], nodes[1], nodes[2], nodes[3]
+	fast := LinkOptions{Latency: time.Millisecond}
+	for _, link := range [][2]*network.PacketConn{{lossy, root}, {clean, root}} {
+		if err := sim.Link(link[0], link[1], fast); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sim.Link(node, lossy, LinkOptions{Latency: time.Millisecond, Loss: 0.02}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Link(node, clean, LinkOptions{Latency: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	cleanKey := ed25519.PublicKey(clean.LocalAddr().(types.Addr))
+	lossyKey := ed25519.PublicKey(lossy.LocalAddr().(types.Addr))
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		parent, _ := node.Debug.GetTreeLinks()
+		if parent.Equal(cleanKey) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("didn't switch to the clean link")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	var lossyQuality, cleanQuality network.PeerQuality
+	for _, info := range node.Peers() {
+		switch {
+		case info.Key.Equal(lossyKey):
+			lossyQuality = info.Quality
+		case info.Key.Equal(cleanKey):
+			cleanQuality = info.Quality
+		}
+	}
+	t.Logf("lossy link %+v, clean link %+v", lossyQuality, cleanQuality)
+	if lossyQuality.Loss <= cleanQuality.Loss || cleanQuality.RTT <= 0 {
+		t.Fatalf("unexpected link quality, lossy %+v, clean %+v", lossyQuality, cleanQuality)
+	}
+}
+
+func TestPathRate(t *testing.T) {
+	// Send faster than a bandwidth limited link can carry, the receiver's estimate should match the link
+	const limit = 256 * 1024
+	const size = 1024
+	sim := NewNetwork()
+	defer sim.Close()
+	a, err := sim.CreateNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := sim.CreateNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Link(a, b, LinkOptions{Latency: time.Millisecond, Bandwidth: limit}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, b.MTU())
+		for {
+			if _, _, err := b.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	// The receiver only tracks rates for destinations it has a path to
+	keyA := ed25519.PublicKey(a.LocalAddr().(types.Addr))
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := b.Debug.GetPath(keyA); ok {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("no path to the sender")
+		}
+		b.WriteTo([]byte{1}, a.LocalAddr())
+	}
+	// Twice the limit, in bursts every 10ms
+	msg := make([]byte, size)
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		for idx := 0; idx < 2*limit/size/100; idx++ {
+			a.WriteTo(msg, b.LocalAddr())
+		}
+	}
+	info, _ := b.Debug.GetPath(keyA)
+	t.Logf("estimated %.0f bytes per second over a %d bytes per second link", info.RXRate, limit)
+	if info.RXRate < 0.8*limit || info.RXRate > 1.2*limit {
+		t.Fatalf("rate estimate %.0f not within 20%% of %d", info.RXRate, limit)
+	}
+}
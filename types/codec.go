@@ -0,0 +1,82 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// AddrCodec converts between public keys and an application's own net.Addr type, see PacketConn.SetAddrCodec.
+type AddrCodec interface {
+	// EncodeAddr returns the address to use for a key, e.g. as the from address returned by ReadFrom.
+	EncodeAddr(key ed25519.PublicKey) net.Addr
+	// DecodeAddr returns the key for an address passed to WriteTo.
+	// Returning an Error (e.g. ErrAmbiguous if the address could be more than one known key) passes it to the caller as-is, other errors are wrapped with ErrBadAddress.
+	DecodeAddr(addr net.Addr) (ed25519.PublicKey, error)
+}
+
+// IdentityCodec is an AddrCodec that uses Addr, which is the same as not setting a codec.
+type IdentityCodec struct{}
+
+func (IdentityCodec) EncodeAddr(key ed25519.PublicKey) net.Addr {
+	return Addr(key)
+}
+
+func (IdentityCodec) DecodeAddr(addr net.Addr) (ed25519.PublicKey, error) {
+	if a, ok := addr.(Addr); ok {
+		return ed25519.PublicKey(a), nil
+	}
+	return nil, ErrBadAddress
+}
+
+// AddrCodecValue holds the AddrCodec for a PacketConn implementation, which can be replaced at any time.
+// The zero value has no codec, so only Addr is used.
+type AddrCodecValue struct {
+	value atomic.Value // addrCodecBox
+}
+
+type addrCodecBox struct {
+	codec AddrCodec
+}
+
+// Store replaces the codec, or removes it if the codec is nil.
+func (v *AddrCodecValue) Store(codec AddrCodec) {
+	v.value.Store(addrCodecBox{codec})
+}
+
+func (v *AddrCodecValue) load() AddrCodec {
+	box, _ := v.value.Load().(addrCodecBox)
+	return box.codec
+}
+
+// Encode returns the address for a key, using the codec if there is one.
+func (v *AddrCodecValue) Encode(key ed25519.PublicKey) net.Addr {
+	if codec := v.load(); codec != nil {
+		return codec.EncodeAddr(key)
+	}
+	return Addr(key)
+}
+
+// Decode returns the key for an address, which may always be an Addr, or else anything the codec (if any) can decode.
+func (v *AddrCodecValue) Decode(addr net.Addr) (ed25519.PublicKey, error) {
+	var key ed25519.PublicKey
+	if a, ok := addr.(Addr); ok {
+		key = ed25519.PublicKey(a)
+	} else if codec := v.load(); codec == nil {
+		return nil, ErrBadAddress
+	} else if k, err := codec.DecodeAddr(addr); err != nil {
+		var e Error
+		if errors.As(err, &e) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrBadAddress, err)
+	} else {
+		key = k
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, ErrBadAddress
+	}
+	return key, nil
+}
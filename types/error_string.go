@@ -20,11 +20,33 @@ func _() {
 	_ = x[ErrPeerNotFound-9]
 	_ = x[ErrBadAddress-10]
 	_ = x[ErrBadKey-11]
+	_ = x[ErrBadKind-12]
+	_ = x[ErrBadPort-13]
+	_ = x[ErrDecodeTruncated-14]
+	_ = x[ErrDecodeTrailingBytes-15]
+	_ = x[ErrDecodeBadSignature-16]
+	_ = x[ErrDecodeOverLength-17]
+	_ = x[ErrTooManyPeers-18]
+	_ = x[ErrTooManyPeerConns-19]
+	_ = x[ErrTooManyPendingPeers-20]
+	_ = x[ErrPeerSetupTimeout-21]
+	_ = x[ErrAmbiguous-22]
+	_ = x[ErrPeerNotAllowed-23]
+	_ = x[ErrNoRoute-24]
+	_ = x[ErrRouteLoop-25]
+	_ = x[ErrTooManyHops-26]
+	_ = x[ErrBadSigner-27]
+	_ = x[ErrQueueFull-28]
+	_ = x[ErrBadMAC-29]
+	_ = x[ErrBadClass-30]
+	_ = x[ErrHandedOff-31]
+	_ = x[ErrPathTooLong-32]
+	_ = x[ErrNoMAC-33]
 }
 
-const _Error_name = "ErrUndefinedErrEncodeErrDecodeErrClosedErrTimeoutErrBadMessageErrEmptyMessageErrOversizedMessageErrUnrecognizedMessageErrPeerNotFoundErrBadAddressErrBadKey"
+const _Error_name = "ErrUndefinedErrEncodeErrDecodeErrClosedErrTimeoutErrBadMessageErrEmptyMessageErrOversizedMessageErrUnrecognizedMessageErrPeerNotFoundErrBadAddressErrBadKeyErrBadKindErrBadPortErrDecodeTruncatedErrDecodeTrailingBytesErrDecodeBadSignatureErrDecodeOverLengthErrTooManyPeersErrTooManyPeerConnsErrTooManyPendingPeersErrPeerSetupTimeoutErrAmbiguousErrPeerNotAllowedErrNoRouteErrRouteLoopErrTooManyHopsErrBadSignerErrQueueFullErrBadMACErrBadClassErrHandedOffErrPathTooLongErrNoMAC"
 
-var _Error_index = [...]uint8{0, 12, 21, 30, 39, 49, 62, 77, 96, 118, 133, 146, 155}
+var _Error_index = [...]uint16{0, 12, 21, 30, 39, 49, 62, 77, 96, 118, 133, 146, 155, 165, 175, 193, 215, 236, 255, 270, 289, 311, 330, 342, 359, 369, 381, 395, 407, 419, 428, 439, 451, 465, 473}
 
 func (i Error) String() string {
 	if i >= Error(len(_Error_index)-1) {
@@ -1,5 +1,7 @@
 package types
 
+import "net"
+
 //go:generate stringer -type=Error
 
 // Error is any error generated by the PacketConn. Note that other errors may still be returned, if e.g. HandleConn returns due to a network error. An Error may be wrapped to provide additional context.
@@ -18,8 +20,45 @@ const (
 	ErrPeerNotFound
 	ErrBadAddress
 	ErrBadKey
+	ErrBadKind
+	ErrBadPort
+	ErrDecodeTruncated     // Message ended before all of its fields were read
+	ErrDecodeTrailingBytes // Message had extra bytes after its last field
+	ErrDecodeBadSignature  // Message decoded, but a signature on it didn't verify
+	ErrDecodeOverLength    // A path or port in the message was over its limit
+	ErrTooManyPeers        // Already at the limit for connections to all peers
+	ErrTooManyPeerConns    // Already at the limit for connections to this peer's key
+	ErrTooManyPendingPeers // Already at the limit for connections that haven't finished setup
+	ErrPeerSetupTimeout    // Peer didn't prove that it has its key before the setup timeout
+	ErrAmbiguous           // Address could be more than one key, see AddrCodec
+	ErrPeerNotAllowed      // Peer's key was rejected by the peer filter
+	ErrNoRoute             // A node on the way to the destination has no next hop for it, see PacketConn.TraceRoute
+	ErrRouteLoop           // A node on the way to the destination sent us back to a node we already visited
+	ErrTooManyHops         // Destination wasn't reached within the maximum number of hops
+	ErrBadSigner           // Signer returned a signature that doesn't verify against its public key
+	ErrQueueFull           // A node on the way to the destination dropped the packet from a full queue
+	ErrBadMAC              // A frame from a peer failed its MAC check, see network.WithFrameMAC
+	ErrBadClass            // Traffic class isn't one of the known ones, see network.TrafficClass
+	ErrHandedOff           // The connection was handed off to another PacketConn, see network.PacketConn.Handoff
+	ErrPathTooLong         // Destination's path is longer than the max path length, see network.WithMaxPathLength
+	ErrNoMAC               // Peer didn't ask for a MAC on a connection that needs one, see network.WithFrameMAC
 )
 
 func (e Error) Error() string {
 	return e.String()
 }
+
+// Is allows the more specific decode errors to match ErrDecode with errors.Is.
+// ErrDecodeBadSignature also matches ErrBadMessage, which was returned for bad signatures before it existed.
+// ErrClosed matches net.ErrClosed, like errors from a closed net.Conn.
+func (e Error) Is(target error) bool {
+	switch e {
+	case ErrClosed:
+		return target == net.ErrClosed
+	case ErrDecodeTruncated, ErrDecodeTrailingBytes, ErrDecodeOverLength:
+		return target == ErrDecode
+	case ErrDecodeBadSignature:
+		return target == ErrDecode || target == ErrBadMessage
+	}
+	return false
+}
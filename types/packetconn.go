@@ -1,6 +1,7 @@
 package types
 
 import (
+	"context"
 	"crypto/ed25519"
 	"net"
 )
@@ -13,6 +14,16 @@ type PacketConn interface {
 	// In all cases, the net.Conn is closed before returning.
 	HandleConn(key ed25519.PublicKey, conn net.Conn, prio uint8) error
 
+	// HandleConnCtx is like HandleConn, but returns ctx.Err() (and closes the net.Conn) if the context is done before the connection is set up.
+	HandleConnCtx(ctx context.Context, key ed25519.PublicKey, conn net.Conn, prio uint8) error
+
+	// ReadFromCtx is like ReadFrom, but returns ctx.Err() if the context is done before a packet is read.
+	// A cancelled read does not consume a packet, it's left for the next read.
+	ReadFromCtx(ctx context.Context, p []byte) (n int, from net.Addr, err error)
+
+	// WriteToCtx is like WriteTo, but returns ctx.Err() if the context is done.
+	WriteToCtx(ctx context.Context, p []byte, addr net.Addr) (n int, err error)
+
 	// IsClosed returns true if and only if the connection is closed.
 	// This is to check if the PacketConn is closed without potentially being stuck on a blocking operation (e.g. a read or write).
 	IsClosed() bool
@@ -25,4 +36,27 @@ type PacketConn interface {
 
 	// SendLookup sends a lookup for a given (possibly partial) key.
 	SendLookup(target ed25519.PublicKey)
+
+	// SendOutOfBand sends a packet of the given kind to a destination, to be handled by that node's out-of-band handler for the kind.
+	// Low kinds are reserved for use by the library, see the implementation for the allowed range.
+	// Out-of-band packets are neither encrypted nor signed by the library, even by a wrapping PacketConn, which only protects ReadFrom and WriteTo.
+	SendOutOfBand(kind uint8, toKey ed25519.PublicKey, data []byte) error
+
+	// SetOutOfBandHandler sets a function to handle received out-of-band packets of the given kind, instead of returning them from ReadFrom.
+	// As with SendOutOfBand, nothing is decrypted or checked, so fromKey is only what the packet claims its source is.
+	SetOutOfBandHandler(kind uint8, handler func(fromKey ed25519.PublicKey, data []byte)) error
+
+	// Broadcast floods a packet to every node reachable within ttl hops, to be handled by their broadcast handler.
+	// Broadcasts are signed, but not encrypted, by the library (even by a wrapping PacketConn).
+	Broadcast(payload []byte, ttl uint8) error
+
+	// SetBroadcastHandler sets a function to handle received broadcasts.
+	SetBroadcastHandler(handler func(fromKey ed25519.PublicKey, data []byte))
+
+	// SetSelfRevivedHandler sets a function to call when the network apparently remembers us from before we went offline (e.g. a restart).
+	SetSelfRevivedHandler(handler func())
+
+	// SetAddrCodec sets a codec for the application's own address type, or removes it if the codec is nil.
+	// With a codec, ReadFrom and LocalAddr return the codec's addresses, and WriteTo accepts them as well as an Addr.
+	SetAddrCodec(codec AddrCodec)
 }